@@ -3,94 +3,267 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func newAttachDBCmd() *cobra.Command {
-	var (
-		name, namespace, user, password, host, db string
-		port int
-	)
-	cmd := &cobra.Command{
-		Use:   "attach-db",
-		Short: "Attach Postgres by creating a Secret with DATABASE_URL",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			if name == "" || host == "" || db == "" { return fmt.Errorf("name, host, db required") }
-			ns := namespace; if ns == "" { ns = "default" }
-			client, ns2, err := getClient(ns); if err != nil { return err }
-			url := fmt.Sprintf("postgres://%s:%s@%s:%d/%s", user, password, host, port, db)
-			sec := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name + "-db", Namespace: ns2}, StringData: map[string]string{"DATABASE_URL": url}}
-			_, err = client.CoreV1().Secrets(ns2).Get(context.Background(), sec.Name, metav1.GetOptions{})
-			if err == nil { _, err = client.CoreV1().Secrets(ns2).Update(context.Background(), sec, metav1.UpdateOptions{}); return err }
-			_, err = client.CoreV1().Secrets(ns2).Create(context.Background(), sec, metav1.CreateOptions{})
-			return err
-		},
+// libpq's sslmode values.
+var postgresSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// postgresConn describes a Postgres attachment.
+type postgresConn struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	// SSLMode is left to the client's default (prefer) when empty.
+	SSLMode string
+	// Params are extra connection parameters, e.g. connect_timeout.
+	Params map[string]string
+}
+
+func (c postgresConn) validate() error {
+	if c.Host == "" || c.Database == "" || c.User == "" {
+		return fmt.Errorf("host, db and user are required")
 	}
-	cmd.Flags().StringVar(&name, "name", "", "App name")
-	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
-	cmd.Flags().StringVar(&user, "user", "app", "DB user")
-	cmd.Flags().StringVar(&password, "password", "changeme", "DB password")
-	cmd.Flags().StringVar(&host, "host", "", "DB host")
-	cmd.Flags().IntVar(&port, "port", 5432, "DB port")
-	cmd.Flags().StringVar(&db, "db", "", "DB name")
-	return cmd
+	if c.Password == "" {
+		return fmt.Errorf("a database password is required (--password, --password-file or --password-stdin)")
+	}
+	if c.SSLMode != "" {
+		ok := false
+		for _, m := range postgresSSLModes {
+			ok = ok || m == c.SSLMode
+		}
+		if !ok {
+			return fmt.Errorf("invalid sslmode %q (want %s)", c.SSLMode, strings.Join(postgresSSLModes, ", "))
+		}
+	}
+	return nil
 }
 
-func newAttachRedisCmd() *cobra.Command {
-	var (
-		name, namespace, host, password string
-		port int
-	)
-	cmd := &cobra.Command{
-		Use:   "attach-redis",
-		Short: "Attach Redis by creating a Secret with REDIS_URL",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			if name == "" || host == "" { return fmt.Errorf("name and host required") }
-			ns := namespace; if ns == "" { ns = "default" }
-			client, ns2, err := getClient(ns); if err != nil { return err }
-			url := fmt.Sprintf("redis://:%s@%s:%d", password, host, port)
-			sec := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name + "-redis", Namespace: ns2}, StringData: map[string]string{"REDIS_URL": url}}
-			_, err = client.CoreV1().Secrets(ns2).Get(context.Background(), sec.Name, metav1.GetOptions{})
-			if err == nil { _, err = client.CoreV1().Secrets(ns2).Update(context.Background(), sec, metav1.UpdateOptions{}); return err }
-			_, err = client.CoreV1().Secrets(ns2).Create(context.Background(), sec, metav1.CreateOptions{})
-			return err
-		},
+// URL returns the connection string with user, password and database
+// escaped, so passwords may contain @, / or :.
+func (c postgresConn) URL() string {
+	q := url.Values{}
+	for k, v := range c.Params {
+		q.Set(k, v)
 	}
-	cmd.Flags().StringVar(&name, "name", "", "App name")
-	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
-	cmd.Flags().StringVar(&host, "host", "", "Redis host")
-	cmd.Flags().IntVar(&port, "port", 6379, "Redis port")
-	cmd.Flags().StringVar(&password, "password", "", "Redis password")
-	return cmd
+	if c.SSLMode != "" {
+		q.Set("sslmode", c.SSLMode)
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:     "/" + c.Database,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// secretData is DATABASE_URL plus the discrete libpq variables.
+func (c postgresConn) secretData() map[string]string {
+	data := map[string]string{
+		"DATABASE_URL": c.URL(),
+		"PGHOST":       c.Host,
+		"PGPORT":       strconv.Itoa(c.Port),
+		"PGUSER":       c.User,
+		"PGPASSWORD":   c.Password,
+		"PGDATABASE":   c.Database,
+	}
+	if c.SSLMode != "" {
+		data["PGSSLMODE"] = c.SSLMode
+	}
+	return data
+}
+
+// redisConn describes a Redis attachment. User is only needed for Redis 6
+// ACLs; TLS selects the rediss scheme.
+type redisConn struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	TLS      bool
+	DB       int
+}
+
+func (c redisConn) URL() string {
+	u := url.URL{Scheme: "redis", Host: net.JoinHostPort(c.Host, strconv.Itoa(c.Port))}
+	if c.TLS {
+		u.Scheme = "rediss"
+	}
+	if c.Password != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	} else if c.User != "" {
+		u.User = url.User(c.User)
+	}
+	if c.DB != 0 {
+		u.Path = "/" + strconv.Itoa(c.DB)
+	}
+	return u.String()
+}
+
+func (c redisConn) secretData() map[string]string {
+	data := map[string]string{
+		"REDIS_URL":  c.URL(),
+		"REDIS_HOST": c.Host,
+		"REDIS_PORT": strconv.Itoa(c.Port),
+	}
+	if c.User != "" {
+		data["REDIS_USERNAME"] = c.User
+	}
+	if c.Password != "" {
+		data["REDIS_PASSWORD"] = c.Password
+	}
+	return data
+}
+
+// passwordSource is a password given inline, in a file, on stdin or as a
+// reference to an external store (secretsmanager://, ssm://).
+type passwordSource struct {
+	value string
+	file  string
+	stdin bool
+	ref   string
+}
+
+// addPasswordFlags registers --<prefix>password, --<prefix>password-file,
+// --<prefix>password-stdin and --<prefix>password-ref.
+func addPasswordFlags(cmd *cobra.Command, prefix, what string, src *passwordSource) {
+	addSecretFlags(cmd, prefix+"password", what+" password", src)
+}
+
+// addSecretFlags registers --<name>, --<name>-file, --<name>-stdin and
+// --<name>-ref for a credential that shouldn't have to be typed on the
+// command line.
+func addSecretFlags(cmd *cobra.Command, name, what string, src *passwordSource) {
+	cmd.Flags().StringVar(&src.value, name, "", what+" (prefer --"+name+"-file or --"+name+"-stdin)")
+	cmd.Flags().StringVar(&src.file, name+"-file", "", "Read the "+what+" from a file")
+	cmd.Flags().BoolVar(&src.stdin, name+"-stdin", false, "Read the "+what+" from stdin")
+	cmd.Flags().StringVar(&src.ref, name+"-ref", "", "Read the "+what+" from secretsmanager://NAME[#KEY] or ssm:///PATH")
+}
+
+// read returns the password, or "" when none was given. A trailing newline
+// in a file or on stdin is dropped.
+func (s passwordSource) read() (string, error) {
+	n := 0
+	for _, set := range []bool{s.value != "", s.file != "", s.stdin, s.ref != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return "", fmt.Errorf("give the password only once: inline, from a file, on stdin or as a reference")
+	}
+	switch {
+	case s.ref != "":
+		ref, ok, err := parseSecretRef(s.ref)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("invalid reference %q (want secretsmanager://NAME[#KEY] or ssm:///PATH)", s.ref)
+		}
+		return secretRefs.resolve(context.Background(), ref)
+	case s.file != "":
+		raw, err := os.ReadFile(s.file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	case s.stdin:
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password from stdin: %v", err)
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	}
+	return s.value, nil
+}
+
+// addVerifyFlags registers the connectivity check flags.
+func addVerifyFlags(cmd *cobra.Command, verify, local *bool) {
+	cmd.Flags().BoolVar(verify, "verify", false, "Check DNS, TCP, TLS and credentials from a Job in the namespace before storing the Secret")
+	cmd.Flags().BoolVar(local, "local", false, "Run the check from this machine instead of the cluster (implies --verify)")
+}
+
+// addProvisionFlags registers --provision and --storage.
+func addProvisionFlags(cmd *cobra.Command, what string, provision *bool, storage *string) {
+	cmd.Flags().BoolVar(provision, "provision", false, "Run a development-grade "+what+" in the namespace (StatefulSet, Service, PVC) with generated credentials")
+	cmd.Flags().StringVar(storage, "storage", defaultProvisionStorage, "Volume size for --provision")
+}
+
+// parseParams turns key=value flags into connection parameters.
+func parseParams(pairs []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid parameter %q (want key=value)", p)
+		}
+		out[k] = v
+	}
+	return out, nil
 }
 
 func newSecretsCmd() *cobra.Command {
 	var (
 		name, namespace string
-		pairs []string
+		pairs, unset    []string
+		replace         bool
 	)
 	cmd := &cobra.Command{
 		Use:   "secrets",
 		Short: "Create/update Secret from key=value pairs",
+		Long: `Create or update a Secret from key=value pairs.
+
+Pairs are merged into the existing keys; --replace makes them the only keys
+and --unset removes keys. Concurrent updates are retried, not overwritten.
+A value may reference an external store (secretsmanager://NAME[#KEY] or
+ssm:///PATH); it is resolved here and stored as a literal.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if name == "" { return fmt.Errorf("name required") }
-			ns := namespace; if ns == "" { ns = "default" }
-			client, ns2, err := getClient(ns); if err != nil { return err }
-			data := map[string]string{}
-			for _, p := range pairs { kv := strings.SplitN(p, "=", 2); if len(kv) != 2 { return fmt.Errorf("invalid pair: %s", p) }; data[kv[0]] = kv[1] }
-			sec := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns2}, StringData: data}
-			_, err = client.CoreV1().Secrets(ns2).Get(context.Background(), name, metav1.GetOptions{})
-			if err == nil { _, err = client.CoreV1().Secrets(ns2).Update(context.Background(), sec, metav1.UpdateOptions{}); return err }
-			_, err = client.CoreV1().Secrets(ns2).Create(context.Background(), sec, metav1.CreateOptions{})
-			return err
+			if name == "" {
+				return fmt.Errorf("name required")
+			}
+			if len(pairs) == 0 && len(unset) == 0 && !replace {
+				return fmt.Errorf("nothing to change: pass --from-literal or --unset")
+			}
+			client, ns, err := getClient(namespace)
+			if err != nil {
+				return err
+			}
+			data, err := parseSecretPairs(pairs)
+			if err != nil {
+				return err
+			}
+			if err := resolveSecretRefs(cmd.Context(), data); err != nil {
+				return err
+			}
+			change, err := upsertSecret(cmd.Context(), client, ns, name, keyUpdate{Set: data, Unset: unset, Replace: replace})
+			if err != nil {
+				return err
+			}
+			verb := "Updated"
+			if change.Created {
+				verb = "Created"
+			}
+			fmt.Printf("%s secret %s: %s\n", verb, name, change)
+			return nil
 		},
 	}
 	cmd.Flags().StringVar(&name, "name", "", "Secret name")
 	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
 	cmd.Flags().StringSliceVar(&pairs, "from-literal", []string{}, "key=value")
+	cmd.Flags().StringSliceVar(&unset, "unset", []string{}, "Keys to remove")
+	cmd.Flags().BoolVar(&replace, "replace", false, "Remove every key not given with --from-literal")
+	cmd.AddCommand(newSecretsEditCmd())
 	return cmd
 }
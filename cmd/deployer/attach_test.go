@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPostgresConnURL(t *testing.T) {
+	tests := []struct {
+		name string
+		conn postgresConn
+		want string
+	}{
+		{
+			name: "plain",
+			conn: postgresConn{Host: "db", Port: 5432, User: "app", Password: "pw", Database: "app"},
+			want: "postgres://app:pw@db:5432/app",
+		},
+		{
+			name: "reserved characters are escaped",
+			conn: postgresConn{Host: "db", Port: 5432, User: "app@corp", Password: "p@ss:w/rd?#%", Database: "my db"},
+			want: "postgres://app%40corp:p%40ss%3Aw%2Frd%3F%23%25@db:5432/my%20db",
+		},
+		{
+			name: "sslmode and params",
+			conn: postgresConn{Host: "db", Port: 6543, User: "app", Password: "pw", Database: "app", SSLMode: "require", Params: map[string]string{"connect_timeout": "5", "application_name": "web app"}},
+			want: "postgres://app:pw@db:6543/app?application_name=web+app&connect_timeout=5&sslmode=require",
+		},
+		{
+			name: "IPv6 host",
+			conn: postgresConn{Host: "::1", Port: 5432, User: "app", Password: "pw", Database: "app"},
+			want: "postgres://app:pw@[::1]:5432/app",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.conn.URL()
+			if got != tt.want {
+				t.Errorf("URL() = %q, want %q", got, tt.want)
+			}
+			// Clients get the original credentials back
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pw, _ := u.User.Password(); u.User.Username() != tt.conn.User || pw != tt.conn.Password || u.Path != "/"+tt.conn.Database {
+				t.Errorf("round trip: user %q password %q path %q", u.User.Username(), pw, u.Path)
+			}
+		})
+	}
+}
+
+func TestPostgresConnValidate(t *testing.T) {
+	ok := postgresConn{Host: "db", User: "app", Password: "pw", Database: "app"}
+	tests := []struct {
+		name string
+		edit func(*postgresConn)
+		want string
+	}{
+		{"valid", func(c *postgresConn) {}, ""},
+		{"valid sslmode", func(c *postgresConn) { c.SSLMode = "verify-full" }, ""},
+		{"missing host", func(c *postgresConn) { c.Host = "" }, "host, db and user are required"},
+		{"missing password", func(c *postgresConn) { c.Password = "" }, "a database password is required"},
+		{"bad sslmode", func(c *postgresConn) { c.SSLMode = "on" }, "invalid sslmode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ok
+			tt.edit(&c)
+			err := c.validate()
+			if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	data := postgresConn{Host: "db", Port: 5432, User: "app", Password: "p@ss", Database: "app", SSLMode: "require"}.secretData()
+	want := map[string]string{
+		"DATABASE_URL": "postgres://app:p%40ss@db:5432/app?sslmode=require",
+		"PGHOST":       "db", "PGPORT": "5432", "PGUSER": "app", "PGPASSWORD": "p@ss", "PGDATABASE": "app", "PGSSLMODE": "require",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("secretData() = %v, want %v", data, want)
+	}
+}
+
+func TestRedisConnURL(t *testing.T) {
+	tests := []struct {
+		name string
+		conn redisConn
+		want string
+		keys []string
+	}{
+		{"no auth", redisConn{Host: "cache", Port: 6379}, "redis://cache:6379", []string{"REDIS_HOST", "REDIS_PORT", "REDIS_URL"}},
+		{"password only", redisConn{Host: "cache", Port: 6379, Password: "p@ss/word"}, "redis://:p%40ss%2Fword@cache:6379", []string{"REDIS_HOST", "REDIS_PASSWORD", "REDIS_PORT", "REDIS_URL"}},
+		{"ACL user with TLS and db", redisConn{Host: "cache", Port: 6380, User: "app", Password: "pw", TLS: true, DB: 2}, "rediss://app:pw@cache:6380/2", []string{"REDIS_HOST", "REDIS_PASSWORD", "REDIS_PORT", "REDIS_URL", "REDIS_USERNAME"}},
+		{"user without password", redisConn{Host: "cache", Port: 6379, User: "app"}, "redis://app@cache:6379", []string{"REDIS_HOST", "REDIS_PORT", "REDIS_URL", "REDIS_USERNAME"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conn.URL(); got != tt.want {
+				t.Errorf("URL() = %q, want %q", got, tt.want)
+			}
+			if keys := sortedKeys(tt.conn.secretData()); !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("secretData() keys = %v, want %v", keys, tt.keys)
+			}
+		})
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	got, err := parseParams([]string{"connect_timeout=5", "options=-c search_path=app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"connect_timeout": "5", "options": "-c search_path=app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseParams() = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"novalue", "=x"} {
+		if _, err := parseParams([]string{bad}); err == nil {
+			t.Errorf("parseParams(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPasswordSourceRead(t *testing.T) {
+	dir := writeTree(t, map[string]string{"db.pass": "s3cret\r\n"})
+	tests := []struct {
+		name string
+		src  passwordSource
+		want string
+		err  string
+	}{
+		{name: "none", src: passwordSource{}},
+		{name: "inline", src: passwordSource{value: "inline"}, want: "inline"},
+		{name: "file drops the trailing newline", src: passwordSource{file: filepath.Join(dir, "db.pass")}, want: "s3cret"},
+		{name: "missing file", src: passwordSource{file: filepath.Join(dir, "missing")}, err: "no such file"},
+		{name: "twice", src: passwordSource{value: "a", file: "b"}, err: "give the password only once"},
+		{name: "bad reference", src: passwordSource{ref: "vault://x"}, err: "invalid reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.src.read()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("read() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// mysqlConn describes a MySQL or MariaDB attachment. TLS is the driver's
+// tls parameter (true, false, skip-verify or preferred).
+type mysqlConn struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Database string
+	TLS      string
+	Params   map[string]string
+}
+
+var mysqlTLSModes = []string{"true", "false", "skip-verify", "preferred"}
+
+func (c mysqlConn) validate() error {
+	if c.Host == "" || c.Database == "" || c.User == "" {
+		return fmt.Errorf("host, db and user are required")
+	}
+	if c.Password == "" {
+		return fmt.Errorf("a database password is required (--password, --password-file or --password-stdin)")
+	}
+	if c.TLS != "" && !contains(mysqlTLSModes, c.TLS) {
+		return fmt.Errorf("invalid tls mode %q (want %s)", c.TLS, strings.Join(mysqlTLSModes, ", "))
+	}
+	return nil
+}
+
+func (c mysqlConn) URL() string {
+	q := url.Values{}
+	for k, v := range c.Params {
+		q.Set(k, v)
+	}
+	if c.TLS != "" {
+		q.Set("tls", c.TLS)
+	}
+	u := url.URL{
+		Scheme:   "mysql",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:     "/" + c.Database,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+func (c mysqlConn) secretData() map[string]string {
+	return map[string]string{
+		"MYSQL_URL":      c.URL(),
+		"MYSQL_HOST":     c.Host,
+		"MYSQL_PORT":     strconv.Itoa(c.Port),
+		"MYSQL_USER":     c.User,
+		"MYSQL_PASSWORD": c.Password,
+		"MYSQL_DATABASE": c.Database,
+	}
+}
+
+// mongoConn describes a MongoDB attachment: a replica set or sharded
+// cluster given as hosts, or an Atlas-style SRV record (a single host).
+type mongoConn struct {
+	Hosts      []string
+	Port       int
+	SRV        bool
+	User       string
+	Password   string
+	Database   string
+	AuthSource string
+	ReplicaSet string
+	TLS        bool
+	Params     map[string]string
+}
+
+func (c mongoConn) validate() error {
+	if len(c.Hosts) == 0 || c.Database == "" {
+		return fmt.Errorf("host and db are required")
+	}
+	if c.SRV && len(c.Hosts) != 1 {
+		return fmt.Errorf("--srv takes exactly one host, the SRV record name")
+	}
+	if (c.User == "") != (c.Password == "") {
+		return fmt.Errorf("set both user and password, or neither")
+	}
+	return nil
+}
+
+// hostList returns the hosts with the default port added; SRV records
+// carry their own ports.
+func (c mongoConn) hostList() []string {
+	if c.SRV {
+		return c.Hosts
+	}
+	out := make([]string, len(c.Hosts))
+	for i, h := range c.Hosts {
+		if _, _, err := net.SplitHostPort(h); err == nil {
+			out[i] = h
+		} else {
+			out[i] = net.JoinHostPort(h, strconv.Itoa(c.Port))
+		}
+	}
+	return out
+}
+
+func (c mongoConn) URL() string {
+	q := url.Values{}
+	for k, v := range c.Params {
+		q.Set(k, v)
+	}
+	if c.AuthSource != "" {
+		q.Set("authSource", c.AuthSource)
+	}
+	if c.ReplicaSet != "" {
+		q.Set("replicaSet", c.ReplicaSet)
+	}
+	if c.TLS {
+		q.Set("tls", "true")
+	}
+	u := url.URL{
+		Scheme:   "mongodb",
+		Host:     strings.Join(c.hostList(), ","),
+		Path:     "/" + c.Database,
+		RawQuery: q.Encode(),
+	}
+	if c.SRV {
+		u.Scheme = "mongodb+srv"
+	}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	}
+	return u.String()
+}
+
+func (c mongoConn) secretData() map[string]string {
+	data := map[string]string{
+		"MONGODB_URI":      c.URL(),
+		"MONGODB_HOSTS":    strings.Join(c.hostList(), ","),
+		"MONGODB_DATABASE": c.Database,
+	}
+	if c.User != "" {
+		data["MONGODB_USERNAME"] = c.User
+		data["MONGODB_PASSWORD"] = c.Password
+	}
+	return data
+}
+
+// amqpConn describes a RabbitMQ (AMQP 0-9-1) attachment.
+type amqpConn struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// VHost "/" is the broker default and is left out of the URL.
+	VHost string
+	TLS   bool
+}
+
+func (c amqpConn) validate() error {
+	if c.Host == "" || c.User == "" {
+		return fmt.Errorf("host and user are required")
+	}
+	if c.Password == "" {
+		return fmt.Errorf("a password is required (--password, --password-file or --password-stdin)")
+	}
+	return nil
+}
+
+// URL escapes the vhost as one path segment, so "/" inside a vhost name
+// becomes %2F as the AMQP URI spec requires.
+func (c amqpConn) URL() string {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(c.User, c.Password),
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+	}
+	if c.TLS {
+		u.Scheme = "amqps"
+	}
+	if c.VHost != "" && c.VHost != "/" {
+		u.Path, u.RawPath = "/"+c.VHost, "/"+url.PathEscape(c.VHost)
+	}
+	return u.String()
+}
+
+func (c amqpConn) secretData() map[string]string {
+	vhost := c.VHost
+	if vhost == "" {
+		vhost = "/"
+	}
+	return map[string]string{
+		"AMQP_URL":      c.URL(),
+		"AMQP_HOST":     c.Host,
+		"AMQP_PORT":     strconv.Itoa(c.Port),
+		"AMQP_USER":     c.User,
+		"AMQP_PASSWORD": c.Password,
+		"AMQP_VHOST":    vhost,
+	}
+}
+
+// s3Conn describes an S3 bucket, on AWS or any S3-compatible store
+// (MinIO, R2, Spaces...) when Endpoint is set. Without keys the app uses
+// its own AWS credentials, e.g. IRSA.
+type s3Conn struct {
+	Bucket          string
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool
+}
+
+func (c s3Conn) validate() error {
+	if c.Bucket == "" {
+		return fmt.Errorf("bucket is required")
+	}
+	if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+		return fmt.Errorf("set both the access key id and secret access key, or neither")
+	}
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q (want http(s)://host[:port])", c.Endpoint)
+		}
+	}
+	return nil
+}
+
+func (c s3Conn) URL() string {
+	return (&url.URL{Scheme: "s3", Host: c.Bucket}).String()
+}
+
+// secretData uses the names the AWS SDKs read, so most clients need no
+// configuration beyond the bucket.
+func (c s3Conn) secretData() map[string]string {
+	data := map[string]string{
+		"S3_URL":    c.URL(),
+		"S3_BUCKET": c.Bucket,
+	}
+	if c.Region != "" {
+		data["S3_REGION"] = c.Region
+		data["AWS_REGION"] = c.Region
+	}
+	if c.Endpoint != "" {
+		data["S3_ENDPOINT"] = c.Endpoint
+		data["AWS_ENDPOINT_URL_S3"] = c.Endpoint
+	}
+	if c.AccessKeyID != "" {
+		data["AWS_ACCESS_KEY_ID"] = c.AccessKeyID
+		data["AWS_SECRET_ACCESS_KEY"] = c.SecretAccessKey
+	}
+	if c.PathStyle {
+		data["S3_FORCE_PATH_STYLE"] = "true"
+	}
+	return data
+}
+
+// kafkaConn describes a Kafka cluster. Mechanism enables SASL.
+type kafkaConn struct {
+	Brokers   []string
+	Port      int
+	TLS       bool
+	Mechanism string
+	User      string
+	Password  string
+}
+
+var kafkaSASLMechanisms = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"}
+
+func (c kafkaConn) validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("at least one broker is required")
+	}
+	if c.Mechanism == "" {
+		if c.User != "" || c.Password != "" {
+			return fmt.Errorf("--sasl-mechanism is required with a user or password")
+		}
+		return nil
+	}
+	if !contains(kafkaSASLMechanisms, c.Mechanism) {
+		return fmt.Errorf("invalid SASL mechanism %q (want %s)", c.Mechanism, strings.Join(kafkaSASLMechanisms, ", "))
+	}
+	if c.User == "" || c.Password == "" {
+		return fmt.Errorf("SASL needs a user and password")
+	}
+	return nil
+}
+
+func (c kafkaConn) brokerList() []string {
+	out := make([]string, len(c.Brokers))
+	for i, b := range c.Brokers {
+		if _, _, err := net.SplitHostPort(b); err == nil {
+			out[i] = b
+		} else {
+			out[i] = net.JoinHostPort(b, strconv.Itoa(c.Port))
+		}
+	}
+	return out
+}
+
+// securityProtocol is the client's security.protocol setting.
+func (c kafkaConn) securityProtocol() string {
+	switch {
+	case c.Mechanism != "" && c.TLS:
+		return "SASL_SSL"
+	case c.Mechanism != "":
+		return "SASL_PLAINTEXT"
+	case c.TLS:
+		return "SSL"
+	}
+	return "PLAINTEXT"
+}
+
+// URL lists one URL per broker, kafka:// or kafka+ssl://. Credentials
+// stay in the SASL keys; no Kafka client reads them from a URL.
+func (c kafkaConn) URL() string {
+	scheme := "kafka://"
+	if c.TLS {
+		scheme = "kafka+ssl://"
+	}
+	urls := make([]string, len(c.Brokers))
+	for i, b := range c.brokerList() {
+		urls[i] = scheme + b
+	}
+	return strings.Join(urls, ",")
+}
+
+func (c kafkaConn) secretData() map[string]string {
+	brokers := strings.Join(c.brokerList(), ",")
+	data := map[string]string{
+		"KAFKA_URL":               c.URL(),
+		"KAFKA_BROKERS":           brokers,
+		"KAFKA_BOOTSTRAP_SERVERS": brokers,
+		"KAFKA_SECURITY_PROTOCOL": c.securityProtocol(),
+	}
+	if c.Mechanism != "" {
+		data["KAFKA_SASL_MECHANISM"] = c.Mechanism
+		data["KAFKA_SASL_USERNAME"] = c.User
+		data["KAFKA_SASL_PASSWORD"] = c.Password
+	}
+	return data
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		conn interface{ URL() string }
+		want string
+	}{
+		{"mysql", mysqlConn{Host: "db", Port: 3306, User: "app", Password: "p@ss:w/rd", Database: "shop", TLS: "skip-verify"},
+			"mysql://app:p%40ss%3Aw%2Frd@db:3306/shop?tls=skip-verify"},
+		{"mysql params", mysqlConn{Host: "db", Port: 3306, User: "app", Password: "pw", Database: "shop", Params: map[string]string{"parseTime": "true", "charset": "utf8mb4"}},
+			"mysql://app:pw@db:3306/shop?charset=utf8mb4&parseTime=true"},
+		{"mongo replica set", mongoConn{Hosts: []string{"m1", "m2:27018", "::1"}, Port: 27017, User: "app", Password: "p@ss", Database: "shop", AuthSource: "admin", ReplicaSet: "rs0", TLS: true},
+			"mongodb://app:p%40ss@m1:27017,m2:27018,[::1]:27017/shop?authSource=admin&replicaSet=rs0&tls=true"},
+		{"mongo srv without auth", mongoConn{Hosts: []string{"cluster0.example.mongodb.net"}, Port: 27017, SRV: true, Database: "shop"},
+			"mongodb+srv://cluster0.example.mongodb.net/shop"},
+		{"amqp default vhost", amqpConn{Host: "mq", Port: 5672, User: "app", Password: "pw", VHost: "/"},
+			"amqp://app:pw@mq:5672"},
+		{"amqps vhost with slash", amqpConn{Host: "mq", Port: 5671, User: "app", Password: "p@ss", VHost: "team/prod", TLS: true},
+			"amqps://app:p%40ss@mq:5671/team%2Fprod"},
+		{"s3", s3Conn{Bucket: "assets"}, "s3://assets"},
+		{"kafka plaintext", kafkaConn{Brokers: []string{"k1", "k2:9093"}, Port: 9092},
+			"kafka://k1:9092,kafka://k2:9093"},
+		{"kafka tls", kafkaConn{Brokers: []string{"k1"}, Port: 9094, TLS: true}, "kafka+ssl://k1:9094"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conn.URL(); got != tt.want {
+				t.Errorf("URL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentSecretData(t *testing.T) {
+	amqp := amqpConn{Host: "mq", Port: 5672, User: "app", Password: "pw"}.secretData()
+	if amqp["AMQP_VHOST"] != "/" || amqp["AMQP_URL"] != "amqp://app:pw@mq:5672" {
+		t.Errorf("amqp secretData() = %v", amqp)
+	}
+
+	mongo := mongoConn{Hosts: []string{"m1", "m2"}, Port: 27017, Database: "shop"}.secretData()
+	if want := (map[string]string{"MONGODB_URI": "mongodb://m1:27017,m2:27017/shop", "MONGODB_HOSTS": "m1:27017,m2:27017", "MONGODB_DATABASE": "shop"}); !reflect.DeepEqual(mongo, want) {
+		t.Errorf("mongo secretData() = %v, want %v", mongo, want)
+	}
+
+	s3 := s3Conn{Bucket: "assets", Region: "eu-west-1", Endpoint: "https://minio:9000", AccessKeyID: "AK", SecretAccessKey: "SK", PathStyle: true}.secretData()
+	want := map[string]string{
+		"S3_URL": "s3://assets", "S3_BUCKET": "assets",
+		"S3_REGION": "eu-west-1", "AWS_REGION": "eu-west-1",
+		"S3_ENDPOINT": "https://minio:9000", "AWS_ENDPOINT_URL_S3": "https://minio:9000",
+		"AWS_ACCESS_KEY_ID": "AK", "AWS_SECRET_ACCESS_KEY": "SK",
+		"S3_FORCE_PATH_STYLE": "true",
+	}
+	if !reflect.DeepEqual(s3, want) {
+		t.Errorf("s3 secretData() = %v, want %v", s3, want)
+	}
+	// Without keys the app's own credentials (e.g. IRSA) are used
+	if keys := sortedKeys(s3Conn{Bucket: "assets"}.secretData()); !reflect.DeepEqual(keys, []string{"S3_BUCKET", "S3_URL"}) {
+		t.Errorf("s3 keys without credentials = %v", keys)
+	}
+
+	for _, tt := range []struct {
+		conn kafkaConn
+		want string
+	}{
+		{kafkaConn{}, "PLAINTEXT"},
+		{kafkaConn{TLS: true}, "SSL"},
+		{kafkaConn{Mechanism: "PLAIN"}, "SASL_PLAINTEXT"},
+		{kafkaConn{Mechanism: "SCRAM-SHA-512", TLS: true}, "SASL_SSL"},
+	} {
+		if got := tt.conn.securityProtocol(); got != tt.want {
+			t.Errorf("securityProtocol(%+v) = %q, want %q", tt.conn, got, tt.want)
+		}
+	}
+	kafka := kafkaConn{Brokers: []string{"k1"}, Port: 9092, Mechanism: "PLAIN", User: "app", Password: "pw"}.secretData()
+	if kafka["KAFKA_BOOTSTRAP_SERVERS"] != "k1:9092" || kafka["KAFKA_SASL_USERNAME"] != "app" || strings.Contains(kafka["KAFKA_URL"], "pw") {
+		t.Errorf("kafka secretData() = %v", kafka)
+	}
+}
+
+func TestAttachmentValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		conn interface{ validate() error }
+		want string
+	}{
+		{"mysql ok", mysqlConn{Host: "db", User: "app", Password: "pw", Database: "shop", TLS: "true"}, ""},
+		{"mysql tls mode", mysqlConn{Host: "db", User: "app", Password: "pw", Database: "shop", TLS: "on"}, "invalid tls mode"},
+		{"mysql password", mysqlConn{Host: "db", User: "app", Database: "shop"}, "password is required"},
+		{"mongo srv with two hosts", mongoConn{Hosts: []string{"a", "b"}, SRV: true, Database: "shop"}, "exactly one host"},
+		{"mongo user without password", mongoConn{Hosts: []string{"a"}, Database: "shop", User: "app"}, "both user and password"},
+		{"amqp ok", amqpConn{Host: "mq", User: "app", Password: "pw"}, ""},
+		{"amqp password", amqpConn{Host: "mq", User: "app"}, "password is required"},
+		{"s3 half a key pair", s3Conn{Bucket: "b", AccessKeyID: "AK"}, "secret access key"},
+		{"s3 endpoint without scheme", s3Conn{Bucket: "b", Endpoint: "minio:9000"}, "invalid endpoint"},
+		{"s3 endpoint", s3Conn{Bucket: "b", Endpoint: "http://minio:9000"}, ""},
+		{"kafka no brokers", kafkaConn{}, "at least one broker"},
+		{"kafka user without mechanism", kafkaConn{Brokers: []string{"k"}, User: "app"}, "--sasl-mechanism is required"},
+		{"kafka bad mechanism", kafkaConn{Brokers: []string{"k"}, Mechanism: "GSSAPI", User: "a", Password: "b"}, "invalid SASL mechanism"},
+		{"kafka sasl without password", kafkaConn{Brokers: []string{"k"}, Mechanism: "PLAIN", User: "a"}, "needs a user and password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conn.validate()
+			if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
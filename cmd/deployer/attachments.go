@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Labels on attachment Secrets, so they can be listed per app.
+const (
+	attachmentAppLabel  = "flow.ai/app"
+	attachmentTypeLabel = "flow.ai/attachment"
+)
+
+// attachmentType is a kind of backing service. Its connection details are
+// stored in the Secret <app>-<Suffix>, which the app loads with envFrom.
+type attachmentType struct {
+	Name    string
+	Aliases []string
+	Title   string
+	Short   string
+	Suffix  string
+	// EndpointKeys are the Secret keys shown (joined with ":") as the
+	// endpoint by `attachments list`; none of them may hold a credential.
+	EndpointKeys []string
+	newConn      func() attachmentConn
+}
+
+// attachmentConn is a connection being configured from flags.
+type attachmentConn interface {
+	addFlags(cmd *cobra.Command)
+	// prepare reads credentials from files or stdin and validates.
+	prepare() error
+	secretData() map[string]string
+}
+
+// provisioner is an attachment flow can run in the cluster itself.
+type provisioner interface {
+	provision(ctx context.Context, app, namespace, storage string) error
+}
+
+// verifier is an attachment whose connectivity can be checked.
+type verifier interface {
+	verify(ctx context.Context, app, namespace string, local bool) error
+}
+
+var attachmentTypes = []attachmentType{
+	{
+		Name: "postgres", Aliases: []string{"postgresql", "db"}, Title: "Postgres",
+		Short:        "Attach Postgres (DATABASE_URL and PG* variables)",
+		Suffix:       "db",
+		EndpointKeys: []string{"PGHOST", "PGPORT"},
+		newConn:      func() attachmentConn { return &postgresAttachment{} },
+	},
+	{
+		Name: "mysql", Aliases: []string{"mariadb"}, Title: "MySQL",
+		Short:        "Attach MySQL or MariaDB (MYSQL_URL and MYSQL_* variables)",
+		Suffix:       "mysql",
+		EndpointKeys: []string{"MYSQL_HOST", "MYSQL_PORT"},
+		newConn:      func() attachmentConn { return &mysqlAttachment{} },
+	},
+	{
+		Name: "mongodb", Aliases: []string{"mongo"}, Title: "MongoDB",
+		Short:        "Attach MongoDB (MONGODB_URI and MONGODB_* variables)",
+		Suffix:       "mongodb",
+		EndpointKeys: []string{"MONGODB_HOSTS"},
+		newConn:      func() attachmentConn { return &mongoAttachment{} },
+	},
+	{
+		Name: "redis", Title: "Redis",
+		Short:        "Attach Redis (REDIS_URL and REDIS_* variables)",
+		Suffix:       "redis",
+		EndpointKeys: []string{"REDIS_HOST", "REDIS_PORT"},
+		newConn:      func() attachmentConn { return &redisAttachment{} },
+	},
+	{
+		Name: "amqp", Aliases: []string{"rabbitmq"}, Title: "RabbitMQ",
+		Short:        "Attach RabbitMQ or another AMQP 0-9-1 broker (AMQP_URL and AMQP_* variables)",
+		Suffix:       "amqp",
+		EndpointKeys: []string{"AMQP_HOST", "AMQP_PORT"},
+		newConn:      func() attachmentConn { return &amqpAttachment{} },
+	},
+	{
+		Name: "s3", Aliases: []string{"object-storage"}, Title: "S3",
+		Short:        "Attach an S3 or S3-compatible bucket (S3_* and AWS_* variables)",
+		Suffix:       "s3",
+		EndpointKeys: []string{"S3_URL"},
+		newConn:      func() attachmentConn { return &s3Attachment{} },
+	},
+	{
+		Name: "kafka", Title: "Kafka",
+		Short:        "Attach Kafka (KAFKA_BROKERS and KAFKA_* variables)",
+		Suffix:       "kafka",
+		EndpointKeys: []string{"KAFKA_BROKERS"},
+		newConn:      func() attachmentConn { return &kafkaAttachment{} },
+	},
+}
+
+// lookupAttachmentType finds a type by name or alias.
+func lookupAttachmentType(name string) (attachmentType, bool) {
+	for _, t := range attachmentTypes {
+		if t.Name == name || contains(t.Aliases, name) {
+			return t, true
+		}
+	}
+	return attachmentType{}, false
+}
+
+func mustAttachmentType(name string) attachmentType {
+	t, ok := lookupAttachmentType(name)
+	if !ok {
+		panic("unknown attachment type " + name)
+	}
+	return t
+}
+
+func (t attachmentType) secretName(app string) string {
+	return app + "-" + t.Suffix
+}
+
+func (t attachmentType) endpoint(data map[string][]byte) string {
+	var parts []string
+	for _, k := range t.EndpointKeys {
+		if v := string(data[k]); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+type postgresAttachment struct {
+	postgresConn
+	password passwordSource
+	params   []string
+}
+
+func (a *postgresAttachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&a.User, "user", "app", "DB user")
+	addPasswordFlags(cmd, "", "DB", &a.password)
+	cmd.Flags().StringVar(&a.Host, "host", "", "DB host")
+	cmd.Flags().IntVar(&a.Port, "port", 5432, "DB port")
+	cmd.Flags().StringVar(&a.Database, "db", "", "DB name")
+	cmd.Flags().StringVar(&a.SSLMode, "sslmode", "", "sslmode: "+strings.Join(postgresSSLModes, ", "))
+	cmd.Flags().StringArrayVar(&a.params, "param", nil, "Extra connection parameter key=value (repeatable)")
+}
+
+func (a *postgresAttachment) prepare() error {
+	var err error
+	if a.Password, err = a.password.read(); err != nil {
+		return err
+	}
+	if a.Params, err = parseParams(a.params); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+func (a *postgresAttachment) provision(ctx context.Context, app, namespace, storage string) error {
+	if a.Host != "" {
+		return fmt.Errorf("--provision creates the database; don't pass --host")
+	}
+	conn, err := provisionPostgres(ctx, app, namespace, storage)
+	a.postgresConn = conn
+	return err
+}
+
+func (a *postgresAttachment) verify(ctx context.Context, app, namespace string, local bool) error {
+	return verifyPostgres(ctx, app, namespace, a.postgresConn, local)
+}
+
+type redisAttachment struct {
+	redisConn
+	password passwordSource
+}
+
+func (a *redisAttachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&a.Host, "host", "", "Redis host")
+	cmd.Flags().IntVar(&a.Port, "port", 6379, "Redis port")
+	cmd.Flags().StringVar(&a.User, "user", "", "Redis ACL user")
+	addPasswordFlags(cmd, "", "Redis", &a.password)
+	cmd.Flags().BoolVar(&a.TLS, "tls", false, "Connect with TLS (rediss://)")
+	cmd.Flags().IntVar(&a.DB, "db", 0, "Redis database number")
+}
+
+func (a *redisAttachment) prepare() error {
+	if a.Host == "" {
+		return fmt.Errorf("host required")
+	}
+	var err error
+	a.Password, err = a.password.read()
+	return err
+}
+
+func (a *redisAttachment) provision(ctx context.Context, app, namespace, storage string) error {
+	if a.Host != "" {
+		return fmt.Errorf("--provision creates Redis; don't pass --host")
+	}
+	conn, err := provisionRedis(ctx, app, namespace, storage)
+	a.redisConn = conn
+	return err
+}
+
+func (a *redisAttachment) verify(ctx context.Context, app, namespace string, local bool) error {
+	return verifyRedis(ctx, app, namespace, a.redisConn, local)
+}
+
+type mysqlAttachment struct {
+	mysqlConn
+	password passwordSource
+	params   []string
+}
+
+func (a *mysqlAttachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&a.Host, "host", "", "MySQL host")
+	cmd.Flags().IntVar(&a.Port, "port", 3306, "MySQL port")
+	cmd.Flags().StringVar(&a.User, "user", "app", "MySQL user")
+	addPasswordFlags(cmd, "", "MySQL", &a.password)
+	cmd.Flags().StringVar(&a.Database, "db", "", "Database name")
+	cmd.Flags().StringVar(&a.TLS, "tls", "", "tls: "+strings.Join(mysqlTLSModes, ", "))
+	cmd.Flags().StringArrayVar(&a.params, "param", nil, "Extra connection parameter key=value (repeatable)")
+}
+
+func (a *mysqlAttachment) prepare() error {
+	var err error
+	if a.Password, err = a.password.read(); err != nil {
+		return err
+	}
+	if a.Params, err = parseParams(a.params); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+type mongoAttachment struct {
+	mongoConn
+	password passwordSource
+	params   []string
+}
+
+func (a *mongoAttachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&a.Hosts, "host", nil, "MongoDB host[:port] (repeatable for a replica set)")
+	cmd.Flags().IntVar(&a.Port, "port", 27017, "Port for hosts given without one")
+	cmd.Flags().BoolVar(&a.SRV, "srv", false, "Host is a DNS SRV record (mongodb+srv://)")
+	cmd.Flags().StringVar(&a.User, "user", "", "MongoDB user")
+	addPasswordFlags(cmd, "", "MongoDB", &a.password)
+	cmd.Flags().StringVar(&a.Database, "db", "", "Database name")
+	cmd.Flags().StringVar(&a.AuthSource, "auth-source", "", "Database holding the user (authSource)")
+	cmd.Flags().StringVar(&a.ReplicaSet, "replica-set", "", "Replica set name")
+	cmd.Flags().BoolVar(&a.TLS, "tls", false, "Connect with TLS")
+	cmd.Flags().StringArrayVar(&a.params, "param", nil, "Extra connection option key=value (repeatable)")
+}
+
+func (a *mongoAttachment) prepare() error {
+	var err error
+	if a.Password, err = a.password.read(); err != nil {
+		return err
+	}
+	if a.Params, err = parseParams(a.params); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+type amqpAttachment struct {
+	amqpConn
+	password passwordSource
+}
+
+func (a *amqpAttachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&a.Host, "host", "", "Broker host")
+	cmd.Flags().IntVar(&a.Port, "port", 0, "Broker port (default 5672, or 5671 with --tls)")
+	cmd.Flags().StringVar(&a.User, "user", "", "Broker user")
+	addPasswordFlags(cmd, "", "Broker", &a.password)
+	cmd.Flags().StringVar(&a.VHost, "vhost", "/", "Virtual host")
+	cmd.Flags().BoolVar(&a.TLS, "tls", false, "Connect with TLS (amqps://)")
+}
+
+func (a *amqpAttachment) prepare() error {
+	if a.Port == 0 {
+		a.Port = 5672
+		if a.TLS {
+			a.Port = 5671
+		}
+	}
+	var err error
+	if a.Password, err = a.password.read(); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+type s3Attachment struct {
+	s3Conn
+	secretKey passwordSource
+}
+
+func (a *s3Attachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&a.Bucket, "bucket", "", "Bucket name")
+	cmd.Flags().StringVar(&a.Region, "region", "", "Bucket region")
+	cmd.Flags().StringVar(&a.Endpoint, "endpoint", "", "Endpoint URL of an S3-compatible store (e.g. https://minio.example.com)")
+	cmd.Flags().StringVar(&a.AccessKeyID, "access-key-id", "", "Access key id (omit to use the app's own AWS credentials)")
+	addSecretFlags(cmd, "secret-access-key", "secret access key", &a.secretKey)
+	cmd.Flags().BoolVar(&a.PathStyle, "path-style", false, "Address the bucket in the path rather than the host name (most self-hosted stores)")
+}
+
+func (a *s3Attachment) prepare() error {
+	var err error
+	if a.SecretAccessKey, err = a.secretKey.read(); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+type kafkaAttachment struct {
+	kafkaConn
+	password passwordSource
+}
+
+func (a *kafkaAttachment) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&a.Brokers, "broker", nil, "Bootstrap broker host[:port] (repeatable)")
+	cmd.Flags().IntVar(&a.Port, "port", 9092, "Port for brokers given without one")
+	cmd.Flags().BoolVar(&a.TLS, "tls", false, "Connect with TLS")
+	cmd.Flags().StringVar(&a.Mechanism, "sasl-mechanism", "", "SASL mechanism: "+strings.Join(kafkaSASLMechanisms, ", "))
+	cmd.Flags().StringVar(&a.User, "user", "", "SASL user")
+	addPasswordFlags(cmd, "", "SASL", &a.password)
+}
+
+func (a *kafkaAttachment) prepare() error {
+	var err error
+	if a.Password, err = a.password.read(); err != nil {
+		return err
+	}
+	return a.validate()
+}
+
+func newAttachCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "attach <type>",
+		Short: "Attach a backing service by storing its connection details in a Secret the app loads",
+		Long: `Attach a backing service to an app.
+
+The connection details go into the Secret <app>-<type>, which the Knative
+Service loads with envFrom; a running service is updated right away.
+Credentials can be read from a file or stdin instead of the command line.`,
+	}
+	for _, t := range attachmentTypes {
+		cmd.AddCommand(newAttachTypeCmd(t, t.Name))
+	}
+	cmd.AddCommand(newAttachRotateCmd())
+	return cmd
+}
+
+// newAttachTypeCmd builds the attach command for one type.
+func newAttachTypeCmd(t attachmentType, use string) *cobra.Command {
+	var (
+		name, namespace string
+		verify, local   bool
+		provision       bool
+		storage         string
+	)
+	conn := t.newConn()
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: t.Short,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if name == "" {
+				return fmt.Errorf("name required")
+			}
+			ctx := cmd.Context()
+			if provision {
+				if err := conn.(provisioner).provision(ctx, name, namespace, storage); err != nil {
+					return err
+				}
+			} else {
+				if err := conn.prepare(); err != nil {
+					return err
+				}
+				if verify || local {
+					if err := conn.(verifier).verify(ctx, name, namespace, local); err != nil {
+						return err
+					}
+				}
+			}
+			if err := writeAttachment(ctx, t, name, namespace, conn.secretData()); err != nil {
+				return fmt.Errorf("failed to store %s: %v", t.secretName(name), err)
+			}
+			fmt.Printf("Attached %s to %s (secret %s)\n", t.Title, name, t.secretName(name))
+			return syncServiceEnvFrom(ctx, name, namespace, "", "")
+		},
+	}
+	if use == t.Name {
+		cmd.Aliases = t.Aliases
+	}
+	cmd.Flags().StringVar(&name, "name", "", "App name")
+	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
+	conn.addFlags(cmd)
+	if _, ok := conn.(verifier); ok {
+		addVerifyFlags(cmd, &verify, &local)
+	}
+	if _, ok := conn.(provisioner); ok {
+		addProvisionFlags(cmd, t.Title, &provision, &storage)
+	}
+	return cmd
+}
+
+// newAttachDBCmd and newAttachRedisCmd keep the original commands working.
+func newAttachDBCmd() *cobra.Command {
+	cmd := newAttachTypeCmd(mustAttachmentType("postgres"), "attach-db")
+	cmd.Deprecated = "use `flow attach postgres`"
+	return cmd
+}
+
+func newAttachRedisCmd() *cobra.Command {
+	cmd := newAttachTypeCmd(mustAttachmentType("redis"), "attach-redis")
+	cmd.Deprecated = "use `flow attach redis`"
+	return cmd
+}
+
+// writeAttachment creates the attachment Secret for app or replaces its keys.
+func writeAttachment(ctx context.Context, t attachmentType, app, namespace string, data map[string]string) error {
+	client, ns, err := getClient(namespace)
+	if err != nil {
+		return err
+	}
+	// The flags describe the whole connection, so keys from a previous
+	// attach (say PGSSLMODE) must not linger
+	_, err = upsertSecret(ctx, client, ns, t.secretName(app), keyUpdate{
+		Set:     data,
+		Replace: true,
+		Labels: map[string]string{
+			attachmentAppLabel:  app,
+			attachmentTypeLabel: t.Name,
+			managedByLabel:      managedByFlow,
+		},
+	})
+	return err
+}
+
+// attachment is an attachment Secret found in the cluster.
+type attachment struct {
+	App    string
+	Type   attachmentType
+	Secret corev1.Secret
+}
+
+// listAttachments returns the attachments in ns, for app or all apps.
+// Secrets written before attachments were labeled are found by name, so
+// only when app is given.
+func listAttachments(ctx context.Context, client *kubernetes.Clientset, ns, app string) ([]attachment, error) {
+	selector := attachmentTypeLabel
+	if app != "" {
+		selector += "," + attachmentAppLabel + "=" + app
+	}
+	list, err := client.CoreV1().Secrets(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var out []attachment
+	seen := map[string]bool{}
+	for _, sec := range list.Items {
+		t, ok := lookupAttachmentType(sec.Labels[attachmentTypeLabel])
+		if !ok {
+			continue
+		}
+		out = append(out, attachment{App: sec.Labels[attachmentAppLabel], Type: t, Secret: sec})
+		seen[sec.Name] = true
+	}
+	if app != "" {
+		for _, t := range []attachmentType{mustAttachmentType("postgres"), mustAttachmentType("redis")} {
+			if seen[t.secretName(app)] {
+				continue
+			}
+			sec, err := client.CoreV1().Secrets(ns).Get(ctx, t.secretName(app), metav1.GetOptions{})
+			if err == nil {
+				out = append(out, attachment{App: app, Type: t, Secret: *sec})
+			} else if !errors.IsNotFound(err) {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].App != out[j].App {
+			return out[i].App < out[j].App
+		}
+		return out[i].Type.Name < out[j].Type.Name
+	})
+	return out, nil
+}
+
+// kubectlCmd returns a kubectl command in namespace, on kubecontext if set.
+func kubectlCmd(ctx context.Context, kubecontext, namespace string, args ...string) *exec.Cmd {
+	args = append([]string{"-n", namespace}, args...)
+	if kubecontext != "" {
+		args = append([]string{"--context", kubecontext}, args...)
+	}
+	return exec.CommandContext(ctx, "kubectl", args...)
+}
+
+func newAttachmentsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "attachments",
+		Short: "Inspect attached backing services",
+	}
+	cmd.AddCommand(newAttachmentsListCmd())
+	return cmd
+}
+
+func newAttachmentsListCmd() *cobra.Command {
+	var name, namespace string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List attachments with their endpoints and keys (never their values)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, ns, err := getClient(namespace)
+			if err != nil {
+				return err
+			}
+			found, err := listAttachments(cmd.Context(), client, ns, name)
+			if err != nil {
+				return err
+			}
+			if len(found) == 0 {
+				fmt.Printf("No attachments in namespace %s\n", ns)
+				return nil
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "APP\tTYPE\tSECRET\tENDPOINT\tKEYS")
+			for _, a := range found {
+				keys := make([]string, 0, len(a.Secret.Data))
+				for k := range a.Secret.Data {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", a.App, a.Type.Name, a.Secret.Name, a.Type.endpoint(a.Secret.Data), strings.Join(keys, ","))
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "Only this app")
+	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
+	return cmd
+}
+
+func newDetachCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "detach <type>",
+		Short: "Remove an attachment's Secret and stop loading it",
+	}
+	for _, t := range attachmentTypes {
+		cmd.AddCommand(newDetachTypeCmd(t))
+	}
+	return cmd
+}
+
+func newDetachTypeCmd(t attachmentType) *cobra.Command {
+	var (
+		name, namespace string
+		deprovision     bool
+	)
+	cmd := &cobra.Command{
+		Use:     t.Name,
+		Aliases: t.Aliases,
+		Short:   "Detach " + t.Title,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if name == "" {
+				return fmt.Errorf("name required")
+			}
+			ctx := cmd.Context()
+			client, ns, err := getClient(namespace)
+			if err != nil {
+				return err
+			}
+			secret := t.secretName(name)
+			if _, err := client.CoreV1().Secrets(ns).Get(ctx, secret, metav1.GetOptions{}); err != nil {
+				if errors.IsNotFound(err) && !deprovision {
+					return fmt.Errorf("%s has no %s attachment (secret %s not found)", name, t.Title, secret)
+				}
+				if !errors.IsNotFound(err) {
+					return err
+				}
+			}
+			// Stop referencing the Secret before deleting it, so new pods
+			// of the current revision don't fail on a missing envFrom
+			if err := syncServiceEnvFrom(ctx, name, ns, "", secret); err != nil {
+				return err
+			}
+			err = client.CoreV1().Secrets(ns).Delete(ctx, secret, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete secret %s: %v", secret, err)
+			}
+			fmt.Printf("Detached %s from %s\n", t.Title, name)
+			if deprovision {
+				// Provisioned datastores are named <app>-<type>
+				return deprovisionDatastore(ctx, client, ns, name+"-"+t.Name)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "App name")
+	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
+	if _, ok := t.newConn().(provisioner); ok {
+		cmd.Flags().BoolVar(&deprovision, "deprovision", false, "Also delete the "+t.Title+" created by --provision, including its data volume")
+	}
+	return cmd
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+)
+
+// Build strategies. An empty strategy means pack when it is installed and
+// Docker otherwise.
+const (
+	strategyPack   = "pack"
+	strategyDocker = "docker"
+	strategyNative = "native"
+)
+
+const (
+	defaultPackBuilder    = "paketobuildpacks/builder-jammy-base"
+	defaultPackPullPolicy = "if-not-present"
+	defaultPlatform       = "linux/amd64"
+)
+
+// buildConfig is shared by `flow build`, `flow deploy` and the `build:`
+// section of flow.yaml so every entry point builds the same way.
+type buildConfig struct {
+	Strategy   string   `json:"strategy,omitempty"`
+	Builder    string   `json:"builder,omitempty"`
+	Buildpacks []string `json:"buildpacks,omitempty"`
+	PullPolicy string   `json:"pullPolicy,omitempty"`
+	CacheImage string   `json:"cacheImage,omitempty"`
+	RunImage   string   `json:"runImage,omitempty"`
+	NoCache    bool     `json:"noCache,omitempty"`
+	Platforms  []string `json:"platforms,omitempty"`
+	// Secrets are available to the build but never stored in the image.
+	Secrets []buildSecret `json:"secrets,omitempty"`
+
+	secretFlags []string
+	// keepLocal builds into the local daemon for a later `flow push`; pack
+	// then only uses (and publishes with) a cache image given explicitly.
+	keepLocal bool
+}
+
+// addBuildFlags registers the build configuration flags on cmd. --builder
+// accepts a strategy name (pack, docker, native) or a pack builder image.
+func addBuildFlags(cmd *cobra.Command, cfg *buildConfig) {
+	cmd.Flags().StringVar(&cfg.Builder, "builder", "", "Build strategy (pack, docker, native) or Paketo builder image (default "+defaultPackBuilder+")")
+	cmd.Flags().StringSliceVar(&cfg.Buildpacks, "buildpack", nil, "Buildpack to use instead of builder detection (repeatable)")
+	cmd.Flags().StringVar(&cfg.PullPolicy, "pull-policy", "", "pack pull policy: always, never or if-not-present (default "+defaultPackPullPolicy+")")
+	cmd.Flags().StringVar(&cfg.CacheImage, "cache-image", "", "Registry image pack uses to store the build cache")
+	cmd.Flags().StringVar(&cfg.RunImage, "run-image", "", "Run image to use instead of the builder's default")
+	cmd.Flags().BoolVar(&cfg.NoCache, "no-cache", false, "Build without the per-branch registry cache")
+	cmd.Flags().StringSliceVar(&cfg.Platforms, "platforms", nil, "Target platforms, e.g. linux/amd64,linux/arm64 (default "+defaultPlatform+")")
+	cmd.Flags().StringArrayVar(&cfg.secretFlags, "build-secret", nil, "Build-only secret: NAME (from $NAME) or id=NAME,src=FILE|env=VAR[,target=PATH][,type=TYPE] (repeatable)")
+}
+
+// resolveBuildConfig layers defaults, the manifest's build sections (project
+// then service) and any flags set on the command line, in that order.
+func resolveBuildConfig(cmd *cobra.Command, flags buildConfig, layers ...buildConfig) (buildConfig, error) {
+	cfg := buildConfig{PullPolicy: defaultPackPullPolicy}
+	for _, l := range layers {
+		cfg.overlay(l)
+	}
+
+	set := func(name string) bool { return cmd.Flags().Changed(name) }
+	if set("builder") {
+		cfg.Builder = flags.Builder
+	}
+	if set("buildpack") {
+		cfg.Buildpacks = flags.Buildpacks
+	}
+	if set("pull-policy") {
+		cfg.PullPolicy = flags.PullPolicy
+	}
+	if set("cache-image") {
+		cfg.CacheImage = flags.CacheImage
+	}
+	if set("run-image") {
+		cfg.RunImage = flags.RunImage
+	}
+	if set("no-cache") {
+		cfg.NoCache = flags.NoCache
+	}
+	if set("platforms") {
+		cfg.Platforms = flags.Platforms
+	}
+	for _, spec := range flags.secretFlags {
+		s, err := parseBuildSecret(spec)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Secrets = mergeBuildSecrets(cfg.Secrets, []buildSecret{s})
+	}
+	for _, s := range cfg.Secrets {
+		if err := s.validate(); err != nil {
+			return cfg, err
+		}
+	}
+	if len(cfg.Platforms) == 0 {
+		cfg.Platforms = []string{defaultPlatform}
+	}
+	for _, p := range cfg.Platforms {
+		if _, err := v1.ParsePlatform(p); err != nil || !strings.Contains(p, "/") {
+			return cfg, fmt.Errorf("invalid platform %q (want os/arch, e.g. linux/arm64)", p)
+		}
+	}
+
+	// --builder doubles as the strategy selector
+	switch cfg.Builder {
+	case strategyPack, strategyDocker, strategyNative:
+		cfg.Strategy, cfg.Builder = cfg.Builder, ""
+	}
+	if cfg.Builder == "" {
+		cfg.Builder = defaultPackBuilder
+	}
+
+	switch cfg.Strategy {
+	case "", strategyPack, strategyDocker, strategyNative:
+	default:
+		return cfg, fmt.Errorf("unknown build strategy %q (want pack, docker or native)", cfg.Strategy)
+	}
+	switch cfg.PullPolicy {
+	case "always", "never", "if-not-present":
+	default:
+		return cfg, fmt.Errorf("invalid pull policy %q (want always, never or if-not-present)", cfg.PullPolicy)
+	}
+	if cfg.Strategy == strategyPack && len(cfg.Platforms) > 1 {
+		return cfg, fmt.Errorf("pack builds one platform at a time; use --builder docker or --builder native for multi-arch images")
+	}
+	return cfg, nil
+}
+
+func (c *buildConfig) overlay(o buildConfig) {
+	if o.Strategy != "" {
+		c.Strategy = o.Strategy
+	}
+	if o.Builder != "" {
+		c.Builder = o.Builder
+	}
+	if len(o.Buildpacks) > 0 {
+		c.Buildpacks = o.Buildpacks
+	}
+	if o.PullPolicy != "" {
+		c.PullPolicy = o.PullPolicy
+	}
+	if o.CacheImage != "" {
+		c.CacheImage = o.CacheImage
+	}
+	if o.RunImage != "" {
+		c.RunImage = o.RunImage
+	}
+	if o.NoCache {
+		c.NoCache = true
+	}
+	if len(o.Platforms) > 0 {
+		c.Platforms = o.Platforms
+	}
+	c.Secrets = mergeBuildSecrets(c.Secrets, o.Secrets)
+}
+
+// multiArch reports whether the build produces a manifest list.
+func (c buildConfig) multiArch() bool {
+	return len(c.Platforms) > 1
+}
+
+// nativePlatforms converts the configured platforms for the native builder.
+func (c buildConfig) nativePlatforms() []v1.Platform {
+	var out []v1.Platform
+	for _, p := range c.Platforms {
+		if pl, err := v1.ParsePlatform(p); err == nil {
+			out = append(out, *pl)
+		}
+	}
+	return out
+}
+
+// packArgs builds the pack command line for cfg.
+func (c buildConfig) packArgs(appPath, imageRef string, envs []string) []string {
+	args := []string{"build", imageRef, "--path", appPath, "--builder", c.Builder, "--pull-policy", c.PullPolicy}
+	for _, bp := range c.Buildpacks {
+		args = append(args, "--buildpack", bp)
+	}
+	if c.RunImage != "" {
+		args = append(args, "--run-image", c.RunImage)
+	}
+	if len(c.Platforms) == 1 && c.Platforms[0] != defaultPlatform {
+		args = append(args, "--platform", c.Platforms[0])
+	}
+	if c.CacheImage != "" {
+		// pack can only use a registry cache when publishing
+		args = append(args, "--cache-image", c.CacheImage, "--publish")
+	}
+	for _, e := range envs {
+		args = append(args, "--env", e)
+	}
+	return args
+}
+
+// packBuild runs pack with cfg. On failure the tail of pack's output is
+// included in the error so it isn't lost in the scrollback. With a cache
+// image pack publishes directly, which is reported through the bool.
+func packBuild(packPath string, cfg buildConfig, appPath, imageRef string, envs []string) (bool, error) {
+	if cfg.CacheImage == "" && !cfg.NoCache && !cfg.keepLocal {
+		cfg.CacheImage = cacheRef(imageRef, cacheKindPack, cacheBranch(appPath))
+	}
+	if cfg.NoCache {
+		cfg.CacheImage = ""
+	}
+	if cfg.CacheImage != "" {
+		fmt.Printf("Using build cache %s\n", cfg.CacheImage)
+		if err := prepareRegistry(imageRef); err != nil {
+			return false, err
+		}
+		if err := prepareRegistry(cfg.CacheImage); err != nil {
+			return false, err
+		}
+	}
+	published := cfg.CacheImage != ""
+
+	args := cfg.packArgs(appPath, imageRef, envs)
+	descriptor, cleanup, err := packDescriptorArgs(appPath)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup()
+	args = append(args, descriptor...)
+	secretArgs, env, cleanupSecrets, err := packSecretArgs(cfg.Secrets, cfg.Builder)
+	if err != nil {
+		return false, err
+	}
+	defer cleanupSecrets()
+	args = append(args, secretArgs...)
+
+	fmt.Printf("Running pack command: %s %v\n", packPath, secretRedactor.redact(strings.Join(args, " ")))
+	tail := &tailBuffer{max: 30}
+	c := exec.Command(packPath, args...)
+	c.Env = env
+	stdout := newRedactWriter(io.MultiWriter(os.Stdout, tail))
+	stderr := newRedactWriter(io.MultiWriter(os.Stderr, tail))
+	c.Stdout, c.Stderr = stdout, stderr
+	err = c.Run()
+	stdout.Flush()
+	stderr.Flush()
+	if err != nil {
+		return false, fmt.Errorf("pack build failed: %v\n\nLast pack output:\n%s\n\nTo build with Docker instead, use --builder docker or set build.strategy: docker in flow.yaml", err, tail.String())
+	}
+	return published, nil
+}
+
+// tailBuffer keeps the last max lines written to it. It is safe to share
+// between a command's stdout and stderr.
+type tailBuffer struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+		if len(t.lines) > t.max {
+			t.lines = t.lines[len(t.lines)-t.max:]
+		}
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string{}, t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// buildFlagsCmd returns a command with the build flags parsed from args.
+func buildFlagsCmd(t *testing.T, args ...string) (*cobra.Command, buildConfig) {
+	t.Helper()
+	var flags buildConfig
+	cmd := &cobra.Command{Use: "build"}
+	addBuildFlags(cmd, &flags)
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, flags
+}
+
+func TestResolveBuildConfig(t *testing.T) {
+	project := buildConfig{Strategy: strategyPack, Builder: "example/builder", PullPolicy: "always", Buildpacks: []string{"bp/node"}}
+	service := buildConfig{RunImage: "example/run", Buildpacks: []string{"bp/python"}}
+
+	tests := []struct {
+		name   string
+		args   []string
+		layers []buildConfig
+		want   buildConfig
+	}{
+		{
+			name: "defaults",
+			want: buildConfig{Builder: defaultPackBuilder, PullPolicy: defaultPackPullPolicy, Platforms: []string{defaultPlatform}},
+		},
+		{
+			name:   "service overrides project",
+			layers: []buildConfig{project, service},
+			want: buildConfig{Strategy: strategyPack, Builder: "example/builder", PullPolicy: "always",
+				Buildpacks: []string{"bp/python"}, RunImage: "example/run", Platforms: []string{defaultPlatform}},
+		},
+		{
+			name:   "flags override the manifest",
+			args:   []string{"--pull-policy", "never", "--buildpack", "bp/go", "--no-cache"},
+			layers: []buildConfig{project},
+			want: buildConfig{Strategy: strategyPack, Builder: "example/builder", PullPolicy: "never",
+				Buildpacks: []string{"bp/go"}, NoCache: true, Platforms: []string{defaultPlatform}},
+		},
+		{
+			name:   "unset flags keep the manifest",
+			args:   []string{"--run-image", "flag/run"},
+			layers: []buildConfig{project},
+			want: buildConfig{Strategy: strategyPack, Builder: "example/builder", PullPolicy: "always",
+				Buildpacks: []string{"bp/node"}, RunImage: "flag/run", Platforms: []string{defaultPlatform}},
+		},
+		{
+			name: "builder selects a strategy",
+			args: []string{"--builder", "docker", "--platforms", "linux/amd64,linux/arm64"},
+			want: buildConfig{Strategy: strategyDocker, Builder: defaultPackBuilder, PullPolicy: defaultPackPullPolicy,
+				Platforms: []string{"linux/amd64", "linux/arm64"}},
+		},
+		{
+			name:   "builder in the manifest selects a strategy",
+			layers: []buildConfig{{Builder: strategyNative}},
+			want:   buildConfig{Strategy: strategyNative, Builder: defaultPackBuilder, PullPolicy: defaultPackPullPolicy, Platforms: []string{defaultPlatform}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, flags := buildFlagsCmd(t, tt.args...)
+			got, err := resolveBuildConfig(cmd, flags, tt.layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Empty and nil slices are the same configuration
+			got.secretFlags = nil
+			if len(got.Secrets) == 0 {
+				got.Secrets = nil
+			}
+			if len(got.Buildpacks) == 0 {
+				got.Buildpacks = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveBuildConfig() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveBuildConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		layers []buildConfig
+		want   string
+	}{
+		{name: "unknown strategy", layers: []buildConfig{{Strategy: "kaniko"}}, want: "unknown build strategy"},
+		{name: "invalid pull policy", args: []string{"--pull-policy", "sometimes"}, want: "invalid pull policy"},
+		{name: "platform without arch", args: []string{"--platforms", "linux"}, want: "invalid platform"},
+		{name: "pack multi-arch", args: []string{"--builder", "pack", "--platforms", "linux/amd64,linux/arm64"}, want: "pack builds one platform"},
+		{name: "invalid build secret", args: []string{"--build-secret", "id=X,bogus=1"}, want: "bogus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, flags := buildFlagsCmd(t, tt.args...)
+			_, err := resolveBuildConfig(cmd, flags, tt.layers...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackArgs(t *testing.T) {
+	cfg := buildConfig{
+		Builder:    "example/builder",
+		PullPolicy: "never",
+		Buildpacks: []string{"bp/a", "bp/b"},
+		RunImage:   "example/run",
+		Platforms:  []string{"linux/arm64"},
+		CacheImage: "registry.example.com/app:cache",
+	}
+	got := cfg.packArgs("./app", "registry.example.com/app:v1", []string{"A=1"})
+	want := []string{"build", "registry.example.com/app:v1", "--path", "./app", "--builder", "example/builder", "--pull-policy", "never",
+		"--buildpack", "bp/a", "--buildpack", "bp/b", "--run-image", "example/run", "--platform", "linux/arm64",
+		"--cache-image", "registry.example.com/app:cache", "--publish", "--env", "A=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("packArgs() =\n%v\nwant\n%v", got, want)
+	}
+
+	// The default platform and no cache image add nothing
+	cfg = buildConfig{Builder: defaultPackBuilder, PullPolicy: defaultPackPullPolicy, Platforms: []string{defaultPlatform}}
+	got = cfg.packArgs(".", "app", nil)
+	want = []string{"build", "app", "--path", ".", "--builder", defaultPackBuilder, "--pull-policy", defaultPackPullPolicy}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("packArgs() = %v, want %v", got, want)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tb := &tailBuffer{max: 3}
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(tb, "line %d\n", i)
+	}
+	tb.Write([]byte("partial"))
+	if got, want := tb.String(), "line 3\nline 4\nline 5\npartial"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
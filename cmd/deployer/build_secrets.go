@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Where the pack build containers see service bindings.
+const packBindingRoot = "/platform/bindings"
+
+// Values shorter than this are not redacted; masking every "1" or "ab" in
+// build output would make it unreadable without protecting anything.
+const minRedactLen = 4
+
+var secretIDRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// buildSecret is a credential the build needs but the image must not keep,
+// e.g. a private registry token. It is read from a file (Src) or an
+// environment variable (Env, defaulting to ID).
+//
+// Without Target the value is exposed as the environment variable ID to
+// dependency installs and compilers. With Target it is a file: mounted at
+// Target in Docker builds and passed to buildpacks as a service binding of
+// Type (default: Target's base name, e.g. npmrc for /app/.npmrc).
+type buildSecret struct {
+	ID     string `json:"id"`
+	Src    string `json:"src,omitempty"`
+	Env    string `json:"env,omitempty"`
+	Target string `json:"target,omitempty"`
+	Type   string `json:"type,omitempty"`
+
+	value []byte
+}
+
+// parseBuildSecret parses --build-secret in docker's syntax,
+// id=NAME[,src=PATH|,env=VAR][,target=PATH][,type=TYPE], or a bare NAME
+// read from the environment variable of the same name.
+func parseBuildSecret(spec string) (buildSecret, error) {
+	var s buildSecret
+	if !strings.Contains(spec, "=") {
+		s.ID = spec
+		return s, s.validate()
+	}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return s, fmt.Errorf("invalid build secret %q: %q is not key=value", spec, kv)
+		}
+		switch k {
+		case "id":
+			s.ID = v
+		case "src", "source":
+			s.Src = v
+		case "env":
+			s.Env = v
+		case "target", "dst":
+			s.Target = v
+		case "type":
+			s.Type = v
+		default:
+			return s, fmt.Errorf("invalid build secret %q: unknown key %q", spec, k)
+		}
+	}
+	return s, s.validate()
+}
+
+func (s buildSecret) validate() error {
+	if !secretIDRE.MatchString(s.ID) {
+		return fmt.Errorf("invalid build secret id %q: use letters, digits and underscores", s.ID)
+	}
+	if s.Src != "" && s.Env != "" {
+		return fmt.Errorf("build secret %s: set src or env, not both", s.ID)
+	}
+	if s.Target != "" && !path.IsAbs(s.Target) {
+		return fmt.Errorf("build secret %s: target %q must be an absolute path", s.ID, s.Target)
+	}
+	return nil
+}
+
+// bindingType is the service binding type buildpacks look for.
+func (s buildSecret) bindingType() string {
+	if s.Type != "" {
+		return s.Type
+	}
+	base := strings.TrimPrefix(path.Base(s.Target), ".")
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// mergeBuildSecrets overlays secrets by ID.
+func mergeBuildSecrets(base, over []buildSecret) []buildSecret {
+	out := append([]buildSecret{}, base...)
+	for _, s := range over {
+		replaced := false
+		for i := range out {
+			if out[i].ID == s.ID {
+				out[i], replaced = s, true
+			}
+		}
+		if !replaced {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// loadBuildSecrets reads every secret's value and registers it for
+// redaction. Relative src paths are relative to the app directory.
+func loadBuildSecrets(secrets []buildSecret, appPath string) ([]buildSecret, error) {
+	out := make([]buildSecret, len(secrets))
+	for i, s := range secrets {
+		switch {
+		case s.Src != "":
+			p := s.Src
+			if strings.HasPrefix(p, "~/") {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					return nil, err
+				}
+				p = filepath.Join(home, p[2:])
+			} else if !filepath.IsAbs(p) {
+				p = filepath.Join(appPath, p)
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return nil, fmt.Errorf("build secret %s: %v", s.ID, err)
+			}
+			s.Src, s.value = p, data
+		default:
+			if s.Env == "" {
+				s.Env = s.ID
+			}
+			v, ok := os.LookupEnv(s.Env)
+			if !ok {
+				return nil, fmt.Errorf("build secret %s: $%s is not set", s.ID, s.Env)
+			}
+			s.value = []byte(v)
+		}
+		secretRedactor.add(string(s.value))
+		out[i] = s
+	}
+	return out, nil
+}
+
+// envSecrets returns the secrets exposed as environment variables as
+// key=value pairs.
+func envSecrets(secrets []buildSecret) []string {
+	var out []string
+	for _, s := range secrets {
+		if s.Target == "" {
+			out = append(out, s.ID+"="+strings.TrimRight(string(s.value), "\r\n"))
+		}
+	}
+	return out
+}
+
+// dockerSecretArgs returns the docker build --secret flags.
+func dockerSecretArgs(secrets []buildSecret) []string {
+	var args []string
+	for _, s := range secrets {
+		if s.Src != "" {
+			args = append(args, "--secret", "id="+s.ID+",src="+s.Src)
+		} else {
+			args = append(args, "--secret", "id="+s.ID+",env="+s.Env)
+		}
+	}
+	return args
+}
+
+// dockerRun returns a Dockerfile RUN instruction for cmd with every secret
+// mounted. Env secrets are exported from /run/secrets for the one step, so
+// they never reach a layer or the image config.
+func dockerRun(secrets []buildSecret, cmd string) string {
+	if len(secrets) == 0 {
+		return "RUN " + cmd
+	}
+	var mounts, exports []string
+	for _, s := range secrets {
+		m := "--mount=type=secret,id=" + s.ID
+		if s.Target != "" {
+			m += ",target=" + s.Target
+		} else {
+			exports = append(exports, fmt.Sprintf(`%s="$(cat /run/secrets/%s)"`, s.ID, s.ID))
+		}
+		mounts = append(mounts, m)
+	}
+	run := "RUN " + strings.Join(mounts, " ") + " "
+	if len(exports) > 0 {
+		run += "export " + strings.Join(exports, " ") + " && "
+	}
+	return run + cmd
+}
+
+// packSecretArgs writes file secrets as service bindings under a temporary
+// directory mounted into the build, and passes env secrets by name so pack
+// reads their values from its environment rather than the command line.
+// The returned env is pack's environment.
+//
+// The bindings are only readable by this user and builder's build user
+// (see grantBindingAccess), not by everyone on the machine.
+func packSecretArgs(secrets []buildSecret, builder string) (args, env []string, cleanup func(), err error) {
+	cleanup = func() {}
+	if len(secrets) == 0 {
+		return nil, nil, cleanup, nil
+	}
+	env = os.Environ()
+	var root string
+	for _, s := range secrets {
+		if s.Target == "" {
+			args = append(args, "--env", s.ID)
+			env = append(env, s.ID+"="+strings.TrimRight(string(s.value), "\r\n"))
+			continue
+		}
+		if root == "" {
+			// MkdirTemp creates the directory 0700
+			if root, err = os.MkdirTemp("", "flow-bindings-*"); err != nil {
+				return nil, nil, cleanup, err
+			}
+			cleanup = func() { os.RemoveAll(root) }
+		}
+		dir := filepath.Join(root, strings.ToLower(s.ID))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			cleanup()
+			return nil, nil, func() {}, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "type"), []byte(s.bindingType()), 0600); err != nil {
+			cleanup()
+			return nil, nil, func() {}, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, path.Base(s.Target)), s.value, 0600); err != nil {
+			cleanup()
+			return nil, nil, func() {}, err
+		}
+	}
+	if root != "" {
+		// The build containers run as the builder's own user, which must
+		// be able to read the mounted bindings
+		uid, gid, err := lookupBuilderUser(builder)
+		if err == nil {
+			err = grantBindingAccess(root, uid, gid)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, func() {}, fmt.Errorf("file build secrets: %v", err)
+		}
+		args = append(args, "--volume", root+":"+packBindingRoot+":ro", "--env", "SERVICE_BINDING_ROOT="+packBindingRoot)
+	}
+	return args, env, cleanup, nil
+}
+
+// lookupBuilderUser is builderUser; tests replace it.
+var lookupBuilderUser = builderUser
+
+// builderUser returns the uid and gid builder's build containers run as,
+// from the CNB_USER_ID and CNB_GROUP_ID its image declares. The builder is
+// pulled if it isn't local yet; pack would pull it next anyway.
+func builderUser(builder string) (uid, gid int, err error) {
+	inspect := func() ([]byte, error) {
+		return exec.Command("docker", "image", "inspect", "--format", "{{json .Config.Env}}", builder).Output()
+	}
+	out, err := inspect()
+	if err != nil {
+		if pull, err := exec.Command("docker", "pull", "--quiet", builder).CombinedOutput(); err != nil {
+			return 0, 0, fmt.Errorf("failed to pull builder %s: %v: %s", builder, err, strings.TrimSpace(string(pull)))
+		}
+		if out, err = inspect(); err != nil {
+			return 0, 0, fmt.Errorf("failed to inspect builder %s: %v", builder, err)
+		}
+	}
+	var env []string
+	if err := json.Unmarshal(out, &env); err != nil {
+		return 0, 0, fmt.Errorf("failed to inspect builder %s: %v", builder, err)
+	}
+	uid, gid, err = parseCNBUser(env)
+	if err != nil {
+		return 0, 0, fmt.Errorf("builder %s: %v", builder, err)
+	}
+	return uid, gid, nil
+}
+
+// parseCNBUser reads CNB_USER_ID and CNB_GROUP_ID from an image's env.
+func parseCNBUser(env []string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "CNB_USER_ID":
+			uid, err = strconv.Atoi(v)
+		case "CNB_GROUP_ID":
+			gid, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s", kv)
+		}
+	}
+	if uid < 0 || gid < 0 {
+		return 0, 0, fmt.Errorf("no CNB_USER_ID/CNB_GROUP_ID in the image environment")
+	}
+	return uid, gid, nil
+}
+
+// grantBindingAccess lets uid/gid read the 0700 bindings under root: by
+// ownership when flow runs as root, otherwise with a POSIX ACL for just
+// that user. Docker Desktop shares files with containers regardless of
+// their owner, so only Linux needs either.
+func grantBindingAccess(root string, uid, gid int) error {
+	if uid == os.Getuid() {
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(p, uid, gid)
+		})
+	}
+	out, err := exec.Command("setfacl", "-R", "-m", fmt.Sprintf("u:%d:rX", uid), root).CombinedOutput()
+	if err == nil || runtime.GOOS != "linux" {
+		return nil
+	}
+	return fmt.Errorf("can't give the builder user (uid %d) access to the bindings: setfacl failed: %v: %s; "+
+		"install the acl package, run as root, or pass the secret as an env var (no target)", uid, err, strings.TrimSpace(string(out)))
+}
+
+// secretIDs lists the secret IDs, for provenance.
+func secretIDs(secrets []buildSecret) []string {
+	ids := make([]string, len(secrets))
+	for i, s := range secrets {
+		ids[i] = s.ID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// redactor masks registered secret values in text.
+type redactor struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+var secretRedactor = &redactor{}
+
+// add registers value (and each of its lines, for multi-line files).
+func (r *redactor) add(value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range append([]string{value}, strings.Split(value, "\n")...) {
+		v = strings.TrimSpace(v)
+		if len(v) < minRedactLen {
+			continue
+		}
+		dup := false
+		for _, have := range r.values {
+			dup = dup || have == v
+		}
+		if !dup {
+			r.values = append(r.values, v)
+		}
+	}
+	// Longest first so a value containing another is masked whole
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, "[REDACTED]")
+	}
+	return s
+}
+
+// redactWriter masks secret values in output written through it. It
+// passes text on a line at a time so values split across writes are still
+// caught; Flush writes out a trailing partial line.
+type redactWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func newRedactWriter(w io.Writer) *redactWriter {
+	return &redactWriter{w: w}
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	// Progress output redraws lines with \r, so treat it as a line end too
+	if i := bytes.LastIndexAny(r.buf, "\n\r"); i >= 0 {
+		if _, err := io.WriteString(r.w, secretRedactor.redact(string(r.buf[:i+1]))); err != nil {
+			return 0, err
+		}
+		r.buf = r.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (r *redactWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, secretRedactor.redact(string(r.buf)))
+	r.buf = nil
+	return err
+}
+
+// runRedacted runs c with its output on the terminal, secrets masked.
+func runRedacted(c *exec.Cmd) error {
+	stdout, stderr := newRedactWriter(os.Stdout), newRedactWriter(os.Stderr)
+	c.Stdout, c.Stderr = stdout, stderr
+	err := c.Run()
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
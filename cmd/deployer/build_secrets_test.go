@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildSecret(t *testing.T) {
+	tests := []struct {
+		spec string
+		want buildSecret
+		err  string
+	}{
+		{spec: "NPM_TOKEN", want: buildSecret{ID: "NPM_TOKEN"}},
+		{spec: "id=NPM_TOKEN,env=CI_NPM_TOKEN", want: buildSecret{ID: "NPM_TOKEN", Env: "CI_NPM_TOKEN"}},
+		{spec: "id=NPMRC,src=~/.npmrc,target=/app/.npmrc", want: buildSecret{ID: "NPMRC", Src: "~/.npmrc", Target: "/app/.npmrc"}},
+		{spec: "id=PIP,source=pip.conf,dst=/etc/pip.conf,type=pip", want: buildSecret{ID: "PIP", Src: "pip.conf", Target: "/etc/pip.conf", Type: "pip"}},
+		{spec: "id=A,src=x,env=Y", err: "set src or env, not both"},
+		{spec: "id=A,target=relative/path", err: "must be an absolute path"},
+		{spec: "id=A,mode=0400", err: `unknown key "mode"`},
+		{spec: "id=A,src", err: `"src" is not key=value`},
+		{spec: "1BAD", err: "invalid build secret id"},
+		{spec: "id=has-dash", err: "invalid build secret id"},
+		{spec: "src=x", err: "invalid build secret id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseBuildSecret(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBuildSecret() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBindingType(t *testing.T) {
+	tests := []struct {
+		s    buildSecret
+		want string
+	}{
+		{buildSecret{Target: "/app/.npmrc"}, "npmrc"},
+		{buildSecret{Target: "/etc/pip.conf"}, "pip"},
+		{buildSecret{Target: "/root/.m2/settings.xml"}, "settings"},
+		{buildSecret{Target: "/app/.npmrc", Type: "custom"}, "custom"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.bindingType(); got != tt.want {
+			t.Errorf("bindingType(%q) = %q, want %q", tt.s.Target, got, tt.want)
+		}
+	}
+}
+
+func TestMergeBuildSecrets(t *testing.T) {
+	base := []buildSecret{{ID: "A", Env: "X"}, {ID: "B"}}
+	got := mergeBuildSecrets(base, []buildSecret{{ID: "A", Src: "a.txt"}, {ID: "C"}})
+	want := []buildSecret{{ID: "A", Src: "a.txt"}, {ID: "B"}, {ID: "C"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeBuildSecrets() = %+v, want %+v", got, want)
+	}
+	if base[0].Env != "X" {
+		t.Error("mergeBuildSecrets modified its input")
+	}
+}
+
+func TestLoadBuildSecrets(t *testing.T) {
+	app := writeTree(t, map[string]string{"secrets/npmrc": "//registry/:_authToken=file-token-value\n"})
+	t.Setenv("TEST_BUILD_TOKEN", "env-token-value\n")
+	got, err := loadBuildSecrets([]buildSecret{
+		{ID: "TOKEN", Env: "TEST_BUILD_TOKEN"},
+		{ID: "NPMRC", Src: "secrets/npmrc", Target: "/app/.npmrc"},
+	}, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[1].Src != filepath.Join(app, "secrets/npmrc") {
+		t.Errorf("Src = %q, want it resolved against the app", got[1].Src)
+	}
+	if env := envSecrets(got); !reflect.DeepEqual(env, []string{"TOKEN=env-token-value"}) {
+		t.Errorf("envSecrets() = %v", env)
+	}
+	if out := secretRedactor.redact("token env-token-value and //registry/:_authToken=file-token-value"); strings.Contains(out, "token-value") {
+		t.Errorf("values not registered for redaction: %q", out)
+	}
+
+	if _, err := loadBuildSecrets([]buildSecret{{ID: "UNSET_TEST_SECRET_XYZ"}}, app); err == nil || !strings.Contains(err.Error(), "is not set") {
+		t.Errorf("unset env: err = %v", err)
+	}
+	if _, err := loadBuildSecrets([]buildSecret{{ID: "F", Src: "missing"}}, app); err == nil {
+		t.Error("missing src: no error")
+	}
+}
+
+func TestDockerSecretArgs(t *testing.T) {
+	secrets := []buildSecret{{ID: "TOKEN", Env: "CI_TOKEN"}, {ID: "NPMRC", Src: "/home/me/.npmrc", Target: "/app/.npmrc"}}
+	want := []string{"--secret", "id=TOKEN,env=CI_TOKEN", "--secret", "id=NPMRC,src=/home/me/.npmrc"}
+	if got := dockerSecretArgs(secrets); !reflect.DeepEqual(got, want) {
+		t.Errorf("dockerSecretArgs() = %v, want %v", got, want)
+	}
+	run := dockerRun(secrets, "npm ci")
+	wantRun := `RUN --mount=type=secret,id=TOKEN --mount=type=secret,id=NPMRC,target=/app/.npmrc export TOKEN="$(cat /run/secrets/TOKEN)" && npm ci`
+	if run != wantRun {
+		t.Errorf("dockerRun() =\n%s\nwant\n%s", run, wantRun)
+	}
+	if got := dockerRun(nil, "npm ci"); got != "RUN npm ci" {
+		t.Errorf("dockerRun(nil) = %q", got)
+	}
+}
+
+func TestPackSecretArgs(t *testing.T) {
+	var gotBuilder string
+	prev := lookupBuilderUser
+	lookupBuilderUser = func(builder string) (int, int, error) {
+		gotBuilder = builder
+		return os.Getuid(), os.Getgid(), nil
+	}
+	t.Cleanup(func() { lookupBuilderUser = prev })
+
+	secrets := []buildSecret{
+		{ID: "TOKEN", value: []byte("t0ken-value\n")},
+		{ID: "NPMRC", Target: "/app/.npmrc", value: []byte("//r/:_authToken=x")},
+	}
+	args, env, cleanup, err := packSecretArgs(secrets, "example/builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotBuilder != "example/builder" {
+		t.Errorf("looked up builder %q", gotBuilder)
+	}
+	if len(args) != 6 || args[0] != "--env" || args[1] != "TOKEN" || args[2] != "--volume" ||
+		!strings.HasSuffix(args[3], ":"+packBindingRoot+":ro") || args[5] != "SERVICE_BINDING_ROOT="+packBindingRoot {
+		t.Fatalf("args = %v", args)
+	}
+	if env[len(env)-1] != "TOKEN=t0ken-value" {
+		t.Errorf("env ends with %q", env[len(env)-1])
+	}
+	if strings.Contains(strings.Join(args, " "), "t0ken-value") {
+		t.Error("secret value on the command line")
+	}
+
+	root := strings.TrimSuffix(args[3], ":"+packBindingRoot+":ro")
+	for p, want := range map[string]os.FileMode{
+		root:                                   0700,
+		filepath.Join(root, "npmrc"):           0700,
+		filepath.Join(root, "npmrc", "type"):   0600,
+		filepath.Join(root, "npmrc", ".npmrc"): 0600,
+	} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s mode %v, want %v", p, info.Mode().Perm(), want)
+		}
+	}
+	if typ, _ := os.ReadFile(filepath.Join(root, "npmrc", "type")); string(typ) != "npmrc" {
+		t.Errorf("binding type = %q", typ)
+	}
+	cleanup()
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("bindings not removed: %v", err)
+	}
+
+	// Env-only secrets need no bindings or builder lookup
+	gotBuilder = ""
+	args, _, cleanup, err = packSecretArgs(secrets[:1], "example/builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if len(args) != 2 || gotBuilder != "" {
+		t.Errorf("args = %v, builder lookup %q", args, gotBuilder)
+	}
+}
+
+func TestParseCNBUser(t *testing.T) {
+	tests := []struct {
+		env      []string
+		uid, gid int
+		err      bool
+	}{
+		{env: []string{"PATH=/bin", "CNB_USER_ID=1002", "CNB_GROUP_ID=1000"}, uid: 1002, gid: 1000},
+		{env: []string{"CNB_USER_ID=1000"}, err: true},
+		{env: []string{"CNB_USER_ID=cnb", "CNB_GROUP_ID=1000"}, err: true},
+		{env: nil, err: true},
+	}
+	for _, tt := range tests {
+		uid, gid, err := parseCNBUser(tt.env)
+		if (err != nil) != tt.err || uid != tt.uid || gid != tt.gid {
+			t.Errorf("parseCNBUser(%v) = %d, %d, %v", tt.env, uid, gid, err)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	r := &redactor{}
+	r.add("abc") // too short to mask
+	r.add("hunter2")
+	r.add("line-one-secret\nline-two-secret\n")
+	r.add("hunter2-extended")
+	tests := []struct {
+		in, want string
+	}{
+		{"abc hunter2", "abc [REDACTED]"},
+		{"hunter2-extended", "[REDACTED]"},
+		{"key: line-two-secret", "key: [REDACTED]"},
+		{"nothing here", "nothing here"},
+	}
+	for _, tt := range tests {
+		if got := r.redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	secretRedactor.add("split-secret-value")
+	var buf bytes.Buffer
+	w := newRedactWriter(&buf)
+	// A value split across writes is still masked once its line completes
+	w.Write([]byte("token=split-sec"))
+	w.Write([]byte("ret-value\nprogress 50%\r"))
+	w.Write([]byte("tail split-secret-value"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "token=[REDACTED]\nprogress 50%\rtail [REDACTED]"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Base images used by the native builder. Node and Python match the images
+// the generated Dockerfiles use so both strategies produce the same runtime.
+// Go differs on purpose: the binary is built here with CGO disabled, so it
+// runs on distroless static as a non-root user, where the Dockerfile's
+// alpine stage exists only because it compiles inside the image.
+const (
+	nativeNodeBase   = "node:18-alpine"
+	nativePythonBase = "python:3.11-slim"
+	nativeGoBase     = "gcr.io/distroless/static-debian12:nonroot"
+)
+
+// nativeBuilder assembles OCI images in-process and pushes them straight to
+// the registry, so it needs neither a Docker daemon nor pack.
+type nativeBuilder struct {
+	Keychain authn.Keychain
+	// Insecure allows plain-HTTP registries, e.g. an in-process test registry.
+	Insecure bool
+	// Platforms to build; more than one produces a manifest list.
+	Platforms []v1.Platform
+	// BaseImage overrides the runtime's default base image.
+	BaseImage string
+}
+
+func newNativeBuilder() *nativeBuilder {
+	return &nativeBuilder{
+		Keychain:  registryKeychain(),
+		Platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}},
+	}
+}
+
+// nativeLayout describes how an app runtime is turned into image layers.
+type nativeLayout struct {
+	Base       string
+	Layers     []v1.Layer
+	Env        []string
+	Entrypoint []string
+	Cmd        []string
+}
+
+// Build assembles the image for appPath and pushes it to imageRef, returning
+// the pushed manifest (or manifest list) digest. envs are build-time
+// key=value pairs; they are visible to compilers and installers but are not
+// stored in the image.
+func (b *nativeBuilder) Build(ctx context.Context, appPath, imageRef string, envs []string) (v1.Hash, error) {
+	ref, err := name.ParseReference(imageRef, b.nameOptions()...)
+	if err != nil {
+		return v1.Hash{}, fmt.Errorf("invalid image reference %s: %v", imageRef, err)
+	}
+	if len(b.Platforms) == 0 {
+		return v1.Hash{}, fmt.Errorf("no target platforms")
+	}
+
+	reg := registryForHost(ref.Context().RegistryStr())
+	if err := reg.EnsureRepository(ref.Context().RepositoryStr()); err != nil {
+		return v1.Hash{}, err
+	}
+
+	if len(b.Platforms) == 1 {
+		img, err := b.buildImage(ctx, appPath, envs, b.Platforms[0])
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		fmt.Printf("Pushing image %s...\n", ref.Name())
+		if err := remote.Write(ref, img, b.remoteOptions(ctx)...); err != nil {
+			return v1.Hash{}, fmt.Errorf("failed to push image %s: %v", ref.Name(), err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		fmt.Printf("Pushed %s@%s\n", ref.Context().Name(), digest)
+		return digest, nil
+	}
+
+	idx := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	for _, p := range b.Platforms {
+		img, err := b.buildImage(ctx, appPath, envs, p)
+		if err != nil {
+			return v1.Hash{}, fmt.Errorf("%s: %v", p.String(), err)
+		}
+		platform := p
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+	fmt.Printf("Pushing multi-arch image %s...\n", ref.Name())
+	if err := remote.WriteIndex(ref, idx, b.remoteOptions(ctx)...); err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to push image %s: %v", ref.Name(), err)
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	fmt.Printf("Pushed %s@%s (%d platforms)\n", ref.Context().Name(), digest, len(b.Platforms))
+	return digest, nil
+}
+
+// buildImage assembles the image for a single platform.
+func (b *nativeBuilder) buildImage(ctx context.Context, appPath string, envs []string, platform v1.Platform) (v1.Image, error) {
+	layout, err := b.layout(appPath, envs, platform)
+	if err != nil {
+		return nil, err
+	}
+	if b.BaseImage != "" {
+		layout.Base = b.BaseImage
+	}
+
+	fmt.Printf("Pulling base image %s for %s...\n", layout.Base, platform.String())
+	baseRef, err := name.ParseReference(layout.Base, b.nameOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base image %s: %v", layout.Base, err)
+	}
+	base, err := remote.Image(baseRef, append(b.remoteOptions(ctx), remote.WithPlatform(platform))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch base image %s: %v", layout.Base, err)
+	}
+
+	img, err := mutate.AppendLayers(base, layout.Layers...)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg := cf.Config
+	cfg.WorkingDir = "/app"
+	cfg.Env = append(cfg.Env, layout.Env...)
+	cfg.Env = append(cfg.Env, "PORT=8080")
+	cfg.Entrypoint = layout.Entrypoint
+	cfg.Cmd = layout.Cmd
+	cfg.ExposedPorts = map[string]struct{}{"8080/tcp": {}}
+	return mutate.Config(img, cfg)
+}
+
+func (b *nativeBuilder) nameOptions() []name.Option {
+	if b.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+func (b *nativeBuilder) remoteOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(b.Keychain),
+	}
+}
+
+// layout detects the runtime the same way createDockerfile does.
+func (b *nativeBuilder) layout(appPath string, envs []string, platform v1.Platform) (*nativeLayout, error) {
+	if _, err := os.Stat(filepath.Join(appPath, "package.json")); err == nil {
+		return b.nodeLayout(appPath, platform)
+	} else if _, err := os.Stat(filepath.Join(appPath, "requirements.txt")); err == nil {
+		return b.pythonLayout(appPath, envs, platform)
+	} else if _, err := os.Stat(filepath.Join(appPath, "go.mod")); err == nil {
+		return b.goLayout(appPath, envs, platform)
+	}
+	return nil, fmt.Errorf("native builder supports Node.js, Python and Go apps; no package.json, requirements.txt or go.mod found in %s", appPath)
+}
+
+// Node.js: the source tree, including node_modules, on top of the Node base.
+// There is no install step, so dependencies must already be installed, and
+// compiled addons only work on the platform they were installed on.
+func (b *nativeBuilder) nodeLayout(appPath string, platform v1.Platform) (*nativeLayout, error) {
+	var pkg struct {
+		Dependencies map[string]string `json:"dependencies"`
+	}
+	raw, err := os.ReadFile(filepath.Join(appPath, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &pkg); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(appPath, "node_modules")); len(pkg.Dependencies) > 0 && os.IsNotExist(err) {
+		return nil, fmt.Errorf("node_modules not found; run `npm ci --omit=dev` before building with the native builder")
+	}
+	if platform.OS != runtime.GOOS || platform.Architecture != runtime.GOARCH {
+		addons, err := nativeAddons(appPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(addons) > 0 {
+			return nil, fmt.Errorf("node_modules has native addons built for %s/%s (%s) that won't run on %s; build with Docker or pack for other platforms",
+				runtime.GOOS, runtime.GOARCH, strings.Join(addons, ", "), platform.String())
+		}
+	}
+
+	layer, err := b.sourceLayer(appPath, true)
+	if err != nil {
+		return nil, err
+	}
+	return &nativeLayout{
+		Base:   nativeNodeBase,
+		Layers: []v1.Layer{layer},
+		Env:    []string{"NODE_ENV=production"},
+		Cmd:    nodeCommand(appPath),
+	}, nil
+}
+
+// nodeCommand starts the app the way npm does: the start script if there
+// is one, else the package's main file, else server.js.
+func nodeCommand(appPath string) []string {
+	var pkg struct {
+		Main    string            `json:"main"`
+		Scripts map[string]string `json:"scripts"`
+	}
+	if raw, err := os.ReadFile(filepath.Join(appPath, "package.json")); err == nil && json.Unmarshal(raw, &pkg) == nil {
+		if pkg.Scripts["start"] != "" {
+			return []string{"npm", "start"}
+		}
+		if pkg.Main != "" {
+			return []string{"node", pkg.Main}
+		}
+	}
+	return []string{"node", "server.js"}
+}
+
+// nativeAddons lists the installed packages with compiled addons: a
+// binding.gyp to build from or a prebuilt .node binary.
+func nativeAddons(appPath string) ([]string, error) {
+	root := filepath.Join(appPath, "node_modules")
+	found := map[string]bool{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if d.Name() != "binding.gyp" && !strings.HasSuffix(d.Name(), ".node") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		// The package is what follows the innermost node_modules
+		segs := strings.Split(filepath.ToSlash(rel), "/")
+		for i := len(segs) - 1; i >= 0; i-- {
+			if segs[i] == "node_modules" {
+				segs = segs[i+1:]
+				break
+			}
+		}
+		pkg := segs[0]
+		if strings.HasPrefix(pkg, "@") && len(segs) > 1 {
+			pkg += "/" + segs[1]
+		}
+		found[pkg] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for pkg := range found {
+		out = append(out, pkg)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Python: dependencies are installed for the target platform with
+// `pip install --target` into their own layer, then the source tree.
+func (b *nativeBuilder) pythonLayout(appPath string, envs []string, platform v1.Platform) (*nativeLayout, error) {
+	pip, err := exec.LookPath("pip3")
+	if err != nil {
+		if pip, err = exec.LookPath("pip"); err != nil {
+			return nil, fmt.Errorf("native Python builds need pip on PATH to vendor requirements.txt: %v", err)
+		}
+	}
+	depsDir, err := os.MkdirTemp("", "flow-pydeps-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(depsDir)
+
+	tag, err := manylinuxTag(platform)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Installing Python dependencies for %s...\n", platform.String())
+	args := []string{"install", "--quiet", "--no-cache-dir",
+		"--target", depsDir,
+		"--platform", tag,
+		"--implementation", "cp", "--python-version", "3.11",
+		"--only-binary=:all:",
+		"-r", filepath.Join(appPath, "requirements.txt")}
+	c := exec.Command(pip, args...)
+	c.Env = append(os.Environ(), envs...)
+	if err := runRedacted(c); err != nil {
+		return nil, fmt.Errorf("pip install failed: %v", err)
+	}
+	deps, err := loadBuildContext(depsDir, true)
+	if err != nil {
+		return nil, err
+	}
+	depsLayer, err := tarLayer(func(w io.Writer) error { return deps.writeTar(w, "app/.deps", nil) })
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := b.sourceLayer(appPath, false)
+	if err != nil {
+		return nil, err
+	}
+	return &nativeLayout{
+		Base:   nativePythonBase,
+		Layers: []v1.Layer{depsLayer, src},
+		Env:    []string{"PYTHONPATH=/app/.deps", "PYTHONUNBUFFERED=1"},
+		Cmd:    []string{"python", "-m", "gunicorn", "--bind", "0.0.0.0:8080", "app:app"},
+	}, nil
+}
+
+// Go: a statically linked binary cross-compiled for the target platform,
+// as the only layer on a distroless base.
+func (b *nativeBuilder) goLayout(appPath string, envs []string, platform v1.Platform) (*nativeLayout, error) {
+	out, err := os.MkdirTemp("", "flow-gobuild-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(out)
+
+	fmt.Printf("Compiling Go binary for %s...\n", platform.String())
+	bin := filepath.Join(out, "main")
+	c := exec.Command("go", "build", "-trimpath", "-ldflags=-s -w", "-o", bin, ".")
+	c.Dir = appPath
+	c.Env = append(os.Environ(), envs...)
+	c.Env = append(c.Env, "CGO_ENABLED=0", "GOOS="+platform.OS, "GOARCH="+platform.Architecture)
+	if platform.Variant != "" && platform.Architecture == "arm" {
+		c.Env = append(c.Env, "GOARM="+strings.TrimPrefix(platform.Variant, "v"))
+	}
+	if err := runRedacted(c); err != nil {
+		return nil, fmt.Errorf("go build failed: %v", err)
+	}
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, err := tarLayer(func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		if err := tw.WriteHeader(&tar.Header{Name: "app/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "app/main", Mode: 0755, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &nativeLayout{
+		Base:       nativeGoBase,
+		Layers:     []v1.Layer{layer},
+		Entrypoint: []string{"/app/main"},
+	}, nil
+}
+
+// sourceLayer packs the pruned build context under /app.
+func (b *nativeBuilder) sourceLayer(appPath string, keepDeps bool) (v1.Layer, error) {
+	bc, err := loadBuildContext(appPath, keepDeps)
+	if err != nil {
+		return nil, err
+	}
+	bc.warnIfLarge()
+	return tarLayer(func(w io.Writer) error { return bc.writeTar(w, "app", nil) })
+}
+
+// tarLayer renders a layer once into memory so it can be re-read for
+// digesting and uploading.
+func tarLayer(write func(io.Writer) error) (v1.Layer, error) {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// manylinuxTag is the wheel platform tag pip installs for p.
+func manylinuxTag(p v1.Platform) (string, error) {
+	arch := map[string]string{
+		"amd64":   "x86_64",
+		"arm64":   "aarch64",
+		"386":     "i686",
+		"ppc64le": "ppc64le",
+		"s390x":   "s390x",
+	}[p.Architecture]
+	if p.Architecture == "arm" && (p.Variant == "v7" || p.Variant == "") {
+		arch = "armv7l"
+	}
+	if p.OS != "linux" || arch == "" {
+		return "", fmt.Errorf("native Python builds have no manylinux wheels for %s; use --builder docker", p.String())
+	}
+	return "manylinux2014_" + arch, nil
+}
+
+// registryKeychain resolves credentials through the registry backend for
+// each host (ECR with tokens from the AWS SDK, others from flow.yaml or
+// the environment) and falls back to the Docker config.
+func registryKeychain() authn.Keychain {
+	return authn.NewMultiKeychain(backendKeychain{}, authn.DefaultKeychain)
+}
+
+type backendKeychain struct{}
+
+func (backendKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return registryForHost(target.RegistryStr()).Resolve(target)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// testRegistry starts an in-process registry and returns its host.
+func testRegistry(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+// pushBaseIndex pushes a random multi-platform base image to ref.
+func pushBaseIndex(t *testing.T, ref string, platforms []v1.Platform) {
+	t.Helper()
+	idx := v1.ImageIndex(empty.Index)
+	for _, p := range platforms {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		platform := p
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+	}
+	r, err := name.ParseReference(ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(r, idx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNativeBuilderPushesMultiArchNodeImage(t *testing.T) {
+	host := testRegistry(t)
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	base := host + "/base/node:18"
+	pushBaseIndex(t, base, platforms)
+
+	app := writeTree(t, map[string]string{
+		"package.json": `{"name": "app", "main": "src/index.js"}`,
+		"src/index.js": "console.log('hi')",
+		".env":         "SECRET=1",
+	})
+	b := &nativeBuilder{Keychain: authn.DefaultKeychain, Insecure: true, Platforms: platforms, BaseImage: base}
+	imageRef := host + "/team/app:v1"
+	digest, err := b.Build(context.Background(), app, imageRef, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, _ := name.ParseReference(imageRef, name.Insecure)
+	idx, err := remote.Index(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := idx.Digest(); got != digest {
+		t.Errorf("pushed digest %s, Build returned %s", got, digest)
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range manifest.Manifests {
+		got = append(got, m.Platform.String())
+	}
+	if want := []string{"linux/amd64", "linux/arm64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("platforms = %v, want %v", got, want)
+	}
+
+	img, err := idx.Image(manifest.Manifests[1].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"node", "src/index.js"}; !reflect.DeepEqual(cf.Config.Cmd, want) {
+		t.Errorf("Cmd = %v, want %v", cf.Config.Cmd, want)
+	}
+	if cf.Config.WorkingDir != "/app" {
+		t.Errorf("WorkingDir = %q, want /app", cf.Config.WorkingDir)
+	}
+	env := strings.Join(cf.Config.Env, " ")
+	if !strings.Contains(env, "NODE_ENV=production") || !strings.Contains(env, "PORT=8080") {
+		t.Errorf("Env = %v", cf.Config.Env)
+	}
+	if _, ok := cf.Config.ExposedPorts["8080/tcp"]; !ok {
+		t.Errorf("ExposedPorts = %v, want 8080/tcp", cf.Config.ExposedPorts)
+	}
+
+	// The app layer is the last one, with the pruned source under /app
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := layerFiles(t, layers[len(layers)-1])
+	if !files["app/src/index.js"] || !files["app/package.json"] {
+		t.Errorf("app layer = %v, want the source under app/", files)
+	}
+	if files["app/.env"] {
+		t.Errorf("app layer contains .env")
+	}
+}
+
+func layerFiles(t *testing.T, l v1.Layer) map[string]bool {
+	t.Helper()
+	rc, err := l.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	files := map[string]bool{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = true
+	}
+}
+
+func TestNodeCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		pkg  string
+		want []string
+	}{
+		{"start script", `{"main": "index.js", "scripts": {"start": "next start"}}`, []string{"npm", "start"}},
+		{"main", `{"main": "dist/server.js"}`, []string{"node", "dist/server.js"}},
+		{"empty start script", `{"main": "app.js", "scripts": {"start": ""}}`, []string{"node", "app.js"}},
+		{"default", `{"name": "app"}`, []string{"node", "server.js"}},
+		{"invalid json", `{`, []string{"node", "server.js"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := writeTree(t, map[string]string{"package.json": tt.pkg})
+			if got := nodeCommand(app); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nodeCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNativeAddons(t *testing.T) {
+	app := writeTree(t, map[string]string{
+		"package.json":                                       `{"dependencies": {"bcrypt": "5"}}`,
+		"node_modules/bcrypt/binding.gyp":                    "{}",
+		"node_modules/@scope/sharp/build/Release/sharp.node": "",
+		"node_modules/express/index.js":                      "",
+		"node_modules/a/node_modules/b/lib/b.node":           "",
+	})
+	got, err := nativeAddons(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"@scope/sharp", "b", "bcrypt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nativeAddons() = %v, want %v", got, want)
+	}
+
+	b := &nativeBuilder{}
+	other := v1.Platform{OS: "linux", Architecture: "s390x"}
+	if runtime.GOARCH == "s390x" {
+		other.Architecture = "amd64"
+	}
+	if _, err := b.nodeLayout(app, other); err == nil || !strings.Contains(err.Error(), "bcrypt") {
+		t.Errorf("cross-platform build with addons: err = %v, want a native addon error", err)
+	}
+	if _, err := b.nodeLayout(app, v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}); err != nil {
+		t.Errorf("host platform build: %v", err)
+	}
+
+	// Pure JavaScript dependencies build for any platform
+	pure := writeTree(t, map[string]string{
+		"package.json":                  `{"dependencies": {"express": "4"}}`,
+		"node_modules/express/index.js": "",
+	})
+	if _, err := b.nodeLayout(pure, other); err != nil {
+		t.Errorf("cross-platform build without addons: %v", err)
+	}
+}
+
+func TestManylinuxTag(t *testing.T) {
+	tests := []struct {
+		platform v1.Platform
+		want     string
+	}{
+		{v1.Platform{OS: "linux", Architecture: "amd64"}, "manylinux2014_x86_64"},
+		{v1.Platform{OS: "linux", Architecture: "arm64"}, "manylinux2014_aarch64"},
+		{v1.Platform{OS: "linux", Architecture: "ppc64le"}, "manylinux2014_ppc64le"},
+		{v1.Platform{OS: "linux", Architecture: "s390x"}, "manylinux2014_s390x"},
+		{v1.Platform{OS: "linux", Architecture: "386"}, "manylinux2014_i686"},
+		{v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "manylinux2014_armv7l"},
+		{v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ""},
+		{v1.Platform{OS: "linux", Architecture: "riscv64"}, ""},
+		{v1.Platform{OS: "windows", Architecture: "amd64"}, ""},
+	}
+	for _, tt := range tests {
+		got, err := manylinuxTag(tt.platform)
+		if tt.want == "" {
+			if err == nil || !strings.Contains(err.Error(), tt.platform.String()) {
+				t.Errorf("manylinuxTag(%s) = %q, %v; want an error naming the platform", tt.platform.String(), got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("manylinuxTag(%s) = %q, %v; want %q", tt.platform.String(), got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+// Cache kinds, used as tag prefixes in the <repo>-cache repository.
+const (
+	cacheKindPack     = "pack"
+	cacheKindBuildKit = "buildkit"
+)
+
+// Name of the buildx builder flow creates for registry cache export; the
+// default docker driver can't write cache manifests to a registry.
+const buildxBuilderName = "flow-builder"
+
+// Suffix of the repository holding a project's build caches.
+const cacheRepoSuffix = "-cache"
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// cacheBranch returns the tag-safe branch name used to key caches. CI
+// checkouts are often detached, so the usual CI variables are checked first.
+func cacheBranch(appPath string) string {
+	branch := ""
+	for _, env := range []string{"FLOW_CACHE_BRANCH", "GITHUB_HEAD_REF", "GITHUB_REF_NAME", "CI_COMMIT_REF_NAME", "BRANCH_NAME"} {
+		if v := os.Getenv(env); v != "" {
+			branch = v
+			break
+		}
+	}
+	if branch == "" {
+		c := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+		c.Dir = appPath
+		if out, err := c.Output(); err == nil {
+			branch = strings.TrimSpace(string(out))
+		}
+	}
+	if branch == "" || branch == "HEAD" {
+		branch = "default"
+	}
+	branch = strings.Trim(invalidTagChars.ReplaceAllString(branch, "-"), "-.")
+	if len(branch) > 100 {
+		branch = branch[:100]
+	}
+	return branch
+}
+
+// cacheRepository returns the repository that holds build caches for
+// imageRef: the image repository with a "-cache" suffix, so cache tags
+// never mix with (or get expired alongside) deployable images.
+func cacheRepository(imageRef string) string {
+	return repositoryOf(imageRef) + cacheRepoSuffix
+}
+
+// cacheRef returns the cache image for one strategy and branch, or "" when
+// imageRef has no registry to store a cache in.
+func cacheRef(imageRef, kind, branch string) string {
+	if !hasRegistry(imageRef) {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s-%s", cacheRepository(imageRef), kind, branch)
+}
+
+// prepareRegistry logs in to the registry holding ref and makes sure its
+// repository exists, for builders that push or read caches themselves.
+func prepareRegistry(ref string) error {
+	r, err := parseImageReference(ref)
+	if err != nil {
+		return err
+	}
+	if r.Registry == "" {
+		return nil
+	}
+	reg := registryForHost(r.Registry)
+	if err := reg.Login(); err != nil {
+		return err
+	}
+	return reg.EnsureRepository(r.Repository)
+}
+
+// buildxBuilderMu serializes builder creation between services built in
+// parallel.
+var buildxBuilderMu sync.Mutex
+
+// ensureBuildxBuilder makes sure the docker-container buildx builder used
+// for registry caches exists. Another flow process creating it at the same
+// time is not an error.
+func ensureBuildxBuilder() error {
+	buildxBuilderMu.Lock()
+	defer buildxBuilderMu.Unlock()
+	if exec.Command("docker", "buildx", "inspect", buildxBuilderName).Run() == nil {
+		return nil
+	}
+	fmt.Printf("Creating buildx builder %s for registry caching...\n", buildxBuilderName)
+	out, err := exec.Command("docker", "buildx", "create", "--name", buildxBuilderName, "--driver", "docker-container").CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "existing instance") {
+		return fmt.Errorf("failed to create buildx builder: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// dockerCacheArgs returns the buildx arguments that read and write the
+// branch's registry cache. Without a usable registry or buildx the build
+// runs uncached rather than failing.
+func dockerCacheArgs(appPath, imageRef string) []string {
+	ref := cacheRef(imageRef, cacheKindBuildKit, cacheBranch(appPath))
+	if ref == "" {
+		return nil
+	}
+	if err := ensureBuildxBuilder(); err != nil {
+		fmt.Printf("Warning: building without cache: %v\n", err)
+		return nil
+	}
+	if err := prepareRegistry(ref); err != nil {
+		fmt.Printf("Warning: building without cache: %v\n", err)
+		return nil
+	}
+	fmt.Printf("Using build cache %s\n", ref)
+	return []string{
+		"--cache-from", "type=registry,ref=" + ref,
+		"--cache-to", "type=registry,ref=" + ref + ",mode=max,image-manifest=true,oci-mediatypes=true",
+	}
+}
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage build caches stored in the registry",
+	}
+	cmd.AddCommand(newCachePruneCmd())
+	return cmd
+}
+
+func newCachePruneCmd() *cobra.Command {
+	var (
+		branch   string
+		all      bool
+		local    bool
+		registry string
+	)
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete this project's build caches for a branch (default: current) or all branches",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			projectName, err := getProjectName()
+			if err != nil {
+				return fmt.Errorf("failed to detect project name: %v", err)
+			}
+			manifest, err := loadManifest(".")
+			if err != nil {
+				return err
+			}
+			reg, err := resolveRegistry(registry, manifest.Registry)
+			if err != nil {
+				return err
+			}
+			imageRef, err := reg.ImageRef(projectName, "latest")
+			if err != nil {
+				return fmt.Errorf("failed to generate image reference: %v", err)
+			}
+			if branch == "" {
+				branch = cacheBranch(".")
+			}
+
+			if hasRegistry(imageRef) {
+				var tags []string
+				if !all {
+					tags = []string{cacheKindPack + "-" + branch, cacheKindBuildKit + "-" + branch}
+				}
+				if err := pruneCacheTags(cacheRepository(imageRef), tags); err != nil {
+					return err
+				}
+			} else {
+				fmt.Printf("No registry configured for %s; skipping registry caches\n", projectName)
+			}
+
+			if local {
+				fmt.Printf("Pruning local BuildKit cache...\n")
+				c := exec.Command("docker", "buildx", "prune", "--force", "--builder", buildxBuilderName)
+				c.Stdout, c.Stderr = os.Stdout, os.Stderr
+				if err := c.Run(); err != nil {
+					return fmt.Errorf("failed to prune local BuildKit cache: %v", err)
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&branch, "branch", "", "Branch whose caches to delete (default: current branch)")
+	cmd.Flags().BoolVar(&all, "all", false, "Delete caches for every branch")
+	cmd.Flags().BoolVar(&local, "local", false, "Also prune the local buildx builder cache")
+	addRegistryFlag(cmd, &registry)
+	return cmd
+}
+
+// pruneCacheTags deletes the given tags from the cache repository, or the
+// whole repository when tags is empty.
+func pruneCacheTags(repository string, tags []string) error {
+	r, err := parseImageReference(repository)
+	if err != nil {
+		return err
+	}
+	if isECRRegistry(r.Registry) {
+		if len(tags) == 0 {
+			fmt.Printf("Deleting cache repository %s...\n", r.Repository)
+		} else {
+			fmt.Printf("Deleting cache tags %s from %s...\n", strings.Join(tags, ", "), r.Repository)
+		}
+		return deleteECRImages(r.Repository, ecrRegion(r.Registry), tags)
+	}
+
+	// Other registries: delete by tag through the registry API
+	if len(tags) == 0 {
+		r, err := remoteRef(repository)
+		if err != nil {
+			return err
+		}
+		if tags, err = remote.List(r.Context(), remote.WithAuthFromKeychain(registryKeychain())); err != nil {
+			return fmt.Errorf("failed to list cache tags: %v", err)
+		}
+	}
+	for _, t := range tags {
+		ref, err := remoteRef(repository + ":" + t)
+		if err != nil {
+			return err
+		}
+		desc, err := remote.Head(ref, remote.WithAuthFromKeychain(registryKeychain()))
+		if err != nil {
+			continue
+		}
+		fmt.Printf("Deleting cache %s...\n", ref.Name())
+		digest := ref.Context().Digest(desc.Digest.String())
+		if err := remote.Delete(digest, remote.WithAuthFromKeychain(registryKeychain())); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", ref.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCacheBranch(t *testing.T) {
+	tests := []struct {
+		env, want string
+	}{
+		{"main", "main"},
+		{"feature/login", "feature-login"},
+		{"-release.", "release"},
+		{"fix: spaces & symbols", "fix-spaces-symbols"},
+		{"HEAD", "default"},
+		{strings.Repeat("a", 120), strings.Repeat("a", 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			for _, env := range []string{"GITHUB_HEAD_REF", "GITHUB_REF_NAME", "CI_COMMIT_REF_NAME", "BRANCH_NAME"} {
+				t.Setenv(env, "")
+			}
+			t.Setenv("FLOW_CACHE_BRANCH", tt.env)
+			if got := cacheBranch(t.TempDir()); got != tt.want {
+				t.Errorf("cacheBranch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheRef(t *testing.T) {
+	tests := []struct {
+		image, want string
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/apps/web:v1", "123456789012.dkr.ecr.us-east-1.amazonaws.com/apps/web-cache:pack-main"},
+		{"localhost:5000/web@sha256:" + strings.Repeat("0", 64), "localhost:5000/web-cache:pack-main"},
+		{"web:latest", ""},
+	}
+	for _, tt := range tests {
+		if got := cacheRef(tt.image, cacheKindPack, "main"); got != tt.want {
+			t.Errorf("cacheRef(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Connectivity check stages, in the order they are attempted.
+const (
+	stageDNS  = "dns"
+	stageTCP  = "tcp"
+	stageTLS  = "tls"
+	stageAuth = "auth"
+)
+
+// stageUnknown is reported when a client fails with output that doesn't
+// match any stage; the raw output is kept so nothing is guessed.
+const stageUnknown = "unknown"
+
+const (
+	probeTimeout    = 5 * time.Second
+	checkJobTimeout = 2 * time.Minute
+	// Prefix of the result lines the check Job prints.
+	checkLinePrefix = "flow-check:"
+)
+
+// probeResult is the outcome of one stage.
+type probeResult struct {
+	Stage  string
+	OK     bool
+	Detail string
+}
+
+// connCheck reports stages as they run and returns an error naming the
+// first one that failed.
+type connCheck struct {
+	target  string
+	results []probeResult
+}
+
+func (c *connCheck) pass(stage, detail string) {
+	c.results = append(c.results, probeResult{Stage: stage, OK: true, Detail: detail})
+	fmt.Printf("  %-4s ok   %s\n", stage, detail)
+}
+
+func (c *connCheck) fail(stage, detail string) error {
+	c.results = append(c.results, probeResult{Stage: stage, Detail: detail})
+	fmt.Printf("  %-4s FAIL %s\n", stage, detail)
+	return fmt.Errorf("%s check failed for %s: %s", strings.ToUpper(stage), c.target, detail)
+}
+
+func (c *connCheck) skip(stage, detail string) {
+	fmt.Printf("  %-4s skip %s\n", stage, detail)
+}
+
+// classifyConnError maps a client's error output to the stage that failed,
+// or stageUnknown when it can't tell.
+func classifyConnError(out string) string {
+	l := strings.ToLower(out)
+	has := func(subs ...string) bool {
+		for _, s := range subs {
+			if strings.Contains(l, s) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("could not translate host name", "name does not resolve", "name or service not known", "no such host", "temporary failure in name resolution", "nodename nor servname"):
+		return stageDNS
+	case has("connection refused", "timeout expired", "timed out", "no route to host", "network is unreachable", "connection reset"):
+		return stageTCP
+	case has("password authentication failed", "role", "database", "wrongpass", "noauth", "invalid password", "invalid username-password", "permission denied"):
+		return stageAuth
+	case has("ssl", "tls", "certificate", "x509"):
+		return stageTLS
+	}
+	return stageUnknown
+}
+
+// failClient fails c at the stage out points to. Unrecognized output is
+// reported verbatim rather than as a guessed stage.
+func (c *connCheck) failClient(out string) error {
+	out = strings.TrimSpace(out)
+	stage := classifyConnError(out)
+	if stage != stageUnknown {
+		return c.fail(stage, out)
+	}
+	if out == "" {
+		out = "(no output)"
+	}
+	return c.fail(stage, "unrecognized client output: "+out)
+}
+
+// verifyPostgresLocal probes conn from this machine: DNS, TCP and the TLS
+// negotiation natively, then authentication and a ping query with psql
+// when it is installed.
+func verifyPostgresLocal(ctx context.Context, conn postgresConn) error {
+	c := &connCheck{target: net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))}
+	fmt.Printf("Checking Postgres at %s from this machine...\n", c.target)
+	nc, err := probeDial(ctx, c, conn.Host, conn.Port)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	switch conn.SSLMode {
+	case "disable":
+		c.skip(stageTLS, "sslmode=disable")
+	default:
+		if err := probePostgresTLS(nc, conn, c); err != nil {
+			return err
+		}
+	}
+
+	psql, err := exec.LookPath("psql")
+	if err != nil {
+		c.skip(stageAuth, "psql not found; run without --local to check in-cluster")
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*probeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, psql, "-Atc", "select 1")
+	cmd.Env = append(os.Environ(), "PGCONNECT_TIMEOUT="+strconv.Itoa(int(probeTimeout.Seconds())))
+	for k, v := range conn.secretData() {
+		if k != "DATABASE_URL" {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	for k, v := range conn.Params {
+		switch k {
+		case "connect_timeout":
+			cmd.Env = append(cmd.Env, "PGCONNECT_TIMEOUT="+v)
+		case "sslrootcert":
+			cmd.Env = append(cmd.Env, "PGSSLROOTCERT="+v)
+		}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "1" {
+		return c.failClient(string(out))
+	}
+	c.pass(stageAuth, "logged in as "+conn.User+" and ran select 1")
+	return nil
+}
+
+// probeDial resolves host and opens a TCP connection to it.
+func probeDial(ctx context.Context, c *connCheck, host string, port int) (net.Conn, error) {
+	if net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			return nil, c.fail(stageDNS, err.Error())
+		}
+		c.pass(stageDNS, host+" -> "+strings.Join(addrs, ", "))
+	}
+	d := net.Dialer{Timeout: probeTimeout}
+	nc, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, c.fail(stageTCP, err.Error())
+	}
+	c.pass(stageTCP, "connected to "+nc.RemoteAddr().String())
+	return nc, nil
+}
+
+// probePostgresTLS sends Postgres' SSLRequest and, if the server agrees,
+// completes a TLS handshake verified the way sslmode asks.
+func probePostgresTLS(nc net.Conn, conn postgresConn, c *connCheck) error {
+	nc.SetDeadline(time.Now().Add(probeTimeout))
+	defer nc.SetDeadline(time.Time{})
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], 80877103)
+	if _, err := nc.Write(req); err != nil {
+		return c.fail(stageTCP, err.Error())
+	}
+	resp := make([]byte, 1)
+	if _, err := nc.Read(resp); err != nil {
+		return c.fail(stageTCP, "no response to SSLRequest: "+err.Error())
+	}
+	required := conn.SSLMode == "require" || strings.HasPrefix(conn.SSLMode, "verify-")
+	if resp[0] != 'S' {
+		if required {
+			return c.fail(stageTLS, "server does not support SSL but sslmode="+conn.SSLMode)
+		}
+		c.skip(stageTLS, "server does not offer SSL")
+		return nil
+	}
+	roots, err := postgresRootCAs(conn)
+	if err != nil {
+		return c.fail(stageTLS, err.Error())
+	}
+	cfg := &tls.Config{ServerName: conn.Host, RootCAs: roots, InsecureSkipVerify: conn.SSLMode != "verify-full"}
+	if conn.SSLMode == "verify-ca" {
+		cfg.VerifyConnection = verifyChainOnly(roots)
+	}
+	tc := tls.Client(nc, cfg)
+	if err := tc.Handshake(); err != nil {
+		return c.fail(stageTLS, err.Error())
+	}
+	c.pass(stageTLS, tlsDescription(tc.ConnectionState()))
+	return nil
+}
+
+// postgresRootCAs loads the CA bundle named by the sslrootcert parameter
+// for the verify modes. nil means the system roots, which is also what
+// sslrootcert=system asks for.
+func postgresRootCAs(conn postgresConn) (*x509.CertPool, error) {
+	path := conn.Params["sslrootcert"]
+	if path == "" || path == "system" || !strings.HasPrefix(conn.SSLMode, "verify-") {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sslrootcert: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("sslrootcert %s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// verifyChainOnly checks the certificate chain against roots (the system
+// pool when nil) without the hostname, as sslmode=verify-ca does.
+func verifyChainOnly(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+func tlsDescription(cs tls.ConnectionState) string {
+	desc := tls.VersionName(cs.Version)
+	if len(cs.PeerCertificates) > 0 {
+		desc += ", certificate for " + cs.PeerCertificates[0].Subject.CommonName
+	}
+	return desc
+}
+
+// verifyRedisLocal probes conn from this machine, authenticating and
+// sending PING over RESP.
+func verifyRedisLocal(ctx context.Context, conn redisConn) error {
+	c := &connCheck{target: net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))}
+	fmt.Printf("Checking Redis at %s from this machine...\n", c.target)
+	nc, err := probeDial(ctx, c, conn.Host, conn.Port)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	if conn.TLS {
+		tc := tls.Client(nc, &tls.Config{ServerName: conn.Host})
+		tc.SetDeadline(time.Now().Add(probeTimeout))
+		if err := tc.Handshake(); err != nil {
+			return c.fail(stageTLS, err.Error())
+		}
+		c.pass(stageTLS, tlsDescription(tc.ConnectionState()))
+		nc = tc
+	}
+	nc.SetDeadline(time.Now().Add(probeTimeout))
+	r := bufio.NewReader(nc)
+	if conn.Password != "" {
+		args := []string{"AUTH", conn.Password}
+		if conn.User != "" {
+			args = []string{"AUTH", conn.User, conn.Password}
+		}
+		reply, err := redisCommand(nc, r, args...)
+		if err != nil {
+			return c.failClient(err.Error())
+		}
+		if reply != "+OK" {
+			return c.fail(stageAuth, strings.TrimPrefix(reply, "-"))
+		}
+	}
+	reply, err := redisCommand(nc, r, "PING")
+	if err != nil {
+		return c.failClient(err.Error())
+	}
+	if reply != "+PONG" {
+		return c.fail(stageAuth, strings.TrimPrefix(reply, "-"))
+	}
+	c.pass(stageAuth, "PING answered PONG")
+	return nil
+}
+
+// redisCommand sends a RESP command and returns the first reply line.
+func redisCommand(nc net.Conn, r *bufio.Reader, args ...string) (string, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := nc.Write(b.Bytes()); err != nil {
+		return "", err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// verifyPostgres checks conn from this machine or, by default, from a Job
+// in namespace.
+func verifyPostgres(ctx context.Context, name, namespace string, conn postgresConn, local bool) error {
+	if local {
+		return verifyPostgresLocal(ctx, conn)
+	}
+	target := net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))
+	return verifyInCluster(ctx, namespace, name, "db", localPostgresImage, postgresCheckScript, target, conn.secretData())
+}
+
+func verifyRedis(ctx context.Context, name, namespace string, conn redisConn, local bool) error {
+	if local {
+		return verifyRedisLocal(ctx, conn)
+	}
+	target := net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))
+	return verifyInCluster(ctx, namespace, name, "redis", localRedisImage, redisCheckScript, target, conn.secretData())
+}
+
+// Scripts the check Job runs. They print "flow-check: <stage> ok|fail|skip"
+// lines and the client's output, which is classified here. TCP and TLS are
+// probed with nc and openssl before the client runs, so a failure there is
+// reported as its own stage; either step is skipped when the image lacks
+// the tool.
+const checkProbeScript = `
+addr="$HOST:$PORT"
+case "$HOST" in *:*) addr="[$HOST]:$PORT" ;; esac
+if getent hosts "$HOST" >/dev/null 2>&1; then echo "flow-check: dns ok $HOST"; else echo "flow-check: dns fail $HOST does not resolve"; exit 1; fi
+if ! command -v nc >/dev/null 2>&1; then
+  echo "flow-check: tcp skip nc not available"
+elif nc -z -w 5 "$HOST" "$PORT" >/dev/null 2>&1; then
+  echo "flow-check: tcp ok connected to $addr"
+else
+  echo "flow-check: tcp fail cannot connect to $addr"; exit 1
+fi
+if [ -z "$TLS" ]; then
+  echo "flow-check: tls skip $TLS_SKIP"
+elif ! command -v openssl >/dev/null 2>&1; then
+  echo "flow-check: tls skip openssl not available"
+else
+  tlsout=$(timeout 10 openssl s_client $STARTTLS -connect "$addr" -servername "$HOST" </dev/null 2>&1)
+  if [ $? -eq 0 ]; then
+    echo "flow-check: tls ok $(echo "$tlsout" | grep -m1 '^New, ' || echo handshake completed)"
+  elif [ "$TLS" = optional ]; then
+    echo "flow-check: tls skip server does not offer SSL"
+  else
+    echo "flow-check: tls fail $(echo "$tlsout" | grep -m1 -i error || echo handshake failed)"; exit 1
+  fi
+fi
+`
+
+const postgresCheckScript = `
+HOST="$PGHOST" PORT="$PGPORT" STARTTLS="-starttls postgres" TLS=required TLS_SKIP=""
+case "$PGSSLMODE" in
+disable) TLS="" TLS_SKIP="sslmode=disable" ;;
+require|verify-*) ;;
+*) TLS=optional ;;
+esac
+` + checkProbeScript + `
+out=$(PGCONNECT_TIMEOUT=5 psql "$DATABASE_URL" -Atc 'select 1' 2>&1)
+if [ "$out" = 1 ]; then echo "flow-check: auth ok logged in as $PGUSER and ran select 1"; exit 0; fi
+echo "$out"
+echo "flow-check: client fail"
+exit 1
+`
+
+const redisCheckScript = `
+HOST="$REDIS_HOST" PORT="$REDIS_PORT" STARTTLS="" TLS="" TLS_SKIP="plain redis:// URL"
+tls=""
+case "$REDIS_URL" in rediss://*) tls="--tls" TLS=required ;; esac
+` + checkProbeScript + `
+out=$(timeout 10 redis-cli $tls -u "$REDIS_URL" --no-auth-warning ping 2>&1)
+if [ "$out" = PONG ]; then echo "flow-check: auth ok PING answered PONG"; exit 0; fi
+echo "$out"
+echo "flow-check: client fail"
+exit 1
+`
+
+// verifyInCluster runs script in image as a Job in namespace, with data
+// in a temporary Secret exposed as its environment, so the check sees the
+// same DNS, network policies and egress as the app.
+func verifyInCluster(ctx context.Context, namespace, name, kind, image, script, target string, data map[string]string) error {
+	client, ns, err := getClient(namespace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checking %s connectivity from namespace %s...\n", kind, ns)
+
+	sec, err := client.CoreV1().Secrets(ns).Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: name + "-" + kind + "-check-", Namespace: ns},
+		StringData: data,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create check secret: %v", err)
+	}
+	defer client.CoreV1().Secrets(ns).Delete(context.Background(), sec.Name, metav1.DeleteOptions{})
+
+	backoff, deadline, ttl := int32(0), int64(checkJobTimeout.Seconds()), int32(300)
+	job, err := client.BatchV1().Jobs(ns).Create(ctx, &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: sec.Name, Namespace: ns},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoff,
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    "check",
+						Image:   image,
+						Command: []string{"sh", "-c", script},
+						EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: sec.Name}}}},
+					}},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create check job: %v", err)
+	}
+	background := metav1.DeletePropagationBackground
+	defer client.BatchV1().Jobs(ns).Delete(context.Background(), job.Name, metav1.DeleteOptions{PropagationPolicy: &background})
+
+	// Wait for the Job to finish, then read what it printed
+	selector := "job-name=" + job.Name
+	timeout := time.After(checkJobTimeout + 30*time.Second)
+	for {
+		j, err := client.BatchV1().Jobs(ns).Get(ctx, job.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if j.Status.Succeeded > 0 || j.Status.Failed > 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			reason := ""
+			if pods, err := client.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: selector}); err == nil {
+				for _, p := range pods.Items {
+					for _, s := range p.Status.ContainerStatuses {
+						if s.State.Waiting != nil {
+							reason = ": " + s.State.Waiting.Reason
+						}
+					}
+				}
+			}
+			return fmt.Errorf("check job %s did not finish within %s%s", job.Name, checkJobTimeout, reason)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+	pods, err := client.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil || len(pods.Items) == 0 {
+		return fmt.Errorf("failed to find the check pod for job %s: %v", job.Name, err)
+	}
+	logs, err := client.CoreV1().Pods(ns).GetLogs(pods.Items[0].Name, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read check output: %v", err)
+	}
+	return reportCheckOutput(&connCheck{target: target}, string(logs))
+}
+
+// reportCheckOutput turns the Job's output into stage results; a client
+// failure is classified from the client's own message.
+func reportCheckOutput(c *connCheck, logs string) error {
+	var clientOut []string
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		if !strings.HasPrefix(line, checkLinePrefix) {
+			clientOut = append(clientOut, line)
+			continue
+		}
+		f := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, checkLinePrefix)), " ", 3)
+		if len(f) < 2 {
+			continue
+		}
+		detail := ""
+		if len(f) == 3 {
+			detail = f[2]
+		}
+		switch {
+		case f[1] == "ok":
+			c.pass(f[0], detail)
+		case f[1] == "skip":
+			c.skip(f[0], detail)
+		case f[0] == "client":
+			return c.failClient(strings.Join(clientOut, "\n"))
+		default:
+			return c.fail(f[0], detail)
+		}
+	}
+	if len(c.results) == 0 || !c.results[len(c.results)-1].OK {
+		return fmt.Errorf("check for %s produced no result:\n%s", c.target, logs)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyConnError(t *testing.T) {
+	tests := []struct {
+		out  string
+		want string
+	}{
+		{`psql: error: could not translate host name "db.internal" to address: Name or service not known`, stageDNS},
+		{"dial tcp: lookup cache.internal: no such host", stageDNS},
+		{`psql: error: connection to server at "10.0.0.5", port 5432 failed: Connection refused`, stageTCP},
+		{"Could not connect to Redis at cache:6379: Connection timed out", stageTCP},
+		{`psql: error: FATAL:  password authentication failed for user "app"`, stageAuth},
+		{"WRONGPASS invalid username-password pair or user is disabled.", stageAuth},
+		{"psql: error: SSL error: certificate verify failed", stageTLS},
+		{"x509: certificate signed by unknown authority", stageTLS},
+		{"psql: error: server closed the connection unexpectedly", stageUnknown},
+		{"", stageUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyConnError(tt.out); got != tt.want {
+			t.Errorf("classifyConnError(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestReportCheckOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		logs   string
+		err    string
+		stages []string
+	}{
+		{
+			name:   "all stages pass",
+			logs:   "flow-check: dns ok db\nflow-check: tcp ok connected to db:5432\nflow-check: tls skip sslmode=disable\nflow-check: auth ok logged in as app and ran select 1\n",
+			stages: []string{stageDNS, stageTCP, stageAuth},
+		},
+		{
+			name:   "tcp probe fails",
+			logs:   "flow-check: dns ok db\nflow-check: tcp fail cannot connect to db:5432\n",
+			err:    "TCP check failed for db:5432: cannot connect to db:5432",
+			stages: []string{stageDNS, stageTCP},
+		},
+		{
+			name:   "client failure is classified",
+			logs:   "flow-check: dns ok db\nflow-check: tcp ok connected\npsql: error: FATAL:  password authentication failed for user \"app\"\nflow-check: client fail\n",
+			err:    "AUTH check failed",
+			stages: []string{stageDNS, stageTCP, stageAuth},
+		},
+		{
+			name:   "unrecognized client output is kept",
+			logs:   "flow-check: dns ok db\nsegfault in libpq\nflow-check: client fail\n",
+			err:    "UNKNOWN check failed for db:5432: unrecognized client output: segfault in libpq",
+			stages: []string{stageDNS, stageUnknown},
+		},
+		{
+			name: "no result",
+			logs: "exec format error\n",
+			err:  "produced no result",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &connCheck{target: "db:5432"}
+			err := reportCheckOutput(c, tt.logs)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+			var stages []string
+			for _, r := range c.results {
+				stages = append(stages, r.Stage)
+			}
+			if strings.Join(stages, ",") != strings.Join(tt.stages, ",") {
+				t.Errorf("stages = %v, want %v", stages, tt.stages)
+			}
+		})
+	}
+}
+
+// testCA writes a self-signed CA and returns its PEM path and a server
+// certificate it issued for names.
+func testCA(t *testing.T, names ...string) (string, tls.Certificate) {
+	t.Helper()
+	newKey := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	caKey, leafKey := newKey(), newKey()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "flow test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := writeTree(t, map[string]string{"ca.pem": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))})
+	return filepath.Join(dir, "ca.pem"), tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}
+}
+
+// fakePostgresTLS answers one SSLRequest with 'S' and a TLS handshake.
+func fakePostgresTLS(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				req := make([]byte, 8)
+				if _, err := nc.Read(req); err != nil {
+					return
+				}
+				nc.Write([]byte("S"))
+				tls.Server(nc, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProbePostgresTLS(t *testing.T) {
+	caPath, cert := testCA(t, "db.internal")
+	addr := fakePostgresTLS(t, cert)
+	tests := []struct {
+		name string
+		conn postgresConn
+		err  string
+	}{
+		{name: "require skips verification", conn: postgresConn{SSLMode: "require"}},
+		{name: "verify-ca with sslrootcert", conn: postgresConn{SSLMode: "verify-ca", Params: map[string]string{"sslrootcert": caPath}}},
+		{name: "verify-ca with system roots", conn: postgresConn{SSLMode: "verify-ca"}, err: "unknown authority"},
+		{name: "verify-full checks the host name", conn: postgresConn{Host: "other.internal", SSLMode: "verify-full", Params: map[string]string{"sslrootcert": caPath}}, err: "other.internal"},
+		{name: "verify-full with matching host", conn: postgresConn{Host: "db.internal", SSLMode: "verify-full", Params: map[string]string{"sslrootcert": caPath}}},
+		{name: "missing sslrootcert", conn: postgresConn{SSLMode: "verify-full", Params: map[string]string{"sslrootcert": caPath + ".missing"}}, err: "failed to read sslrootcert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			err = probePostgresTLS(nc, tt.conn, &connCheck{target: addr})
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -5,15 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -27,254 +27,554 @@ type deployReport struct {
 	Status      string    `json:"status"`
 	Description string    `json:"description"`
 	CreatedAt   time.Time `json:"createdAt"`
+	Digest      string    `json:"digest,omitempty"`
+	SBOM        string    `json:"sbom,omitempty"`
+	Provenance  string    `json:"provenance,omitempty"`
+
+	Vulnerabilities *scanSummary `json:"vulnerabilities,omitempty"`
 }
 
 func newBuildCmd() *cobra.Command {
 	var (
-		appPath   string
-		imageRef  string
-		builder   string
-		envs      []string
+		appPath    string
+		imageRef   string
+		buildFlags buildConfig
+		envs       []string
 	)
 	cmd := &cobra.Command{
 		Use:   "build",
-		Short: "Build OCI image with Paketo (pack build)",
+		Short: "Build OCI image with Paketo (pack build), Docker or the native builder",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if appPath == "" || imageRef == "" {
 				return fmt.Errorf("app and image are required")
 			}
-			if builder == "" {
-				builder = "paketobuildpacks/builder:base"
+			manifest, err := loadManifest(appPath)
+			if err != nil {
+				return err
+			}
+			if _, err := resolveRegistry("", manifest.Registry); err != nil {
+				return err
+			}
+			cfg, err := resolveBuildConfig(cmd, buildFlags, manifest.Build)
+			if err != nil {
+				return err
+			}
+			cfg.keepLocal = true
+			pushed, err := buildApplication(cmd.Context(), cfg, appPath, imageRef, envs)
+			if err != nil {
+				return err
+			}
+			if pushed {
+				fmt.Printf("Image %s was published to the registry during the build; flow push is not needed\n", imageRef)
 			}
-			packArgs := []string{"build", imageRef, "--path", appPath, "--builder", builder, "--pull-policy", "if-not-present"}
-			for _, e := range envs { packArgs = append(packArgs, "--env", e) }
-			c := exec.Command("pack", packArgs...)
-			c.Stdout, c.Stderr = os.Stdout, os.Stderr
-			return c.Run()
+			return nil
 		},
 	}
 	cmd.Flags().StringVar(&appPath, "app", ".", "Path to application source")
 	cmd.Flags().StringVar(&imageRef, "image", "", "Target image reference (e.g. 000000000000.dkr.ecr.us-east-1.amazonaws.com/apps/myapp:tag)")
-	cmd.Flags().StringVar(&builder, "builder", "", "Paketo builder image")
-	cmd.Flags().StringSliceVar(&envs, "env", []string{}, "Build env key=value")
+	addBuildFlags(cmd, &buildFlags)
+	cmd.Flags().StringSliceVar(&envs, "env", []string{}, "Build env key=value (shown in build logs; use --build-secret for credentials)")
 	return cmd
 }
 
 func newPushCmd() *cobra.Command {
-	var imageRef string
+	var imageRef, signKey, appPath string
+	var skipAttest bool
 	cmd := &cobra.Command{
 		Use:   "push",
-		Short: "Push built image to ECR (docker push)",
+		Short: "Push built image to its registry (docker push)",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if imageRef == "" {
 				return fmt.Errorf("image is required")
 			}
-			return dockerPushWithECRLogin(imageRef)
+			started := time.Now()
+			manifest, err := loadManifest(appPath)
+			if err != nil {
+				return err
+			}
+			if _, err := resolveRegistry("", manifest.Registry); err != nil {
+				return err
+			}
+			if localImageExists(imageRef) {
+				if err := pushImage(imageRef); err != nil {
+					return err
+				}
+			} else if remoteImageExists(cmd.Context(), imageRef) {
+				fmt.Printf("Image %s is not in the local daemon but already in the registry (published by the build); skipping push\n", imageRef)
+			} else {
+				return fmt.Errorf("image %s not found locally or in the registry; run flow build first", imageRef)
+			}
+			if hasRegistry(imageRef) && !skipAttest {
+				projectName := manifest.Name
+				if projectName == "" {
+					abs, err := filepath.Abs(appPath)
+					if err != nil {
+						return err
+					}
+					projectName = filepath.Base(abs)
+				}
+				fmt.Printf("Attaching SBOM and provenance...\n")
+				if _, err := attestImage(cmd.Context(), appPath, projectName, imageRef, manifest.Build, started); err != nil {
+					return fmt.Errorf("failed to attach SBOM and provenance: %v (pass --skip-attestations to push without them)", err)
+				}
+			}
+			if signing := signingFromFlags(cmd, manifest, signKey, false); signing.Key != "" {
+				_, err = signImage(cmd.Context(), imageRef, signing.Key)
+				return err
+			}
+			return nil
 		},
 	}
 	cmd.Flags().StringVar(&imageRef, "image", "", "Image to push")
+	cmd.Flags().StringVar(&appPath, "app", ".", "App directory the image was built from (SBOM and flow.yaml)")
+	addSigningFlags(cmd, &signKey, nil)
+	addAttestationFlag(cmd, &skipAttest)
 	return cmd
 }
 
+// deployOptions holds the deploy command's flags. Values that a service in
+// flow.yaml can also set only override the manifest when given explicitly.
+type deployOptions struct {
+	namespace      string
+	port           int
+	cpu            string
+	mem            string
+	envs           []string
+	serverURL      string
+	kubecontext    string
+	db             postgresConn
+	dbPassword     passwordSource
+	dbParams       []string
+	redis          redisConn
+	redisPassword  passwordSource
+	secrets        []string
+	unsetSecrets   []string
+	replaceSecrets bool
+	secretsFile    string
+	secretRefs     string
+	secretStores   secretStores
+	buildFlags     buildConfig
+	registry       string
+	signKey        string
+	verifySigs     bool
+	failOn         string
+	scanReport     string
+	allowVulns     bool
+	skipAttest     bool
+	migrate        string
+	skipMigrate    bool
+	all            bool
+}
+
 func newDeployCmd() *cobra.Command {
-	var (
-		namespace     string
-		port          int
-		cpu           string
-		mem           string
-		envs          []string
-		serverURL     string
-		kubecontext   string
-		dbHost        string
-		dbName        string
-		dbUser        string
-		dbPassword    string
-		dbPort        int
-		redisHost     string
-		redisPassword string
-		redisPort     int
-		secrets       []string
-	)
+	opts := &deployOptions{}
 	cmd := &cobra.Command{
-		Use:   "deploy",
+		Use:   "deploy [service...]",
 		Short: "Build, push, and deploy application with optional database, cache, and secrets",
+		Long: `Build, push, and deploy the application in the current directory.
+
+When flow.yaml declares services, name the ones to deploy or pass --all.
+Services are deployed in parallel unless they declare dependsOn.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Auto-detect project name from current directory
-			projectName, err := getProjectName()
+			if opts.namespace == "" {
+				opts.namespace = "default"
+			}
+
+			manifest, err := loadManifest(".")
 			if err != nil {
-				return fmt.Errorf("failed to detect project name: %v", err)
+				return err
 			}
-			
-			// Auto-generate image reference
-			imageRef, err := generateImageRef(projectName)
+			services, err := manifest.selectServices(args, opts.all)
 			if err != nil {
-				return fmt.Errorf("failed to generate image reference: %v", err)
+				return err
 			}
-			
-			if namespace == "" { namespace = "default" }
-			
-			// Step 1: Build the application
-			fmt.Printf("Building application %s...\n", projectName)
-			if err := buildApplication(".", imageRef, envs); err != nil {
-				return fmt.Errorf("build failed: %v", err)
+			reg, err := resolveRegistry(opts.registry, manifest.Registry)
+			if err != nil {
+				return err
 			}
-			
-		// Step 2: Push to ECR
-		fmt.Printf("Pushing image %s...\n", imageRef)
-		if err := dockerPushWithECRLogin(imageRef); err != nil {
-			return fmt.Errorf("push failed: %v", err)
-		}
-			
-		// Step 3: Deploy Knative Service
-		fmt.Printf("Deploying service %s...\n", projectName)
-		if err := knServiceApply(projectName, imageRef, namespace, cpu, mem, toEnvMap(envs), kubecontext, port); err != nil {
-			return fmt.Errorf("deploy failed: %v", err)
-		}
-		
-		// Step 3.5: Configure ECR pull permissions
-		fmt.Printf("Configuring ECR pull permissions...\n")
-		if err := configureECRPullPermissions(projectName, namespace, kubecontext); err != nil {
-			fmt.Printf("Warning: Failed to configure ECR pull permissions: %v\n", err)
-			fmt.Printf("The service may not be able to pull images from ECR.\n")
-		}
-			
-			// Step 4: Attach database if specified
-			if dbHost != "" {
-				fmt.Printf("Attaching database...\n")
-				if err := attachDatabase(projectName, namespace, dbUser, dbPassword, dbHost, dbPort, dbName, kubecontext); err != nil {
-					return fmt.Errorf("database attach failed: %v", err)
+			if reg.Name() == registryLocal {
+				if err := setupLocalRegistry(cmd.Context(), opts.kubecontext, reg.Host()); err != nil {
+					return fmt.Errorf("local registry: %v", err)
 				}
 			}
-			
-			// Step 5: Attach Redis if specified
-			if redisHost != "" {
-				fmt.Printf("Attaching Redis...\n")
-				if err := attachRedis(projectName, namespace, redisHost, redisPort, redisPassword, kubecontext); err != nil {
-					return fmt.Errorf("redis attach failed: %v", err)
+			// Resolve attachment credentials before building anything
+			if opts.dbPassword.stdin && opts.redisPassword.stdin {
+				return fmt.Errorf("only one of --db-password-stdin and --redis-password-stdin can read stdin")
+			}
+			if opts.db.Host != "" {
+				if opts.db.Password, err = opts.dbPassword.read(); err != nil {
+					return err
+				}
+				if opts.db.Params, err = parseParams(opts.dbParams); err != nil {
+					return err
+				}
+				if err := opts.db.validate(); err != nil {
+					return fmt.Errorf("database: %v", err)
 				}
 			}
-			
-			// Step 6: Create secrets if specified
-			if len(secrets) > 0 {
-				fmt.Printf("Creating secrets...\n")
-				if err := createSecrets(projectName, namespace, secrets, kubecontext); err != nil {
-					return fmt.Errorf("secrets creation failed: %v", err)
+			if opts.redis.Host != "" {
+				if opts.redis.Password, err = opts.redisPassword.read(); err != nil {
+					return err
 				}
 			}
-			
-			// Report deployment
-			if serverURL != "" {
-				_ = report(serverURL, deployReport{
-					ID:          fmt.Sprintf("%s:%d", projectName, time.Now().UnixNano()),
-					Project:     projectName,
-					Namespace:   namespace,
-					Image:       imageRef,
-					Status:      "deployed",
-					Description: "Application deployed with auto-build and push",
-					CreatedAt:   time.Now(),
-				})
+			waves, err := deployWaves(services)
+			if err != nil {
+				return err
+			}
+
+			for _, wave := range waves {
+				if len(wave) == 1 {
+					if err := deployService(cmd, manifest, reg, wave[0], opts); err != nil {
+						return err
+					}
+					continue
+				}
+
+				names := make([]string, len(wave))
+				for i, svc := range wave {
+					names[i] = svc.Name
+				}
+				fmt.Printf("Deploying %s in parallel...\n", strings.Join(names, ", "))
+				errs := make([]error, len(wave))
+				var wg sync.WaitGroup
+				for i, svc := range wave {
+					wg.Add(1)
+					go func(i int, svc serviceSpec) {
+						defer wg.Done()
+						errs[i] = deployService(cmd, manifest, reg, svc, opts)
+					}(i, svc)
+				}
+				wg.Wait()
+
+				var failed []string
+				for i, err := range errs {
+					if err != nil {
+						failed = append(failed, fmt.Sprintf("%s: %v", wave[i].Name, err))
+					}
+				}
+				if len(failed) > 0 {
+					return fmt.Errorf("deploy failed for %d service(s):\n%s", len(failed), strings.Join(failed, "\n"))
+				}
 			}
-			
-			
-			fmt.Printf("Successfully deployed %s to namespace %s\n", projectName, namespace)
 			return nil
 		},
 	}
-	
+
 	// Core deployment flags
-	cmd.Flags().StringVar(&namespace, "namespace", "default", "Kubernetes namespace")
-	cmd.Flags().IntVar(&port, "port", 8080, "Service port")
-	cmd.Flags().StringVar(&cpu, "cpu", "250m", "CPU request/limit")
-	cmd.Flags().StringVar(&mem, "mem", "256Mi", "Memory request/limit")
-	cmd.Flags().StringSliceVar(&envs, "env", []string{}, "Runtime environment variables (key=value)")
-	cmd.Flags().StringVar(&serverURL, "server", "", "API server to report deployments")
-	cmd.Flags().StringVar(&kubecontext, "kubecontext", "", "kubectl context to use")
-	
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "default", "Kubernetes namespace")
+	cmd.Flags().IntVar(&opts.port, "port", 8080, "Service port")
+	cmd.Flags().StringVar(&opts.cpu, "cpu", "250m", "CPU request/limit")
+	cmd.Flags().StringVar(&opts.mem, "mem", "256Mi", "Memory request/limit")
+	cmd.Flags().StringSliceVar(&opts.envs, "env", []string{}, "Runtime environment variables (key=value)")
+	cmd.Flags().StringVar(&opts.serverURL, "server", "", "API server to report deployments")
+	cmd.Flags().StringVar(&opts.kubecontext, "kubecontext", "", "kubectl context to use")
+	cmd.Flags().BoolVar(&opts.all, "all", false, "Deploy every service declared in flow.yaml")
+	addRegistryFlag(cmd, &opts.registry)
+	addSigningFlags(cmd, &opts.signKey, &opts.verifySigs)
+	addScanFlags(cmd, &opts.failOn, &opts.scanReport, &opts.allowVulns)
+	addAttestationFlag(cmd, &opts.skipAttest)
+
 	// Database flags
-	cmd.Flags().StringVar(&dbHost, "db-host", "", "Database host")
-	cmd.Flags().StringVar(&dbName, "db-name", "", "Database name")
-	cmd.Flags().StringVar(&dbUser, "db-user", "app", "Database user")
-	cmd.Flags().StringVar(&dbPassword, "db-password", "changeme", "Database password")
-	cmd.Flags().IntVar(&dbPort, "db-port", 5432, "Database port")
-	
+	cmd.Flags().StringVar(&opts.db.Host, "db-host", "", "Database host")
+	cmd.Flags().StringVar(&opts.db.Database, "db-name", "", "Database name")
+	cmd.Flags().StringVar(&opts.db.User, "db-user", "app", "Database user")
+	addPasswordFlags(cmd, "db-", "Database", &opts.dbPassword)
+	cmd.Flags().IntVar(&opts.db.Port, "db-port", 5432, "Database port")
+	cmd.Flags().StringVar(&opts.db.SSLMode, "db-sslmode", "", "Database sslmode: "+strings.Join(postgresSSLModes, ", "))
+	cmd.Flags().StringArrayVar(&opts.dbParams, "db-param", nil, "Extra database connection parameter key=value (repeatable)")
+
 	// Redis flags
-	cmd.Flags().StringVar(&redisHost, "redis-host", "", "Redis host")
-	cmd.Flags().StringVar(&redisPassword, "redis-password", "", "Redis password")
-	cmd.Flags().IntVar(&redisPort, "redis-port", 6379, "Redis port")
-	
+	cmd.Flags().StringVar(&opts.redis.Host, "redis-host", "", "Redis host")
+	addPasswordFlags(cmd, "redis-", "Redis", &opts.redisPassword)
+	cmd.Flags().IntVar(&opts.redis.Port, "redis-port", 6379, "Redis port")
+	cmd.Flags().BoolVar(&opts.redis.TLS, "redis-tls", false, "Connect to Redis with TLS (rediss://)")
+
+	// Migration flags
+	cmd.Flags().StringVar(&opts.migrate, "migrate", "", "Command to run as a Job before rollout (overrides migrate.command in flow.yaml)")
+	cmd.Flags().BoolVar(&opts.skipMigrate, "skip-migrations", false, "Don't run the migration Job")
+
 	// Secrets flags
-	cmd.Flags().StringSliceVar(&secrets, "secret", []string{}, "Secret key=value pairs")
-	
-	
+	cmd.Flags().StringSliceVar(&opts.secrets, "secret", []string{}, "Secret key=value pairs (merged into <name>-secrets)")
+	cmd.Flags().StringSliceVar(&opts.unsetSecrets, "unset-secret", []string{}, "Secret keys to remove")
+	cmd.Flags().BoolVar(&opts.replaceSecrets, "replace-secrets", false, "Replace all keys of <name>-secrets with the --secret pairs")
+	cmd.Flags().StringVar(&opts.secretRefs, "secret-refs", secretRefsResolve, "How secretsmanager:// and ssm:// secret values are handled: resolve (at deploy time) or sync (in the cluster, with the External Secrets Operator)")
+	cmd.Flags().StringVar(&opts.secretStores.SecretsManager, "secretsmanager-store", "aws-secretsmanager", "ClusterSecretStore for secretsmanager:// references with --secret-refs sync")
+	cmd.Flags().StringVar(&opts.secretStores.ParameterStore, "ssm-store", "aws-parameterstore", "ClusterSecretStore for ssm:// references with --secret-refs sync")
+	cmd.Flags().StringVar(&opts.secretsFile, "secrets-file", "", "SOPS-encrypted secrets file (default <app>/"+defaultSecretsFile+" if present)")
+
+	// Build flags
+	addBuildFlags(cmd, &opts.buildFlags)
+
 	return cmd
 }
 
+// deployService builds, pushes and deploys one service.
+func deployService(cmd *cobra.Command, manifest *projectManifest, reg registryBackend, svc serviceSpec, opts *deployOptions) error {
+	projectName := svc.Name
+	appPath := svc.Path
+	namespace := opts.namespace
+	kubecontext := opts.kubecontext
+
+	port, cpu, mem := opts.port, opts.cpu, opts.mem
+	if svc.Port != 0 && !cmd.Flags().Changed("port") {
+		port = svc.Port
+	}
+	if svc.CPU != "" && !cmd.Flags().Changed("cpu") {
+		cpu = svc.CPU
+	}
+	if svc.Memory != "" && !cmd.Flags().Changed("mem") {
+		mem = svc.Memory
+	}
+	env := map[string]string{}
+	for k, v := range svc.Env {
+		env[k] = v
+	}
+	for k, v := range toEnvMap(opts.envs) {
+		env[k] = v
+	}
+	envs := make([]string, 0, len(env))
+	for k, v := range env {
+		envs = append(envs, k+"="+v)
+	}
+
+	// Decrypt secrets before building, so a key problem fails the deploy early
+	secrets, secretRefs, err := deploySecrets(cmd.Context(), appPath, opts)
+	if err != nil {
+		return err
+	}
+
+	// Auto-generate image reference
+	imageRef, err := reg.ImageRef(projectName, deployTag(appPath))
+	if err != nil {
+		return fmt.Errorf("failed to generate image reference: %v", err)
+	}
+
+	buildCfg, err := resolveBuildConfig(cmd, opts.buildFlags, manifest.Build, svc.Build)
+	if err != nil {
+		return err
+	}
+
+	// Step 1: Build the application
+	fmt.Printf("Building application %s...\n", projectName)
+	buildStarted := time.Now()
+	pushed, err := buildApplication(cmd.Context(), buildCfg, appPath, imageRef, envs)
+	if err != nil {
+		return fmt.Errorf("build failed: %v", err)
+	}
+
+	// Step 2: Push to the registry
+	if !pushed {
+		fmt.Printf("Pushing image %s...\n", imageRef)
+		if err := pushImage(imageRef); err != nil {
+			return fmt.Errorf("push failed: %v", err)
+		}
+	}
+
+	// Step 2.5: Make sure the image runs on every node architecture
+	if hasRegistry(imageRef) {
+		if err := verifyImagePlatforms(cmd.Context(), imageRef, namespace); err != nil {
+			return fmt.Errorf("platform check failed: %v", err)
+		}
+	}
+
+	// Step 2.6: Gate on vulnerability scan findings
+	scanCfg := scanFromFlags(cmd, manifest, opts.failOn, opts.scanReport)
+	if err := scanCfg.validate(); err != nil {
+		return err
+	}
+	var scan *scanSummary
+	var findings []vulnFinding
+	var scanErr error
+	if scanCfg.enabled() {
+		scan, findings, scanErr = scanImage(cmd.Context(), imageRef, scanCfg)
+	}
+	if scanErr != nil {
+		if !opts.allowVulns {
+			return fmt.Errorf("vulnerability scan failed: %v; fix the scanner, set scan.enabled: false, or pass --allow-vulnerabilities", scanErr)
+		}
+		fmt.Printf("Warning: Deploying without a vulnerability scan (--allow-vulnerabilities): %v\n", scanErr)
+		if scan != nil {
+			scan.Status = "overridden"
+		}
+	} else if scan != nil {
+		printScanSummary(scan, findings)
+		if scan.Status == "failed" {
+			if !opts.allowVulns {
+				return fmt.Errorf("%d vulnerabilities at or above %s severity (%s); fix them, add them to scan.ignore, or pass --allow-vulnerabilities",
+					len(scan.Blocking), strings.ToLower(scan.Threshold), strings.Join(scan.Blocking, ", "))
+			}
+			fmt.Printf("Warning: Deploying despite %d blocking vulnerabilities (--allow-vulnerabilities)\n", len(scan.Blocking))
+			scan.Status = "overridden"
+		}
+	}
+
+	// Step 2.7: Attach SBOM and build provenance to the pushed image
+	attestations := &attestationRefs{}
+	if hasRegistry(imageRef) && !opts.skipAttest {
+		fmt.Printf("Attaching SBOM and provenance...\n")
+		refs, err := attestImage(cmd.Context(), appPath, projectName, imageRef, buildCfg, buildStarted)
+		if err != nil {
+			return fmt.Errorf("failed to attach SBOM and provenance: %v (pass --skip-attestations to deploy without them)", err)
+		}
+		attestations = refs
+	}
+
+	// Step 2.8: Sign the pushed digest
+	signing := signingFromFlags(cmd, manifest, opts.signKey, opts.verifySigs)
+	if signing.Key != "" {
+		if !hasRegistry(imageRef) {
+			return fmt.Errorf("cannot sign %s: it was not pushed to a registry", imageRef)
+		}
+		if _, err := signImage(cmd.Context(), imageRef, signing.Key); err != nil {
+			return fmt.Errorf("signing failed: %v", err)
+		}
+	}
+
+	// Step 2.9: Verify the signature and pin the verified digest
+	deployRef := imageRef
+	if signing.Verify {
+		pub, err := signing.verifyKey()
+		if err != nil {
+			return err
+		}
+		if !hasRegistry(imageRef) {
+			return fmt.Errorf("cannot verify %s: it was not pushed to a registry", imageRef)
+		}
+		if deployRef, err = verifyImageSignature(cmd.Context(), imageRef, pub); err != nil {
+			return fmt.Errorf("signature verification failed: %v", err)
+		}
+		fmt.Printf("Verified signature of %s\n", deployRef)
+	}
+
+	// Step 3: Attach database if specified
+	if opts.db.Host != "" {
+		fmt.Printf("Attaching database...\n")
+		if err := attachDatabase(projectName, namespace, opts.db, kubecontext); err != nil {
+			return fmt.Errorf("database attach failed: %v", err)
+		}
+	}
+
+	// Step 4: Attach Redis if specified
+	if opts.redis.Host != "" {
+		fmt.Printf("Attaching Redis...\n")
+		if err := attachRedis(projectName, namespace, opts.redis, kubecontext); err != nil {
+			return fmt.Errorf("redis attach failed: %v", err)
+		}
+	}
+
+	// Step 5: Create secrets. This runs even without any, so an
+	// ExternalSecret left from an earlier deploy is removed
+	if len(secrets) > 0 || len(secretRefs) > 0 || len(opts.unsetSecrets) > 0 {
+		fmt.Printf("Creating secrets...\n")
+	}
+	if err := createSecrets(projectName, namespace, secrets, secretRefs, opts.secretStores, opts.unsetSecrets, opts.replaceSecrets, kubecontext); err != nil {
+		return fmt.Errorf("secrets creation failed: %v", err)
+	}
+
+	// Step 5.5: Configure registry pull permissions, which the
+	// migration Job needs as well as the service
+	if reg.Name() == registryECR {
+		fmt.Printf("Configuring ECR pull permissions...\n")
+		if err := configureECRPullPermissions(projectName, namespace, kubecontext); err != nil {
+			fmt.Printf("Warning: Failed to configure ECR pull permissions: %v\n", err)
+			fmt.Printf("The service may not be able to pull images from ECR.\n")
+		}
+	} else if reg.Name() != registryLocal {
+		if err := configureRegistryPullSecret(cmd.Context(), reg, namespace); err != nil {
+			fmt.Printf("Warning: Failed to configure pull secret for %s: %v\n", reg.Host(), err)
+		}
+	}
+
+	sources, err := loadEnvSources(cmd.Context(), projectName, namespace)
+	if err != nil {
+		return err
+	}
+
+	// Step 5.7: Run migrations before the new revision takes traffic
+	migration := svc.Migrate
+	if opts.migrate != "" {
+		migration = &migrationSpec{Command: opts.migrate}
+	}
+	if migration != nil && !opts.skipMigrate {
+		launcher, err := usesCNBLauncher(cmd.Context(), deployRef)
+		if err != nil {
+			return fmt.Errorf("migration failed: %v; %s was not updated", err, projectName)
+		}
+		if err := runMigration(cmd.Context(), projectName, namespace, deployRef, *migration, launcher, env, sources.refs("")); err != nil {
+			return fmt.Errorf("%v; %s was not updated", err, projectName)
+		}
+	}
+
+	// Step 6: Deploy Knative Service, loading the ConfigMap and Secrets
+	// created above
+	fmt.Printf("Deploying service %s...\n", projectName)
+	if err := knServiceApply(projectName, deployRef, namespace, cpu, mem, env, sources, kubecontext, port); err != nil {
+		return fmt.Errorf("deploy failed: %v", err)
+	}
+
+	// Report deployment
+	if opts.serverURL != "" {
+		_ = report(opts.serverURL, deployReport{
+			ID:              fmt.Sprintf("%s:%d", projectName, time.Now().UnixNano()),
+			Project:         projectName,
+			Namespace:       namespace,
+			Image:           imageRef,
+			Status:          "deployed",
+			Description:     "Application deployed with auto-build and push",
+			CreatedAt:       time.Now(),
+			Digest:          attestations.Digest,
+			SBOM:            attestations.SBOM,
+			Provenance:      attestations.Provenance,
+			Vulnerabilities: scan,
+		})
+	}
+
+	fmt.Printf("Successfully deployed %s to namespace %s\n", projectName, namespace)
+	return nil
+}
+
 func dockerPushWithECRLogin(imageRef string) error {
 	// Get AWS account ID and region
-	region := os.Getenv("AWS_REGION")
-	if region == "" { region = os.Getenv("AWS_DEFAULT_REGION") }
-	if region == "" { region = "us-east-1" }
-	
-	// Get AWS account ID
-	cmd := exec.Command("aws", "sts", "get-caller-identity", "--query", "Account", "--output", "text")
-	out, err := cmd.Output()
+	region := awsRegion()
+
+	// Get AWS account ID (cached from image reference generation)
+	accountID, err := ecrAccountID()
 	if err != nil {
-		return fmt.Errorf("failed to get AWS account ID for ECR push: %v\n\nTroubleshooting:\n1. Run: aws configure\n2. Ensure your AWS credentials are valid\n3. Set AWS_ACCOUNT_ID environment variable", err)
+		return err
 	}
-	accountID := strings.TrimSpace(string(out))
 	if accountID == "" {
-		return fmt.Errorf("AWS account ID is empty")
+		return fmt.Errorf("failed to get AWS account ID for ECR push\n\nTroubleshooting:\n1. Run: aws configure (or set AWS_PROFILE)\n2. Ensure your AWS credentials are valid\n3. Set AWS_ACCOUNT_ID environment variable")
 	}
-	
+
+	ref, err := parseImageReference(imageRef)
+	if err != nil {
+		return err
+	}
+
 	// Handle local image names (e.g., "nodejs-app:latest")
-	var ecrImageRef string
-	if !strings.Contains(imageRef, ".dkr.ecr.") {
+	if !isECRRegistry(ref.Registry) {
 		// This is a local image, need to tag it for ECR
-		projectName := strings.Split(imageRef, ":")[0]
-		ecrImageRef = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s:latest", accountID, region, projectName)
-		
-		fmt.Printf("Tagging local image %s as %s...\n", imageRef, ecrImageRef)
-		tagCmd := exec.Command("docker", "tag", imageRef, ecrImageRef)
+		local := ref.String()
+		ref.Registry = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", accountID, region)
+		if ref.Tag == "" && ref.Digest == "" {
+			ref.Tag = "latest"
+		}
+		imageRef = ref.String()
+
+		fmt.Printf("Tagging local image %s as %s...\n", local, imageRef)
+		tagCmd := exec.Command("docker", "tag", local, imageRef)
 		tagCmd.Stdout, tagCmd.Stderr = os.Stdout, os.Stderr
 		if err := tagCmd.Run(); err != nil {
 			return fmt.Errorf("failed to tag image for ECR: %v", err)
 		}
-		imageRef = ecrImageRef
-	}
-	
-	parts := strings.Split(imageRef, "/")
-	if len(parts) < 1 { return fmt.Errorf("invalid image: %s", imageRef) }
-	reg := parts[0]
-
-	// Extract repository name from image reference
-	repoName := strings.Split(imageRef, "/")[1]
-	repoName = strings.Split(repoName, ":")[0]
-
-	fmt.Printf("Authenticating with ECR...\n")
-	authCmd := exec.Command("aws", "ecr", "get-login-password", "--region", region)
-	authOut, err := authCmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to get ECR login password: %v\n\nTroubleshooting:\n1. Run: aws configure\n2. Ensure your AWS credentials are valid\n3. Check if you have ECR permissions", err)
 	}
 
-	auth := exec.Command("docker", "login", "--username", "AWS", "--password-stdin", reg)
-	auth.Stdin = bytes.NewReader(authOut)
-	auth.Stdout, auth.Stderr = os.Stdout, os.Stderr
-	if err := auth.Run(); err != nil {
-		return fmt.Errorf("failed to login to ECR: %v", err)
+	reg := registryForHost(ref.Registry)
+	if err := reg.Login(); err != nil {
+		return err
 	}
-
-	// Check if repository exists, create if not
-	fmt.Printf("Checking ECR repository: %s\n", repoName)
-	checkRepo := exec.Command("aws", "ecr", "describe-repositories", "--repository-names", repoName, "--region", region)
-	if err := checkRepo.Run(); err != nil {
-		fmt.Printf("Repository %s not found, creating...\n", repoName)
-		createRepo := exec.Command("aws", "ecr", "create-repository", "--repository-name", repoName, "--region", region)
-		createRepo.Stdout, createRepo.Stderr = os.Stdout, os.Stderr
-		if err := createRepo.Run(); err != nil {
-			return fmt.Errorf("failed to create ECR repository %s: %v\n\nTroubleshooting:\n1. Ensure you have ecr:CreateRepository permission\n2. Run: ./setup-ecr.sh", repoName, err)
-		}
-		fmt.Printf("Repository %s created successfully\n", repoName)
+	if err := reg.EnsureRepository(ref.Repository); err != nil {
+		return err
 	}
 
 	fmt.Printf("Pushing image %s...\n", imageRef)
@@ -291,28 +591,45 @@ func toEnvMap(pairs []string) map[string]string {
 	m := map[string]string{}
 	for _, p := range pairs {
 		kv := strings.SplitN(p, "=", 2)
-		if len(kv) == 2 { m[kv[0]] = kv[1] }
+		if len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		}
 	}
 	return m
 }
 
-func knServiceApply(name, image, ns, cpu, mem string, env map[string]string, kubecontext string, port int) error {
-	y := newKnServiceYAML(name, image, ns, cpu, mem, env, port)
+func knServiceApply(name, image, ns, cpu, mem string, env map[string]string, sources envSources, kubecontext string, port int) error {
+	y := newKnServiceYAML(name, image, ns, cpu, mem, env, sources, port)
 	args := []string{"apply", "-f", "-"}
-	if kubecontext != "" { args = append([]string{"--context", kubecontext}, args...) }
+	if kubecontext != "" {
+		args = append([]string{"--context", kubecontext}, args...)
+	}
 	c := exec.Command("kubectl", args...)
 	c.Stdin = bytes.NewBufferString(y)
 	c.Stdout, c.Stderr = os.Stdout, os.Stderr
 	return c.Run()
 }
 
-func newKnServiceYAML(name, image, ns, cpu, mem string, env map[string]string, port int) string {
+func newKnServiceYAML(name, image, ns, cpu, mem string, env map[string]string, sources envSources, port int) string {
 	var envLines []string
-	for k, v := range env {
-		envLines = append(envLines, fmt.Sprintf("          - name: %s\n            value: \"%s\"", k, v))
+	for _, k := range sortedKeys(env) {
+		envLines = append(envLines, fmt.Sprintf("          - name: %s\n            value: %q", k, env[k]))
 	}
 	envBlock := ""
-	if len(envLines) > 0 { envBlock = "        env:\n" + strings.Join(envLines, "\n") }
+	if len(envLines) > 0 {
+		envBlock = "          env:\n" + strings.Join(envLines, "\n") + "\n"
+	}
+	// Configuration, attachments and secrets come in whole, with envFrom
+	for i, ref := range sources.refs("") {
+		if i == 0 {
+			envBlock += "          envFrom:\n"
+		}
+		if ref.ConfigMapRef != nil {
+			envBlock += fmt.Sprintf("          - configMapRef:\n              name: %s\n", ref.ConfigMapRef.Name)
+		} else {
+			envBlock += fmt.Sprintf("          - secretRef:\n              name: %s\n", ref.SecretRef.Name)
+		}
+	}
 	return fmt.Sprintf(`apiVersion: serving.knative.dev/v1
 kind: Service
 metadata:
@@ -323,6 +640,7 @@ spec:
     metadata:
       annotations:
         autoscaling.knative.dev/minScale: "1"
+        %s: "%s"
     spec:
       containers:
         - image: %s
@@ -330,7 +648,7 @@ spec:
             - containerPort: %d
               name: http1
 %s
-`, name, ns, image, port, envBlock)
+`, name, ns, configHashAnnotation, sources.ConfigHash, image, port, envBlock)
 }
 
 func getClient(namespace string) (*kubernetes.Clientset, string, error) {
@@ -349,13 +667,26 @@ func getClient(namespace string) (*kubernetes.Clientset, string, error) {
 
 func report(server string, payload deployReport) error {
 	b, _ := json.Marshal(payload)
-	c := exec.Command("curl", "-sS", "-X", "POST", "-H", "Content-Type: application/json", "-d", string(b), server+"/deployments")
+	body := secretRedactor.redact(string(b))
+	c := exec.Command("curl", "-sS", "-X", "POST", "-H", "Content-Type: application/json", "-d", body, server+"/deployments")
 	c.Stdout, c.Stderr = os.Stdout, os.Stderr
 	return c.Run()
 }
 
 // Helper functions for the new deploy command
 
+// Deployed images get a unique tag so repositories can keep tags immutable
+// and lifecycle policies can count deploys.
+const deployTagPrefix = "deploy-"
+
+func deployTag(appPath string) string {
+	tag := deployTagPrefix + time.Now().UTC().Format("20060102-150405")
+	if sha, err := gitOutput(appPath, "rev-parse", "--short", "HEAD"); err == nil {
+		tag += "-" + sha
+	}
+	return tag
+}
+
 func getProjectName() (string, error) {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -368,116 +699,136 @@ func getProjectName() (string, error) {
 	return parts[len(parts)-1], nil
 }
 
-func generateImageRef(projectName string) (string, error) {
-	// Get AWS account ID and region
-	region := os.Getenv("AWS_REGION")
-	if region == "" {
-		region = os.Getenv("AWS_DEFAULT_REGION")
-	}
-	if region == "" {
-		region = "us-east-1"
-	}
-	
-	// Try to get AWS account ID from AWS CLI
-	cmd := exec.Command("aws", "sts", "get-caller-identity", "--query", "Account", "--output", "text")
-	out, err := cmd.Output()
-	if err != nil {
-		// If AWS CLI fails, try to get account ID from environment or use a fallback
-		accountID := os.Getenv("AWS_ACCOUNT_ID")
-		if accountID == "" {
-			// Try to parse from existing ECR URLs in environment
-			ecrURL := os.Getenv("ECR_URL")
-			if ecrURL != "" {
-				// Extract account ID from ECR URL like "123456789012.dkr.ecr.us-east-1.amazonaws.com"
-				parts := strings.Split(ecrURL, ".")
-				if len(parts) > 0 && strings.Contains(parts[0], "dkr") {
-					accountID = strings.Split(parts[0], ".")[0]
-				}
-			}
+// buildApplication builds imageRef with the configured strategy. It
+// reports whether the image was already pushed (the native builder pushes
+// as part of the build).
+func buildApplication(ctx context.Context, cfg buildConfig, appPath, imageRef string, envs []string) (bool, error) {
+	var err error
+	if cfg.Secrets, err = loadBuildSecrets(cfg.Secrets, appPath); err != nil {
+		return false, err
+	}
+	switch cfg.Strategy {
+	case strategyNative:
+		reg := registryForRef(imageRef)
+		if reg == nil {
+			return false, fmt.Errorf("native builder needs a registry image reference; set AWS_ACCOUNT_ID, configure AWS credentials or use --registry")
 		}
-		
-		if accountID == "" {
-			// Last resort: use a local image name for building, will be tagged for ECR during push
-			fmt.Printf("⚠️  Could not determine AWS account ID. Using local image name for building.\n")
-			imageRef := fmt.Sprintf("%s:latest", projectName)
-			return imageRef, nil
+		b := newNativeBuilder()
+		b.Insecure = reg.Insecure()
+		b.Platforms = cfg.nativePlatforms()
+		for _, s := range cfg.Secrets {
+			if s.Target != "" {
+				fmt.Printf("Warning: The native builder ignores file secret %s; it uses this host's own config files\n", s.ID)
+			}
 		}
-		
-		imageRef := fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s:latest", accountID, region, projectName)
-		return imageRef, nil
-	}
-	
-	accountID := strings.TrimSpace(string(out))
-	if accountID == "" {
-		return "", fmt.Errorf("AWS account ID is empty")
+		_, err := b.Build(ctx, appPath, imageRef, append(envs, envSecrets(cfg.Secrets)...))
+		return err == nil, err
+	case strategyDocker:
+		return buildWithDocker(cfg, appPath, imageRef, envs)
 	}
-	
-	// Generate image reference
-	imageRef := fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/%s:latest", accountID, region, projectName)
-	return imageRef, nil
-}
 
-
-func buildApplication(appPath, imageRef string, envs []string) error {
-	// Try to use bundled pack CLI first, fallback to system pack
+	// Try to use bundled pack CLI first, fallback to system pack.
+	// pack can't produce manifest lists, so multi-arch goes to Docker.
 	packPath := findPackCLI()
-	if packPath == "" {
-		fmt.Printf("Pack CLI not found, falling back to Docker build...\n")
-		return buildWithDocker(appPath, imageRef, envs)
-	}
-	
-	// Use a more stable builder image
-	builder := "paketobuildpacks/builder:tiny"
-	args := []string{"build", imageRef, "--path", appPath, "--builder", builder, "--pull-policy", "always", "--verbose"}
-	for _, e := range envs {
-		args = append(args, "--env", e)
-	}
-	
-	fmt.Printf("Running pack command: %s %v\n", packPath, args)
-	c := exec.Command(packPath, args...)
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	
-	// Try pack build first
-	if err := c.Run(); err != nil {
-		fmt.Printf("Pack build failed: %v\n", err)
-		fmt.Println("Falling back to Docker build...")
-		return buildWithDocker(appPath, imageRef, envs)
+	if packPath == "" || cfg.multiArch() {
+		if packPath == "" && cfg.Strategy == strategyPack {
+			return false, fmt.Errorf("pack CLI not found; install pack or see PACK_BUNDLING.md")
+		}
+		if packPath == "" {
+			fmt.Printf("Pack CLI not found, falling back to Docker build...\n")
+		}
+		return buildWithDocker(cfg, appPath, imageRef, envs)
 	}
-	
-	return nil
+	return packBuild(packPath, cfg, appPath, imageRef, envs)
 }
 
-func buildWithDocker(appPath, imageRef string, envs []string) error {
+// Name of the generated Dockerfile inside the streamed build context
+const generatedDockerfile = ".flow.Dockerfile"
+
+// buildWithDocker builds with the generated Dockerfile. Multi-arch builds
+// can't be loaded into the local daemon, so buildx pushes them and they are
+// reported as already pushed.
+func buildWithDocker(cfg buildConfig, appPath, imageRef string, envs []string) (bool, error) {
 	// Create a simple Dockerfile for the application
-	dockerfile := createDockerfile(appPath)
-	
-	// Build with Docker for linux/amd64 platform (EKS compatibility)
-	args := []string{"build", "--platform", "linux/amd64", "-t", imageRef, "-f", "-", appPath}
+	dockerfile := createDockerfile(appPath, cfg.Secrets)
+
+	// Only send files that survive .flowignore and the default exclusions
+	bc, err := loadBuildContext(appPath, false)
+	if err != nil {
+		return false, err
+	}
+	bc.warnIfLarge()
+
+	// Build for the target platforms (linux/amd64 by default for EKS compatibility)
+	args := []string{"build", "--platform", strings.Join(cfg.Platforms, ","), "-t", imageRef, "-f", generatedDockerfile}
+	var cacheArgs []string
+	if !cfg.NoCache {
+		cacheArgs = dockerCacheArgs(appPath, imageRef)
+	}
+	multiArch := cfg.multiArch()
+	if multiArch {
+		if !hasRegistry(imageRef) {
+			return false, fmt.Errorf("multi-arch images are pushed during the build and need a registry image reference")
+		}
+		if err := ensureBuildxBuilder(); err != nil {
+			return false, err
+		}
+		if err := prepareRegistry(imageRef); err != nil {
+			return false, err
+		}
+		fmt.Printf("Building %s for %s (cross-arch RUN steps need QEMU binfmt on this host)...\n", imageRef, strings.Join(cfg.Platforms, ", "))
+	}
+	if multiArch || len(cacheArgs) > 0 {
+		args = append([]string{"buildx"}, args...)
+		args = append(args, "--builder", buildxBuilderName)
+		args = append(args, cacheArgs...)
+		if multiArch {
+			args = append(args, "--push")
+		} else {
+			args = append(args, "--load")
+		}
+	}
+	args = append(args, dockerSecretArgs(cfg.Secrets)...)
+	args = append(args, "-")
 	c := exec.Command("docker", args...)
-	c.Stdin = strings.NewReader(dockerfile)
-	c.Stdout, c.Stderr = os.Stdout, os.Stderr
-	
-	return c.Run()
+	if len(cfg.Secrets) > 0 {
+		// Secret mounts need BuildKit
+		c.Env = append(os.Environ(), "DOCKER_BUILDKIT=1")
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(bc.writeTar(pw, "", map[string][]byte{generatedDockerfile: []byte(dockerfile)}))
+	}()
+	c.Stdin = pr
+	stdout, stderr := newRedactWriter(os.Stdout), newRedactWriter(os.Stderr)
+	c.Stdout, c.Stderr = stdout, stderr
+
+	err = c.Run()
+	pr.Close()
+	stdout.Flush()
+	stderr.Flush()
+	return multiArch && err == nil, err
 }
 
-func createDockerfile(appPath string) string {
+func createDockerfile(appPath string, secrets []buildSecret) string {
 	// Detect the application type and create appropriate Dockerfile
 	if _, err := os.Stat(filepath.Join(appPath, "package.json")); err == nil {
 		// Node.js application
+		cmd, _ := json.Marshal(nodeCommand(appPath))
 		return `FROM node:18-alpine
 WORKDIR /app
 COPY package*.json ./
-RUN npm install --omit=dev
+` + dockerRun(secrets, "npm install --omit=dev") + `
 COPY . .
 EXPOSE 8080
-CMD ["node", "server.js"]`
+CMD ` + string(cmd)
 	} else if _, err := os.Stat(filepath.Join(appPath, "requirements.txt")); err == nil {
 		// Python application
 		return `FROM python:3.11-slim
 RUN apt-get update && apt-get install -y gcc && rm -rf /var/lib/apt/lists/*
 WORKDIR /app
 COPY requirements.txt .
-RUN pip install --no-cache-dir -r requirements.txt
+` + dockerRun(secrets, "pip install --no-cache-dir -r requirements.txt") + `
 COPY . .
 EXPOSE 8080
 CMD ["gunicorn", "--bind", "0.0.0.0:8080", "app:app"]`
@@ -486,9 +837,9 @@ CMD ["gunicorn", "--bind", "0.0.0.0:8080", "app:app"]`
 		return `FROM golang:1.21-alpine AS builder
 WORKDIR /app
 COPY go.mod ./
-RUN go mod download
+` + dockerRun(secrets, "go mod download") + `
 COPY . .
-RUN go build -o main .
+` + dockerRun(secrets, "go build -o main .") + `
 
 FROM alpine:latest
 RUN apk add --no-cache ca-certificates
@@ -549,82 +900,85 @@ func findBundledPack() string {
 	return ""
 }
 
-func attachDatabase(name, namespace, user, password, host string, port int, db string, kubecontext string) error {
-	client, ns, err := getClient(namespace)
+func attachDatabase(name, namespace string, conn postgresConn, kubecontext string) error {
+	return writeAttachment(context.Background(), mustAttachmentType("postgres"), name, namespace, conn.secretData())
+}
+
+func attachRedis(name, namespace string, conn redisConn, kubecontext string) error {
+	return writeAttachment(context.Background(), mustAttachmentType("redis"), name, namespace, conn.secretData())
+}
+
+// deploySecrets returns the app's secrets: the encrypted secrets file,
+// if any, overridden by --secret pairs. External references are resolved,
+// or with --secret-refs sync returned separately for the cluster to sync.
+func deploySecrets(ctx context.Context, appPath string, opts *deployOptions) (map[string]string, map[string]secretRef, error) {
+	data := map[string]string{}
+	path := opts.secretsFile
+	if path == "" {
+		path = filepath.Join(appPath, defaultSecretsFile)
+	}
+	if _, err := os.Stat(path); err == nil || opts.secretsFile != "" {
+		f, err := readSecretsFile(ctx, path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt secrets: %v", err)
+		}
+		data = f.data()
+		fmt.Printf("Decrypted %d secrets from %s\n", len(data), path)
+	}
+	flags, err := parseSecretPairs(opts.secrets)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	
-	url := fmt.Sprintf("postgres://%s:%s@%s:%d/%s", user, password, host, port, db)
-	sec := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      name + "-db",
-			Namespace: ns,
-		},
-		StringData: map[string]string{"DATABASE_URL": url},
+	for k, v := range flags {
+		data[k] = v
 	}
-	
-	_, err = client.CoreV1().Secrets(ns).Get(context.Background(), sec.Name, metav1.GetOptions{})
-	if err == nil {
-		_, err = client.CoreV1().Secrets(ns).Update(context.Background(), sec, metav1.UpdateOptions{})
-		return err
+	switch opts.secretRefs {
+	case secretRefsResolve:
+		if err := resolveSecretRefs(ctx, data); err != nil {
+			return nil, nil, err
+		}
+		return data, nil, nil
+	case secretRefsSync:
+		refs, err := splitSecretRefs(data)
+		return data, refs, err
 	}
-	_, err = client.CoreV1().Secrets(ns).Create(context.Background(), sec, metav1.CreateOptions{})
-	return err
+	return nil, nil, fmt.Errorf("invalid --secret-refs %q (want %s or %s)", opts.secretRefs, secretRefsResolve, secretRefsSync)
 }
 
-func attachRedis(name, namespace, host string, port int, password string, kubecontext string) error {
+// createSecrets writes data to <name>-secrets. Keys in refs are synced
+// into it by an ExternalSecret; keys a previous ExternalSecret synced and
+// nothing sets any more are removed, along with the ExternalSecret when
+// no references are left.
+func createSecrets(name, namespace string, data map[string]string, refs map[string]secretRef, stores secretStores, unset []string, replace bool, kubecontext string) error {
 	client, ns, err := getClient(namespace)
 	if err != nil {
 		return err
 	}
-	
-	url := fmt.Sprintf("redis://:%s@%s:%d", password, host, port)
-	sec := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      name + "-redis",
-			Namespace: ns,
-		},
-		StringData: map[string]string{"REDIS_URL": url},
-	}
-	
-	_, err = client.CoreV1().Secrets(ns).Get(context.Background(), sec.Name, metav1.GetOptions{})
-	if err == nil {
-		_, err = client.CoreV1().Secrets(ns).Update(context.Background(), sec, metav1.UpdateOptions{})
-		return err
-	}
-	_, err = client.CoreV1().Secrets(ns).Create(context.Background(), sec, metav1.CreateOptions{})
-	return err
-}
-
-func createSecrets(name, namespace string, pairs []string, kubecontext string) error {
-	client, ns, err := getClient(namespace)
+	ctx := context.Background()
+	secretName := name + "-secrets"
+	prev, err := getExternalSecret(ctx, secretName, ns, kubecontext)
 	if err != nil {
 		return err
 	}
-	
-	data := map[string]string{}
-	for _, p := range pairs {
-		kv := strings.SplitN(p, "=", 2)
-		if len(kv) != 2 {
-			return fmt.Errorf("invalid secret pair: %s", p)
-		}
-		data[kv[0]] = kv[1]
+	if len(data) == 0 && len(refs) == 0 && len(unset) == 0 && prev == nil {
+		// Nothing to write or clean up; don't create an empty Secret
+		return nil
 	}
-	
-	sec := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      name + "-secrets",
-			Namespace: ns,
-		},
-		StringData: data,
+	var keep []string
+	for k := range refs {
+		keep = append(keep, k)
 	}
-	
-	_, err = client.CoreV1().Secrets(ns).Get(context.Background(), sec.Name, metav1.GetOptions{})
-	if err == nil {
-		_, err = client.CoreV1().Secrets(ns).Update(context.Background(), sec, metav1.UpdateOptions{})
+	for _, k := range prev.keys() {
+		_, synced := refs[k]
+		_, set := data[k]
+		if !synced && !set && !contains(unset, k) {
+			unset = append(unset, k)
+		}
+	}
+	change, err := upsertSecret(ctx, client, ns, secretName, keyUpdate{Set: data, Unset: unset, Replace: replace, Keep: keep})
+	if err != nil {
 		return err
 	}
-	_, err = client.CoreV1().Secrets(ns).Create(context.Background(), sec, metav1.CreateOptions{})
-	return err
+	fmt.Printf("Secret %s: %s\n", secretName, change)
+	return applyExternalSecret(ctx, name, secretName, ns, kubecontext, refs, stores, prev)
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// ECR authorization tokens are valid for 12 hours; refresh them a little
+// before they expire so a long build doesn't push with a stale one.
+const ecrTokenRefreshMargin = 5 * time.Minute
+
+// ecrAPI and stsAPI are the SDK calls flow makes, so tests can substitute
+// fakes. Against a mock server, AWS_ENDPOINT_URL (or AWS_ENDPOINT_URL_ECR
+// and AWS_ENDPOINT_URL_STS) is enough.
+type ecrAPI interface {
+	GetAuthorizationToken(ctx context.Context, in *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error)
+	DescribeRepositories(ctx context.Context, in *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error)
+	CreateRepository(ctx context.Context, in *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error)
+	BatchDeleteImage(ctx context.Context, in *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error)
+	DeleteRepository(ctx context.Context, in *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.DeleteRepositoryOutput, error)
+	PutImageTagMutability(ctx context.Context, in *ecr.PutImageTagMutabilityInput, optFns ...func(*ecr.Options)) (*ecr.PutImageTagMutabilityOutput, error)
+	PutImageScanningConfiguration(ctx context.Context, in *ecr.PutImageScanningConfigurationInput, optFns ...func(*ecr.Options)) (*ecr.PutImageScanningConfigurationOutput, error)
+	PutLifecyclePolicy(ctx context.Context, in *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error)
+	DeleteLifecyclePolicy(ctx context.Context, in *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.DeleteLifecyclePolicyOutput, error)
+	DescribeImageScanFindings(ctx context.Context, in *ecr.DescribeImageScanFindingsInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error)
+	StartImageScan(ctx context.Context, in *ecr.StartImageScanInput, optFns ...func(*ecr.Options)) (*ecr.StartImageScanOutput, error)
+}
+
+type stsAPI interface {
+	GetCallerIdentity(ctx context.Context, in *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+type ecrToken struct {
+	password string
+	expires  time.Time
+}
+
+// awsSession loads the shared AWS config once (environment, AWS_PROFILE,
+// SSO and instance/IRSA credentials through the default chain) and caches
+// what it learns for the life of the process.
+type awsSession struct {
+	mu        sync.Mutex
+	cfg       *aws.Config
+	accountID *string
+	tokens    map[string]ecrToken // by region
+	loggedIn  map[string]string   // registry -> password docker was logged in with
+	repos     map[string]bool     // region/repository known to exist
+
+	// newECR and newSTS build clients; tests replace them.
+	newECR func(cfg aws.Config, region string) ecrAPI
+	newSTS func(cfg aws.Config) stsAPI
+}
+
+var awsClients = &awsSession{
+	newECR: func(cfg aws.Config, region string) ecrAPI {
+		return ecr.NewFromConfig(cfg, func(o *ecr.Options) { o.Region = region })
+	},
+	newSTS: func(cfg aws.Config) stsAPI { return sts.NewFromConfig(cfg) },
+}
+
+func (s *awsSession) config(ctx context.Context) (aws.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cfg != nil {
+		return *s.cfg, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS configuration: %v", err)
+	}
+	s.cfg = &cfg
+	return cfg, nil
+}
+
+func (s *awsSession) ecr(ctx context.Context, region string) (ecrAPI, error) {
+	cfg, err := s.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newECR(cfg, region), nil
+}
+
+// awsRegion returns AWS_REGION or AWS_DEFAULT_REGION, then the region of
+// the ECR_URL registry, then the profile's region, then us-east-1.
+func awsRegion() string {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		_, region, _ = ecrURLHost()
+	}
+	if region == "" {
+		// The profile's region, if it has one
+		if cfg, err := awsClients.config(context.Background()); err == nil {
+			region = cfg.Region
+		}
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return region
+}
+
+// ecrAccountID finds the account to push to: the caller identity, then
+// AWS_ACCOUNT_ID, then ECR_URL. "" means unknown. The result is cached so a
+// deploy calls STS at most once.
+func ecrAccountID() (string, error) {
+	s := awsClients
+	s.mu.Lock()
+	if s.accountID != nil {
+		defer s.mu.Unlock()
+		return *s.accountID, nil
+	}
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	accountID := ""
+	cfg, err := s.config(ctx)
+	if err == nil {
+		var out *sts.GetCallerIdentityOutput
+		if out, err = s.newSTS(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}); err == nil {
+			accountID = aws.ToString(out.Account)
+			if accountID == "" {
+				return "", fmt.Errorf("AWS account ID is empty")
+			}
+		}
+	}
+	if err != nil {
+		// Without usable credentials, try to get account ID from environment
+		accountID = os.Getenv("AWS_ACCOUNT_ID")
+		if accountID == "" {
+			accountID, _, _ = ecrURLHost()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accountID = &accountID
+	return accountID, nil
+}
+
+// ecrURLHost parses the account and region from ECR_URL, e.g.
+// "https://123456789012.dkr.ecr.us-east-1.amazonaws.com/apps".
+func ecrURLHost() (account, region string, ok bool) {
+	host := strings.TrimPrefix(strings.TrimPrefix(os.Getenv("ECR_URL"), "https://"), "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return parseECRHost(host)
+}
+
+// ecrLoginPassword returns the registry password for region, reusing the
+// authorization token until shortly before it expires.
+func ecrLoginPassword(region string) ([]byte, error) {
+	s := awsClients
+	s.mu.Lock()
+	if t, ok := s.tokens[region]; ok && time.Now().Before(t.expires) {
+		s.mu.Unlock()
+		return []byte(t.password), nil
+	}
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	client, err := s.ecr(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ECR login password: %v\n\nTroubleshooting:\n1. Run: aws configure (or set AWS_PROFILE)\n2. Ensure your AWS credentials are valid\n3. Check if you have ECR permissions", err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return nil, fmt.Errorf("ECR returned no authorization data")
+	}
+	data := out.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(data.AuthorizationToken))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ECR authorization token: %v", err)
+	}
+	// The token is "AWS:<password>"
+	_, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid ECR authorization token")
+	}
+	expires := time.Now().Add(time.Hour)
+	if data.ExpiresAt != nil {
+		expires = *data.ExpiresAt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = map[string]ecrToken{}
+	}
+	s.tokens[region] = ecrToken{password: password, expires: expires.Add(-ecrTokenRefreshMargin)}
+	return []byte(password), nil
+}
+
+// ecrDockerLogin logs docker in to registry, skipping the login when it
+// was already done with the current token.
+func ecrDockerLogin(registry, region string) error {
+	authOut, err := ecrLoginPassword(region)
+	if err != nil {
+		return err
+	}
+	s := awsClients
+	s.mu.Lock()
+	done := s.loggedIn[registry] == string(authOut)
+	s.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	fmt.Printf("Authenticating with ECR...\n")
+	auth := exec.Command("docker", "login", "--username", "AWS", "--password-stdin", registry)
+	auth.Stdin = bytes.NewReader(authOut)
+	auth.Stdout, auth.Stderr = os.Stdout, os.Stderr
+	if err := auth.Run(); err != nil {
+		return fmt.Errorf("failed to login to ECR: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loggedIn == nil {
+		s.loggedIn = map[string]string{}
+	}
+	s.loggedIn[registry] = string(authOut)
+	return nil
+}
+
+// ensureECRRepository creates repoName with policy applied unless it
+// already exists. Existing repositories are left alone; `flow registry
+// configure` updates them.
+func ensureECRRepository(repoName, region string, policy repositoryPolicy) error {
+	s := awsClients
+	key := region + "/" + repoName
+	s.mu.Lock()
+	known := s.repos[key]
+	s.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	ctx := context.Background()
+	client, err := s.ecr(ctx, region)
+	if err != nil {
+		return err
+	}
+	// Check if repository exists, create if not
+	fmt.Printf("Checking ECR repository: %s\n", repoName)
+	_, err = client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{RepositoryNames: []string{repoName}})
+	var notFound *ecrtypes.RepositoryNotFoundException
+	if errors.As(err, &notFound) {
+		fmt.Printf("Repository %s not found, creating...\n", repoName)
+		_, err = client.CreateRepository(ctx, policy.createInput(repoName))
+		var exists *ecrtypes.RepositoryAlreadyExistsException
+		if errors.As(err, &exists) {
+			// Created concurrently, e.g. by a parallel service deploy
+			err = nil
+		} else if err == nil {
+			err = putLifecyclePolicy(ctx, client, repoName, policy)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create ECR repository %s: %v\n\nTroubleshooting:\n1. Ensure you have ecr:CreateRepository and ecr:PutLifecyclePolicy permissions\n2. Run: ./setup-ecr.sh", repoName, err)
+		}
+		fmt.Printf("Repository %s created successfully (%s)\n", repoName, policy)
+	} else if err != nil {
+		return fmt.Errorf("failed to check ECR repository %s: %v", repoName, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repos == nil {
+		s.repos = map[string]bool{}
+	}
+	s.repos[key] = true
+	return nil
+}
+
+// deleteECRImages deletes tags from repoName, or the whole repository when
+// tags is empty. A missing repository is not an error.
+func deleteECRImages(repoName, region string, tags []string) error {
+	ctx := context.Background()
+	client, err := awsClients.ecr(ctx, region)
+	if err != nil {
+		return err
+	}
+	var notFound *ecrtypes.RepositoryNotFoundException
+	if len(tags) == 0 {
+		_, err = client.DeleteRepository(ctx, &ecr.DeleteRepositoryInput{RepositoryName: aws.String(repoName), Force: true})
+		if errors.As(err, &notFound) {
+			fmt.Printf("No caches found\n")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete repository %s: %v", repoName, err)
+		}
+		awsClients.mu.Lock()
+		delete(awsClients.repos, region+"/"+repoName)
+		awsClients.mu.Unlock()
+		return nil
+	}
+
+	ids := make([]ecrtypes.ImageIdentifier, len(tags))
+	for i, t := range tags {
+		ids[i] = ecrtypes.ImageIdentifier{ImageTag: aws.String(t)}
+	}
+	_, err = client.BatchDeleteImage(ctx, &ecr.BatchDeleteImageInput{RepositoryName: aws.String(repoName), ImageIds: ids})
+	if errors.As(err, &notFound) {
+		fmt.Printf("No caches found\n")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete images from %s: %v", repoName, err)
+	}
+	return nil
+}
+
+func isECRRegistry(registry string) bool {
+	_, _, ok := parseECRHost(registry)
+	return ok
+}
+
+// ecrRegion extracts the region from <account>.dkr.ecr.<region>.amazonaws.com.
+func ecrRegion(registry string) string {
+	if _, region, ok := parseECRHost(registry); ok {
+		return region
+	}
+	return awsRegion()
+}
+
+// ecrKeychain resolves ECR registries with the same cached login password
+// the docker push path uses.
+type ecrKeychain struct{}
+
+func (ecrKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	registry := target.RegistryStr()
+	if !isECRRegistry(registry) {
+		return authn.Anonymous, nil
+	}
+	password, err := ecrLoginPassword(ecrRegion(registry))
+	if err != nil {
+		return nil, err
+	}
+	return &authn.Basic{Username: "AWS", Password: string(password)}, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/spf13/cobra"
+)
+
+// Defaults applied to repositories flow creates.
+const (
+	defaultKeepImages         = 30
+	defaultExpireUntaggedDays = 14
+)
+
+// repositoryPolicy is the registry.repository section of flow.yaml. It is
+// applied when flow creates an ECR repository and by `flow registry
+// configure`. Negative counts disable the corresponding lifecycle rule.
+type repositoryPolicy struct {
+	ImmutableTags      *bool  `json:"immutableTags,omitempty"`
+	ScanOnPush         *bool  `json:"scanOnPush,omitempty"`
+	Encryption         string `json:"encryption,omitempty"`
+	KMSKey             string `json:"kmsKey,omitempty"`
+	KeepImages         int    `json:"keepImages,omitempty"`
+	ExpireUntaggedDays int    `json:"expireUntaggedDays,omitempty"`
+}
+
+// withDefaults fills unset fields: mutable tags, scan on push, AES256,
+// keep the last 30 deploys and expire untagged images after 14 days.
+// Immutability is opt-in, not applied on every create: it covers every tag
+// in the repository, and `flow build`/`flow push` overwrite :latest.
+// Deploys work either way, since they push unique deploy-<time>-<sha> tags.
+func (p repositoryPolicy) withDefaults() repositoryPolicy {
+	if p.ImmutableTags == nil {
+		p.ImmutableTags = aws.Bool(false)
+	}
+	if p.ScanOnPush == nil {
+		p.ScanOnPush = aws.Bool(true)
+	}
+	if p.Encryption == "" {
+		p.Encryption = string(ecrtypes.EncryptionTypeAes256)
+		if p.KMSKey != "" {
+			p.Encryption = string(ecrtypes.EncryptionTypeKms)
+		}
+	}
+	if p.KeepImages == 0 {
+		p.KeepImages = defaultKeepImages
+	}
+	if p.ExpireUntaggedDays == 0 {
+		p.ExpireUntaggedDays = defaultExpireUntaggedDays
+	}
+	return p
+}
+
+// cacheRepositoryPolicy is used for <repo>-cache repositories: cache tags
+// are overwritten on every build, so they must stay mutable, and caches
+// aren't worth scanning.
+func cacheRepositoryPolicy() repositoryPolicy {
+	return repositoryPolicy{
+		ImmutableTags:      aws.Bool(false),
+		ScanOnPush:         aws.Bool(false),
+		KeepImages:         -1,
+		ExpireUntaggedDays: 7,
+	}.withDefaults()
+}
+
+func (p repositoryPolicy) validate() error {
+	switch ecrtypes.EncryptionType(p.Encryption) {
+	case "", ecrtypes.EncryptionTypeAes256:
+		if p.KMSKey != "" {
+			return fmt.Errorf("kmsKey requires encryption KMS")
+		}
+	case ecrtypes.EncryptionTypeKms, ecrtypes.EncryptionTypeKmsDsse:
+	default:
+		return fmt.Errorf("invalid encryption %q (want AES256, KMS or KMS_DSSE)", p.Encryption)
+	}
+	return nil
+}
+
+func (p repositoryPolicy) tagMutability() ecrtypes.ImageTagMutability {
+	if aws.ToBool(p.ImmutableTags) {
+		return ecrtypes.ImageTagMutabilityImmutable
+	}
+	return ecrtypes.ImageTagMutabilityMutable
+}
+
+// lifecyclePolicy renders the ECR lifecycle policy document, or "" when
+// both rules are disabled.
+func (p repositoryPolicy) lifecyclePolicy() (string, error) {
+	type selection struct {
+		TagStatus     string   `json:"tagStatus"`
+		TagPrefixList []string `json:"tagPrefixList,omitempty"`
+		CountType     string   `json:"countType"`
+		CountUnit     string   `json:"countUnit,omitempty"`
+		CountNumber   int      `json:"countNumber"`
+	}
+	type rule struct {
+		RulePriority int               `json:"rulePriority"`
+		Description  string            `json:"description"`
+		Selection    selection         `json:"selection"`
+		Action       map[string]string `json:"action"`
+	}
+	var rules []rule
+	expire := map[string]string{"type": "expire"}
+	if p.ExpireUntaggedDays > 0 {
+		rules = append(rules, rule{
+			RulePriority: len(rules) + 1,
+			Description:  fmt.Sprintf("Expire untagged images after %d days", p.ExpireUntaggedDays),
+			Selection:    selection{TagStatus: "untagged", CountType: "sinceImagePushed", CountUnit: "days", CountNumber: p.ExpireUntaggedDays},
+			Action:       expire,
+		})
+	}
+	if p.KeepImages > 0 {
+		rules = append(rules, rule{
+			RulePriority: len(rules) + 1,
+			Description:  fmt.Sprintf("Keep the last %d deployed images", p.KeepImages),
+			Selection:    selection{TagStatus: "tagged", TagPrefixList: []string{deployTagPrefix}, CountType: "imageCountMoreThan", CountNumber: p.KeepImages},
+			Action:       expire,
+		})
+	}
+	if len(rules) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(map[string]interface{}{"rules": rules})
+	return string(b), err
+}
+
+func (p repositoryPolicy) createInput(repoName string) *ecr.CreateRepositoryInput {
+	in := &ecr.CreateRepositoryInput{
+		RepositoryName:             aws.String(repoName),
+		ImageTagMutability:         p.tagMutability(),
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{ScanOnPush: aws.ToBool(p.ScanOnPush)},
+		EncryptionConfiguration:    &ecrtypes.EncryptionConfiguration{EncryptionType: ecrtypes.EncryptionType(p.Encryption)},
+	}
+	if p.KMSKey != "" {
+		in.EncryptionConfiguration.KmsKey = aws.String(p.KMSKey)
+	}
+	return in
+}
+
+func (p repositoryPolicy) String() string {
+	keep, untagged := "off", "off"
+	if p.KeepImages > 0 {
+		keep = fmt.Sprintf("last %d", p.KeepImages)
+	}
+	if p.ExpireUntaggedDays > 0 {
+		untagged = fmt.Sprintf("%dd", p.ExpireUntaggedDays)
+	}
+	return fmt.Sprintf("tags %s, scan on push %t, encryption %s, keep deploys %s, expire untagged %s",
+		strings.ToLower(string(p.tagMutability())), aws.ToBool(p.ScanOnPush), p.Encryption, keep, untagged)
+}
+
+// putLifecyclePolicy sets (or, with both rules disabled, removes) the
+// repository's lifecycle policy.
+func putLifecyclePolicy(ctx context.Context, client ecrAPI, repoName string, p repositoryPolicy) error {
+	doc, err := p.lifecyclePolicy()
+	if err != nil {
+		return err
+	}
+	if doc == "" {
+		_, err := client.DeleteLifecyclePolicy(ctx, &ecr.DeleteLifecyclePolicyInput{RepositoryName: aws.String(repoName)})
+		var none *ecrtypes.LifecyclePolicyNotFoundException
+		if errors.As(err, &none) {
+			return nil
+		}
+		return err
+	}
+	_, err = client.PutLifecyclePolicy(ctx, &ecr.PutLifecyclePolicyInput{
+		RepositoryName:      aws.String(repoName),
+		LifecyclePolicyText: aws.String(doc),
+	})
+	return err
+}
+
+// configureECRRepository applies p to an existing repository. Encryption
+// is fixed at creation, so a mismatch is only reported.
+func configureECRRepository(repoName, region string, p repositoryPolicy) error {
+	ctx := context.Background()
+	client, err := awsClients.ecr(ctx, region)
+	if err != nil {
+		return err
+	}
+	out, err := client.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{RepositoryNames: []string{repoName}})
+	if err != nil {
+		return fmt.Errorf("failed to describe ECR repository %s: %v", repoName, err)
+	}
+	if len(out.Repositories) == 1 {
+		if enc := out.Repositories[0].EncryptionConfiguration; enc != nil && string(enc.EncryptionType) != p.Encryption {
+			fmt.Printf("Warning: %s is encrypted with %s; encryption can only be set when a repository is created\n", repoName, enc.EncryptionType)
+		}
+	}
+
+	if _, err := client.PutImageTagMutability(ctx, &ecr.PutImageTagMutabilityInput{
+		RepositoryName:     aws.String(repoName),
+		ImageTagMutability: p.tagMutability(),
+	}); err != nil {
+		return fmt.Errorf("failed to set tag mutability on %s: %v", repoName, err)
+	}
+	if _, err := client.PutImageScanningConfiguration(ctx, &ecr.PutImageScanningConfigurationInput{
+		RepositoryName:             aws.String(repoName),
+		ImageScanningConfiguration: &ecrtypes.ImageScanningConfiguration{ScanOnPush: aws.ToBool(p.ScanOnPush)},
+	}); err != nil {
+		return fmt.Errorf("failed to set scan on push on %s: %v", repoName, err)
+	}
+	if err := putLifecyclePolicy(ctx, client, repoName, p); err != nil {
+		return fmt.Errorf("failed to set lifecycle policy on %s: %v", repoName, err)
+	}
+	return nil
+}
+
+func newRegistryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "registry",
+		Short: "Manage the project's image repository",
+	}
+	cmd.AddCommand(newRegistryConfigureCmd())
+	cmd.AddCommand(newRegistryLocalCmd())
+	return cmd
+}
+
+func newRegistryConfigureCmd() *cobra.Command {
+	var (
+		registry           string
+		immutableTags      bool
+		scanOnPush         bool
+		encryption         string
+		kmsKey             string
+		keepImages         int
+		expireUntaggedDays int
+	)
+	cmd := &cobra.Command{
+		Use:   "configure [service...]",
+		Short: "Apply tag immutability, scan-on-push, encryption and lifecycle settings to existing ECR repositories",
+		Long: `Apply the registry.repository settings from flow.yaml (overridden by flags)
+to the project's ECR repositories, creating them if needed. Without
+service names every service declared in flow.yaml is configured.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := loadManifest(".")
+			if err != nil {
+				return err
+			}
+			reg, err := resolveRegistry(registry, manifest.Registry)
+			if err != nil {
+				return err
+			}
+			ecrReg, ok := reg.(*ecrRegistry)
+			if !ok {
+				return fmt.Errorf("repository policies are only supported for ECR, not %s", reg.Name())
+			}
+
+			p := manifest.Registry.Repository
+			set := func(name string) bool { return cmd.Flags().Changed(name) }
+			if set("immutable-tags") {
+				p.ImmutableTags = aws.Bool(immutableTags)
+			}
+			if set("scan-on-push") {
+				p.ScanOnPush = aws.Bool(scanOnPush)
+			}
+			if set("encryption") {
+				p.Encryption = encryption
+			}
+			if set("kms-key") {
+				p.KMSKey = kmsKey
+			}
+			if set("keep-images") {
+				p.KeepImages = keepImages
+			}
+			if set("expire-untagged-days") {
+				p.ExpireUntaggedDays = expireUntaggedDays
+			}
+			p = p.withDefaults()
+			if err := p.validate(); err != nil {
+				return err
+			}
+			ecrReg.policy = p
+
+			services, err := manifest.selectServices(args, len(args) == 0)
+			if err != nil {
+				return err
+			}
+			for _, svc := range services {
+				imageRef, err := reg.ImageRef(svc.Name, defaultImageTag)
+				if err != nil {
+					return err
+				}
+				ref, err := parseImageReference(imageRef)
+				if err != nil {
+					return err
+				}
+				if ref.Registry == "" {
+					return fmt.Errorf("could not determine the ECR registry; configure AWS credentials or set AWS_ACCOUNT_ID")
+				}
+				if err := reg.EnsureRepository(ref.Repository); err != nil {
+					return err
+				}
+				fmt.Printf("Configuring %s (%s)...\n", ref.Repository, p)
+				if err := configureECRRepository(ref.Repository, ecrRegion(ref.Registry), p); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	addRegistryFlag(cmd, &registry)
+	cmd.Flags().BoolVar(&immutableTags, "immutable-tags", false, "Reject pushes that overwrite an existing tag. Off by default rather than always on, since flow build and flow push overwrite :latest")
+	cmd.Flags().BoolVar(&scanOnPush, "scan-on-push", true, "Scan images for vulnerabilities when pushed")
+	cmd.Flags().StringVar(&encryption, "encryption", "", "Encryption for new repositories: AES256, KMS or KMS_DSSE (default AES256)")
+	cmd.Flags().StringVar(&kmsKey, "kms-key", "", "KMS key ARN or alias for KMS encryption")
+	cmd.Flags().IntVar(&keepImages, "keep-images", defaultKeepImages, "Deployed images to keep; older ones expire (-1 to disable)")
+	cmd.Flags().IntVar(&expireUntaggedDays, "expire-untagged-days", defaultExpireUntaggedDays, "Days after which untagged images expire (-1 to disable)")
+	return cmd
+}
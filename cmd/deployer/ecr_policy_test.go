@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+func TestRepositoryPolicyWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		in   repositoryPolicy
+		want repositoryPolicy
+	}{
+		{
+			name: "defaults keep tags mutable",
+			want: repositoryPolicy{ImmutableTags: aws.Bool(false), ScanOnPush: aws.Bool(true), Encryption: "AES256", KeepImages: 30, ExpireUntaggedDays: 14},
+		},
+		{
+			name: "immutability is opt-in",
+			in:   repositoryPolicy{ImmutableTags: aws.Bool(true), ScanOnPush: aws.Bool(false), KeepImages: -1},
+			want: repositoryPolicy{ImmutableTags: aws.Bool(true), ScanOnPush: aws.Bool(false), Encryption: "AES256", KeepImages: -1, ExpireUntaggedDays: 14},
+		},
+		{
+			name: "kms key implies KMS",
+			in:   repositoryPolicy{KMSKey: "alias/ecr"},
+			want: repositoryPolicy{ImmutableTags: aws.Bool(false), ScanOnPush: aws.Bool(true), Encryption: "KMS", KMSKey: "alias/ecr", KeepImages: 30, ExpireUntaggedDays: 14},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.in.withDefaults(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withDefaults() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if got := (repositoryPolicy{}).withDefaults().tagMutability(); got != ecrtypes.ImageTagMutabilityMutable {
+		t.Errorf("default tag mutability = %s", got)
+	}
+	if got := cacheRepositoryPolicy(); aws.ToBool(got.ImmutableTags) || got.KeepImages != -1 {
+		t.Errorf("cacheRepositoryPolicy() = %s", got)
+	}
+}
+
+func TestRepositoryPolicyValidate(t *testing.T) {
+	tests := []struct {
+		p    repositoryPolicy
+		want string
+	}{
+		{repositoryPolicy{Encryption: "AES256"}, ""},
+		{repositoryPolicy{Encryption: "KMS_DSSE", KMSKey: "k"}, ""},
+		{repositoryPolicy{Encryption: "AES256", KMSKey: "k"}, "kmsKey requires encryption KMS"},
+		{repositoryPolicy{Encryption: "ROT13"}, "invalid encryption"},
+	}
+	for _, tt := range tests {
+		err := tt.p.validate()
+		if (tt.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("validate(%+v) = %v, want %q", tt.p, err, tt.want)
+		}
+	}
+}
+
+func TestLifecyclePolicy(t *testing.T) {
+	doc, err := repositoryPolicy{KeepImages: 5, ExpireUntaggedDays: 3}.lifecyclePolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policy struct {
+		Rules []struct {
+			RulePriority int
+			Selection    struct {
+				TagStatus     string
+				TagPrefixList []string
+				CountType     string
+				CountNumber   int
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(doc), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 2 {
+		t.Fatalf("rules = %+v", policy.Rules)
+	}
+	untagged, deploys := policy.Rules[0], policy.Rules[1]
+	if untagged.RulePriority != 1 || untagged.Selection.TagStatus != "untagged" || untagged.Selection.CountNumber != 3 {
+		t.Errorf("untagged rule = %+v", untagged)
+	}
+	if deploys.RulePriority != 2 || !reflect.DeepEqual(deploys.Selection.TagPrefixList, []string{deployTagPrefix}) ||
+		deploys.Selection.CountType != "imageCountMoreThan" || deploys.Selection.CountNumber != 5 {
+		t.Errorf("deploy rule = %+v", deploys)
+	}
+
+	if doc, err := (repositoryPolicy{KeepImages: -1, ExpireUntaggedDays: -1}).lifecyclePolicy(); err != nil || doc != "" {
+		t.Errorf("lifecyclePolicy() with both rules off = %q, %v", doc, err)
+	}
+}
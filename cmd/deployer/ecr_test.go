@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// fakeECR implements the ECR calls the tests exercise; the embedded nil
+// interface panics on anything else.
+type fakeECR struct {
+	ecrAPI
+	tokenCalls int
+	expiresIn  time.Duration
+	exists     bool
+	createErr  error
+	created    []string
+	lifecycles []string
+}
+
+func (f *fakeECR) GetAuthorizationToken(ctx context.Context, in *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.tokenCalls++
+	token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:password-%d", f.tokenCalls)))
+	expires := time.Now().Add(f.expiresIn)
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []ecrtypes.AuthorizationData{{
+		AuthorizationToken: aws.String(token),
+		ExpiresAt:          &expires,
+	}}}, nil
+}
+
+func (f *fakeECR) DescribeRepositories(ctx context.Context, in *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	if !f.exists {
+		return nil, &ecrtypes.RepositoryNotFoundException{}
+	}
+	return &ecr.DescribeRepositoriesOutput{}, nil
+}
+
+func (f *fakeECR) CreateRepository(ctx context.Context, in *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	f.created = append(f.created, aws.ToString(in.RepositoryName))
+	return &ecr.CreateRepositoryOutput{}, nil
+}
+
+func (f *fakeECR) PutLifecyclePolicy(ctx context.Context, in *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error) {
+	f.lifecycles = append(f.lifecycles, aws.ToString(in.RepositoryName))
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+type fakeSTS struct {
+	account string
+	err     error
+	calls   int
+}
+
+func (f *fakeSTS) GetCallerIdentity(ctx context.Context, in *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String(f.account)}, nil
+}
+
+// useFakeAWS replaces the process-wide AWS session for one test.
+func useFakeAWS(t *testing.T, e *fakeECR, s *fakeSTS) {
+	t.Helper()
+	prev := awsClients
+	awsClients = &awsSession{
+		cfg:    &aws.Config{},
+		newECR: func(aws.Config, string) ecrAPI { return e },
+		newSTS: func(aws.Config) stsAPI { return s },
+	}
+	t.Cleanup(func() { awsClients = prev })
+}
+
+func TestECRLoginPasswordCache(t *testing.T) {
+	e := &fakeECR{expiresIn: 12 * time.Hour}
+	useFakeAWS(t, e, nil)
+
+	for i := 0; i < 3; i++ {
+		got, err := ecrLoginPassword("us-east-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "password-1" {
+			t.Errorf("password = %q, want the first token", got)
+		}
+	}
+	if e.tokenCalls != 1 {
+		t.Errorf("GetAuthorizationToken called %d times, want 1", e.tokenCalls)
+	}
+
+	// Tokens are per region
+	if _, err := ecrLoginPassword("eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if e.tokenCalls != 2 {
+		t.Errorf("GetAuthorizationToken called %d times, want 2", e.tokenCalls)
+	}
+}
+
+func TestECRLoginPasswordRefreshesBeforeExpiry(t *testing.T) {
+	// Inside the refresh margin the cached token is already stale
+	e := &fakeECR{expiresIn: ecrTokenRefreshMargin - time.Minute}
+	useFakeAWS(t, e, nil)
+
+	first, err := ecrLoginPassword("us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ecrLoginPassword("us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.tokenCalls != 2 || string(first) == string(second) {
+		t.Errorf("tokens %q, %q after %d calls, want a refresh", first, second, e.tokenCalls)
+	}
+
+	// ecrKeychain hands out the same cached password
+	reg, _ := name.NewRegistry("123456789012.dkr.ecr.us-east-1.amazonaws.com")
+	auth, err := ecrKeychain{}.Resolve(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if basic, ok := auth.(*authn.Basic); !ok || basic.Username != "AWS" {
+		t.Errorf("Resolve() = %#v", auth)
+	}
+	other, _ := name.NewRegistry("ghcr.io")
+	if auth, _ := (ecrKeychain{}).Resolve(other); auth != authn.Anonymous {
+		t.Errorf("Resolve(ghcr.io) = %#v, want anonymous", auth)
+	}
+}
+
+func TestECRAccountID(t *testing.T) {
+	tests := []struct {
+		name       string
+		sts        *fakeSTS
+		accountEnv string
+		ecrURL     string
+		want       string
+		wantErr    bool
+	}{
+		{name: "caller identity", sts: &fakeSTS{account: "111111111111"}, accountEnv: "222222222222", want: "111111111111"},
+		{name: "AWS_ACCOUNT_ID", sts: &fakeSTS{err: errors.New("no credentials")}, accountEnv: "222222222222", ecrURL: "333333333333.dkr.ecr.eu-west-1.amazonaws.com", want: "222222222222"},
+		{name: "ECR_URL", sts: &fakeSTS{err: errors.New("no credentials")}, ecrURL: "https://333333333333.dkr.ecr.eu-west-1.amazonaws.com/apps", want: "333333333333"},
+		{name: "unknown", sts: &fakeSTS{err: errors.New("no credentials")}, ecrURL: "https://registry.example.com", want: ""},
+		{name: "empty identity", sts: &fakeSTS{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_ACCOUNT_ID", tt.accountEnv)
+			t.Setenv("ECR_URL", tt.ecrURL)
+			useFakeAWS(t, nil, tt.sts)
+			got, err := ecrAccountID()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ecrAccountID() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ecrAccountID() = %q, %v, want %q", got, err, tt.want)
+			}
+			// The answer is cached for the process
+			if _, err := ecrAccountID(); err != nil || tt.sts.calls != 1 {
+				t.Errorf("STS called %d times, want 1", tt.sts.calls)
+			}
+		})
+	}
+}
+
+func TestAWSRegion(t *testing.T) {
+	useFakeAWS(t, nil, nil)
+	awsClients.cfg.Region = "ap-south-1"
+	tests := []struct {
+		name, region, defaultRegion, ecrURL, want string
+	}{
+		{"AWS_REGION", "eu-central-1", "us-west-2", "https://1.dkr.ecr.eu-west-1.amazonaws.com", "eu-central-1"},
+		{"AWS_DEFAULT_REGION", "", "us-west-2", "https://1.dkr.ecr.eu-west-1.amazonaws.com", "us-west-2"},
+		{"ECR_URL", "", "", "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com/apps", "eu-west-1"},
+		{"profile", "", "", "", "ap-south-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", tt.region)
+			t.Setenv("AWS_DEFAULT_REGION", tt.defaultRegion)
+			t.Setenv("ECR_URL", tt.ecrURL)
+			if got := awsRegion(); got != tt.want {
+				t.Errorf("awsRegion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	awsClients.cfg.Region = ""
+	if got := awsRegion(); got != "us-east-1" {
+		t.Errorf("awsRegion() = %q, want us-east-1", got)
+	}
+}
+
+func TestEnsureECRRepository(t *testing.T) {
+	policy := repositoryPolicy{}.withDefaults()
+
+	e := &fakeECR{}
+	useFakeAWS(t, e, nil)
+	if err := ensureECRRepository("apps/web", "us-east-1", policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.created) != 1 || len(e.lifecycles) != 1 {
+		t.Errorf("created %v with lifecycle %v, want one of each", e.created, e.lifecycles)
+	}
+	// Known repositories aren't checked again
+	if err := ensureECRRepository("apps/web", "us-east-1", policy); err != nil || len(e.created) != 1 {
+		t.Errorf("second call: err %v, created %v", err, e.created)
+	}
+
+	// A repository created concurrently is fine
+	e = &fakeECR{createErr: &ecrtypes.RepositoryAlreadyExistsException{}}
+	useFakeAWS(t, e, nil)
+	if err := ensureECRRepository("apps/api", "us-east-1", policy); err != nil {
+		t.Errorf("concurrent create: %v", err)
+	}
+
+	e = &fakeECR{createErr: errors.New("AccessDenied")}
+	useFakeAWS(t, e, nil)
+	if err := ensureECRRepository("apps/api", "us-east-1", policy); err == nil {
+		t.Error("create failure: no error")
+	}
+
+	e = &fakeECR{exists: true}
+	useFakeAWS(t, e, nil)
+	if err := ensureECRRepository("apps/api", "us-east-1", policy); err != nil || len(e.created) != 0 {
+		t.Errorf("existing repository: err %v, created %v", err, e.created)
+	}
+}
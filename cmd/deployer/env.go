@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The pod template annotation that changes with the ConfigMap's values,
+// so that a change rolls out a new revision.
+const configHashAnnotation = "flow.ai/config-hash"
+
+var envKeyRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envSources is what a service loads with envFrom. Later sources win:
+// the ConfigMap, then attachments, then <app>-secrets; the service's own
+// env (deploy --env, flow.yaml) overrides them all.
+type envSources struct {
+	ConfigMap  string
+	ConfigHash string
+	Secrets    []string
+}
+
+func envConfigMapName(app string) string {
+	return app + "-env"
+}
+
+// loadEnvSources finds app's ConfigMap, attachments and secrets.
+func loadEnvSources(ctx context.Context, app, namespace string) (envSources, error) {
+	var s envSources
+	client, ns, err := getClient(namespace)
+	if err != nil {
+		return s, err
+	}
+	data := map[string]string{}
+	cm, err := client.CoreV1().ConfigMaps(ns).Get(ctx, envConfigMapName(app), metav1.GetOptions{})
+	if err == nil {
+		s.ConfigMap, data = cm.Name, cm.Data
+	} else if !errors.IsNotFound(err) {
+		return s, err
+	}
+	s.ConfigHash = configHash(data)
+
+	found, err := listAttachments(ctx, client, ns, app)
+	if err != nil {
+		return s, fmt.Errorf("failed to list attachments: %v", err)
+	}
+	for _, a := range found {
+		s.Secrets = append(s.Secrets, a.Secret.Name)
+	}
+	_, err = client.CoreV1().Secrets(ns).Get(ctx, app+"-secrets", metav1.GetOptions{})
+	if err == nil {
+		s.Secrets = append(s.Secrets, app+"-secrets")
+	} else if !errors.IsNotFound(err) {
+		return s, err
+	}
+	return s, nil
+}
+
+// refs returns the envFrom list, leaving out the Secret except.
+func (s envSources) refs(except string) []corev1.EnvFromSource {
+	refs := []corev1.EnvFromSource{}
+	if s.ConfigMap != "" {
+		refs = append(refs, corev1.EnvFromSource{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: s.ConfigMap}}})
+	}
+	for _, n := range s.Secrets {
+		if n != except {
+			refs = append(refs, corev1.EnvFromSource{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: n}}})
+		}
+	}
+	return refs
+}
+
+// configHash is a short digest of the ConfigMap's data.
+func configHash(data map[string]string) string {
+	h := sha256.New()
+	for _, k := range sortedKeys(data) {
+		// Quoted, so a value containing "\nK=V" can't pass for another key
+		fmt.Fprintf(h, "%q=%q\n", k, data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// syncServiceEnvFrom points the Knative Service's envFrom at the app's
+// current ConfigMap and Secrets, leaving out the Secret except, and
+// records the ConfigMap hash. Either change rolls out a new revision; a
+// service that isn't deployed yet picks them up on deploy.
+func syncServiceEnvFrom(ctx context.Context, app, namespace, kubecontext, except string) error {
+	if namespace == "" {
+		namespace = "default"
+	}
+	sources, err := loadEnvSources(ctx, app, namespace)
+	if err != nil {
+		return err
+	}
+	if kubectlCmd(ctx, kubecontext, namespace, "get", "ksvc", app, "-o", "name").Run() != nil {
+		fmt.Printf("Service %s is not deployed; it will load its env on deploy\n", app)
+		return nil
+	}
+	patch, err := json.Marshal([]map[string]interface{}{
+		{"op": "add", "path": "/spec/template/spec/containers/0/envFrom", "value": sources.refs(except)},
+		{"op": "add", "path": "/spec/template/metadata/annotations/" + strings.ReplaceAll(configHashAnnotation, "/", "~1"), "value": sources.ConfigHash},
+	})
+	if err != nil {
+		return err
+	}
+	c := kubectlCmd(ctx, kubecontext, namespace, "patch", "ksvc", app, "--type", "json", "-p", string(patch))
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("failed to update env of service %s: %v", app, err)
+	}
+	return nil
+}
+
+// parseDotEnv reads a .env file: KEY=VALUE lines, optionally prefixed
+// with export, with # comments and single- or double-quoted values. Only
+// a " #" comment may follow a closing quote.
+func parseDotEnv(r io.Reader) (map[string]string, error) {
+	out := map[string]string{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || !envKeyRE.MatchString(k) {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		v = strings.TrimSpace(v)
+		switch {
+		case strings.HasPrefix(v, `"`):
+			var b strings.Builder
+			end := -1
+			for i := 1; i < len(v) && end < 0; i++ {
+				switch c := v[i]; {
+				case c == '"':
+					end = i
+				case c == '\\' && i+1 < len(v):
+					i++
+					switch v[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(v[i])
+					}
+				default:
+					b.WriteByte(c)
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated quote", n)
+			}
+			if !onlyComment(v[end+1:]) {
+				return nil, fmt.Errorf("line %d: unexpected text after the closing quote", n)
+			}
+			v = b.String()
+		case strings.HasPrefix(v, "'"):
+			end := strings.Index(v[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated quote", n)
+			}
+			if !onlyComment(v[end+2:]) {
+				return nil, fmt.Errorf("line %d: unexpected text after the closing quote", n)
+			}
+			v = v[1 : end+1]
+		default:
+			if i := strings.Index(v, " #"); i >= 0 {
+				v = strings.TrimSpace(v[:i])
+			}
+		}
+		out[k] = v
+	}
+	return out, sc.Err()
+}
+
+// onlyComment reports whether rest, the text after a closing quote, is
+// empty or a comment set off by whitespace.
+func onlyComment(rest string) bool {
+	trimmed := strings.TrimLeft(rest, " \t")
+	return trimmed == "" || (len(trimmed) < len(rest) && trimmed[0] == '#')
+}
+
+// envTarget is the service an env command works on.
+type envTarget struct {
+	name, namespace, kubecontext string
+}
+
+func (t *envTarget) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&t.name, "name", "", "App name")
+	cmd.Flags().StringVar(&t.namespace, "namespace", "default", "Namespace")
+	cmd.Flags().StringVar(&t.kubecontext, "kubecontext", "", "kubectl context to use")
+}
+
+// update applies u to the ConfigMap and, if anything changed, rolls the
+// service onto the new values.
+func (t *envTarget) update(ctx context.Context, u keyUpdate) error {
+	if t.name == "" {
+		return fmt.Errorf("name required")
+	}
+	client, ns, err := getClient(t.namespace)
+	if err != nil {
+		return err
+	}
+	u.Labels = map[string]string{attachmentAppLabel: t.name, managedByLabel: managedByFlow}
+	change, err := upsertConfigMap(ctx, client, ns, envConfigMapName(t.name), u)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", envConfigMapName(t.name), change)
+	if len(change.Set) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+	return syncServiceEnvFrom(ctx, t.name, ns, t.kubecontext, "")
+}
+
+func newEnvCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: "Manage a service's runtime configuration",
+		Long: `Manage non-secret runtime configuration, kept in the ConfigMap <name>-env and
+loaded by the service with envFrom. It survives deploys; changing a value
+rolls out a new revision.
+
+Values set with deploy --env or in flow.yaml take precedence, then
+<name>-secrets and attachments, then this ConfigMap.`,
+	}
+	cmd.AddCommand(newEnvSetCmd(), newEnvUnsetCmd(), newEnvImportCmd(), newEnvListCmd())
+	return cmd
+}
+
+func newEnvSetCmd() *cobra.Command {
+	var target envTarget
+	cmd := &cobra.Command{
+		Use:   "set KEY=VALUE...",
+		Short: "Set configuration values",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			set := map[string]string{}
+			for _, a := range args {
+				k, v, ok := strings.Cut(a, "=")
+				if !ok || !envKeyRE.MatchString(k) {
+					return fmt.Errorf("invalid %q (want KEY=VALUE)", a)
+				}
+				set[k] = v
+			}
+			return target.update(cmd.Context(), keyUpdate{Set: set})
+		},
+	}
+	target.addFlags(cmd)
+	return cmd
+}
+
+func newEnvUnsetCmd() *cobra.Command {
+	var target envTarget
+	cmd := &cobra.Command{
+		Use:   "unset KEY...",
+		Short: "Remove configuration values",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return target.update(cmd.Context(), keyUpdate{Unset: args})
+		},
+	}
+	target.addFlags(cmd)
+	return cmd
+}
+
+func newEnvImportCmd() *cobra.Command {
+	var (
+		target  envTarget
+		replace bool
+	)
+	cmd := &cobra.Command{
+		Use:   "import FILE",
+		Short: "Set configuration values from a .env file (- for stdin)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			set, err := parseDotEnv(r)
+			if err != nil {
+				return fmt.Errorf("%s: %v", args[0], err)
+			}
+			return target.update(cmd.Context(), keyUpdate{Set: set, Replace: replace})
+		},
+	}
+	target.addFlags(cmd)
+	cmd.Flags().BoolVar(&replace, "replace", false, "Remove values not in the file")
+	return cmd
+}
+
+// envEntry is one variable as the service sees it.
+type envEntry struct {
+	value    string
+	source   string
+	secret   bool
+	shadowed []string
+}
+
+func newEnvListCmd() *cobra.Command {
+	var target envTarget
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the service's environment and where each value comes from",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if target.name == "" {
+				return fmt.Errorf("name required")
+			}
+			ctx := cmd.Context()
+			client, ns, err := getClient(target.namespace)
+			if err != nil {
+				return err
+			}
+
+			entries := map[string]*envEntry{}
+			add := func(k, v, source string, secret bool) {
+				if e, ok := entries[k]; ok {
+					e.shadowed = append(e.shadowed, e.source)
+					e.value, e.source, e.secret = v, source, secret
+					return
+				}
+				entries[k] = &envEntry{value: v, source: source, secret: secret}
+			}
+			// In precedence order, lowest first
+			if cm, err := client.CoreV1().ConfigMaps(ns).Get(ctx, envConfigMapName(target.name), metav1.GetOptions{}); err == nil {
+				for k, v := range cm.Data {
+					add(k, v, "configmap "+cm.Name, false)
+				}
+			} else if !errors.IsNotFound(err) {
+				return err
+			}
+			found, err := listAttachments(ctx, client, ns, target.name)
+			if err != nil {
+				return err
+			}
+			for _, a := range found {
+				for k := range a.Secret.Data {
+					add(k, "", "attachment "+a.Type.Name+" ("+a.Secret.Name+")", true)
+				}
+			}
+			if sec, err := client.CoreV1().Secrets(ns).Get(ctx, target.name+"-secrets", metav1.GetOptions{}); err == nil {
+				for k := range sec.Data {
+					add(k, "", "secret "+sec.Name, true)
+				}
+			} else if !errors.IsNotFound(err) {
+				return err
+			}
+			for _, e := range serviceEnv(ctx, target.name, ns, target.kubecontext) {
+				if e.ValueFrom == nil {
+					add(e.Name, e.Value, "service env (deploy --env/flow.yaml)", false)
+				}
+			}
+
+			if len(entries) == 0 {
+				fmt.Printf("No environment configured for %s\n", target.name)
+				return nil
+			}
+			keys := make([]string, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+			for _, k := range keys {
+				e := entries[k]
+				value, source := e.value, e.source
+				if e.secret {
+					value = "(hidden)"
+				}
+				if len(e.shadowed) > 0 {
+					source += ", overrides " + strings.Join(e.shadowed, ", ")
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", k, value, source)
+			}
+			return w.Flush()
+		},
+	}
+	target.addFlags(cmd)
+	return cmd
+}
+
+// serviceEnv returns the env set directly on the deployed service, or
+// nothing if it isn't deployed.
+func serviceEnv(ctx context.Context, app, ns, kubecontext string) []corev1.EnvVar {
+	out, err := kubectlCmd(ctx, kubecontext, ns, "get", "ksvc", app, "-o", "json").Output()
+	if err != nil {
+		return nil
+	}
+	var ksvc struct {
+		Spec struct {
+			Template struct {
+				Spec corev1.PodSpec `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if json.Unmarshal(out, &ksvc) != nil || len(ksvc.Spec.Template.Spec.Containers) == 0 {
+		return nil
+	}
+	return ksvc.Spec.Template.Spec.Containers[0].Env
+}
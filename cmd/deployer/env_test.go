@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDotEnv(t *testing.T) {
+	in := `# comment
+PLAIN=value
+export EXPORTED=1
+  export   SPACED = padded value  
+URL=https://example.com/#anchor
+COMMENTED=value # trailing comment
+EMPTY=
+DOUBLE="a \"quoted\" value\nwith\tescapes"
+SINGLE='no $escapes \n here'
+DQ_COMMENT="x" # note
+SQ_COMMENT='y'	# tab before the comment
+HASH_IN_QUOTES="a # b"
+EQUALS=a=b=c
+`
+	got, err := parseDotEnv(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"PLAIN":          "value",
+		"EXPORTED":       "1",
+		"SPACED":         "padded value",
+		"URL":            "https://example.com/#anchor",
+		"COMMENTED":      "value",
+		"EMPTY":          "",
+		"DOUBLE":         "a \"quoted\" value\nwith\tescapes",
+		"SINGLE":         `no $escapes \n here`,
+		"DQ_COMMENT":     "x",
+		"SQ_COMMENT":     "y",
+		"HASH_IN_QUOTES": "a # b",
+		"EQUALS":         "a=b=c",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDotEnv() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseDotEnvErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"NOVALUE", "line 1: expected KEY=VALUE"},
+		{"OK=1\n1BAD=x", "line 2: expected KEY=VALUE"},
+		{"export =x", "expected KEY=VALUE"},
+		{`A="open`, "unterminated quote"},
+		{`A='open`, "unterminated quote"},
+		{`B="x" trailing`, "unexpected text after the closing quote"},
+		{`B='x'trailing`, "unexpected text after the closing quote"},
+		{`B="x"# no space`, "unexpected text after the closing quote"},
+	}
+	for _, tt := range tests {
+		_, err := parseDotEnv(strings.NewReader(tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseDotEnv(%q) err = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	a := configHash(map[string]string{"A": "1", "B": "2"})
+	if len(a) != 16 {
+		t.Errorf("len(configHash()) = %d, want 16", len(a))
+	}
+	if b := configHash(map[string]string{"B": "2", "A": "1"}); a != b {
+		t.Errorf("hash depends on insertion order: %s != %s", a, b)
+	}
+	for name, data := range map[string]map[string]string{
+		"changed value":       {"A": "1", "B": "3"},
+		"extra key":           {"A": "1", "B": "2", "C": ""},
+		"value spanning keys": {"A": "1\nB=2"},
+	} {
+		if configHash(data) == a {
+			t.Errorf("%s: hash collides with the original", name)
+		}
+	}
+	if configHash(nil) != configHash(map[string]string{}) {
+		t.Error("nil and empty data hash differently")
+	}
+}
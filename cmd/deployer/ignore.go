@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Patterns excluded from every build context, even when the app ships its
+// own ignore file: repository metadata and credentials that must never end
+// up in a layer.
+var defaultIgnorePatterns = []string{
+	".git",
+	"**/.env",
+	"**/.env.*",
+	"**/.npmrc",
+	"**/.pypirc",
+	"**/.netrc",
+	"**/.aws",
+	"**/.ssh",
+	"**/*.pem",
+	"**/*.key",
+	"**/id_rsa*",
+	"**/id_ed25519*",
+}
+
+// Dependency directories the Dockerfile reinstalls. The native builder has
+// no install step, so it keeps them.
+var dependencyIgnorePatterns = []string{"**/node_modules"}
+
+// Ignore files in order of preference. The first one found wins.
+var ignoreFiles = []string{".flowignore", ".dockerignore", ".gitignore"}
+
+const defaultContextWarnBytes = 100 << 20
+
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreMatcher struct {
+	rules  []ignoreRule
+	source string
+}
+
+// loadIgnoreMatcher reads the app's ignore file (if any) on top of the
+// default exclusions. .flowignore and .dockerignore patterns are anchored at
+// the app root like Docker's; .gitignore patterns without a slash match at
+// any depth like git's. The credential patterns come after the app's rules,
+// so a "!" pattern can't bring those files back.
+func loadIgnoreMatcher(appPath string, keepDeps bool) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	if !keepDeps {
+		for _, p := range dependencyIgnorePatterns {
+			m.add(p, true)
+		}
+	}
+	for _, name := range ignoreFiles {
+		f, err := os.Open(filepath.Join(appPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		anchored := name != ".gitignore"
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			m.add(line, anchored)
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		m.source = name
+		break
+	}
+	for _, p := range defaultIgnorePatterns {
+		m.add(p, true)
+	}
+	return m, nil
+}
+
+func (m *ignoreMatcher) add(pattern string, anchored bool) {
+	r := ignoreRule{}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	} else if strings.Contains(pattern, "/") {
+		anchored = true
+	}
+	pattern = path.Clean(pattern)
+	if !anchored && !strings.HasPrefix(pattern, "**/") {
+		pattern = "**/" + pattern
+	}
+	r.pattern = pattern
+	m.rules = append(m.rules, r)
+}
+
+// Excluded reports whether rel (slash-separated, relative to the app root)
+// is excluded. The last matching rule wins, so "!" patterns can re-include
+// files excluded by earlier ones.
+func (m *ignoreMatcher) Excluded(rel string, isDir bool) bool {
+	excluded := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if globMatch(r.pattern, rel) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+// gitPatterns renders the rules in gitignore syntax, which is what pack
+// expects in a project descriptor's exclude list.
+func (m *ignoreMatcher) gitPatterns() []string {
+	var out []string
+	for _, r := range m.rules {
+		p := r.pattern
+		if strings.HasPrefix(p, "**/") {
+			p = strings.TrimPrefix(p, "**/")
+		} else {
+			p = "/" + p
+		}
+		if r.dirOnly {
+			p += "/"
+		}
+		if r.negate {
+			p = "!" + p
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// defaultExcludedFiles lists the files and directories under appPath that
+// only defaultIgnorePatterns exclude, without descending into excluded
+// directories.
+func defaultExcludedFiles(appPath string) ([]string, error) {
+	m := &ignoreMatcher{}
+	for _, p := range defaultIgnorePatterns {
+		m.add(p, true)
+	}
+	var out []string
+	err := filepath.WalkDir(appPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(appPath, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !m.Excluded(rel, d.IsDir()) {
+			return nil
+		}
+		out = append(out, rel)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build context %s: %v", appPath, err)
+	}
+	return out, nil
+}
+
+// globMatch matches a slash-separated path against a pattern where "**"
+// matches any number of path segments and other segments use path.Match.
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				return true
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+type buildContext struct {
+	Root    string
+	Files   []string
+	Size    int64
+	ignores *ignoreMatcher
+}
+
+// loadBuildContext walks appPath and returns the files that should be sent
+// to the builder, skipping excluded files and whole excluded directories.
+func loadBuildContext(appPath string, keepDeps bool) (*buildContext, error) {
+	m, err := loadIgnoreMatcher(appPath, keepDeps)
+	if err != nil {
+		return nil, err
+	}
+	bc := &buildContext{Root: appPath, ignores: m}
+	err = filepath.WalkDir(appPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(appPath, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if m.Excluded(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		bc.Files = append(bc.Files, rel)
+		bc.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build context %s: %v", appPath, err)
+	}
+	return bc, nil
+}
+
+// warnIfLarge prints a warning when the context is bigger than the
+// threshold (FLOW_CONTEXT_WARN_MB, default 100MB).
+func (bc *buildContext) warnIfLarge() {
+	limit := int64(defaultContextWarnBytes)
+	if v := os.Getenv("FLOW_CONTEXT_WARN_MB"); v != "" {
+		if mb, err := strconv.ParseInt(v, 10, 64); err == nil && mb > 0 {
+			limit = mb << 20
+		}
+	}
+	if bc.Size <= limit {
+		return
+	}
+	hint := "add a .flowignore"
+	if bc.ignores.source != "" {
+		hint = "review " + bc.ignores.source
+	}
+	fmt.Printf("⚠️  Build context is %.1fMB (%d files), above the %dMB warning threshold; %s to exclude large files.\n",
+		float64(bc.Size)/(1<<20), len(bc.Files), limit>>20, hint)
+}
+
+// writeTar streams the context as a tar archive with every entry placed
+// under prefix ("" for the archive root). Extra entries (such as a generated
+// Dockerfile) are added next to the context files.
+func (bc *buildContext) writeTar(w io.Writer, prefix string, extra map[string][]byte) error {
+	tw := tar.NewWriter(w)
+	dirs := map[string]bool{}
+	if prefix != "" {
+		dirs[prefix] = true
+		if err := tw.WriteHeader(&tar.Header{Name: prefix + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+			return err
+		}
+	}
+	for _, rel := range bc.Files {
+		if err := bc.writeParents(tw, prefix, rel, dirs); err != nil {
+			return err
+		}
+		if err := bc.writeFile(tw, prefix, rel); err != nil {
+			return err
+		}
+	}
+	for name, data := range extra {
+		hdr := &tar.Header{Name: path.Join(prefix, name), Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (bc *buildContext) writeParents(tw *tar.Writer, prefix, rel string, seen map[string]bool) error {
+	dir := path.Dir(rel)
+	if dir == "." || seen[path.Join(prefix, dir)] {
+		return nil
+	}
+	if err := bc.writeParents(tw, prefix, dir, seen); err != nil {
+		return err
+	}
+	seen[path.Join(prefix, dir)] = true
+	info, err := os.Stat(filepath.Join(bc.Root, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = path.Join(prefix, dir) + "/"
+	return tw.WriteHeader(hdr)
+}
+
+func (bc *buildContext) writeFile(tw *tar.Writer, prefix, rel string) error {
+	full := filepath.Join(bc.Root, filepath.FromSlash(rel))
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(full); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = path.Join(prefix, rel)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// packDescriptorArgs returns the pack flags that apply the same exclusions
+// to a buildpacks build and warns about a large context. Apps with their
+// own project.toml keep control of their excludes; pack then only applies
+// that file's, so any credentials the defaults would have excluded are
+// listed in a warning.
+func packDescriptorArgs(appPath string) ([]string, func(), error) {
+	noop := func() {}
+	bc, err := loadBuildContext(appPath, false)
+	if err != nil {
+		return nil, noop, err
+	}
+	bc.warnIfLarge()
+	if _, err := os.Stat(filepath.Join(appPath, "project.toml")); err == nil {
+		files, err := defaultExcludedFiles(appPath)
+		if err != nil {
+			return nil, noop, err
+		}
+		if len(files) > 0 {
+			const shown = 10
+			more := ""
+			if len(files) > shown {
+				files, more = files[:shown], fmt.Sprintf(" and %d more", len(files)-shown)
+			}
+			fmt.Printf("⚠️  project.toml replaces flow's default exclusions, so pack will send %s%s; add them to its [io.buildpacks] exclude list.\n",
+				strings.Join(files, ", "), more)
+		}
+		return nil, noop, nil
+	}
+	m := bc.ignores
+	f, err := os.CreateTemp("", "flow-project-*.toml")
+	if err != nil {
+		return nil, noop, err
+	}
+	var quoted []string
+	for _, p := range m.gitPatterns() {
+		quoted = append(quoted, strconv.Quote(p))
+	}
+	fmt.Fprintf(f, "[_]\nschema-version = \"0.2\"\n\n[io.buildpacks]\nexclude = [%s]\n", strings.Join(quoted, ", "))
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, noop, err
+	}
+	return []string{"--descriptor", f.Name()}, func() { os.Remove(f.Name()) }, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTree creates files (slash-separated paths) under a temp dir.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**/.env", ".env", true},
+		{"**/.env", "config/.env", true},
+		{"**/.env", ".envrc", false},
+		{"**/*.pem", "certs/deep/server.pem", true},
+		{".git", ".git", true},
+		{".git", "sub/.git", false},
+		{"build/*.js", "build/app.js", true},
+		{"build/*.js", "build/sub/app.js", false},
+		{"docs/**", "docs/a/b.md", true},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreMatcherExcluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		keepDeps bool
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{name: "default credential", path: ".env", want: true},
+		{name: "nested credential", path: "config/prod.pem", want: true},
+		{name: "git metadata", path: ".git", isDir: true, want: true},
+		{name: "source file", path: "main.go", want: false},
+		{name: "dependencies", path: "node_modules", isDir: true, want: true},
+		{name: "dependencies kept", keepDeps: true, path: "node_modules", isDir: true, want: false},
+		{
+			name:  "flowignore anchored",
+			files: map[string]string{".flowignore": "tmp\n"},
+			path:  "sub/tmp", isDir: true, want: false,
+		},
+		{
+			name:  "gitignore matches at any depth",
+			files: map[string]string{".gitignore": "tmp\n"},
+			path:  "sub/tmp", isDir: true, want: true,
+		},
+		{
+			name:  "dir-only rule skips files",
+			files: map[string]string{".flowignore": "logs/\n"},
+			path:  "logs", want: false,
+		},
+		{
+			name:  "negation re-includes",
+			files: map[string]string{".flowignore": "*.md\n!README.md\n"},
+			path:  "README.md", want: false,
+		},
+		{
+			name:  "negation can't re-include .env",
+			files: map[string]string{".dockerignore": "!.env\n"},
+			path:  ".env", want: true,
+		},
+		{
+			name:  "negation can't re-include keys",
+			files: map[string]string{".flowignore": "!**/*.pem\n"},
+			path:  "certs/server.pem", want: true,
+		},
+		{
+			name:  "negation can re-include dependencies",
+			files: map[string]string{".flowignore": "!node_modules\n"},
+			path:  "node_modules", isDir: true, want: false,
+		},
+		{
+			name:  "flowignore preferred over gitignore",
+			files: map[string]string{".flowignore": "a.txt\n", ".gitignore": "b.txt\n"},
+			path:  "b.txt", want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := loadIgnoreMatcher(writeTree(t, tt.files), tt.keepDeps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Excluded(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("Excluded(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcherGitPatterns(t *testing.T) {
+	dir := writeTree(t, map[string]string{".flowignore": "/dist\n!.env\n"})
+	m, err := loadIgnoreMatcher(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.gitPatterns()
+	want := []string{"/dist", "!/.env", "/.git", ".env"}
+	if !reflect.DeepEqual(got[:4], want) {
+		t.Errorf("gitPatterns() = %v, want prefix %v", got, want)
+	}
+	// The credential defaults come last, so they win in gitignore order too
+	if last := got[len(got)-1]; last != "id_ed25519*" {
+		t.Errorf("last pattern = %q, want a credential default", last)
+	}
+}
+
+func TestLoadBuildContext(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		".flowignore":          "!.env\nlarge/\n",
+		".env":                 "SECRET=1",
+		"main.go":              "package main",
+		"pkg/util.go":          "package pkg",
+		"large/blob.bin":       "xxxx",
+		"node_modules/x/i.js":  "",
+		"certs/server.pem":     "key",
+		"config/.env.local":    "A=1",
+		"config/settings.json": "{}",
+	})
+	bc, err := loadBuildContext(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".flowignore", "config/settings.json", "main.go", "pkg/util.go"}
+	if !reflect.DeepEqual(bc.Files, want) {
+		t.Errorf("Files = %v, want %v", bc.Files, want)
+	}
+	var size int64
+	for _, f := range want {
+		info, _ := os.Stat(filepath.Join(dir, f))
+		size += info.Size()
+	}
+	if bc.Size != size {
+		t.Errorf("Size = %d, want %d", bc.Size, size)
+	}
+}
+
+func TestPackDescriptorArgs(t *testing.T) {
+	dir := writeTree(t, map[string]string{".flowignore": "tmp/\n", "app.py": ""})
+	args, cleanup, err := packDescriptorArgs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if len(args) != 2 || args[0] != "--descriptor" {
+		t.Fatalf("args = %v", args)
+	}
+	raw, err := os.ReadFile(args[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `"/tmp/"`) || !strings.Contains(string(raw), `".env"`) {
+		t.Errorf("descriptor misses excludes:\n%s", raw)
+	}
+
+	// An app's own project.toml is left alone
+	dir = writeTree(t, map[string]string{"project.toml": "", "app.py": ""})
+	args, cleanup, err = packDescriptorArgs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if args != nil {
+		t.Errorf("args = %v, want none with project.toml", args)
+	}
+}
+
+func TestDefaultExcludedFiles(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"project.toml":     "",
+		"app.py":           "",
+		".env":             "SECRET=1",
+		"config/tls.pem":   "",
+		".aws/credentials": "",
+		".aws/config":      "",
+		"docs/keys.md":     "",
+	})
+	got, err := defaultExcludedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Excluded directories are listed once, not file by file
+	if want := []string{".aws", ".env", "config/tls.pem"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("defaultExcludedFiles() = %v, want %v", got, want)
+	}
+}
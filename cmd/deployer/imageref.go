@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Grammar from the distribution reference spec.
+var (
+	pathComponentRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRE           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRE        = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// imageReference is a parsed image reference:
+//
+//	[registry/]repository[:tag][@digest]
+//
+// Registry is empty for names without one, which docker resolves to Docker
+// Hub or a local image. Docker Hub single-component names get the library/
+// prefix only when the registry is given explicitly.
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference splits ref into its parts. The first path component
+// is a registry when it contains "." or ":" or is "localhost", as docker
+// does it; nested repository paths (apps/team/api) are kept whole.
+func parseImageReference(ref string) (imageReference, error) {
+	var r imageReference
+	if ref == "" {
+		return r, fmt.Errorf("empty image reference")
+	}
+	rest := ref
+	if i := strings.Index(rest, "@"); i >= 0 {
+		rest, r.Digest = rest[:i], rest[i+1:]
+		if !digestRE.MatchString(r.Digest) {
+			return r, fmt.Errorf("invalid image reference %q: bad digest %q", ref, r.Digest)
+		}
+	}
+	// A tag follows the last ":" after the last "/"; earlier colons are ports
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		rest, r.Tag = rest[:i], rest[i+1:]
+		if !tagRE.MatchString(r.Tag) {
+			return r, fmt.Errorf("invalid image reference %q: bad tag %q", ref, r.Tag)
+		}
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		first := rest[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			r.Registry, rest = first, rest[i+1:]
+		}
+	}
+	if r.Registry == dockerHubIndex || r.Registry == "registry-1.docker.io" {
+		r.Registry = dockerHubHost
+	}
+	if r.Registry == dockerHubHost && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	if rest == "" {
+		return r, fmt.Errorf("invalid image reference %q: missing repository", ref)
+	}
+	for _, c := range strings.Split(rest, "/") {
+		if !pathComponentRE.MatchString(c) {
+			return r, fmt.Errorf("invalid image reference %q: bad repository path component %q", ref, c)
+		}
+	}
+	r.Repository = rest
+	return r, nil
+}
+
+// Name is the registry and repository, without tag or digest.
+func (r imageReference) Name() string {
+	if r.Registry == "" {
+		return r.Repository
+	}
+	return r.Registry + "/" + r.Repository
+}
+
+func (r imageReference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Canonical is the fully qualified form registry clients resolve ref to:
+// Docker Hub names get index.docker.io and library/, and a reference
+// without tag or digest gets :latest.
+func (r imageReference) Canonical() string {
+	if r.Registry == "" || r.Registry == dockerHubHost {
+		r.Registry = dockerHubIndex
+		if !strings.Contains(r.Repository, "/") {
+			r.Repository = "library/" + r.Repository
+		}
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = defaultImageTag
+	}
+	return r.String()
+}
+
+// WithTag returns the reference with tag and without a digest.
+func (r imageReference) WithTag(tag string) imageReference {
+	r.Tag, r.Digest = tag, ""
+	return r
+}
+
+// hasRegistry reports whether ref names a registry, i.e. can be pushed or
+// inspected remotely rather than only existing in the local daemon.
+func hasRegistry(ref string) bool {
+	r, err := parseImageReference(ref)
+	return err == nil && r.Registry != ""
+}
+
+// repositoryOf strips the tag and digest from ref.
+func repositoryOf(ref string) string {
+	r, err := parseImageReference(ref)
+	if err != nil {
+		return ref
+	}
+	return r.Name()
+}
+
+// parseECRHost splits <account>.dkr.ecr.<region>.amazonaws.com[.cn].
+func parseECRHost(host string) (account, region string, ok bool) {
+	parts := strings.Split(host, ".")
+	if len(parts) < 5 || parts[1] != "dkr" || !strings.HasPrefix(parts[2], "ecr") || parts[4] != "amazonaws" {
+		return "", "", false
+	}
+	return parts[0], parts[3], true
+}
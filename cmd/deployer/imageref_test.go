@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestParseImageReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	tests := []struct {
+		ref       string
+		want      imageReference
+		canonical string
+		// go-containerregistry doesn't treat a bare "localhost" as a
+		// registry; docker, and flow, do
+		notGGCR bool
+	}{
+		{
+			ref:       "123456789012.dkr.ecr.us-east-1.amazonaws.com/apps/team/api:v1.2",
+			want:      imageReference{Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com", Repository: "apps/team/api", Tag: "v1.2"},
+			canonical: "123456789012.dkr.ecr.us-east-1.amazonaws.com/apps/team/api:v1.2",
+		},
+		{
+			ref:       "nginx",
+			want:      imageReference{Repository: "nginx"},
+			canonical: "index.docker.io/library/nginx:latest",
+		},
+		{
+			ref:       "user/app",
+			want:      imageReference{Repository: "user/app"},
+			canonical: "index.docker.io/user/app:latest",
+		},
+		{
+			ref:       "docker.io/nginx:1.27",
+			want:      imageReference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.27"},
+			canonical: "index.docker.io/library/nginx:1.27",
+		},
+		{
+			ref:       "index.docker.io/user/app",
+			want:      imageReference{Registry: "docker.io", Repository: "user/app"},
+			canonical: "index.docker.io/user/app:latest",
+		},
+		{
+			ref:       "localhost:5000/a/b@" + digest,
+			want:      imageReference{Registry: "localhost:5000", Repository: "a/b", Digest: digest},
+			canonical: "localhost:5000/a/b@" + digest,
+		},
+		{
+			ref:       "ghcr.io/acme/web:v1@" + digest,
+			want:      imageReference{Registry: "ghcr.io", Repository: "acme/web", Tag: "v1", Digest: digest},
+			canonical: "ghcr.io/acme/web:v1@" + digest,
+		},
+		{
+			ref:       "localhost/app",
+			want:      imageReference{Registry: "localhost", Repository: "app"},
+			canonical: "localhost/app:latest",
+			notGGCR:   true,
+		},
+		{
+			ref:       "my_repo/sub-dir__x.y:TAG_1",
+			want:      imageReference{Repository: "my_repo/sub-dir__x.y", Tag: "TAG_1"},
+			canonical: "index.docker.io/my_repo/sub-dir__x.y:TAG_1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseImageReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseImageReference() = %+v, want %+v", got, tt.want)
+			}
+			if c := got.Canonical(); c != tt.canonical {
+				t.Errorf("Canonical() = %q, want %q", c, tt.canonical)
+			}
+			if tt.notGGCR {
+				return
+			}
+			// go-containerregistry resolves the same repository
+			r, err := name.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _, _ := strings.Cut(tt.canonical, "@"); !strings.HasPrefix(want, r.Context().Name()+":") && want != r.Context().Name() {
+				t.Errorf("name.ParseReference(%q) repository %q, want %q", tt.ref, r.Context().Name(), want)
+			}
+		})
+	}
+}
+
+func TestParseImageReferenceErrors(t *testing.T) {
+	tests := []struct {
+		ref, want string
+	}{
+		{"", "empty image reference"},
+		{"Upper/app", "bad repository path component"},
+		{"app:", "bad tag"},
+		{"app:-tag", "bad tag"},
+		{"app:" + strings.Repeat("t", 129), "bad tag"},
+		{"app@sha256:short", "bad digest"},
+		{"app@", "bad digest"},
+		{"localhost:5000/", "missing repository"},
+		{"registry.example.com/a//b", "bad repository path component"},
+		{"a/b--c_", "bad repository path component"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			_, err := parseImageReference(tt.ref)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseImageReference(%q) err = %v, want %q", tt.ref, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageReferenceHelpers(t *testing.T) {
+	r, err := parseImageReference("ghcr.io/acme/web:v1@sha256:" + strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.WithTag("v2").String(); got != "ghcr.io/acme/web:v2" {
+		t.Errorf("WithTag() = %q", got)
+	}
+	if got := repositoryOf("localhost:5000/web:v1"); got != "localhost:5000/web" {
+		t.Errorf("repositoryOf() = %q", got)
+	}
+	if hasRegistry("web:v1") || !hasRegistry("localhost:5000/web") || hasRegistry("Bad/Ref") {
+		t.Error("hasRegistry() mismatch")
+	}
+	tests := []struct {
+		host, account, region string
+		ok                    bool
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", "123456789012", "us-east-1", true},
+		{"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", "123456789012", "us-gov-west-1", true},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", "123456789012", "cn-north-1", true},
+		{"public.ecr.aws", "", "", false},
+		{"ghcr.io", "", "", false},
+	}
+	for _, tt := range tests {
+		account, region, ok := parseECRHost(tt.host)
+		if account != tt.account || region != tt.region || ok != tt.ok {
+			t.Errorf("parseECRHost(%q) = %q, %q, %v", tt.host, account, region, ok)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The local registry runs as a registry:2 container published on
+// localhost:5000. kind and k3d nodes are containers themselves, where
+// localhost is the node, so their container runtimes are pointed at the
+// registry container by name on the cluster's docker network instead.
+const (
+	localRegistryContainer = "flow-registry"
+	localRegistryPort      = "5000"
+	localRegistryImage     = "registry:2"
+)
+
+// localRegistryMirror is where cluster nodes reach the registry.
+var localRegistryMirror = "http://" + localRegistryContainer + ":" + localRegistryPort
+
+// localCluster identifies a kind or k3d cluster from its kubeconfig
+// context name (kind-<name>, k3d-<name>).
+type localCluster struct {
+	Tool string
+	Name string
+}
+
+func localClusterFor(kubecontext string) (localCluster, bool) {
+	for _, tool := range []string{"kind", "k3d"} {
+		if name := strings.TrimPrefix(kubecontext, tool+"-"); name != kubecontext && name != "" {
+			return localCluster{Tool: tool, Name: name}, true
+		}
+	}
+	return localCluster{}, false
+}
+
+// network is the docker network the cluster's nodes are attached to.
+func (c localCluster) network() string {
+	if c.Tool == "kind" {
+		return "kind"
+	}
+	return "k3d-" + c.Name
+}
+
+// nodes lists the cluster's node containers.
+func (c localCluster) nodes() ([]string, error) {
+	label := "io.x-k8s.kind.cluster=" + c.Name
+	if c.Tool == "k3d" {
+		label = "k3d.cluster=" + c.Name
+	}
+	out, err := exec.Command("docker", "ps", "--filter", "label="+label, "--format", "{{.Names}}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s nodes: %v", c.Tool, err)
+	}
+	nodes := strings.Fields(string(out))
+	if c.Tool == "k3d" {
+		// The load balancer and tools containers don't pull images
+		var servers []string
+		for _, n := range nodes {
+			if !strings.HasSuffix(n, "-serverlb") && !strings.HasSuffix(n, "-tools") {
+				servers = append(servers, n)
+			}
+		}
+		nodes = servers
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no running nodes found for %s cluster %q", c.Tool, c.Name)
+	}
+	return nodes, nil
+}
+
+// kindHostsToml points containerd on kind nodes at the registry container
+// for pulls of localhost:5000/... images.
+func kindHostsToml() string {
+	return fmt.Sprintf("[host.%q]\n  capabilities = [\"pull\", \"resolve\"]\n", localRegistryMirror)
+}
+
+// k3sRegistriesYaml does the same for k3s, which reads mirrors from
+// /etc/rancher/k3s/registries.yaml at startup.
+func k3sRegistriesYaml() string {
+	return fmt.Sprintf("mirrors:\n  %q:\n    endpoint:\n      - %s\n", defaultLocalHost, localRegistryMirror)
+}
+
+// localRegistryHostingConfigMap advertises the registry to cluster tooling
+// (KEP-1755), as kind's and k3d's own registry setups do.
+func localRegistryHostingConfigMap() string {
+	return fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: local-registry-hosting
+  namespace: kube-public
+data:
+  localRegistryHosting.v1: |
+    host: "%s"
+    help: "https://kind.sigs.k8s.io/docs/user/local-registry/"
+`, defaultLocalHost)
+}
+
+// ensureLocalRegistry starts the registry container if it isn't running.
+func ensureLocalRegistry() error {
+	out, err := exec.Command("docker", "inspect", "-f", "{{.State.Running}}", localRegistryContainer).Output()
+	switch {
+	case err != nil:
+		fmt.Printf("Starting local registry %s on %s...\n", localRegistryContainer, defaultLocalHost)
+		out, err := exec.Command("docker", "run", "-d", "--restart=always", "--name", localRegistryContainer,
+			"-p", "127.0.0.1:"+localRegistryPort+":5000", localRegistryImage).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to start local registry: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	case strings.TrimSpace(string(out)) != "true":
+		if out, err := exec.Command("docker", "start", localRegistryContainer).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to start local registry: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// setupLocalRegistry makes localhost:5000 images pullable from a kind or
+// k3d cluster: it runs the registry, attaches it to the cluster network
+// and maps localhost:5000 to it on every node. Other clusters are left
+// alone with a note, since their nodes can't see this machine's localhost.
+func setupLocalRegistry(ctx context.Context, kubecontext, host string) error {
+	if host != defaultLocalHost {
+		// A registry the user runs (e.g. k3d registry create) under a name
+		// the nodes already resolve
+		return nil
+	}
+	if err := ensureLocalRegistry(); err != nil {
+		return err
+	}
+	if kubecontext == "" {
+		out, err := exec.Command("kubectl", "config", "current-context").Output()
+		if err != nil {
+			return fmt.Errorf("failed to read the current kubectl context: %v", err)
+		}
+		kubecontext = strings.TrimSpace(string(out))
+	}
+	cluster, ok := localClusterFor(kubecontext)
+	if !ok {
+		fmt.Printf("Note: context %s is not a kind or k3d cluster; its nodes must be able to pull from %s themselves\n", kubecontext, defaultLocalHost)
+		return nil
+	}
+	nodes, err := cluster.nodes()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("docker", "network", "connect", cluster.network(), localRegistryContainer).CombinedOutput(); err != nil &&
+		!strings.Contains(string(out), "already exists") {
+		return fmt.Errorf("failed to connect %s to network %s: %v: %s", localRegistryContainer, cluster.network(), err, strings.TrimSpace(string(out)))
+	}
+
+	if cluster.Tool == "kind" {
+		err = configureKindNodes(nodes)
+	} else {
+		err = configureK3dNodes(nodes)
+	}
+	if err != nil {
+		return err
+	}
+
+	apply := exec.CommandContext(ctx, "kubectl", "--context", kubecontext, "apply", "-f", "-")
+	apply.Stdin = strings.NewReader(localRegistryHostingConfigMap())
+	if out, err := apply.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to publish local-registry-hosting: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func configureKindNodes(nodes []string) error {
+	dir := "/etc/containerd/certs.d/" + defaultLocalHost
+	for _, node := range nodes {
+		// containerd only reads certs.d when the cluster enables it
+		if exec.Command("docker", "exec", node, "grep", "-q", "config_path", "/etc/containerd/config.toml").Run() != nil {
+			return fmt.Errorf(`kind node %s doesn't read /etc/containerd/certs.d; recreate the cluster with
+containerdConfigPatches:
+- |-
+  [plugins."io.containerd.grpc.v1.cri".registry]
+    config_path = "/etc/containerd/certs.d"`, node)
+		}
+		if err := writeNodeFile(node, dir, dir+"/hosts.toml", kindHostsToml()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureK3dNodes writes registries.yaml and restarts nodes whose
+// mirrors changed, since k3s only reads it at startup.
+func configureK3dNodes(nodes []string) error {
+	const dir = "/etc/rancher/k3s"
+	want := k3sRegistriesYaml()
+	for _, node := range nodes {
+		current, _ := exec.Command("docker", "exec", node, "cat", dir+"/registries.yaml").Output()
+		if string(current) == want {
+			continue
+		}
+		if len(current) > 0 {
+			return fmt.Errorf("k3d node %s already has a %s/registries.yaml; add a mirror for %s pointing to %s to it", node, dir, defaultLocalHost, localRegistryMirror)
+		}
+		if err := writeNodeFile(node, dir, dir+"/registries.yaml", want); err != nil {
+			return err
+		}
+		fmt.Printf("Restarting k3d node %s to load the registry mirror...\n", node)
+		if out, err := exec.Command("docker", "restart", node).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restart %s: %v: %s", node, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func writeNodeFile(node, dir, path, content string) error {
+	c := exec.Command("docker", "exec", "-i", node, "sh", "-c", fmt.Sprintf("mkdir -p '%s' && cat > '%s'", dir, path))
+	c.Stdin = strings.NewReader(content)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write %s on %s: %v: %s", path, node, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func newRegistryLocalCmd() *cobra.Command {
+	var kubecontext string
+	cmd := &cobra.Command{
+		Use:   "local",
+		Short: "Run the local registry and make it pullable from a kind or k3d cluster",
+		Long: `Start a registry:2 container (` + localRegistryContainer + `) on ` + defaultLocalHost + `, attach it to
+the current kind or k3d cluster's docker network and point every node's
+container runtime at it for ` + defaultLocalHost + ` images. Deploys with
+--registry local do this automatically.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := setupLocalRegistry(cmd.Context(), kubecontext, defaultLocalHost); err != nil {
+				return err
+			}
+			fmt.Printf("Images pushed to %s can be pulled by the cluster\n", defaultLocalHost)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&kubecontext, "kubecontext", "", "kubectl context to use")
+	return cmd
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestLocalClusterFor(t *testing.T) {
+	tests := []struct {
+		context string
+		want    localCluster
+		ok      bool
+	}{
+		{"kind-kind", localCluster{Tool: "kind", Name: "kind"}, true},
+		{"kind-dev-cluster", localCluster{Tool: "kind", Name: "dev-cluster"}, true},
+		{"k3d-flow", localCluster{Tool: "k3d", Name: "flow"}, true},
+		{"kind-", localCluster{}, false},
+		{"arn:aws:eks:us-east-1:123456789012:cluster/prod", localCluster{}, false},
+		{"docker-desktop", localCluster{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := localClusterFor(tt.context)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("localClusterFor(%q) = %+v, %v, want %+v, %v", tt.context, got, ok, tt.want, tt.ok)
+		}
+	}
+	if n := (localCluster{Tool: "k3d", Name: "flow"}).network(); n != "k3d-flow" {
+		t.Errorf("k3d network = %q", n)
+	}
+	if n := (localCluster{Tool: "kind", Name: "dev"}).network(); n != "kind" {
+		t.Errorf("kind network = %q", n)
+	}
+}
+
+func TestLocalRegistryNodeConfig(t *testing.T) {
+	var registries struct {
+		Mirrors map[string]struct {
+			Endpoint []string `json:"endpoint"`
+		} `json:"mirrors"`
+	}
+	if err := yaml.UnmarshalStrict([]byte(k3sRegistriesYaml()), &registries); err != nil {
+		t.Fatal(err)
+	}
+	if got := registries.Mirrors["localhost:5000"].Endpoint; !reflect.DeepEqual(got, []string{"http://flow-registry:5000"}) {
+		t.Errorf("k3s mirror endpoints = %v", got)
+	}
+
+	if got := kindHostsToml(); !strings.HasPrefix(got, `[host."http://flow-registry:5000"]`) {
+		t.Errorf("hosts.toml = %q", got)
+	}
+
+	var cm struct {
+		Metadata struct{ Name, Namespace string }
+		Data     map[string]string
+	}
+	if err := yaml.Unmarshal([]byte(localRegistryHostingConfigMap()), &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Metadata.Namespace != "kube-public" || !strings.Contains(cm.Data["localRegistryHosting.v1"], `host: "localhost:5000"`) {
+		t.Errorf("ConfigMap = %+v", cm)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Manifest file names looked up in the app directory, in order.
+var manifestFiles = []string{"flow.yaml", "flow.yml"}
+
+// projectManifest is the optional flow.yaml checked in next to the app.
+// Flags always take precedence over values set here.
+type projectManifest struct {
+	Name     string         `json:"name,omitempty"`
+	Build    buildConfig    `json:"build,omitempty"`
+	Registry registryConfig `json:"registry,omitempty"`
+	Signing  signingConfig  `json:"signing,omitempty"`
+	Scan     scanConfig     `json:"scan,omitempty"`
+	// Migrate applies when the manifest directory is the only service.
+	Migrate  *migrationSpec `json:"migrate,omitempty"`
+	Services []serviceSpec  `json:"services,omitempty"`
+
+	path string
+	dir  string
+}
+
+// serviceSpec is one deployable service. In a monorepo each service lives
+// in its own subdirectory; its build section is layered over the
+// project-level one.
+type serviceSpec struct {
+	Name      string            `json:"name"`
+	Path      string            `json:"path,omitempty"`
+	Port      int               `json:"port,omitempty"`
+	CPU       string            `json:"cpu,omitempty"`
+	Memory    string            `json:"memory,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Build     buildConfig       `json:"build,omitempty"`
+	DependsOn []string          `json:"dependsOn,omitempty"`
+	Migrate   *migrationSpec    `json:"migrate,omitempty"`
+}
+
+// loadManifest reads flow.yaml from appPath. A missing manifest is not an
+// error; an empty manifest is returned instead.
+func loadManifest(appPath string) (*projectManifest, error) {
+	for _, name := range manifestFiles {
+		p := filepath.Join(appPath, name)
+		raw, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := &projectManifest{}
+		if err := yaml.UnmarshalStrict(raw, m); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", p, err)
+		}
+		m.path = p
+		m.dir = appPath
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", p, err)
+		}
+		return m, nil
+	}
+	return &projectManifest{dir: appPath}, nil
+}
+
+func (m *projectManifest) validate() error {
+	if err := m.Scan.validate(); err != nil {
+		return fmt.Errorf("scan: %v", err)
+	}
+	if m.Migrate != nil {
+		if len(m.Services) > 0 {
+			return fmt.Errorf("migrate: set it on each service instead")
+		}
+		if err := m.Migrate.validate(); err != nil {
+			return fmt.Errorf("migrate: %v", err)
+		}
+	}
+	seen := map[string]bool{}
+	for i, svc := range m.Services {
+		if svc.Name == "" {
+			return fmt.Errorf("services[%d]: name is required", i)
+		}
+		if seen[svc.Name] {
+			return fmt.Errorf("duplicate service %q", svc.Name)
+		}
+		seen[svc.Name] = true
+		if svc.Migrate != nil {
+			if err := svc.Migrate.validate(); err != nil {
+				return fmt.Errorf("service %q: migrate: %v", svc.Name, err)
+			}
+		}
+	}
+	for _, svc := range m.Services {
+		for _, dep := range svc.DependsOn {
+			if !seen[dep] {
+				return fmt.Errorf("service %q depends on unknown service %q", svc.Name, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// selectServices returns the services to deploy. Without declared services
+// the manifest directory itself is the one service, named after the
+// manifest or the directory.
+func (m *projectManifest) selectServices(names []string, all bool) ([]serviceSpec, error) {
+	if len(m.Services) == 0 {
+		if len(names) > 0 {
+			return nil, fmt.Errorf("no services declared in flow.yaml; run deploy without a service name")
+		}
+		name := m.Name
+		if name == "" {
+			var err error
+			if name, err = getProjectName(); err != nil {
+				return nil, fmt.Errorf("failed to detect project name: %v", err)
+			}
+		}
+		return []serviceSpec{{Name: name, Path: m.dir, Migrate: m.Migrate}}, nil
+	}
+
+	var out []serviceSpec
+	switch {
+	case all:
+		out = append(out, m.Services...)
+	case len(names) > 0:
+		for _, n := range names {
+			svc, ok := m.service(n)
+			if !ok {
+				return nil, fmt.Errorf("unknown service %q (declared: %s)", n, strings.Join(m.serviceNames(), ", "))
+			}
+			out = append(out, svc)
+		}
+	default:
+		return nil, fmt.Errorf("flow.yaml declares %d services (%s); name the ones to deploy or pass --all", len(m.Services), strings.Join(m.serviceNames(), ", "))
+	}
+	for i := range out {
+		if out[i].Path == "" {
+			out[i].Path = out[i].Name
+		}
+		out[i].Path = filepath.Join(m.dir, out[i].Path)
+	}
+	return out, nil
+}
+
+func (m *projectManifest) service(name string) (serviceSpec, bool) {
+	for _, svc := range m.Services {
+		if svc.Name == name {
+			return svc, true
+		}
+	}
+	return serviceSpec{}, false
+}
+
+func (m *projectManifest) serviceNames() []string {
+	names := make([]string, len(m.Services))
+	for i, svc := range m.Services {
+		names[i] = svc.Name
+	}
+	return names
+}
+
+// deployWaves orders services so each wave only depends on earlier waves;
+// services within a wave are independent and can be deployed in parallel.
+// Dependencies outside the selection are assumed to be deployed already.
+func deployWaves(services []serviceSpec) ([][]serviceSpec, error) {
+	selected := map[string]bool{}
+	for _, svc := range services {
+		selected[svc.Name] = true
+	}
+	done := map[string]bool{}
+	remaining := services
+	var waves [][]serviceSpec
+	for len(remaining) > 0 {
+		var wave, next []serviceSpec
+		for _, svc := range remaining {
+			ready := true
+			for _, dep := range svc.DependsOn {
+				if selected[dep] && !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, svc)
+			} else {
+				next = append(next, svc)
+			}
+		}
+		if len(wave) == 0 {
+			var names []string
+			for _, svc := range next {
+				names = append(names, svc.Name)
+			}
+			return nil, fmt.Errorf("dependency cycle between services: %s", strings.Join(names, ", "))
+		}
+		for _, svc := range wave {
+			done[svc.Name] = true
+		}
+		waves = append(waves, wave)
+		remaining = next
+	}
+	return waves, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeployWaves(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []serviceSpec
+		want     [][]string
+		err      string
+	}{
+		{
+			name:     "independent",
+			services: []serviceSpec{{Name: "a"}, {Name: "b"}},
+			want:     [][]string{{"a", "b"}},
+		},
+		{
+			name: "chain",
+			services: []serviceSpec{
+				{Name: "web", DependsOn: []string{"api"}},
+				{Name: "api", DependsOn: []string{"db"}},
+				{Name: "db"},
+			},
+			want: [][]string{{"db"}, {"api"}, {"web"}},
+		},
+		{
+			name: "diamond",
+			services: []serviceSpec{
+				{Name: "web", DependsOn: []string{"api", "auth"}},
+				{Name: "api", DependsOn: []string{"db"}},
+				{Name: "auth", DependsOn: []string{"db"}},
+				{Name: "db"},
+			},
+			want: [][]string{{"db"}, {"api", "auth"}, {"web"}},
+		},
+		{
+			name:     "dependency outside the selection",
+			services: []serviceSpec{{Name: "web", DependsOn: []string{"api"}}},
+			want:     [][]string{{"web"}},
+		},
+		{
+			name: "cycle",
+			services: []serviceSpec{
+				{Name: "a", DependsOn: []string{"b"}},
+				{Name: "b", DependsOn: []string{"a"}},
+				{Name: "c"},
+			},
+			err: "dependency cycle between services: a, b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waves, err := deployWaves(tt.services)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][]string
+			for _, wave := range waves {
+				var names []string
+				for _, svc := range wave {
+					names = append(names, svc.Name)
+				}
+				got = append(got, names)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("deployWaves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	tests := []struct {
+		name, manifest, want string
+	}{
+		{"unknown field", "nmae: app\n", "unknown field"},
+		{"missing name", "services:\n- path: api\n", "services[0]: name is required"},
+		{"duplicate", "services:\n- name: api\n- name: api\n", `duplicate service "api"`},
+		{"unknown dependency", "services:\n- name: web\n  dependsOn: [api]\n", `depends on unknown service "api"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadManifest(writeTree(t, map[string]string{"flow.yaml": tt.manifest}))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectServices(t *testing.T) {
+	dir := writeTree(t, map[string]string{"flow.yml": `
+services:
+- name: api
+- name: web
+  path: frontend
+  dependsOn: [api]
+`})
+	m, err := loadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.selectServices([]string{"web"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Path != filepath.Join(dir, "frontend") {
+		t.Errorf("selectServices(web) = %+v", got)
+	}
+	got, err = m.selectServices(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Path != filepath.Join(dir, "api") {
+		t.Errorf("selectServices(--all) = %+v", got)
+	}
+	if _, err := m.selectServices(nil, false); err == nil || !strings.Contains(err.Error(), "--all") {
+		t.Errorf("no selection: err = %v", err)
+	}
+	if _, err := m.selectServices([]string{"worker"}, false); err == nil || !strings.Contains(err.Error(), "declared: api, web") {
+		t.Errorf("unknown service: err = %v", err)
+	}
+
+	// Without services the directory is the one service
+	single, err := loadManifest(writeTree(t, map[string]string{"flow.yaml": "name: solo\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = single.selectServices(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "solo" || got[0].Path != single.dir {
+		t.Errorf("selectServices() = %+v", got)
+	}
+	if _, err := single.selectServices([]string{"solo"}, false); err == nil {
+		t.Error("naming a service without declared services succeeded")
+	}
+}
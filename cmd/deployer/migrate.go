@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultMigrationTimeout = 10 * time.Minute
+	// How long a failed migration Job is kept for inspection.
+	failedMigrationTTL = 24 * 60 * 60
+	// Launches a command with the buildpacks' environment (PATH etc.)
+	cnbLauncher = "/cnb/lifecycle/launcher"
+	// Set on every image the CNB lifecycle exports, whichever tool ran it.
+	cnbLifecycleLabel = "io.buildpacks.lifecycle.metadata"
+)
+
+// migrationSpec is a command run to completion, with the app's image and
+// environment, before a new revision takes traffic.
+type migrationSpec struct {
+	Command string `json:"command"`
+	// Timeout is a duration such as 5m (default 10m).
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (m migrationSpec) validate() error {
+	if m.Command == "" {
+		return fmt.Errorf("command is required")
+	}
+	if m.Timeout != "" {
+		if d, err := time.ParseDuration(m.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q", m.Timeout)
+		}
+	}
+	return nil
+}
+
+func (m migrationSpec) timeout() time.Duration {
+	if d, err := time.ParseDuration(m.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultMigrationTimeout
+}
+
+// usesCNBLauncher reports whether imageRef was built with buildpacks, from
+// its lifecycle label rather than the configured strategy, since the
+// default strategy may or may not have used pack.
+func usesCNBLauncher(ctx context.Context, imageRef string) (bool, error) {
+	if !hasRegistry(imageRef) {
+		out, err := exec.CommandContext(ctx, "docker", "image", "inspect", "-f", `{{index .Config.Labels "`+cnbLifecycleLabel+`"}}`, imageRef).Output()
+		if err != nil {
+			return false, fmt.Errorf("failed to inspect %s: %v", imageRef, err)
+		}
+		label := strings.TrimSpace(string(out))
+		return label != "" && label != "<no value>", nil
+	}
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return false, err
+	}
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain()))
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch %s: %v", imageRef, err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return false, fmt.Errorf("failed to read the config of %s: %v", imageRef, err)
+	}
+	_, ok := cf.Config.Labels[cnbLifecycleLabel]
+	return ok, nil
+}
+
+// migrationCommand runs m through the CNB launcher for buildpack images,
+// so it sees the same PATH and environment as the app's processes.
+func migrationCommand(m migrationSpec, launcher bool) []string {
+	if launcher {
+		return []string{cnbLauncher, m.Command}
+	}
+	return []string{"sh", "-c", m.Command}
+}
+
+// runMigration runs m as a Job in namespace and streams its output. The
+// Job gets the same env and envFrom sources as the service, so attached
+// databases appear as DATABASE_URL etc. A failed Job is left behind for
+// `kubectl logs`; a successful one is deleted.
+func runMigration(ctx context.Context, app, namespace, image string, m migrationSpec, launcher bool, env map[string]string, envFrom []corev1.EnvFromSource) error {
+	client, ns, err := getClient(namespace)
+	if err != nil {
+		return err
+	}
+	hasDB := false
+	for _, ref := range envFrom {
+		for _, t := range []string{"postgres", "mysql", "mongodb"} {
+			hasDB = hasDB || (ref.SecretRef != nil && ref.SecretRef.Name == mustAttachmentType(t).secretName(app))
+		}
+	}
+	if !hasDB {
+		fmt.Printf("Warning: %s has no database attached; the migration only sees its env and secrets\n", app)
+	}
+
+	command := migrationCommand(m, launcher)
+	var envVars []corev1.EnvVar
+	for _, k := range sortedKeys(env) {
+		envVars = append(envVars, corev1.EnvVar{Name: k, Value: env[k]})
+	}
+
+	timeout := m.timeout()
+	// Migrations are not generally safe to retry blindly
+	backoff, deadline, ttl := int32(0), int64(timeout.Seconds()), int32(failedMigrationTTL)
+	labels := map[string]string{attachmentAppLabel: app, managedByLabel: managedByFlow}
+	job, err := client.BatchV1().Jobs(ns).Create(ctx, &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: app + "-migrate-", Namespace: ns, Labels: labels},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoff,
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:    "migrate",
+						Image:   image,
+						Command: command,
+						Env:     envVars,
+						EnvFrom: envFrom,
+					}},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create migration job: %v", err)
+	}
+	fmt.Printf("Running migration job %s: %s\n", job.Name, m.Command)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout+time.Minute)
+	defer cancel()
+	pod, err := waitForJobPod(ctx, client, ns, job.Name)
+	if err != nil {
+		return fmt.Errorf("migration job %s: %v", job.Name, err)
+	}
+	// Follow the logs until the container exits
+	if logs, err := client.CoreV1().Pods(ns).GetLogs(pod, &corev1.PodLogOptions{Follow: true}).Stream(ctx); err == nil {
+		out := newRedactWriter(os.Stdout)
+		io.Copy(out, logs)
+		out.Flush()
+		logs.Close()
+	} else {
+		fmt.Printf("Warning: Failed to stream migration logs: %v\n", err)
+	}
+
+	if err := waitForJob(ctx, client, ns, job.Name); err != nil {
+		return fmt.Errorf("migration job %s failed: %v (kept for inspection: kubectl -n %s logs job/%s)", job.Name, err, ns, job.Name)
+	}
+	background := metav1.DeletePropagationBackground
+	client.BatchV1().Jobs(ns).Delete(context.Background(), job.Name, metav1.DeleteOptions{PropagationPolicy: &background})
+	fmt.Printf("Migration completed\n")
+	return nil
+}
+
+// waitForJobPod returns the Job's pod once its container has started,
+// failing early when it can't start at all (bad image, missing Secret).
+func waitForJobPod(ctx context.Context, client *kubernetes.Clientset, ns, job string) (string, error) {
+	for {
+		pods, err := client.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + job})
+		if err != nil {
+			return "", err
+		}
+		for _, p := range pods.Items {
+			if p.Status.Phase != corev1.PodPending {
+				return p.Name, nil
+			}
+			for _, s := range p.Status.ContainerStatuses {
+				if w := s.State.Waiting; w != nil {
+					switch w.Reason {
+					case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError":
+						return "", fmt.Errorf("pod %s cannot start: %s: %s", p.Name, w.Reason, w.Message)
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("pod did not start: %v", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// waitForJob waits until the Job completes or fails.
+func waitForJob(ctx context.Context, client *kubernetes.Clientset, ns, name string) error {
+	for {
+		j, err := client.BatchV1().Jobs(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, c := range j.Status.Conditions {
+			if c.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch c.Type {
+			case batchv1.JobComplete:
+				return nil
+			case batchv1.JobFailed:
+				return fmt.Errorf("%s: %s", c.Reason, c.Message)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("did not finish: %v", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
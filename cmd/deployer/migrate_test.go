@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestMigrationSpec(t *testing.T) {
+	tests := []struct {
+		spec    migrationSpec
+		valid   bool
+		timeout time.Duration
+	}{
+		{migrationSpec{Command: "rake db:migrate"}, true, defaultMigrationTimeout},
+		{migrationSpec{Command: "alembic upgrade head", Timeout: "90s"}, true, 90 * time.Second},
+		{migrationSpec{Timeout: "5m"}, false, 5 * time.Minute},
+		{migrationSpec{Command: "x", Timeout: "soon"}, false, defaultMigrationTimeout},
+		{migrationSpec{Command: "x", Timeout: "-1m"}, false, defaultMigrationTimeout},
+	}
+	for _, tt := range tests {
+		if err := tt.spec.validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: validate() = %v, want valid %v", tt.spec, err, tt.valid)
+		}
+		if got := tt.spec.timeout(); got != tt.timeout {
+			t.Errorf("%+v: timeout() = %s, want %s", tt.spec, got, tt.timeout)
+		}
+	}
+
+	m := migrationSpec{Command: "npm run migrate"}
+	if got, want := migrationCommand(m, true), []string{cnbLauncher, "npm run migrate"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("migrationCommand(launcher) = %v, want %v", got, want)
+	}
+	if got, want := migrationCommand(m, false), []string{"sh", "-c", "npm run migrate"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("migrationCommand() = %v, want %v", got, want)
+	}
+}
+
+func TestUsesCNBLauncher(t *testing.T) {
+	host := testRegistry(t)
+	push := func(repo string, labels map[string]string) string {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf.Config.Labels = labels
+		if img, err = mutate.ConfigFile(img, cf); err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.ParseReference(host+"/"+repo, name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatal(err)
+		}
+		return ref.String()
+	}
+
+	// Whether pack ran is only known from the image, not the strategy
+	pack := push("app:pack", map[string]string{cnbLifecycleLabel: `{"app":[]}`})
+	docker := push("app:docker", map[string]string{"org.opencontainers.image.source": "x"})
+	for ref, want := range map[string]bool{pack: true, docker: false} {
+		got, err := usesCNBLauncher(context.Background(), ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("usesCNBLauncher(%s) = %v, want %v", ref, got, want)
+		}
+	}
+	if _, err := usesCNBLauncher(context.Background(), host+"/app:missing"); err == nil {
+		t.Error("missing image: want an error")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// verifyImagePlatforms checks that imageRef has a variant for every
+// os/architecture among the cluster's nodes, so pods don't land on a node
+// they can't run on (e.g. an amd64-only image on a Graviton node group).
+func verifyImagePlatforms(ctx context.Context, imageRef, namespace string) error {
+	nodes, err := nodePlatforms(ctx, namespace)
+	if err != nil {
+		fmt.Printf("Warning: could not list cluster nodes to verify image architectures: %v\n", err)
+		return nil
+	}
+	image, err := imagePlatforms(ctx, imageRef)
+	if err != nil {
+		return fmt.Errorf("failed to inspect image %s: %v", imageRef, err)
+	}
+
+	var missing []string
+	for platform, names := range nodes {
+		if !image[platform] {
+			missing = append(missing, fmt.Sprintf("%s (%d nodes, e.g. %s)", platform, len(names), names[0]))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("image %s is built for %s but the cluster also runs %s; rebuild with --platforms %s",
+			imageRef, strings.Join(sortedKeys(image), ", "), strings.Join(missing, ", "), strings.Join(sortedKeys(mergeSets(image, nodes)), ","))
+	}
+	fmt.Printf("Image covers cluster architectures: %s\n", strings.Join(sortedKeys(nodes), ", "))
+	return nil
+}
+
+// nodePlatforms returns the cluster's os/arch pairs with the nodes running
+// each of them.
+func nodePlatforms(ctx context.Context, namespace string) (map[string][]string, error) {
+	client, _, err := getClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]string{}
+	for _, n := range list.Items {
+		info := n.Status.NodeInfo
+		if info.OperatingSystem == "" || info.Architecture == "" {
+			continue
+		}
+		p := info.OperatingSystem + "/" + info.Architecture
+		out[p] = append(out[p], n.Name)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no nodes report an architecture")
+	}
+	return out, nil
+}
+
+// imagePlatforms returns the os/arch pairs imageRef can run on: every
+// entry of a manifest list, or the config platform of a single image.
+func imagePlatforms(ctx context.Context, imageRef string) (map[string]bool, error) {
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain()))
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]bool{}
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range m.Manifests {
+			// Skip attestation manifests BuildKit adds with an unknown platform
+			if d.Platform != nil && d.Platform.OS != "unknown" {
+				out[d.Platform.OS+"/"+d.Platform.Architecture] = true
+			}
+		}
+		return out, nil
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	out[cf.OS+"/"+cf.Architecture] = true
+	return out, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mergeSets(a map[string]bool, b map[string][]string) map[string]bool {
+	out := map[string]bool{}
+	for k := range a {
+		out[k] = true
+	}
+	for k := range b {
+		out[k] = true
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestImagePlatforms(t *testing.T) {
+	host := testRegistry(t)
+
+	// A manifest list, including a BuildKit attestation entry
+	multi := host + "/app/multi:v1"
+	pushBaseIndex(t, multi, []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "unknown", Architecture: "unknown"},
+	})
+	got, err := imagePlatforms(context.Background(), multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"linux/amd64": true, "linux/arm64": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("imagePlatforms(index) = %v, want %v", got, want)
+	}
+
+	// A single image reports its config platform
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.OS, cf.Architecture = "linux", "arm64"
+	img, err = mutate.ConfigFile(img, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single := host + "/app/single:v1"
+	ref, _ := name.ParseReference(single, name.Insecure)
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	got, err = imagePlatforms(context.Background(), single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"linux/arm64": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("imagePlatforms(image) = %v, want %v", got, want)
+	}
+
+	if _, err := imagePlatforms(context.Background(), host+"/app/missing:v1"); err == nil {
+		t.Error("imagePlatforms(missing) succeeded")
+	}
+}
+
+func TestNativePlatforms(t *testing.T) {
+	cfg := buildConfig{Platforms: []string{"linux/amd64", "linux/arm64/v8"}}
+	want := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}}
+	if got := cfg.nativePlatforms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("nativePlatforms() = %v, want %v", got, want)
+	}
+	if !cfg.multiArch() {
+		t.Error("multiArch() = false for two platforms")
+	}
+}
+
+func TestMergeSets(t *testing.T) {
+	got := sortedKeys(mergeSets(map[string]bool{"linux/amd64": true}, map[string][]string{"linux/arm64": {"node-1"}, "linux/amd64": {"node-2"}}))
+	if want := []string{"linux/amd64", "linux/arm64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeSets() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultProvisionStorage = "1Gi"
+	provisionReadyTimeout   = 5 * time.Minute
+	// Label values marking what flow provisioned.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByFlow  = "flow"
+	// A NOAUTH reply proves Redis is up without depending on a password
+	// that rotation may change under the running pod.
+	redisReadinessProbe = `redis-cli ping 2>&1 | grep -qE 'PONG|NOAUTH'`
+)
+
+// provisionSpec describes a single-replica, development-grade datastore:
+// one StatefulSet with a PVC for its data, a Service in front of it and a
+// Secret with the generated credentials.
+type provisionSpec struct {
+	name      string // <app>-postgres or <app>-redis
+	namespace string
+	kind      string // postgres or redis
+	image     string
+	port      int32
+	dataPath  string
+	storage   resource.Quantity
+	// credentials become the auth Secret; they are generated once and
+	// kept, since the data volume is initialized with them.
+	credentials map[string]string
+	env         []corev1.EnvVar
+	args        []string
+	probe       []string
+}
+
+// provisionPostgres creates (or reuses) an in-cluster Postgres for app and
+// returns how to reach it.
+func provisionPostgres(ctx context.Context, app, namespace, storage string) (postgresConn, error) {
+	password, err := generatePassword()
+	if err != nil {
+		return postgresConn{}, err
+	}
+	spec := provisionSpec{
+		name:      app + "-postgres",
+		namespace: namespace,
+		kind:      "postgres",
+		image:     localPostgresImage,
+		port:      5432,
+		dataPath:  "/var/lib/postgresql/data",
+		credentials: map[string]string{
+			"POSTGRES_USER":     "app",
+			"POSTGRES_PASSWORD": password,
+			"POSTGRES_DB":       dbNameFor(app),
+		},
+		// initdb refuses a mount point that isn't empty (lost+found)
+		env:   []corev1.EnvVar{{Name: "PGDATA", Value: "/var/lib/postgresql/data/pgdata"}},
+		probe: []string{"sh", "-c", `pg_isready -U "$POSTGRES_USER" -d "$POSTGRES_DB"`},
+	}
+	creds, ns, err := provisionDatastore(ctx, spec, storage)
+	if err != nil {
+		return postgresConn{}, err
+	}
+	return postgresConn{
+		Host:     serviceHost(spec.name, ns),
+		Port:     int(spec.port),
+		User:     creds["POSTGRES_USER"],
+		Password: creds["POSTGRES_PASSWORD"],
+		Database: creds["POSTGRES_DB"],
+		// Plain TCP inside the cluster network
+		SSLMode: "disable",
+	}, nil
+}
+
+// provisionRedis creates (or reuses) an in-cluster Redis for app with
+// append-only persistence.
+func provisionRedis(ctx context.Context, app, namespace, storage string) (redisConn, error) {
+	password, err := generatePassword()
+	if err != nil {
+		return redisConn{}, err
+	}
+	spec := provisionSpec{
+		name:        app + "-redis",
+		namespace:   namespace,
+		kind:        "redis",
+		image:       localRedisImage,
+		port:        6379,
+		dataPath:    "/data",
+		credentials: map[string]string{"REDIS_PASSWORD": password},
+		args:        []string{"sh", "-c", `exec redis-server --appendonly yes --requirepass "$REDIS_PASSWORD"`},
+		probe:       []string{"sh", "-c", redisReadinessProbe},
+	}
+	creds, ns, err := provisionDatastore(ctx, spec, storage)
+	if err != nil {
+		return redisConn{}, err
+	}
+	return redisConn{Host: serviceHost(spec.name, ns), Port: int(spec.port), Password: creds["REDIS_PASSWORD"]}, nil
+}
+
+// provisionDatastore applies spec and waits for it to become ready,
+// returning the credentials actually in use.
+func provisionDatastore(ctx context.Context, spec provisionSpec, storage string) (map[string]string, string, error) {
+	if storage == "" {
+		storage = defaultProvisionStorage
+	}
+	qty, err := resource.ParseQuantity(storage)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid storage size %q: %v", storage, err)
+	}
+	spec.storage = qty
+
+	client, ns, err := getClient(spec.namespace)
+	if err != nil {
+		return nil, "", err
+	}
+	spec.namespace = ns
+	labels := map[string]string{
+		"app.kubernetes.io/name":     spec.kind,
+		"app.kubernetes.io/instance": spec.name,
+		managedByLabel:               managedByFlow,
+	}
+
+	creds, err := ensureCredentials(ctx, client, spec, labels)
+	if err != nil {
+		return nil, "", err
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: spec.name, Namespace: ns, Labels: labels},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports:    []corev1.ServicePort{{Name: spec.kind, Port: spec.port, TargetPort: intstr.FromInt(int(spec.port))}},
+		},
+	}
+	if _, err := client.CoreV1().Services(ns).Create(ctx, svc, metav1.CreateOptions{}); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, "", fmt.Errorf("failed to create service %s: %v", spec.name, err)
+	}
+
+	replicas := int32(1)
+	container := corev1.Container{
+		Name:  spec.kind,
+		Image: spec.image,
+		Ports: []corev1.ContainerPort{{Name: spec.kind, ContainerPort: spec.port}},
+		Env:   spec.env,
+		EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: spec.name + "-auth"},
+		}}},
+		VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: spec.dataPath}},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler:        corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: spec.probe}},
+			InitialDelaySeconds: 5,
+			PeriodSeconds:       5,
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+		},
+	}
+	if len(spec.args) > 0 {
+		container.Command = spec.args
+	}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: spec.name, Namespace: ns, Labels: labels},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: spec.name,
+			Replicas:    &replicas,
+			Selector:    &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{container}},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Labels: labels},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: spec.storage},
+					},
+				},
+			}},
+		},
+	}
+	_, err = client.AppsV1().StatefulSets(ns).Create(ctx, sts, metav1.CreateOptions{})
+	switch {
+	case errors.IsAlreadyExists(err):
+		// The claim template can't change; leave an existing one alone
+		fmt.Printf("Using existing %s %s\n", spec.kind, spec.name)
+	case err != nil:
+		return nil, "", fmt.Errorf("failed to create statefulset %s: %v", spec.name, err)
+	default:
+		fmt.Printf("Provisioning %s %s (%s)...\n", spec.kind, spec.name, spec.storage.String())
+	}
+
+	return creds, ns, waitForStatefulSet(ctx, client, ns, spec.name)
+}
+
+// deprovisionDatastore deletes what provisionDatastore created for name,
+// including the data volume.
+func deprovisionDatastore(ctx context.Context, client *kubernetes.Clientset, ns, name string) error {
+	deletes := []struct {
+		kind string
+		del  func() error
+	}{
+		{"statefulset", func() error { return client.AppsV1().StatefulSets(ns).Delete(ctx, name, metav1.DeleteOptions{}) }},
+		{"service", func() error { return client.CoreV1().Services(ns).Delete(ctx, name, metav1.DeleteOptions{}) }},
+		{"secret", func() error { return client.CoreV1().Secrets(ns).Delete(ctx, name+"-auth", metav1.DeleteOptions{}) }},
+		// StatefulSets leave their claims behind: data-<name>-0
+		{"volume claim", func() error {
+			return client.CoreV1().PersistentVolumeClaims(ns).Delete(ctx, "data-"+name+"-0", metav1.DeleteOptions{})
+		}},
+	}
+	for _, d := range deletes {
+		if err := d.del(); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete %s of %s: %v", d.kind, name, err)
+		}
+	}
+	fmt.Printf("Deleted %s and its data\n", name)
+	return nil
+}
+
+// ensureCredentials returns the credentials in <name>-auth, creating it
+// from spec.credentials the first time.
+func ensureCredentials(ctx context.Context, client *kubernetes.Clientset, spec provisionSpec, labels map[string]string) (map[string]string, error) {
+	secrets := client.CoreV1().Secrets(spec.namespace)
+	name := spec.name + "-auth"
+	existing, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		creds := map[string]string{}
+		for k, v := range existing.Data {
+			creds[k] = string(v)
+		}
+		for k := range spec.credentials {
+			if creds[k] == "" {
+				return nil, fmt.Errorf("secret %s has no %s; delete it together with statefulset %s to start over", name, k, spec.name)
+			}
+		}
+		return creds, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	_, err = secrets.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: spec.namespace, Labels: labels},
+		StringData: spec.credentials,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret %s: %v", name, err)
+	}
+	return spec.credentials, nil
+}
+
+func waitForStatefulSet(ctx context.Context, client *kubernetes.Clientset, ns, name string) error {
+	deadline := time.Now().Add(provisionReadyTimeout)
+	for {
+		sts, err := client.AppsV1().StatefulSets(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if sts.Status.ReadyReplicas >= 1 {
+			fmt.Printf("%s is ready\n", name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not ready within %s; check `kubectl -n %s describe statefulset %s` (a PVC needs a default StorageClass)", name, provisionReadyTimeout, ns, name)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// serviceHost is the cluster DNS name of a Service.
+func serviceHost(name, ns string) string {
+	return name + "." + ns + ".svc.cluster.local"
+}
+
+// generatePassword returns 32 random bytes, URL-safe encoded.
+func generatePassword() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		pw, err := generatePassword()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pw) != 43 {
+			t.Errorf("len(%q) = %d, want 43", pw, len(pw))
+		}
+		// Generated passwords go into URLs unescaped by other tools
+		if url.QueryEscape(pw) != pw {
+			t.Errorf("password %q is not URL-safe", pw)
+		}
+		if seen[pw] {
+			t.Fatalf("password %q generated twice", pw)
+		}
+		seen[pw] = true
+	}
+	if got, want := serviceHost("myapp-postgres", "team"), "myapp-postgres.team.svc.cluster.local"; got != want {
+		t.Errorf("serviceHost() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Registry types accepted by --registry and the registry: section of
+// flow.yaml.
+const (
+	registryECR       = "ecr"
+	registryOCI       = "oci"
+	registryGHCR      = "ghcr"
+	registryDockerHub = "dockerhub"
+	registryLocal     = "local"
+)
+
+const (
+	ghcrHost         = "ghcr.io"
+	dockerHubHost    = "docker.io"
+	defaultLocalHost = "localhost:5000"
+	dockerHubIndex   = "index.docker.io"
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+	defaultImageTag  = "latest"
+	pullSecretPrefix = "flow-registry-"
+)
+
+// registryConfig selects where images are pushed. Secrets are never stored
+// in flow.yaml; passwordEnv and tokenEnv name the variables holding them.
+type registryConfig struct {
+	Type        string `json:"type,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Username    string `json:"username,omitempty"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+	TokenEnv    string `json:"tokenEnv,omitempty"`
+	Insecure    bool   `json:"insecure,omitempty"`
+	// Repository settings for repositories flow creates (ECR only)
+	Repository repositoryPolicy `json:"repository,omitempty"`
+}
+
+// registryBackend is a registry images can be pushed to. It is also the
+// keychain in-process clients (native builder, inspection, attestations)
+// use for its host.
+type registryBackend interface {
+	authn.Keychain
+	Name() string
+	// Host is the registry host, or "" when it isn't known yet (ECR
+	// before the account is discovered).
+	Host() string
+	// ImageRef returns the reference for repository:tag in this registry.
+	ImageRef(repository, tag string) (string, error)
+	// Login makes docker (and pack, which shares its config) able to push.
+	Login() error
+	// EnsureRepository creates repository on registries that need it.
+	EnsureRepository(repository string) error
+	// Insecure reports whether the registry is plain HTTP.
+	Insecure() bool
+}
+
+// Backends configured through flow.yaml or --registry, by host, so code that
+// only has an image reference (caches, inspection) finds their credentials.
+var (
+	registriesMu sync.Mutex
+	registries   = map[string]registryBackend{}
+)
+
+func addRegistryFlag(cmd *cobra.Command, v *string) {
+	cmd.Flags().StringVar(v, "registry", "", "Registry to push to: ecr, ghcr, dockerhub, local, or a host[/namespace] (default ecr)")
+}
+
+// resolveRegistry returns the backend selected by --registry, falling back
+// to the manifest and then ECR. A flag naming a different registry type
+// discards the manifest's settings; otherwise it overlays them.
+func resolveRegistry(flag string, manifest registryConfig) (registryBackend, error) {
+	cfg := manifest
+	if flag != "" {
+		f := parseRegistryFlag(flag)
+		if cfg.registryType() != f.registryType() {
+			cfg = registryConfig{}
+		}
+		cfg.Type = f.Type
+		if f.Host != "" {
+			cfg.Host = f.Host
+		}
+		if f.Namespace != "" {
+			cfg.Namespace = f.Namespace
+		}
+	}
+	reg, err := newRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if host := reg.Host(); host != "" {
+		registriesMu.Lock()
+		registries[host] = reg
+		registriesMu.Unlock()
+	}
+	return reg, nil
+}
+
+// parseRegistryFlag accepts a registry type or a host with an optional
+// namespace, e.g. ghcr.io/acme or localhost:5001.
+func parseRegistryFlag(v string) registryConfig {
+	switch v {
+	case registryECR, registryOCI, registryGHCR, registryDockerHub, registryLocal:
+		return registryConfig{Type: v}
+	}
+	host, namespace := v, ""
+	if i := strings.Index(v, "/"); i >= 0 {
+		host, namespace = v[:i], v[i+1:]
+	}
+	return registryConfig{Type: registryTypeForHost(host), Host: host, Namespace: namespace}
+}
+
+func (c registryConfig) registryType() string {
+	if c.Type != "" {
+		return c.Type
+	}
+	if c.Host != "" {
+		return registryTypeForHost(c.Host)
+	}
+	return registryECR
+}
+
+// registryTypeForHost infers the registry type from its host name.
+func registryTypeForHost(host string) string {
+	h := host
+	if i := strings.LastIndex(h, ":"); i >= 0 {
+		h = h[:i]
+	}
+	switch {
+	case isECRRegistry(host):
+		return registryECR
+	case host == ghcrHost:
+		return registryGHCR
+	case host == dockerHubHost || host == dockerHubIndex || host == "registry-1.docker.io":
+		return registryDockerHub
+	case h == "localhost" || h == "127.0.0.1" || strings.HasSuffix(h, ".localhost"):
+		return registryLocal
+	}
+	return registryOCI
+}
+
+func newRegistry(cfg registryConfig) (registryBackend, error) {
+	r := &ociRegistry{
+		kind:        cfg.registryType(),
+		host:        cfg.Host,
+		namespace:   strings.Trim(cfg.Namespace, "/"),
+		username:    cfg.Username,
+		passwordEnv: cfg.PasswordEnv,
+		tokenEnv:    cfg.TokenEnv,
+		insecure:    cfg.Insecure,
+	}
+	defaults := func(host, usernameEnv, passwordEnv string) {
+		if r.host == "" {
+			r.host = host
+		}
+		if r.username == "" && usernameEnv != "" {
+			r.username = os.Getenv(usernameEnv)
+		}
+		if r.passwordEnv == "" {
+			r.passwordEnv = passwordEnv
+		}
+	}
+
+	switch r.kind {
+	case registryECR:
+		policy := cfg.Repository.withDefaults()
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("registry.repository: %v", err)
+		}
+		return &ecrRegistry{host: cfg.Host, namespace: r.namespace, policy: policy}, nil
+	case registryGHCR:
+		defaults(ghcrHost, "GITHUB_ACTOR", "GITHUB_TOKEN")
+		if r.namespace == "" {
+			r.namespace = os.Getenv("GITHUB_REPOSITORY_OWNER")
+		}
+		// GHCR rejects upper-case repository paths
+		r.namespace = strings.ToLower(r.namespace)
+		if r.namespace == "" {
+			return nil, fmt.Errorf("ghcr needs an owner: set registry.namespace in flow.yaml or use --registry ghcr.io/<owner>")
+		}
+	case registryDockerHub:
+		defaults(dockerHubHost, "DOCKERHUB_USERNAME", "DOCKERHUB_TOKEN")
+		if r.namespace == "" {
+			r.namespace = r.username
+		}
+		if r.namespace == "" {
+			return nil, fmt.Errorf("docker hub needs a namespace: set registry.namespace or DOCKERHUB_USERNAME, or use --registry docker.io/<user>")
+		}
+	case registryLocal:
+		defaults(defaultLocalHost, "", "")
+		r.insecure = true
+	case registryOCI:
+		defaults("", "FLOW_REGISTRY_USERNAME", "FLOW_REGISTRY_PASSWORD")
+		if r.tokenEnv == "" {
+			r.tokenEnv = "FLOW_REGISTRY_TOKEN"
+		}
+		if r.host == "" {
+			return nil, fmt.Errorf("oci registry needs a host: set registry.host in flow.yaml or use --registry <host>[/namespace]")
+		}
+	default:
+		return nil, fmt.Errorf("unknown registry type %q (want ecr, oci, ghcr, dockerhub or local)", r.kind)
+	}
+	return r, nil
+}
+
+// registryForHost returns the configured backend for host, or one inferred
+// from the host name with credentials from the environment.
+func registryForHost(host string) registryBackend {
+	if host == dockerHubIndex {
+		host = dockerHubHost
+	}
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+	if reg, ok := registries[host]; ok {
+		return reg
+	}
+	cfg := registryConfig{Host: host}
+	if registryTypeForHost(host) == registryDockerHub {
+		// Any namespace will do; only credentials matter here
+		cfg.Namespace = "library"
+	}
+	reg, err := newRegistry(cfg)
+	if err != nil {
+		reg = &ociRegistry{kind: registryOCI, host: host}
+	}
+	// Kept so ECR login passwords are cached for the process
+	registries[host] = reg
+	return reg
+}
+
+// registryForRef returns the backend for the registry holding ref, or nil
+// for a local image name without a registry.
+func registryForRef(ref string) registryBackend {
+	r, err := parseImageReference(ref)
+	if err != nil || r.Registry == "" {
+		return nil
+	}
+	return registryForHost(r.Registry)
+}
+
+// remoteRef parses ref for registry clients, allowing plain HTTP for
+// insecure registries.
+func remoteRef(ref string) (name.Reference, error) {
+	if reg := registryForRef(ref); reg != nil && reg.Insecure() {
+		return name.ParseReference(ref, name.Insecure)
+	}
+	return name.ParseReference(ref)
+}
+
+// pushImage pushes a locally built image with docker.
+func pushImage(imageRef string) error {
+	reg := registryForRef(imageRef)
+	if reg == nil || reg.Name() == registryECR {
+		// Local names are the ECR fallback when the account is unknown
+		return dockerPushWithECRLogin(imageRef)
+	}
+	ref, err := parseImageReference(imageRef)
+	if err != nil {
+		return err
+	}
+	if err := reg.Login(); err != nil {
+		return err
+	}
+	if err := reg.EnsureRepository(ref.Repository); err != nil {
+		return err
+	}
+
+	fmt.Printf("Pushing image %s...\n", imageRef)
+	push := exec.Command("docker", "push", imageRef)
+	push.Stdout, push.Stderr = os.Stdout, os.Stderr
+	if err := push.Run(); err != nil {
+		hint := "Check that you are logged in to " + reg.Host()
+		if reg.Insecure() && reg.Name() != registryLocal {
+			hint = "Add " + reg.Host() + " to insecure-registries in the Docker daemon config"
+		}
+		return fmt.Errorf("failed to push image to %s: %v\n\n%s", reg.Host(), err, hint)
+	}
+	return nil
+}
+
+// localImageExists reports whether the Docker daemon has imageRef.
+func localImageExists(imageRef string) bool {
+	return exec.Command("docker", "image", "inspect", imageRef).Run() == nil
+}
+
+// remoteImageExists reports whether imageRef is in its registry, e.g.
+// because pack or buildx published it during the build.
+func remoteImageExists(ctx context.Context, imageRef string) bool {
+	if !hasRegistry(imageRef) {
+		return false
+	}
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return false
+	}
+	_, err = remote.Head(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain()))
+	return err == nil
+}
+
+// ociRegistry is any registry speaking the distribution API: GHCR, Docker
+// Hub, a local registry:2 or a generic host with basic or token auth.
+type ociRegistry struct {
+	kind        string
+	host        string
+	namespace   string
+	username    string
+	passwordEnv string
+	tokenEnv    string
+	insecure    bool
+}
+
+func (r *ociRegistry) Name() string   { return r.kind }
+func (r *ociRegistry) Host() string   { return r.host }
+func (r *ociRegistry) Insecure() bool { return r.insecure }
+
+func (r *ociRegistry) ImageRef(repository, tag string) (string, error) {
+	if tag == "" {
+		tag = defaultImageTag
+	}
+	return imageReference{Registry: r.host, Repository: path.Join(r.namespace, repository), Tag: tag}.String(), nil
+}
+
+// Repositories are created on first push.
+func (r *ociRegistry) EnsureRepository(repository string) error { return nil }
+
+func (r *ociRegistry) password() string {
+	if r.passwordEnv == "" {
+		return ""
+	}
+	return os.Getenv(r.passwordEnv)
+}
+
+func (r *ociRegistry) token() string {
+	if r.tokenEnv == "" {
+		return ""
+	}
+	return os.Getenv(r.tokenEnv)
+}
+
+// Login runs docker login when credentials are configured. Without them
+// the existing docker config is used as is.
+func (r *ociRegistry) Login() error {
+	password := r.password()
+	if r.username == "" || password == "" {
+		if r.token() != "" {
+			fmt.Printf("Note: %s uses token auth, which docker login can't use; run docker login %s or use --builder native\n", r.host, r.host)
+		}
+		return nil
+	}
+	server := r.host
+	if r.kind == registryDockerHub {
+		server = ""
+	}
+	fmt.Printf("Authenticating with %s...\n", r.host)
+	args := []string{"login", "--username", r.username, "--password-stdin"}
+	if server != "" {
+		args = append(args, server)
+	}
+	login := exec.Command("docker", args...)
+	login.Stdin = strings.NewReader(password)
+	login.Stdout, login.Stderr = os.Stdout, os.Stderr
+	if err := login.Run(); err != nil {
+		return fmt.Errorf("failed to login to %s: %v", r.host, err)
+	}
+	return nil
+}
+
+// Resolve returns the configured credentials for this registry's host.
+// Anonymous lets a multi-keychain fall through to the docker config.
+func (r *ociRegistry) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	host := target.RegistryStr()
+	if host != r.host && !(r.kind == registryDockerHub && host == dockerHubIndex) {
+		return authn.Anonymous, nil
+	}
+	if token := r.token(); token != "" {
+		return &authn.Bearer{Token: token}, nil
+	}
+	if password := r.password(); r.username != "" && password != "" {
+		return &authn.Basic{Username: r.username, Password: password}, nil
+	}
+	return authn.Anonymous, nil
+}
+
+// ecrRegistry pushes to the account's private ECR registry. The account is
+// discovered through STS unless the host is configured.
+type ecrRegistry struct {
+	mu        sync.Mutex
+	host      string
+	namespace string
+	policy    repositoryPolicy
+	keychain  ecrKeychain
+}
+
+func (r *ecrRegistry) Name() string   { return registryECR }
+func (r *ecrRegistry) Insecure() bool { return false }
+
+func (r *ecrRegistry) Host() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.host
+}
+
+func (r *ecrRegistry) ImageRef(repository, tag string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if tag == "" {
+		tag = defaultImageTag
+	}
+	if r.host == "" {
+		accountID, err := ecrAccountID()
+		if err != nil {
+			return "", err
+		}
+		if accountID == "" {
+			// Last resort: use a local image name for building, will be tagged for ECR during push
+			fmt.Printf("⚠️  Could not determine AWS account ID. Using local image name for building.\n")
+			return fmt.Sprintf("%s:%s", repository, tag), nil
+		}
+		r.host = fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", accountID, awsRegion())
+		// Now that the host is known, references to it use this backend
+		registriesMu.Lock()
+		registries[r.host] = r
+		registriesMu.Unlock()
+	}
+	return imageReference{Registry: r.host, Repository: path.Join(r.namespace, repository), Tag: tag}.String(), nil
+}
+
+func (r *ecrRegistry) Login() error {
+	host := r.Host()
+	if host == "" {
+		return fmt.Errorf("ECR registry host is not known yet")
+	}
+	return ecrDockerLogin(host, ecrRegion(host))
+}
+
+func (r *ecrRegistry) EnsureRepository(repository string) error {
+	region := awsRegion()
+	if host := r.Host(); host != "" {
+		region = ecrRegion(host)
+	}
+	policy := r.policy
+	if strings.HasSuffix(repository, cacheRepoSuffix) {
+		policy = cacheRepositoryPolicy()
+	}
+	return ensureECRRepository(repository, region, policy)
+}
+
+func (r *ecrRegistry) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return r.keychain.Resolve(target)
+}
+
+// configureRegistryPullSecret stores reg's credentials as a docker config
+// secret and adds it to the namespace's default service account, so the
+// cluster can pull from private non-ECR registries. Registries without
+// configured credentials are assumed to be pullable as is.
+func configureRegistryPullSecret(ctx context.Context, reg registryBackend, namespace string) error {
+	registry, err := name.NewRegistry(reg.Host())
+	if err != nil {
+		return err
+	}
+	a, err := reg.Resolve(registry)
+	if err != nil || a == authn.Anonymous {
+		return err
+	}
+	auth, err := a.Authorization()
+	if err != nil {
+		return err
+	}
+	if auth.Username == "" || auth.Password == "" {
+		fmt.Printf("Note: no username/password for %s; the cluster must already be able to pull from it\n", reg.Host())
+		return nil
+	}
+
+	key := reg.Host()
+	if reg.Name() == registryDockerHub {
+		key = dockerHubAuthKey
+	}
+	dockerConfig, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			key: map[string]string{
+				"username": auth.Username,
+				"password": auth.Password,
+				"auth":     base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password)),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	client, ns, err := getClient(namespace)
+	if err != nil {
+		return err
+	}
+	secretName := pullSecretPrefix + strings.NewReplacer(".", "-", ":", "-").Replace(reg.Host())
+	secrets := client.CoreV1().Secrets(ns)
+	existing, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: ns},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig},
+		}, metav1.CreateOptions{})
+	case err == nil && !bytes.Equal(existing.Data[corev1.DockerConfigJsonKey], dockerConfig):
+		existing.Data = map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig}
+		_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store pull secret %s: %v", secretName, err)
+	}
+
+	sa, err := client.CoreV1().ServiceAccounts(ns).Get(ctx, "default", metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, ref := range sa.ImagePullSecrets {
+		if ref.Name == secretName {
+			return nil
+		}
+	}
+	sa.ImagePullSecrets = append(sa.ImagePullSecrets, corev1.LocalObjectReference{Name: secretName})
+	if _, err := client.CoreV1().ServiceAccounts(ns).Update(ctx, sa, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to add pull secret to service account default: %v", err)
+	}
+	fmt.Printf("Configured pull secret %s for %s\n", secretName, reg.Host())
+	return nil
+}
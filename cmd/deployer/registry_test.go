@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestRegistryTypeForHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com", registryECR},
+		{"ghcr.io", registryGHCR},
+		{"docker.io", registryDockerHub},
+		{"index.docker.io", registryDockerHub},
+		{"localhost:5000", registryLocal},
+		{"127.0.0.1:5001", registryLocal},
+		{"k3d-flow.localhost:5000", registryLocal},
+		{"registry.example.com", registryOCI},
+	}
+	for _, tt := range tests {
+		if got := registryTypeForHost(tt.host); got != tt.want {
+			t.Errorf("registryTypeForHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRegistryImageRef(t *testing.T) {
+	t.Setenv("GITHUB_REPOSITORY_OWNER", "Acme")
+	t.Setenv("DOCKERHUB_USERNAME", "")
+	tests := []struct {
+		name     string
+		flag     string
+		manifest registryConfig
+		want     string
+		insecure bool
+	}{
+		{name: "ghcr owner from the environment", flag: "ghcr", want: "ghcr.io/acme/web:v1"},
+		{name: "ghcr flag namespace", flag: "ghcr.io/other", want: "ghcr.io/other/web:v1"},
+		{name: "dockerhub", manifest: registryConfig{Type: registryDockerHub, Namespace: "me"}, want: "docker.io/me/web:v1"},
+		{name: "local default", flag: "local", want: "localhost:5000/web:v1", insecure: true},
+		{name: "local host", flag: "k3d-flow.localhost:5000", want: "k3d-flow.localhost:5000/web:v1", insecure: true},
+		{name: "oci with namespace", flag: "registry.example.com/team/sub", want: "registry.example.com/team/sub/web:v1"},
+		{
+			name:     "flag overlays the manifest of the same type",
+			flag:     "registry.example.com",
+			manifest: registryConfig{Type: registryOCI, Host: "old.example.com", Namespace: "team", Insecure: true},
+			want:     "registry.example.com/team/web:v1", insecure: true,
+		},
+		{
+			name:     "flag of another type drops the manifest",
+			flag:     "local",
+			manifest: registryConfig{Type: registryGHCR, Namespace: "acme"},
+			want:     "localhost:5000/web:v1", insecure: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := resolveRegistry(tt.flag, tt.manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := reg.ImageRef("web", "v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || reg.Insecure() != tt.insecure {
+				t.Errorf("ImageRef() = %q (insecure %v), want %q (insecure %v)", got, reg.Insecure(), tt.want, tt.insecure)
+			}
+		})
+	}
+}
+
+func TestResolveRegistryErrors(t *testing.T) {
+	t.Setenv("GITHUB_REPOSITORY_OWNER", "")
+	t.Setenv("DOCKERHUB_USERNAME", "")
+	tests := []struct {
+		name     string
+		manifest registryConfig
+		want     string
+	}{
+		{"ghcr without owner", registryConfig{Type: registryGHCR}, "ghcr needs an owner"},
+		{"dockerhub without namespace", registryConfig{Type: registryDockerHub}, "docker hub needs a namespace"},
+		{"oci without host", registryConfig{Type: registryOCI}, "oci registry needs a host"},
+		{"unknown type", registryConfig{Type: "quay"}, "unknown registry type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := resolveRegistry("", tt.manifest); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOCIRegistryResolve(t *testing.T) {
+	t.Setenv("TEST_REGISTRY_PASSWORD", "s3cret")
+	t.Setenv("TEST_REGISTRY_TOKEN", "")
+	r := &ociRegistry{kind: registryOCI, host: "registry.example.com", username: "bot", passwordEnv: "TEST_REGISTRY_PASSWORD", tokenEnv: "TEST_REGISTRY_TOKEN"}
+	resolve := func(host string) authn.Authenticator {
+		reg, err := name.NewRegistry(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := r.Resolve(reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return auth
+	}
+	if auth, ok := resolve("registry.example.com").(*authn.Basic); !ok || auth.Username != "bot" || auth.Password != "s3cret" {
+		t.Errorf("Resolve() = %#v, want basic auth", auth)
+	}
+	if auth := resolve("other.example.com"); auth != authn.Anonymous {
+		t.Errorf("Resolve(other host) = %#v, want anonymous", auth)
+	}
+	t.Setenv("TEST_REGISTRY_TOKEN", "tok")
+	if auth, ok := resolve("registry.example.com").(*authn.Bearer); !ok || auth.Token != "tok" {
+		t.Errorf("Resolve() = %#v, want the bearer token", auth)
+	}
+}
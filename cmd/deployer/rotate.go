@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	revisionReadyTimeout = 5 * time.Minute
+	// Postgres rotation alternates between the owner role and this
+	// second login role, so the old password keeps working until the new
+	// revision is Ready.
+	rotatedRoleSuffix   = "_2"
+	rotatedAtAnnotation = "flow.ai/rotated-at"
+)
+
+// rotation is a new credential that is valid alongside the current one
+// until retire is called.
+type rotation struct {
+	data   map[string]string
+	auth   map[string]string
+	retire func() error
+}
+
+func newAttachRotateCmd() *cobra.Command {
+	var name, namespace, kubecontext string
+	cmd := &cobra.Command{
+		Use:   "rotate <postgres|redis>",
+		Short: "Rotate the password of a provisioned Postgres or Redis without downtime",
+		Long: `Generate a new password for a datastore created with --provision and switch
+the app over to it: the new password is added next to the old one, the
+attachment Secret is updated, a new Knative revision is rolled out and,
+once it is Ready, the old password is retired.
+
+For external databases, rotate the password with the provider and re-run
+flow attach.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if name == "" {
+				return fmt.Errorf("name required")
+			}
+			t, ok := lookupAttachmentType(args[0])
+			if !ok {
+				return fmt.Errorf("unknown attachment type %q", args[0])
+			}
+			return rotateAttachment(cmd.Context(), t, name, namespace, kubecontext)
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "App name")
+	cmd.Flags().StringVar(&namespace, "namespace", "default", "Namespace")
+	cmd.Flags().StringVar(&kubecontext, "kubecontext", "", "kubectl context to use")
+	return cmd
+}
+
+// rotateAttachment rotates the credential of app's provisioned t.
+func rotateAttachment(ctx context.Context, t attachmentType, app, namespace, kubecontext string) error {
+	if t.Name != "postgres" && t.Name != "redis" {
+		return fmt.Errorf("rotate supports postgres and redis created with --provision, not %s", t.Name)
+	}
+	client, ns, err := getClient(namespace)
+	if err != nil {
+		return err
+	}
+	// Provisioned datastores are named <app>-<type>
+	store := app + "-" + t.Name
+	sts, err := client.AppsV1().StatefulSets(ns).Get(ctx, store, metav1.GetOptions{})
+	if errors.IsNotFound(err) || (err == nil && sts.Labels[managedByLabel] != managedByFlow) {
+		return fmt.Errorf("%s has no %s created with --provision; rotate the password with the provider and re-run flow attach %s", app, t.Title, t.Name)
+	}
+	if err != nil {
+		return err
+	}
+	current, err := client.CoreV1().Secrets(ns).Get(ctx, t.secretName(app), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", t.secretName(app), err)
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return err
+	}
+
+	var r rotation
+	switch t.Name {
+	case "postgres":
+		r, err = rotatePostgres(ctx, kubecontext, ns, store, current.Data, password)
+	case "redis":
+		if err = ensureRedisProbe(ctx, client, ns, store); err == nil {
+			r, err = rotateRedis(ctx, kubecontext, ns, store, current.Data, password)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add the new credential: %v", err)
+	}
+	fmt.Printf("New %s credential added; the old one stays valid until the rollout is Ready\n", t.Title)
+
+	if err := writeAttachment(ctx, t, app, ns, r.data); err != nil {
+		return fmt.Errorf("failed to update %s: %v (both credentials remain valid)", t.secretName(app), err)
+	}
+	if err := rollRevision(ctx, app, ns, kubecontext); err != nil {
+		return fmt.Errorf("%v; both credentials remain valid, re-run rotate once the service is healthy", err)
+	}
+
+	if err := r.retire(); err != nil {
+		return fmt.Errorf("failed to retire the old credential: %v", err)
+	}
+	// Keep the auth Secret current, so a restart or --provision re-run
+	// uses the credential that still works
+	if _, err := upsertSecret(ctx, client, ns, store+"-auth", keyUpdate{Set: r.auth}); err != nil {
+		return err
+	}
+	fmt.Printf("Rotated %s credentials for %s; the old password no longer works\n", t.Title, app)
+	return nil
+}
+
+// rotatePostgres gives the login role not in use a new password. That is
+// the owner or <owner>_2, a member of the owner that acts as it, so both
+// see and create the same objects.
+func rotatePostgres(ctx context.Context, kubecontext, ns, store string, current map[string][]byte, password string) (rotation, error) {
+	port, _ := strconv.Atoi(string(current["PGPORT"]))
+	conn := postgresConn{
+		Host:     string(current["PGHOST"]),
+		Port:     port,
+		User:     string(current["PGUSER"]),
+		Database: string(current["PGDATABASE"]),
+		SSLMode:  string(current["PGSSLMODE"]),
+	}
+	plan := planPostgresRotation(conn.User, password)
+	conn.User, conn.Password = plan.user, password
+	psql := func(sql string) error {
+		return execInPod(ctx, kubecontext, ns, store+"-0", sql, "psql", "-v", "ON_ERROR_STOP=1", "-qAt", "-U", plan.owner, "-d", conn.Database, "-f", "-")
+	}
+	if err := psql(plan.sql); err != nil {
+		return rotation{}, err
+	}
+	return rotation{
+		data: conn.secretData(),
+		auth: map[string]string{"POSTGRES_USER": conn.User, "POSTGRES_PASSWORD": password},
+		retire: func() error {
+			return psql(plan.retireSQL)
+		},
+	}, nil
+}
+
+// postgresRotation is what rotating away from a login role runs: sql
+// gives user the new password, creating <owner>_2 if needed, and
+// retireSQL disables the current role's password.
+type postgresRotation struct {
+	owner, user    string
+	sql, retireSQL string
+}
+
+// planPostgresRotation alternates between owner and <owner>_2, starting
+// from current, the role the app logs in as now.
+func planPostgresRotation(current, password string) postgresRotation {
+	owner := strings.TrimSuffix(current, rotatedRoleSuffix)
+	p := postgresRotation{owner: owner, user: owner + rotatedRoleSuffix}
+	if current != owner {
+		p.user = owner
+	}
+	if p.user != owner {
+		p.sql = fmt.Sprintf(`DO $$ BEGIN
+  IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = %[1]s) THEN CREATE ROLE %[2]s IN ROLE %[3]s; END IF;
+END $$;
+ALTER ROLE %[2]s SET role = %[4]s;
+`, quoteLiteral(p.user), quoteIdent(p.user), quoteIdent(owner), quoteLiteral(owner))
+	}
+	p.sql += fmt.Sprintf("ALTER ROLE %s WITH LOGIN PASSWORD %s;\n", quoteIdent(p.user), quoteLiteral(password))
+	p.retireSQL = fmt.Sprintf("ALTER ROLE %s WITH PASSWORD NULL;\n", quoteIdent(current))
+	return p
+}
+
+// rotateRedis adds a second password to the default user; setting
+// requirepass afterwards leaves only the new one.
+func rotateRedis(ctx context.Context, kubecontext, ns, store string, current map[string][]byte, password string) (rotation, error) {
+	port, _ := strconv.Atoi(string(current["REDIS_PORT"]))
+	conn := redisConn{Host: string(current["REDIS_HOST"]), Port: port, Password: password}
+	oldPassword := string(current["REDIS_PASSWORD"])
+	redis := func(auth string, commands ...string) error {
+		// Commands go in on stdin so passwords stay out of process lists
+		script := "AUTH " + auth + "\n" + strings.Join(commands, "\n") + "\n"
+		return execInPod(ctx, kubecontext, ns, store+"-0", script, "redis-cli", "--no-auth-warning")
+	}
+	if err := redis(oldPassword, "ACL SETUSER default on >"+password); err != nil {
+		return rotation{}, err
+	}
+	return rotation{
+		data: conn.secretData(),
+		auth: map[string]string{"REDIS_PASSWORD": password},
+		retire: func() error {
+			return redis(password, "CONFIG SET requirepass "+password)
+		},
+	}, nil
+}
+
+// ensureRedisProbe replaces a readiness probe that authenticates with the
+// password the pod started with, which stops working once rotated. This
+// restarts Redis once; its data is kept in the append-only file.
+func ensureRedisProbe(ctx context.Context, client *kubernetes.Clientset, ns, store string) error {
+	sts, err := client.AppsV1().StatefulSets(ns).Get(ctx, store, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	c := &sts.Spec.Template.Spec.Containers[0]
+	if c.ReadinessProbe == nil || c.ReadinessProbe.Exec == nil || !strings.Contains(strings.Join(c.ReadinessProbe.Exec.Command, " "), "REDIS_PASSWORD") {
+		return nil
+	}
+	fmt.Printf("Updating the readiness probe of %s (restarts it once)...\n", store)
+	c.ReadinessProbe.Exec.Command = []string{"sh", "-c", redisReadinessProbe}
+	if _, err := client.AppsV1().StatefulSets(ns).Update(ctx, sts, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(provisionReadyTimeout)
+	for {
+		s, err := client.AppsV1().StatefulSets(ns).Get(ctx, store, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if s.Status.ObservedGeneration >= s.Generation && s.Status.CurrentRevision == s.Status.UpdateRevision && s.Status.ReadyReplicas >= 1 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not restart within %s", store, provisionReadyTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// execInPod runs command in pod with stdin, failing on a non-zero exit or
+// a client error reply.
+func execInPod(ctx context.Context, kubecontext, ns, pod, stdin string, command ...string) error {
+	c := kubectlCmd(ctx, kubecontext, ns, append([]string{"exec", "-i", pod, "--"}, command...)...)
+	c.Stdin = strings.NewReader(stdin)
+	var out bytes.Buffer
+	c.Stdout, c.Stderr = &out, &out
+	err := c.Run()
+	text := strings.TrimSpace(out.String())
+	// redis-cli exits 0 on error replies
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimPrefix(line, "(error) ")
+		if strings.HasPrefix(line, "ERR") || strings.HasPrefix(line, "WRONGPASS") || strings.HasPrefix(line, "NOAUTH") {
+			return fmt.Errorf("%s: %s", command[0], line)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s in %s: %v: %s", command[0], pod, err, text)
+	}
+	return nil
+}
+
+// ksvcStatus is the part of a Knative Service's status rollout needs.
+type ksvcStatus struct {
+	Metadata struct {
+		Generation int64 `json:"generation"`
+	} `json:"metadata"`
+	Status struct {
+		ObservedGeneration        int64  `json:"observedGeneration"`
+		LatestCreatedRevisionName string `json:"latestCreatedRevisionName"`
+		LatestReadyRevisionName   string `json:"latestReadyRevisionName"`
+		Conditions                []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func getKsvcStatus(ctx context.Context, app, ns, kubecontext string) (*ksvcStatus, error) {
+	out, err := kubectlCmd(ctx, kubecontext, ns, "get", "ksvc", app, "-o", "json").Output()
+	if err != nil {
+		return nil, err
+	}
+	var s ksvcStatus
+	if err := json.Unmarshal(out, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// rollRevision makes app start a new revision, picking up changed Secret
+// values, and waits until that revision is Ready. A service that isn't
+// deployed has nothing to roll.
+func rollRevision(ctx context.Context, app, ns, kubecontext string) error {
+	before, err := getKsvcStatus(ctx, app, ns, kubecontext)
+	if err != nil {
+		fmt.Printf("Service %s is not deployed; nothing to roll out\n", app)
+		return nil
+	}
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, rotatedAtAnnotation, time.Now().UTC().Format(time.RFC3339))
+	if out, err := kubectlCmd(ctx, kubecontext, ns, "patch", "ksvc", app, "--type", "merge", "-p", patch).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to roll a new revision of %s: %v: %s", app, err, strings.TrimSpace(string(out)))
+	}
+	fmt.Printf("Rolling out a new revision of %s...\n", app)
+
+	deadline := time.Now().Add(revisionReadyTimeout)
+	for {
+		s, err := getKsvcStatus(ctx, app, ns, kubecontext)
+		if err != nil {
+			return err
+		}
+		created := s.Status.LatestCreatedRevisionName
+		if s.Status.ObservedGeneration > before.Metadata.Generation && created != before.Status.LatestCreatedRevisionName {
+			if s.Status.LatestReadyRevisionName == created {
+				fmt.Printf("Revision %s is Ready\n", created)
+				return nil
+			}
+			for _, c := range s.Status.Conditions {
+				if c.Type == "ConfigurationsReady" && c.Status == "False" {
+					return fmt.Errorf("revision %s failed: %s: %s", created, c.Reason, c.Message)
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("revision %s of %s was not Ready within %s", created, app, revisionReadyTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// quoteIdent and quoteLiteral quote SQL identifiers and strings.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestQuoteSQL(t *testing.T) {
+	tests := []struct {
+		in           string
+		ident, value string
+	}{
+		{"app", `"app"`, `'app'`},
+		{"App User", `"App User"`, `'App User'`},
+		{`we"ird`, `"we""ird"`, `'we"ird'`},
+		{"o'brien", `"o'brien"`, `'o''brien'`},
+		{`'; DROP ROLE app; --`, `"'; DROP ROLE app; --"`, `'''; DROP ROLE app; --'`},
+		{`back\slash`, `"back\slash"`, `'back\slash'`},
+		{"", `""`, `''`},
+	}
+	for _, tt := range tests {
+		if got := quoteIdent(tt.in); got != tt.ident {
+			t.Errorf("quoteIdent(%q) = %s, want %s", tt.in, got, tt.ident)
+		}
+		if got := quoteLiteral(tt.in); got != tt.value {
+			t.Errorf("quoteLiteral(%q) = %s, want %s", tt.in, got, tt.value)
+		}
+	}
+}
+
+func TestPlanPostgresRotation(t *testing.T) {
+	createApp2 := `DO $$ BEGIN
+  IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'app_2') THEN CREATE ROLE "app_2" IN ROLE "app"; END IF;
+END $$;
+ALTER ROLE "app_2" SET role = 'app';
+`
+	tests := []struct {
+		name, current string
+		want          postgresRotation
+	}{
+		{
+			name:    "owner to second role",
+			current: "app",
+			want: postgresRotation{
+				owner:     "app",
+				user:      "app_2",
+				sql:       createApp2 + "ALTER ROLE \"app_2\" WITH LOGIN PASSWORD 'n3w';\n",
+				retireSQL: "ALTER ROLE \"app\" WITH PASSWORD NULL;\n",
+			},
+		},
+		{
+			name:    "second role back to owner",
+			current: "app_2",
+			want: postgresRotation{
+				owner:     "app",
+				user:      "app",
+				sql:       "ALTER ROLE \"app\" WITH LOGIN PASSWORD 'n3w';\n",
+				retireSQL: "ALTER ROLE \"app_2\" WITH PASSWORD NULL;\n",
+			},
+		},
+		{
+			name:    "quoted owner",
+			current: "o'b_2",
+			want: postgresRotation{
+				owner:     "o'b",
+				user:      "o'b",
+				sql:       "ALTER ROLE \"o'b\" WITH LOGIN PASSWORD 'n3w';\n",
+				retireSQL: "ALTER ROLE \"o'b_2\" WITH PASSWORD NULL;\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planPostgresRotation(tt.current, "n3w"); got != tt.want {
+				t.Errorf("planPostgresRotation(%q) = %+v, want %+v", tt.current, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Images for the local attachment containers `flow run` can start.
+const (
+	localPostgresImage = "postgres:16-alpine"
+	localRedisImage    = "redis:7-alpine"
+	// Only reachable on the run's own docker network, so a fixed password
+	// is fine and keeps the persisted data volume usable across runs.
+	localServicePassword = "flow-local"
+	localServiceTimeout  = 60 * time.Second
+)
+
+type runOptions struct {
+	port       int
+	hostPort   int
+	envs       []string
+	buildFlags buildConfig
+	registry   string
+	postgres   bool
+	redis      bool
+	dbURL      string
+	redisURL   string
+	keep       bool
+	// attachments loads the service's attachment Secrets from namespace.
+	attachments bool
+	namespace   string
+}
+
+func newRunCmd() *cobra.Command {
+	opts := &runOptions{}
+	cmd := &cobra.Command{
+		Use:   "run [service]",
+		Short: "Build the image and run it locally, tailing logs until interrupted",
+		Long: `Build the image exactly as deploy would and run it with Docker.
+
+The container gets the service's port (as PORT, like Knative) and env.
+--postgres and --redis start local containers and inject DATABASE_URL and
+REDIS_URL; --db-url and --redis-url point at existing ones instead.
+
+The service's attachments in the cluster are not used unless --attachments
+is given. It loads their Secrets (as flow env list shows them) from
+--namespace; their hosts must then be reachable from this machine, and
+--postgres, --redis and the URL flags still take precedence.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manifest, err := loadManifest(".")
+			if err != nil {
+				return err
+			}
+			services, err := manifest.selectServices(args, false)
+			if err != nil {
+				return err
+			}
+			if len(services) != 1 {
+				return fmt.Errorf("flow.yaml declares %d services; name the one to run", len(services))
+			}
+			reg, err := resolveRegistry(opts.registry, manifest.Registry)
+			if err != nil {
+				return err
+			}
+			return runService(cmd, manifest, reg, services[0], opts)
+		},
+	}
+	cmd.Flags().IntVar(&opts.port, "port", 8080, "Container port")
+	cmd.Flags().IntVar(&opts.hostPort, "host-port", 0, "Port on this machine (default: the container port)")
+	cmd.Flags().StringSliceVar(&opts.envs, "env", []string{}, "Runtime environment variables (key=value)")
+	cmd.Flags().BoolVar(&opts.postgres, "postgres", false, "Start a local Postgres and set DATABASE_URL")
+	cmd.Flags().BoolVar(&opts.redis, "redis", false, "Start a local Redis and set REDIS_URL")
+	cmd.Flags().StringVar(&opts.dbURL, "db-url", "", "DATABASE_URL to inject instead of a local Postgres")
+	cmd.Flags().StringVar(&opts.redisURL, "redis-url", "", "REDIS_URL to inject instead of a local Redis")
+	cmd.Flags().BoolVar(&opts.keep, "keep-services", false, "Leave the Postgres/Redis containers running on exit")
+	cmd.Flags().BoolVar(&opts.attachments, "attachments", false, "Inject the service's attachment Secrets from the cluster")
+	cmd.Flags().StringVar(&opts.namespace, "namespace", "default", "Namespace to read attachments from")
+	addRegistryFlag(cmd, &opts.registry)
+	addBuildFlags(cmd, &opts.buildFlags)
+	return cmd
+}
+
+// runService builds svc and runs it in the foreground.
+func runService(cmd *cobra.Command, manifest *projectManifest, reg registryBackend, svc serviceSpec, opts *runOptions) error {
+	port := opts.port
+	if svc.Port != 0 && !cmd.Flags().Changed("port") {
+		port = svc.Port
+	}
+	hostPort := opts.hostPort
+	if hostPort == 0 {
+		hostPort = port
+	}
+
+	// Ctrl-C cancels the build and the readiness waits too, so the
+	// deferred cleanup below always runs
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var attached map[string]string
+	if opts.attachments {
+		client, ns, err := getClient(opts.namespace)
+		if err != nil {
+			return err
+		}
+		found, err := listAttachments(ctx, client, ns, svc.Name)
+		if err != nil {
+			return fmt.Errorf("failed to read attachments: %v", err)
+		}
+		attached = attachmentEnv(found)
+		fmt.Printf("Loaded %d attachment(s) of %s from namespace %s\n", len(found), svc.Name, ns)
+	}
+
+	buildCfg, err := resolveBuildConfig(cmd, opts.buildFlags, manifest.Build, svc.Build)
+	if err != nil {
+		return err
+	}
+	// A multi-arch build can't be loaded into the local daemon; run the
+	// variant for this machine, or the first one under emulation.
+	if buildCfg.multiArch() {
+		platform := localPlatform(buildCfg.Platforms, runtime.GOARCH)
+		fmt.Printf("Building only %s for the local run\n", platform)
+		buildCfg.Platforms = []string{platform}
+	}
+
+	// The native builder pushes as it builds, so run from the registry;
+	// everything else stays in the local daemon.
+	imageRef := fmt.Sprintf("flow-run/%s:latest", svc.Name)
+	if buildCfg.Strategy == strategyNative {
+		if imageRef, err = reg.ImageRef(svc.Name, deployTag(svc.Path)); err != nil {
+			return fmt.Errorf("failed to generate image reference: %v", err)
+		}
+	}
+	// Build-time env is the service's own, without attachments or PORT
+	buildEnv := runEnv(nil, svc.Env, toEnvMap(opts.envs), nil, 0)
+	envs := make([]string, 0, len(buildEnv))
+	for _, k := range sortedKeys(buildEnv) {
+		envs = append(envs, k+"="+buildEnv[k])
+	}
+	fmt.Printf("Building application %s...\n", svc.Name)
+	if _, err := buildApplication(ctx, buildCfg, svc.Path, imageRef, envs); err != nil {
+		return fmt.Errorf("build failed: %v", err)
+	}
+
+	network := "flow-" + svc.Name
+	if err := ensureDockerNetwork(network); err != nil {
+		return err
+	}
+	var started []string
+	defer func() {
+		if opts.keep || len(started) == 0 {
+			return
+		}
+		fmt.Printf("Removing %s...\n", strings.Join(started, ", "))
+		exec.Command("docker", append([]string{"rm", "-f"}, started...)...).Run()
+	}()
+
+	// Containers are recorded before they start, so one that never
+	// becomes ready is removed as well
+	if opts.dbURL == "" && opts.postgres {
+		name := localServiceName(svc.Name, "postgres")
+		started = append(started, name)
+		if err := startLocalPostgres(ctx, network, name, svc.Name); err != nil {
+			return err
+		}
+	}
+	if opts.redisURL == "" && opts.redis {
+		name := localServiceName(svc.Name, "redis")
+		started = append(started, name)
+		if err := startLocalRedis(ctx, network, name); err != nil {
+			return err
+		}
+	}
+	env := runEnv(attached, svc.Env, toEnvMap(opts.envs), localServiceEnv(svc.Name, opts), port)
+
+	container := "flow-run-" + svc.Name
+	args, dockerEnv := dockerRunArgs(container, network, hostPort, port, imageRef, env)
+	c := exec.Command("docker", args...)
+	c.Env = append(os.Environ(), dockerEnv...)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	if err := c.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", imageRef, err)
+	}
+	fmt.Printf("Running %s on http://localhost:%d (Ctrl-C to stop)\n", svc.Name, hostPort)
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	// Stop the container on Ctrl-C and still clean up after it exits
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s exited: %v", svc.Name, err)
+		}
+		return nil
+	case <-ctx.Done():
+		fmt.Printf("\nStopping %s...\n", svc.Name)
+		exec.Command("docker", "stop", "-t", "10", container).Run()
+		<-done
+		return nil
+	}
+}
+
+// localPlatform picks the platform to run from a multi-arch build: this
+// machine's, or the first one under emulation.
+func localPlatform(platforms []string, goarch string) string {
+	for _, p := range platforms {
+		if p == "linux/"+goarch {
+			return p
+		}
+	}
+	return platforms[0]
+}
+
+// attachmentEnv flattens attachment Secrets into env, in the order
+// listAttachments returns them.
+func attachmentEnv(found []attachment) map[string]string {
+	env := map[string]string{}
+	for _, a := range found {
+		for k, v := range a.Secret.Data {
+			env[k] = string(v)
+		}
+	}
+	return env
+}
+
+// localServiceEnv is the env for --db-url/--redis-url or the local
+// containers, which the URL flags take precedence over.
+func localServiceEnv(service string, opts *runOptions) map[string]string {
+	env := map[string]string{}
+	switch {
+	case opts.dbURL != "":
+		env["DATABASE_URL"] = opts.dbURL
+	case opts.postgres:
+		conn := postgresConn{Host: localServiceName(service, "postgres"), Port: 5432, User: "app", Password: localServicePassword, Database: dbNameFor(service), SSLMode: "disable"}
+		for k, v := range conn.secretData() {
+			env[k] = v
+		}
+	}
+	switch {
+	case opts.redisURL != "":
+		env["REDIS_URL"] = opts.redisURL
+	case opts.redis:
+		for k, v := range (redisConn{Host: localServiceName(service, "redis"), Port: 6379, Password: localServicePassword}).secretData() {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// runEnv merges the container's env, lowest precedence first: attachment
+// Secrets, flow.yaml env, --env, then the local services. PORT is set to
+// port, as Knative does, unless something else set it; 0 leaves it out.
+func runEnv(attached, svcEnv, flagEnv, services map[string]string, port int) map[string]string {
+	env := map[string]string{}
+	for _, layer := range []map[string]string{attached, svcEnv, flagEnv, services} {
+		for k, v := range layer {
+			env[k] = v
+		}
+	}
+	if _, ok := env["PORT"]; !ok && port != 0 {
+		env["PORT"] = fmt.Sprint(port)
+	}
+	return env
+}
+
+// dockerRunArgs returns the docker run arguments and the KEY=VALUE pairs
+// for docker's own environment. Values go through the environment, with
+// only the names on the command line, so they don't show up in ps.
+func dockerRunArgs(container, network string, hostPort, port int, imageRef string, env map[string]string) ([]string, []string) {
+	args := []string{"run", "--rm", "--name", container, "--network", network, "-p", fmt.Sprintf("%d:%d", hostPort, port)}
+	var pairs []string
+	for _, k := range sortedKeys(env) {
+		args = append(args, "--env", k)
+		pairs = append(pairs, k+"="+env[k])
+	}
+	return append(args, imageRef), pairs
+}
+
+// dbNameFor turns a service name into a Postgres database name.
+func dbNameFor(service string) string {
+	return strings.ReplaceAll(service, "-", "_")
+}
+
+func ensureDockerNetwork(network string) error {
+	if exec.Command("docker", "network", "inspect", network).Run() == nil {
+		return nil
+	}
+	if out, err := exec.Command("docker", "network", "create", network).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create docker network %s: %v: %s", network, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// localServiceName is the container (and volume) name of a local service.
+func localServiceName(service, kind string) string {
+	return "flow-" + service + "-" + kind
+}
+
+// startLocalPostgres starts Postgres as name on network with its data in a
+// named volume, and waits until it accepts connections.
+func startLocalPostgres(ctx context.Context, network, name, service string) error {
+	args := []string{"run", "-d", "--rm", "--name", name, "--network", network,
+		"-v", name + ":/var/lib/postgresql/data",
+		"-e", "POSTGRES_USER=app", "-e", "POSTGRES_PASSWORD=" + localServicePassword, "-e", "POSTGRES_DB=" + dbNameFor(service),
+		localPostgresImage}
+	if err := startLocalContainer(name, args); err != nil {
+		return err
+	}
+	return waitForContainer(ctx, name, "pg_isready", "-U", "app")
+}
+
+// startLocalRedis starts Redis as name on network and waits until it
+// answers.
+func startLocalRedis(ctx context.Context, network, name string) error {
+	args := []string{"run", "-d", "--rm", "--name", name, "--network", network,
+		localRedisImage, "redis-server", "--requirepass", localServicePassword}
+	if err := startLocalContainer(name, args); err != nil {
+		return err
+	}
+	return waitForContainer(ctx, name, "redis-cli", "-a", localServicePassword, "--no-auth-warning", "ping")
+}
+
+// startLocalContainer runs docker args unless name is already running,
+// e.g. kept from a previous run with --keep-services.
+func startLocalContainer(name string, args []string) error {
+	if out, err := exec.Command("docker", "inspect", "-f", "{{.State.Running}}", name).Output(); err == nil && strings.TrimSpace(string(out)) == "true" {
+		fmt.Printf("Using running %s\n", name)
+		return nil
+	}
+	fmt.Printf("Starting %s...\n", name)
+	if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to start %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// waitForContainer runs probe inside name until it succeeds or ctx is
+// cancelled.
+func waitForContainer(ctx context.Context, name string, probe ...string) error {
+	deadline := time.Now().Add(localServiceTimeout)
+	for {
+		if exec.Command("docker", append([]string{"exec", name}, probe...)...).Run() == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not become ready within %s", name, localServiceTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("interrupted while waiting for %s", name)
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// Artifact types for attachments pushed as OCI referrers of the image.
+const (
+	cycloneDXMediaType = "application/vnd.cyclonedx+json"
+	inTotoMediaType    = "application/vnd.in-toto+json"
+)
+
+const flowBuildType = "https://flow.ai/buildtypes/flow-build/v1"
+
+type sbomComponent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+// cycloneDXBOM is the subset of CycloneDX 1.5 flow emits.
+type cycloneDXBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     sbomMetadata    `json:"metadata"`
+	Components   []sbomComponent `json:"components"`
+}
+
+type sbomMetadata struct {
+	Timestamp string        `json:"timestamp"`
+	Tools     []sbomTool    `json:"tools"`
+	Component sbomComponent `json:"component"`
+}
+
+type sbomTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+// generateSBOM builds a CycloneDX SBOM from the dependency manifests found
+// in appPath (package-lock.json, requirements.txt, go.sum).
+func generateSBOM(appPath, projectName string) (*cycloneDXBOM, error) {
+	var components []sbomComponent
+	readers := []struct {
+		file string
+		read func(string) ([]sbomComponent, error)
+	}{
+		{"package-lock.json", npmComponents},
+		{"requirements.txt", pypiComponents},
+		{"go.sum", goComponents},
+	}
+	for _, r := range readers {
+		p := filepath.Join(appPath, r.file)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		found, err := r.read(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", r.file, err)
+		}
+		components = append(components, found...)
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].PURL < components[j].PURL })
+
+	return &cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + uuid.NewString(),
+		Version:      1,
+		Metadata: sbomMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     []sbomTool{{Vendor: "flow.ai", Name: "flow"}},
+			Component: sbomComponent{Type: "application", Name: projectName},
+		},
+		Components: components,
+	}, nil
+}
+
+// npmComponents reads lockfile v2/v3 "packages" or v1 "dependencies".
+func npmComponents(path string) ([]sbomComponent, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock struct {
+		Packages map[string]struct {
+			Version string `json:"version"`
+			Dev     bool   `json:"dev"`
+		} `json:"packages"`
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+			Dev     bool   `json:"dev"`
+		} `json:"dependencies"`
+	}
+	if err := json.Unmarshal(raw, &lock); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var out []sbomComponent
+	add := func(name, version string) {
+		purl := npmPURL(name, version)
+		if name == "" || version == "" || seen[purl] {
+			return
+		}
+		seen[purl] = true
+		out = append(out, sbomComponent{Type: "library", Name: name, Version: version, PURL: purl})
+	}
+	for p, pkg := range lock.Packages {
+		if p == "" || pkg.Dev {
+			continue
+		}
+		i := strings.LastIndex(p, "node_modules/")
+		add(p[i+len("node_modules/"):], pkg.Version)
+	}
+	if len(lock.Packages) == 0 {
+		for name, dep := range lock.Dependencies {
+			if !dep.Dev {
+				add(name, dep.Version)
+			}
+		}
+	}
+	return out, nil
+}
+
+func npmPURL(name, version string) string {
+	if strings.HasPrefix(name, "@") {
+		name = "%40" + strings.TrimPrefix(name, "@")
+	}
+	return "pkg:npm/" + name + "@" + url.PathEscape(version)
+}
+
+// pypiComponents reads pinned (name==version) lines; unpinned requirements
+// are recorded without a version.
+func pypiComponents(path string) ([]sbomComponent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []sbomComponent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || strings.HasPrefix(line, "-") {
+			continue
+		}
+		// Drop environment markers and extras (uvicorn[standard]==0.29.0)
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		if i := strings.Index(line, "["); i >= 0 {
+			if j := strings.Index(line[i:], "]"); j >= 0 {
+				line = line[:i] + line[i+j+1:]
+			} else {
+				line = line[:i]
+			}
+		}
+		name, version := line, ""
+		if i := strings.Index(line, "=="); i >= 0 {
+			name, version = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+2:])
+		} else if i := strings.IndexAny(line, "<>=!~"); i >= 0 {
+			name = strings.TrimSpace(line[:i])
+		}
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		c := sbomComponent{Type: "library", Name: name, Version: version, PURL: "pkg:pypi/" + name}
+		if version != "" {
+			c.PURL += "@" + version
+		}
+		out = append(out, c)
+	}
+	return out, s.Err()
+}
+
+// goComponents reads module versions from go.sum, ignoring the go.mod-only
+// hash lines.
+func goComponents(path string) ([]sbomComponent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seen := map[string]bool{}
+	var out []sbomComponent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		mod, version := fields[0], fields[1]
+		purl := "pkg:golang/" + mod + "@" + version
+		if seen[purl] {
+			continue
+		}
+		seen[purl] = true
+		out = append(out, sbomComponent{Type: "library", Name: mod, Version: version, PURL: purl})
+	}
+	return out, s.Err()
+}
+
+// provenanceStatement returns an in-toto statement with a SLSA v1
+// provenance predicate describing how imageRef@digest was built.
+func provenanceStatement(appPath, imageRef string, digest v1.Hash, cfg buildConfig, started, finished time.Time) map[string]interface{} {
+	source := map[string]interface{}{}
+	if out, err := gitOutput(appPath, "config", "--get", "remote.origin.url"); err == nil {
+		source["uri"] = out
+	}
+	if out, err := gitOutput(appPath, "rev-parse", "HEAD"); err == nil {
+		source["digest"] = map[string]string{"gitCommit": out}
+	}
+	strategy := cfg.Strategy
+	if strategy == "" {
+		strategy = "auto"
+	}
+	builderID := "https://flow.ai/builders/" + strategy
+	if host, err := os.Hostname(); err == nil {
+		builderID += "?host=" + url.QueryEscape(host)
+	}
+
+	return map[string]interface{}{
+		"_type": "https://in-toto.io/Statement/v1",
+		"subject": []map[string]interface{}{{
+			"name":   repositoryOf(imageRef),
+			"digest": map[string]string{digest.Algorithm: digest.Hex},
+		}},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": map[string]interface{}{
+			"buildDefinition": map[string]interface{}{
+				"buildType": flowBuildType,
+				"externalParameters": map[string]interface{}{
+					"strategy":   strategy,
+					"builder":    cfg.Builder,
+					"buildpacks": cfg.Buildpacks,
+					"platforms":  cfg.Platforms,
+					"secrets":    secretIDs(cfg.Secrets),
+					"source":     source,
+				},
+			},
+			"runDetails": map[string]interface{}{
+				"builder": map[string]string{"id": builderID},
+				"metadata": map[string]string{
+					"invocationId": uuid.NewString(),
+					"startedOn":    started.UTC().Format(time.RFC3339),
+					"finishedOn":   finished.UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	out, err := c.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func addAttestationFlag(cmd *cobra.Command, skip *bool) {
+	cmd.Flags().BoolVar(skip, "skip-attestations", false, "Don't attach an SBOM and provenance to the pushed image (otherwise a failure to attach them is an error)")
+}
+
+// attestationRefs are the digest references of the attachments pushed for
+// an image, recorded in the deployment report.
+type attestationRefs struct {
+	Digest     string
+	SBOM       string
+	Provenance string
+}
+
+// attestImage attaches the SBOM and provenance statement to the pushed
+// image as OCI referrers. Registries without the referrers API get the
+// fallback tag index instead.
+func attestImage(ctx context.Context, appPath, projectName, imageRef string, cfg buildConfig, started time.Time) (*attestationRefs, error) {
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain())}
+	subject, err := remote.Head(ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve pushed image %s: %v", imageRef, err)
+	}
+
+	bom, err := generateSBOM(appPath, projectName)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Generated SBOM with %d components\n", len(bom.Components))
+	refs := &attestationRefs{Digest: subject.Digest.String()}
+
+	bomJSON, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if refs.SBOM, err = pushReferrer(ref.Context(), *subject, cycloneDXMediaType, bomJSON, opts); err != nil {
+		return nil, fmt.Errorf("failed to attach SBOM: %v", err)
+	}
+
+	statement := provenanceStatement(appPath, imageRef, subject.Digest, cfg, started, time.Now())
+	provJSON, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if refs.Provenance, err = pushReferrer(ref.Context(), *subject, inTotoMediaType, provJSON, opts); err != nil {
+		return nil, fmt.Errorf("failed to attach provenance: %v", err)
+	}
+	fmt.Printf("Attached SBOM %s and provenance %s\n", refs.SBOM, refs.Provenance)
+	return refs, nil
+}
+
+// pushReferrer pushes data as a single-layer OCI artifact whose subject is
+// the image, returning its digest reference.
+func pushReferrer(repo name.Repository, subject v1.Descriptor, artifactType string, data []byte, opts []remote.Option) (string, error) {
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, types.MediaType(artifactType))
+	img, err := mutate.Append(img, mutate.Addendum{
+		Layer: static.NewLayer(data, types.MediaType(artifactType)),
+		Annotations: map[string]string{
+			"org.opencontainers.image.created": time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	subject = v1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}
+	artifact, ok := mutate.Subject(img, subject).(v1.Image)
+	if !ok {
+		return "", fmt.Errorf("unexpected artifact type")
+	}
+	digest, err := artifact.Digest()
+	if err != nil {
+		return "", err
+	}
+	target := repo.Digest(digest.String())
+	if err := remote.Write(target, artifact, opts...); err != nil {
+		return "", err
+	}
+	return target.String(), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestGenerateSBOM(t *testing.T) {
+	app := writeTree(t, map[string]string{
+		"package-lock.json": `{"lockfileVersion": 3, "packages": {
+			"": {"name": "app"},
+			"node_modules/express": {"version": "4.19.2"},
+			"node_modules/@types/node": {"version": "20.1.0", "dev": true},
+			"node_modules/@scope/lib": {"version": "1.0.0"},
+			"node_modules/a/node_modules/express": {"version": "4.19.2"}
+		}}`,
+		"requirements.txt": "# deps\nDjango_Rest==3.15.1\nrequests>=2.0 ; python_version > '3'\n-r other.txt\nuvicorn[standard]==0.29.0\n",
+		"go.sum":           "github.com/pkg/errors v0.9.1 h1:abc=\ngithub.com/pkg/errors v0.9.1/go.mod h1:def=\n",
+	})
+	bom, err := generateSBOM(app, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range bom.Components {
+		got = append(got, c.PURL)
+	}
+	want := []string{
+		"pkg:golang/github.com/pkg/errors@v0.9.1",
+		"pkg:npm/%40scope/lib@1.0.0",
+		"pkg:npm/express@4.19.2",
+		"pkg:pypi/django-rest@3.15.1",
+		"pkg:pypi/requests",
+		"pkg:pypi/uvicorn@0.29.0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("components =\n%v\nwant\n%v", got, want)
+	}
+	if bom.BOMFormat != "CycloneDX" || bom.Metadata.Component.Name != "app" || !strings.HasPrefix(bom.SerialNumber, "urn:uuid:") {
+		t.Errorf("metadata = %+v", bom)
+	}
+
+	// Lockfile v1 lists dependencies instead of packages
+	v1 := writeTree(t, map[string]string{
+		"package-lock.json": `{"dependencies": {"lodash": {"version": "4.17.21"}, "jest": {"version": "29.0.0", "dev": true}}}`,
+	})
+	if bom, err = generateSBOM(v1, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bom.Components) != 1 || bom.Components[0].PURL != "pkg:npm/lodash@4.17.21" {
+		t.Errorf("v1 components = %+v", bom.Components)
+	}
+
+	if _, err := generateSBOM(writeTree(t, map[string]string{"package-lock.json": "{"}), "app"); err == nil {
+		t.Error("invalid lockfile: no error")
+	}
+}
+
+func TestAttestImage(t *testing.T) {
+	host := testRegistry(t)
+	imageRef := host + "/team/app:v1"
+	ref, _ := name.ParseReference(imageRef, name.Insecure)
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	app := writeTree(t, map[string]string{"go.sum": "golang.org/x/text v0.14.0 h1:x=\n"})
+	cfg := buildConfig{Strategy: strategyDocker, Platforms: []string{defaultPlatform}}
+	refs, err := attestImage(context.Background(), app, "app", imageRef, cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := img.Digest()
+	if refs.Digest != digest.String() {
+		t.Errorf("Digest = %s, want %s", refs.Digest, digest)
+	}
+
+	idx, err := remote.Referrers(ref.Context().Digest(digest.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]string{}
+	for _, d := range m.Manifests {
+		types[d.ArtifactType] = ref.Context().Digest(d.Digest.String()).String()
+	}
+	if types[cycloneDXMediaType] != refs.SBOM || types[inTotoMediaType] != refs.Provenance {
+		t.Errorf("referrers = %v, want SBOM %s and provenance %s", types, refs.SBOM, refs.Provenance)
+	}
+
+	if _, err := attestImage(context.Background(), app, "app", host+"/team/missing:v1", cfg, time.Now()); err == nil {
+		t.Error("attesting a missing image succeeded")
+	}
+}
+
+func TestProvenanceStatement(t *testing.T) {
+	img, _ := random.Image(16, 1)
+	digest, _ := img.Digest()
+	cfg := buildConfig{Builder: "example/builder", Buildpacks: []string{"bp/node"}, Secrets: []buildSecret{{ID: "NPM_TOKEN"}}}
+	st := provenanceStatement(t.TempDir(), "registry.example.com/team/app:v1", digest, cfg, time.Now(), time.Now())
+	subject := st["subject"].([]map[string]interface{})[0]
+	if subject["name"] != "registry.example.com/team/app" {
+		t.Errorf("subject name = %v", subject["name"])
+	}
+	params := st["predicate"].(map[string]interface{})["buildDefinition"].(map[string]interface{})["externalParameters"].(map[string]interface{})
+	if params["strategy"] != "auto" || !reflect.DeepEqual(params["secrets"], []string{"NPM_TOKEN"}) {
+		t.Errorf("externalParameters = %v", params)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+// Scanners flow knows how to read findings from.
+const (
+	scannerECR   = "ecr"
+	scannerTrivy = "trivy"
+	scannerGrype = "grype"
+	scannerNone  = "none"
+)
+
+const (
+	defaultFailOn = "critical"
+	// ECR basic scans usually finish within a minute or two of the push.
+	ecrScanTimeout  = 10 * time.Minute
+	ecrScanInterval = 5 * time.Second
+)
+
+// severityOrder lists severities from most to least severe, in ECR's
+// spelling; other scanners' names are mapped onto it.
+var severityOrder = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "INFORMATIONAL", "UNDEFINED"}
+
+// normalizeSeverity maps ECR, Inspector, Trivy and Grype severities onto
+// severityOrder.
+func normalizeSeverity(s string) string {
+	switch s = strings.ToUpper(strings.TrimSpace(s)); s {
+	case "CRITICAL", "HIGH", "MEDIUM", "LOW", "INFORMATIONAL":
+		return s
+	case "INFO", "NEGLIGIBLE":
+		return "INFORMATIONAL"
+	}
+	return "UNDEFINED"
+}
+
+func severityRank(s string) int {
+	for i, v := range severityOrder {
+		if v == s {
+			return i
+		}
+	}
+	return len(severityOrder)
+}
+
+// scanConfig is the scan section of flow.yaml.
+type scanConfig struct {
+	// Enabled: false turns the gate off. Otherwise a scan that can't run
+	// stops the deploy like a failing one.
+	Enabled *bool `json:"enabled,omitempty"`
+	// FailOn is the lowest severity that blocks a deploy (critical, high,
+	// medium, low) or "none" to only report.
+	FailOn string `json:"failOn,omitempty"`
+	// Scanner is ecr, trivy, grype or none. Defaults to ecr for ECR images;
+	// other registries are only scanned when one is set.
+	Scanner string `json:"scanner,omitempty"`
+	// Report is a Trivy or Grype JSON report to read instead of scanning.
+	Report string `json:"report,omitempty"`
+	// Ignore lists vulnerability IDs that never block a deploy.
+	Ignore []string `json:"ignore,omitempty"`
+}
+
+func (c scanConfig) validate() error {
+	switch c.Scanner {
+	case "", scannerECR, scannerTrivy, scannerGrype, scannerNone:
+	default:
+		return fmt.Errorf("unknown scanner %q (want ecr, trivy, grype or none)", c.Scanner)
+	}
+	if c.FailOn != "" && c.FailOn != "none" && normalizeSeverity(c.FailOn) == "UNDEFINED" {
+		return fmt.Errorf("unknown severity %q (want critical, high, medium, low or none)", c.FailOn)
+	}
+	return nil
+}
+
+// enabled reports whether deploys scan at all: unless scan.enabled is
+// false or the scanner is none.
+func (c scanConfig) enabled() bool {
+	return (c.Enabled == nil || *c.Enabled) && c.Scanner != scannerNone
+}
+
+// threshold is the normalized FailOn severity, or "" when nothing blocks.
+func (c scanConfig) threshold() string {
+	switch c.FailOn {
+	case "":
+		return normalizeSeverity(defaultFailOn)
+	case "none":
+		return ""
+	}
+	return normalizeSeverity(c.FailOn)
+}
+
+// vulnFinding is one vulnerability in one package.
+type vulnFinding struct {
+	ID       string
+	Severity string
+	Package  string
+	Version  string
+	FixedIn  string
+}
+
+// scanSummary is what deploy prints and reports.
+type scanSummary struct {
+	Source string `json:"source"`
+	// Status is passed, failed, overridden or unavailable.
+	Status    string         `json:"status"`
+	Threshold string         `json:"threshold,omitempty"`
+	Counts    map[string]int `json:"counts,omitempty"`
+	// Blocking lists the vulnerability IDs at or above the threshold.
+	Blocking []string `json:"blocking,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// scanImage collects findings for imageRef and applies cfg's threshold.
+// It returns nil when no scanner applies to the image.
+func scanImage(ctx context.Context, imageRef string, cfg scanConfig) (*scanSummary, []vulnFinding, error) {
+	source, findings, err := collectFindings(ctx, imageRef, cfg)
+	if source == "" {
+		return nil, nil, err
+	}
+	if err != nil {
+		return &scanSummary{Source: source, Status: "unavailable", Error: err.Error()}, nil, err
+	}
+	return summarizeFindings(source, findings, cfg), findings, nil
+}
+
+func collectFindings(ctx context.Context, imageRef string, cfg scanConfig) (string, []vulnFinding, error) {
+	if cfg.Report != "" {
+		raw, err := os.ReadFile(cfg.Report)
+		if err != nil {
+			return cfg.Report, nil, err
+		}
+		findings, err := parseScanReport(raw)
+		return cfg.Report, findings, err
+	}
+	scanner := cfg.Scanner
+	if scanner == "" {
+		ref, err := parseImageReference(imageRef)
+		if err != nil || !isECRRegistry(ref.Registry) {
+			return "", nil, nil
+		}
+		scanner = scannerECR
+	}
+	switch scanner {
+	case scannerECR:
+		findings, err := ecrScanFindings(ctx, imageRef)
+		return scannerECR, findings, err
+	case scannerTrivy, scannerGrype:
+		args := []string{"image", "--format", "json", "--quiet", imageRef}
+		if scanner == scannerGrype {
+			args = []string{imageRef, "-o", "json", "-q"}
+		}
+		var stderr bytes.Buffer
+		c := exec.CommandContext(ctx, scanner, args...)
+		c.Stderr = &stderr
+		out, err := c.Output()
+		if err != nil {
+			return scanner, nil, fmt.Errorf("%s failed: %v: %s", scanner, err, strings.TrimSpace(stderr.String()))
+		}
+		findings, err := parseScanReport(out)
+		return scanner, findings, err
+	}
+	return "", nil, nil
+}
+
+// summarizeFindings dedupes findings, drops ignored IDs and checks the
+// rest against the threshold.
+func summarizeFindings(source string, findings []vulnFinding, cfg scanConfig) *scanSummary {
+	ignored := map[string]bool{}
+	for _, id := range cfg.Ignore {
+		ignored[strings.ToUpper(id)] = true
+	}
+	s := &scanSummary{Source: source, Status: "passed", Threshold: cfg.threshold(), Counts: map[string]int{}}
+	seen := map[string]bool{}
+	blocking := map[string]bool{}
+	for _, f := range findings {
+		key := f.ID + " " + f.Package + " " + f.Version
+		if seen[key] || ignored[strings.ToUpper(f.ID)] {
+			continue
+		}
+		seen[key] = true
+		s.Counts[f.Severity]++
+		if s.Threshold != "" && severityRank(f.Severity) <= severityRank(s.Threshold) {
+			blocking[f.ID] = true
+		}
+	}
+	if len(blocking) > 0 {
+		s.Status = "failed"
+		s.Blocking = sortedKeys(blocking)
+	}
+	return s
+}
+
+// printScanSummary prints counts by severity and the blocking findings.
+func printScanSummary(s *scanSummary, findings []vulnFinding) {
+	var counts []string
+	for _, sev := range severityOrder {
+		if n := s.Counts[sev]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, strings.ToLower(sev)))
+		}
+	}
+	if len(counts) == 0 {
+		fmt.Printf("Vulnerability scan (%s): no findings\n", s.Source)
+		return
+	}
+	fmt.Printf("Vulnerability scan (%s): %s\n", s.Source, strings.Join(counts, ", "))
+	blocking := map[string]bool{}
+	for _, id := range s.Blocking {
+		blocking[id] = true
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return severityRank(findings[i].Severity) < severityRank(findings[j].Severity) })
+	printed := map[string]bool{}
+	for _, f := range findings {
+		key := f.ID + " " + f.Package + " " + f.Version
+		if !blocking[f.ID] || printed[key] {
+			continue
+		}
+		printed[key] = true
+		line := fmt.Sprintf("  %-8s %s %s %s", f.Severity, f.ID, f.Package, f.Version)
+		if f.FixedIn != "" {
+			line += " (fixed in " + f.FixedIn + ")"
+		}
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+}
+
+// parseScanReport reads a Trivy (`trivy image --format json`) or Grype
+// (`grype -o json`) report.
+func parseScanReport(raw []byte) ([]vulnFinding, error) {
+	var report struct {
+		// Trivy; Results is omitted when nothing was scanned
+		SchemaVersion *int
+		Results       *[]struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				FixedVersion     string
+				Severity         string
+			}
+		}
+		// Grype
+		Matches *[]struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+				Fix      struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(raw, &report); err != nil {
+		return nil, fmt.Errorf("invalid scan report: %v", err)
+	}
+	var out []vulnFinding
+	switch {
+	case report.SchemaVersion != nil || report.Results != nil:
+		if report.Results == nil {
+			break
+		}
+		for _, r := range *report.Results {
+			for _, v := range r.Vulnerabilities {
+				out = append(out, vulnFinding{ID: v.VulnerabilityID, Severity: normalizeSeverity(v.Severity), Package: v.PkgName, Version: v.InstalledVersion, FixedIn: v.FixedVersion})
+			}
+		}
+	case report.Matches != nil:
+		for _, m := range *report.Matches {
+			out = append(out, vulnFinding{
+				ID:       m.Vulnerability.ID,
+				Severity: normalizeSeverity(m.Vulnerability.Severity),
+				Package:  m.Artifact.Name,
+				Version:  m.Artifact.Version,
+				FixedIn:  strings.Join(m.Vulnerability.Fix.Versions, ", "),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized scan report: expected Trivy or Grype JSON")
+	}
+	return out, nil
+}
+
+// ecrScanFindings waits for ECR's scan of each image behind imageRef (every
+// platform of a manifest list, which ECR scans individually) and returns
+// the combined findings. Images pushed to a repository without scan on
+// push get a scan started.
+func ecrScanFindings(ctx context.Context, imageRef string) ([]vulnFinding, error) {
+	ref, err := parseImageReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	account, region, ok := parseECRHost(ref.Registry)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECR image", imageRef)
+	}
+	client, err := awsClients.ecr(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	digests, err := scannableDigests(ctx, imageRef)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ecrScanTimeout)
+	defer cancel()
+	var out []vulnFinding
+	for _, digest := range digests {
+		id := &ecrtypes.ImageIdentifier{ImageDigest: aws.String(digest)}
+		started := false
+		for {
+			in := &ecr.DescribeImageScanFindingsInput{RegistryId: aws.String(account), RepositoryName: aws.String(ref.Repository), ImageId: id}
+			res, err := client.DescribeImageScanFindings(ctx, in)
+			var notFound *ecrtypes.ScanNotFoundException
+			if errors.As(err, &notFound) && !started {
+				_, err = client.StartImageScan(ctx, &ecr.StartImageScanInput{RegistryId: aws.String(account), RepositoryName: aws.String(ref.Repository), ImageId: id})
+				if err != nil {
+					return nil, fmt.Errorf("failed to start scan of %s@%s: %v", ref.Name(), digest, err)
+				}
+				started = true
+				continue
+			}
+			if err != nil && !errors.As(err, &notFound) {
+				return nil, fmt.Errorf("failed to get scan findings for %s@%s: %v", ref.Name(), digest, err)
+			}
+
+			status := ecrtypes.ScanStatusPending
+			if res != nil && res.ImageScanStatus != nil {
+				status = res.ImageScanStatus.Status
+			}
+			switch status {
+			case ecrtypes.ScanStatusComplete, ecrtypes.ScanStatusActive:
+				for {
+					out = append(out, ecrFindings(res.ImageScanFindings)...)
+					if res.NextToken == nil {
+						break
+					}
+					in.NextToken = res.NextToken
+					if res, err = client.DescribeImageScanFindings(ctx, in); err != nil {
+						return nil, fmt.Errorf("failed to get scan findings for %s@%s: %v", ref.Name(), digest, err)
+					}
+				}
+			case ecrtypes.ScanStatusInProgress, ecrtypes.ScanStatusPending:
+				select {
+				case <-ctx.Done():
+					return nil, fmt.Errorf("timed out waiting for the scan of %s@%s", ref.Name(), digest)
+				case <-time.After(ecrScanInterval):
+				}
+				continue
+			default:
+				desc := ""
+				if res.ImageScanStatus.Description != nil {
+					desc = ": " + *res.ImageScanStatus.Description
+				}
+				return nil, fmt.Errorf("scan of %s@%s is %s%s", ref.Name(), digest, status, desc)
+			}
+			break
+		}
+	}
+	return out, nil
+}
+
+// ecrFindings converts basic and enhanced (Inspector) findings.
+func ecrFindings(f *ecrtypes.ImageScanFindings) []vulnFinding {
+	if f == nil {
+		return nil
+	}
+	var out []vulnFinding
+	for _, b := range f.Findings {
+		v := vulnFinding{ID: aws.ToString(b.Name), Severity: normalizeSeverity(string(b.Severity))}
+		for _, a := range b.Attributes {
+			switch aws.ToString(a.Key) {
+			case "package_name":
+				v.Package = aws.ToString(a.Value)
+			case "package_version":
+				v.Version = aws.ToString(a.Value)
+			}
+		}
+		out = append(out, v)
+	}
+	for _, e := range f.EnhancedFindings {
+		d := e.PackageVulnerabilityDetails
+		if d == nil {
+			continue
+		}
+		v := vulnFinding{ID: aws.ToString(d.VulnerabilityId), Severity: normalizeSeverity(aws.ToString(e.Severity))}
+		if len(d.VulnerablePackages) == 0 {
+			out = append(out, v)
+		}
+		for _, p := range d.VulnerablePackages {
+			v.Package, v.Version, v.FixedIn = aws.ToString(p.Name), aws.ToString(p.Version), aws.ToString(p.FixedInVersion)
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// scannableDigests returns the image digests behind imageRef, skipping the
+// attestation manifests BuildKit adds to manifest lists.
+func scannableDigests(ctx context.Context, imageRef string) ([]string, error) {
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", imageRef, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		return []string{desc.Digest.String()}, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, d := range m.Manifests {
+		if d.Platform != nil && d.Platform.OS != "unknown" {
+			out = append(out, d.Digest.String())
+		}
+	}
+	return out, nil
+}
+
+// scanFromFlags layers the scan flags over the manifest's scan section.
+func scanFromFlags(cmd *cobra.Command, manifest *projectManifest, failOn, report string) scanConfig {
+	cfg := manifest.Scan
+	if cfg.Report != "" && !filepath.IsAbs(cfg.Report) {
+		cfg.Report = filepath.Join(manifest.dir, cfg.Report)
+	}
+	if cmd.Flags().Changed("fail-on-severity") {
+		cfg.FailOn = failOn
+	}
+	if cmd.Flags().Changed("scan-report") {
+		cfg.Report = report
+	}
+	return cfg
+}
+
+func addScanFlags(cmd *cobra.Command, failOn, report *string, allow *bool) {
+	cmd.Flags().StringVar(failOn, "fail-on-severity", defaultFailOn, "Lowest vulnerability severity that blocks the deploy (critical, high, medium, low or none)")
+	cmd.Flags().StringVar(report, "scan-report", "", "Trivy or Grype JSON report to gate on instead of the registry's scan")
+	cmd.Flags().BoolVar(allow, "allow-vulnerabilities", false, "Deploy even when findings exceed --fail-on-severity or the scan can't run")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+func TestSummarizeFindingsThresholds(t *testing.T) {
+	findings := []vulnFinding{
+		{ID: "CVE-1", Severity: "CRITICAL", Package: "openssl", Version: "3.0.1"},
+		{ID: "CVE-1", Severity: "CRITICAL", Package: "openssl", Version: "3.0.1"},
+		{ID: "CVE-2", Severity: "HIGH", Package: "zlib", Version: "1.2"},
+		{ID: "CVE-3", Severity: "MEDIUM", Package: "curl", Version: "8.0"},
+		{ID: "CVE-4", Severity: "LOW", Package: "bash", Version: "5.1"},
+		{ID: "CVE-5", Severity: "UNDEFINED", Package: "tar", Version: "1.34"},
+	}
+	tests := []struct {
+		name     string
+		cfg      scanConfig
+		status   string
+		blocking []string
+	}{
+		{name: "default critical", status: "failed", blocking: []string{"CVE-1"}},
+		{name: "high", cfg: scanConfig{FailOn: "high"}, status: "failed", blocking: []string{"CVE-1", "CVE-2"}},
+		{name: "case insensitive", cfg: scanConfig{FailOn: "Medium"}, status: "failed", blocking: []string{"CVE-1", "CVE-2", "CVE-3"}},
+		{name: "low", cfg: scanConfig{FailOn: "low"}, status: "failed", blocking: []string{"CVE-1", "CVE-2", "CVE-3", "CVE-4"}},
+		{name: "none only reports", cfg: scanConfig{FailOn: "none"}, status: "passed"},
+		{name: "ignored", cfg: scanConfig{Ignore: []string{"cve-1"}}, status: "passed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := summarizeFindings("test", findings, tt.cfg)
+			if s.Status != tt.status || !reflect.DeepEqual(s.Blocking, tt.blocking) {
+				t.Errorf("status %s blocking %v, want %s %v", s.Status, s.Blocking, tt.status, tt.blocking)
+			}
+		})
+	}
+	s := summarizeFindings("test", findings, scanConfig{})
+	if want := map[string]int{"CRITICAL": 1, "HIGH": 1, "MEDIUM": 1, "LOW": 1, "UNDEFINED": 1}; !reflect.DeepEqual(s.Counts, want) {
+		t.Errorf("counts = %v, want %v (duplicates merged)", s.Counts, want)
+	}
+}
+
+func TestScanConfig(t *testing.T) {
+	tests := []struct {
+		cfg     scanConfig
+		err     string
+		enabled bool
+	}{
+		{cfg: scanConfig{}, enabled: true},
+		{cfg: scanConfig{FailOn: "high", Scanner: scannerTrivy}, enabled: true},
+		{cfg: scanConfig{Enabled: aws.Bool(false)}, enabled: false},
+		{cfg: scanConfig{Enabled: aws.Bool(true)}, enabled: true},
+		{cfg: scanConfig{Scanner: scannerNone}, enabled: false},
+		{cfg: scanConfig{Scanner: "snyk"}, err: "unknown scanner"},
+		{cfg: scanConfig{FailOn: "severe"}, err: "unknown severity"},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.validate()
+		if (tt.err == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validate(%+v) = %v, want %q", tt.cfg, err, tt.err)
+		}
+		if tt.err == "" && tt.cfg.enabled() != tt.enabled {
+			t.Errorf("enabled(%+v) = %v, want %v", tt.cfg, tt.cfg.enabled(), tt.enabled)
+		}
+	}
+	if got := (scanConfig{FailOn: "none"}).threshold(); got != "" {
+		t.Errorf("threshold(none) = %q", got)
+	}
+	if got := (scanConfig{}).threshold(); got != "CRITICAL" {
+		t.Errorf("default threshold = %q", got)
+	}
+}
+
+func TestParseScanReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		report string
+		want   []vulnFinding
+		err    string
+	}{
+		{
+			name: "trivy",
+			report: `{"SchemaVersion": 2, "Results": [{"Vulnerabilities": [
+				{"VulnerabilityID": "CVE-1", "PkgName": "openssl", "InstalledVersion": "3.0.1", "FixedVersion": "3.0.2", "Severity": "CRITICAL"}]}]}`,
+			want: []vulnFinding{{ID: "CVE-1", Severity: "CRITICAL", Package: "openssl", Version: "3.0.1", FixedIn: "3.0.2"}},
+		},
+		{name: "trivy without results", report: `{"SchemaVersion": 2}`},
+		{
+			name: "grype",
+			report: `{"matches": [{"vulnerability": {"id": "GHSA-1", "severity": "Negligible", "fix": {"versions": ["1.1", "2.1"]}},
+				"artifact": {"name": "lodash", "version": "1.0"}}]}`,
+			want: []vulnFinding{{ID: "GHSA-1", Severity: "INFORMATIONAL", Package: "lodash", Version: "1.0", FixedIn: "1.1, 2.1"}},
+		},
+		{name: "grype without matches", report: `{"matches": []}`},
+		{name: "unknown format", report: `{"vulns": []}`, err: "unrecognized scan report"},
+		{name: "invalid json", report: `{`, err: "invalid scan report"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseScanReport([]byte(tt.report))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseScanReport() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanImageFromReport(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"trivy.json": `{"SchemaVersion": 2, "Results": [{"Vulnerabilities": [{"VulnerabilityID": "CVE-9", "Severity": "HIGH"}]}]}`,
+	})
+	s, findings, err := scanImage(context.Background(), "web:v1", scanConfig{Report: filepath.Join(dir, "trivy.json"), FailOn: "high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != "failed" || len(findings) != 1 {
+		t.Errorf("scanImage() = %+v, %v", s, findings)
+	}
+
+	// A report that can't be read is an error, not a pass
+	s, _, err = scanImage(context.Background(), "web:v1", scanConfig{Report: filepath.Join(dir, "missing.json")})
+	if err == nil || s == nil || s.Status != "unavailable" {
+		t.Errorf("missing report: summary %+v, err %v", s, err)
+	}
+
+	// Non-ECR images without a configured scanner aren't scanned
+	if s, _, err := scanImage(context.Background(), "ghcr.io/acme/web:v1", scanConfig{}); s != nil || err != nil {
+		t.Errorf("unscanned registry: %+v, %v", s, err)
+	}
+}
+
+func TestECRFindings(t *testing.T) {
+	f := &ecrtypes.ImageScanFindings{
+		Findings: []ecrtypes.ImageScanFinding{{
+			Name:     aws.String("CVE-1"),
+			Severity: ecrtypes.FindingSeverityHigh,
+			Attributes: []ecrtypes.Attribute{
+				{Key: aws.String("package_name"), Value: aws.String("openssl")},
+				{Key: aws.String("package_version"), Value: aws.String("3.0.1")},
+			},
+		}},
+		EnhancedFindings: []ecrtypes.EnhancedImageScanFinding{{
+			Severity: aws.String("CRITICAL"),
+			PackageVulnerabilityDetails: &ecrtypes.PackageVulnerabilityDetails{
+				VulnerabilityId: aws.String("CVE-2"),
+				VulnerablePackages: []ecrtypes.VulnerablePackage{
+					{Name: aws.String("glibc"), Version: aws.String("2.35"), FixedInVersion: aws.String("2.36")},
+				},
+			},
+		}},
+	}
+	want := []vulnFinding{
+		{ID: "CVE-1", Severity: "HIGH", Package: "openssl", Version: "3.0.1"},
+		{ID: "CVE-2", Severity: "CRITICAL", Package: "glibc", Version: "2.35", FixedIn: "2.36"},
+	}
+	if got := ecrFindings(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("ecrFindings() = %+v, want %+v", got, want)
+	}
+}
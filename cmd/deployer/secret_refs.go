@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	secretsManagerScheme = "secretsmanager://"
+	ssmScheme            = "ssm://"
+
+	// secretStoreFileEnv names a local file that stands in for the AWS
+	// stores, so tests and CI can use the same references offline.
+	secretStoreFileEnv = "FLOW_SECRET_STORE_FILE"
+
+	// How deploy handles references: resolve them locally, or sync them
+	// in the cluster with the External Secrets Operator.
+	secretRefsResolve = "resolve"
+	secretRefsSync    = "sync"
+
+	externalSecretTimeout = 2 * time.Minute
+	syncedAtAnnotation    = "flow.ai/synced-at"
+)
+
+// secretRef is a secret value kept in an external store:
+//
+//	secretsmanager://NAME[?region=R][#KEY]  AWS Secrets Manager (name or ARN)
+//	ssm:///PATH[?region=R][#KEY]            SSM Parameter Store, decrypted
+//
+// KEY picks a field of a JSON value.
+type secretRef struct {
+	Scheme string
+	Name   string
+	Key    string
+	Region string
+}
+
+// parseSecretRef parses s; ok is false when s is a plain value.
+func parseSecretRef(s string) (ref secretRef, ok bool, err error) {
+	var rest string
+	switch {
+	case strings.HasPrefix(s, secretsManagerScheme):
+		ref.Scheme, rest = secretsManagerScheme, strings.TrimPrefix(s, secretsManagerScheme)
+	case strings.HasPrefix(s, ssmScheme):
+		ref.Scheme, rest = ssmScheme, strings.TrimPrefix(s, ssmScheme)
+	default:
+		return ref, false, nil
+	}
+	rest, ref.Key, _ = strings.Cut(rest, "#")
+	rest, query, _ := strings.Cut(rest, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return ref, true, fmt.Errorf("invalid secret reference %s: %v", s, err)
+	}
+	ref.Name, ref.Region = rest, q.Get("region")
+	if ref.Name == "" {
+		return ref, true, fmt.Errorf("invalid secret reference %s: no name", s)
+	}
+	// The region of an ARN is the secret's region
+	if parts := strings.Split(ref.Name, ":"); ref.Region == "" && len(parts) > 3 && parts[0] == "arn" {
+		ref.Region = parts[3]
+	}
+	return ref, true, nil
+}
+
+// String is the reference without the key: the value that is fetched.
+func (r secretRef) String() string {
+	s := r.Scheme + r.Name
+	if r.Region != "" && !strings.HasPrefix(r.Name, "arn:") {
+		s += "?region=" + r.Region
+	}
+	return s
+}
+
+// secretRefResolver fetches referenced values once per deploy.
+type secretRefResolver struct {
+	mu     sync.Mutex
+	values map[string]string
+	local  map[string]string
+}
+
+var secretRefs = &secretRefResolver{}
+
+// resolve returns the value r refers to and registers it for redaction.
+func (s *secretRefResolver) resolve(ctx context.Context, r secretRef) (string, error) {
+	raw, err := s.fetch(ctx, r)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", r, err)
+	}
+	value := raw
+	if r.Key != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+			return "", fmt.Errorf("%s#%s: the value is not a JSON object", r, r.Key)
+		}
+		v, ok := fields[r.Key]
+		if !ok {
+			return "", fmt.Errorf("%s has no key %s", r, r.Key)
+		}
+		if str, isString := v.(string); isString {
+			value = str
+		} else {
+			b, _ := json.Marshal(v)
+			value = string(b)
+		}
+	}
+	secretRedactor.add(value)
+	return value, nil
+}
+
+func (s *secretRefResolver) fetch(ctx context.Context, r secretRef) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[r.String()]; ok {
+		return v, nil
+	}
+	var v string
+	var err error
+	if path := os.Getenv(secretStoreFileEnv); path != "" {
+		v, err = s.fetchLocal(path, r)
+	} else {
+		v, err = fetchAWS(ctx, r)
+	}
+	if err != nil {
+		return "", err
+	}
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	s.values[r.String()] = v
+	return v, nil
+}
+
+// fetchLocal reads r from the local store file, a YAML or JSON map of
+// references (without #KEY) to values; map values are stored as JSON.
+func (s *secretRefResolver) fetchLocal(path string, r secretRef) (string, error) {
+	if s.local == nil {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", secretStoreFileEnv, err)
+		}
+		var entries map[string]interface{}
+		if err := yaml.Unmarshal(raw, &entries); err != nil {
+			return "", fmt.Errorf("%s: %v", path, err)
+		}
+		s.local = map[string]string{}
+		for k, v := range entries {
+			if str, ok := v.(string); ok {
+				s.local[k] = str
+			} else {
+				b, _ := json.Marshal(v)
+				s.local[k] = string(b)
+			}
+		}
+	}
+	v, ok := s.local[r.String()]
+	if !ok {
+		return "", fmt.Errorf("not found in %s", path)
+	}
+	return v, nil
+}
+
+func fetchAWS(ctx context.Context, r secretRef) (string, error) {
+	cfg, err := awsClients.config(ctx)
+	if err != nil {
+		return "", err
+	}
+	region := r.Region
+	if region == "" {
+		region = awsRegion()
+	}
+	switch r.Scheme {
+	case secretsManagerScheme:
+		client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) { o.Region = region })
+		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &r.Name})
+		if err != nil {
+			return "", err
+		}
+		if out.SecretString != nil {
+			return *out.SecretString, nil
+		}
+		return string(out.SecretBinary), nil
+	case ssmScheme:
+		client := ssm.NewFromConfig(cfg, func(o *ssm.Options) { o.Region = region })
+		decrypt := true
+		out, err := client.GetParameter(ctx, &ssm.GetParameterInput{Name: &r.Name, WithDecryption: &decrypt})
+		if err != nil {
+			return "", err
+		}
+		if out.Parameter == nil || out.Parameter.Value == nil {
+			return "", fmt.Errorf("parameter has no value")
+		}
+		return *out.Parameter.Value, nil
+	}
+	return "", fmt.Errorf("unknown store %s", r.Scheme)
+}
+
+// resolveSecretRefs replaces references in data with their values.
+func resolveSecretRefs(ctx context.Context, data map[string]string) error {
+	for _, k := range sortedKeys(data) {
+		ref, ok, err := parseSecretRef(data[k])
+		if err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		if !ok {
+			continue
+		}
+		if data[k], err = secretRefs.resolve(ctx, ref); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// splitSecretRefs moves references out of data.
+func splitSecretRefs(data map[string]string) (map[string]secretRef, error) {
+	refs := map[string]secretRef{}
+	for k, v := range data {
+		ref, ok, err := parseSecretRef(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if ok {
+			refs[k] = ref
+			delete(data, k)
+		}
+	}
+	return refs, nil
+}
+
+// secretStores names the ClusterSecretStores that serve each scheme.
+type secretStores struct {
+	SecretsManager string
+	ParameterStore string
+}
+
+func (s secretStores) storeRef(r secretRef) map[string]string {
+	name := s.SecretsManager
+	if r.Scheme == ssmScheme {
+		name = s.ParameterStore
+	}
+	return map[string]string{"name": name, "kind": "ClusterSecretStore"}
+}
+
+// externalSecret is the part of an ExternalSecret flow reads back.
+type externalSecret struct {
+	Spec struct {
+		Data []struct {
+			SecretKey string `json:"secretKey"`
+		} `json:"data"`
+	} `json:"spec"`
+	Status struct {
+		SyncedResourceVersion string `json:"syncedResourceVersion"`
+		Conditions            []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// getExternalSecret returns nil when there is none, including when the
+// External Secrets Operator isn't installed. Any other failure is an
+// error, so an unreachable cluster isn't mistaken for no ExternalSecret.
+func getExternalSecret(ctx context.Context, name, ns, kubecontext string) (*externalSecret, error) {
+	var stderr bytes.Buffer
+	c := kubectlCmd(ctx, kubecontext, ns, "get", "externalsecrets.external-secrets.io", name, "-o", "json", "--ignore-not-found")
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		if externalSecretAbsent(stderr.String()) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get externalsecret %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, nil
+	}
+	var es externalSecret
+	if err := json.Unmarshal(out, &es); err != nil {
+		return nil, fmt.Errorf("failed to read externalsecret %s: %v", name, err)
+	}
+	return &es, nil
+}
+
+// externalSecretAbsent reports whether kubectl's error output means the
+// ExternalSecret doesn't exist: NotFound, or no ExternalSecret CRD.
+func externalSecretAbsent(stderr string) bool {
+	return strings.Contains(stderr, "(NotFound)") ||
+		strings.Contains(stderr, "doesn't have a resource type") ||
+		strings.Contains(stderr, "no matches for kind")
+}
+
+// syncedSince reports whether es is Ready from a sync of what was applied:
+// the synced version moved on from before and, as the operator writes it
+// as <generation>-<metadata hash>, belongs to generation. The generation
+// covers an ExternalSecret that had never synced, where before is empty.
+func (es *externalSecret) syncedSince(before string, generation string) bool {
+	v := es.synced()
+	if v == "" || v == before {
+		return false
+	}
+	if gen, _, ok := strings.Cut(v, "-"); ok && generation != "" && gen != generation {
+		return false
+	}
+	for _, c := range es.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+func (es *externalSecret) synced() string {
+	if es == nil {
+		return ""
+	}
+	return es.Status.SyncedResourceVersion
+}
+
+func (es *externalSecret) keys() []string {
+	if es == nil {
+		return nil
+	}
+	var keys []string
+	for _, d := range es.Spec.Data {
+		keys = append(keys, d.SecretKey)
+	}
+	return keys
+}
+
+// externalSecretsAPIVersion picks the ExternalSecret version the cluster
+// serves from kubectl api-versions output. v1 replaced v1beta1, which
+// newer operators no longer serve.
+func externalSecretsAPIVersion(apiVersions string) (string, error) {
+	served := map[string]bool{}
+	for _, v := range strings.Fields(apiVersions) {
+		served[v] = true
+	}
+	for _, v := range []string{"external-secrets.io/v1", "external-secrets.io/v1beta1"} {
+		if served[v] {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("the cluster doesn't serve external-secrets.io/v1 or v1beta1; install the External Secrets Operator to use --secret-refs sync")
+}
+
+// applyExternalSecret has the External Secrets Operator merge refs into
+// the Secret name, and waits for the first sync so the new revision
+// starts with the values. No refs removes the ExternalSecret; the keys it
+// synced are left to the caller.
+func applyExternalSecret(ctx context.Context, app, name, ns, kubecontext string, refs map[string]secretRef, stores secretStores, prev *externalSecret) error {
+	if len(refs) == 0 {
+		if prev == nil {
+			return nil
+		}
+		if out, err := kubectlCmd(ctx, kubecontext, ns, "delete", "externalsecrets.external-secrets.io", name, "--ignore-not-found").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to delete externalsecret %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		fmt.Printf("Removed externalsecret %s\n", name)
+		return nil
+	}
+
+	var data []map[string]interface{}
+	keys := make([]string, 0, len(refs))
+	for k := range refs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r := refs[k]
+		remote := map[string]string{"key": r.Name}
+		if r.Key != "" {
+			remote["property"] = r.Key
+		}
+		data = append(data, map[string]interface{}{
+			"secretKey": k,
+			"remoteRef": remote,
+			"sourceRef": map[string]interface{}{"storeRef": stores.storeRef(r)},
+		})
+	}
+	out, err := kubectlCmd(ctx, kubecontext, ns, "api-versions").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list API versions: %v", err)
+	}
+	apiVersion, err := externalSecretsAPIVersion(string(out))
+	if err != nil {
+		return err
+	}
+	manifest := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "ExternalSecret",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": ns,
+			"labels":    map[string]string{attachmentAppLabel: app, managedByLabel: managedByFlow},
+			// A new annotation makes the operator sync now, so a deploy
+			// picks up values changed in the store
+			"annotations": map[string]string{syncedAtAnnotation: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+		"spec": map[string]interface{}{
+			"refreshInterval": "1h",
+			"secretStoreRef":  stores.storeRef(refs[keys[0]]),
+			// Merge into the Secret flow writes literals to
+			"target": map[string]string{"name": name, "creationPolicy": "Merge", "deletionPolicy": "Retain"},
+			"data":   data,
+		},
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	c := kubectlCmd(ctx, kubecontext, ns, "apply", "-f", "-", "-o", "jsonpath={.metadata.generation}")
+	c.Stdin, c.Stderr = bytes.NewReader(b), &stderr
+	out, err = c.Output()
+	if err != nil {
+		return fmt.Errorf("failed to apply externalsecret %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	generation := strings.TrimSpace(string(out))
+	before := prev.synced()
+	fmt.Printf("Waiting for externalsecret %s to sync %d keys...\n", name, len(refs))
+	ctx, cancel := context.WithTimeout(ctx, externalSecretTimeout)
+	defer cancel()
+	// A failed sync leaves the synced version alone; the last Ready
+	// condition (or lookup error) explains the timeout
+	last := ""
+	for {
+		es, err := getExternalSecret(ctx, name, ns, kubecontext)
+		switch {
+		case err != nil:
+			last = ": " + err.Error()
+		case es.syncedSince(before, generation):
+			return nil
+		case es != nil:
+			for _, c := range es.Status.Conditions {
+				if c.Type == "Ready" {
+					last = fmt.Sprintf(": %s: %s", c.Reason, c.Message)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("externalsecret %s did not sync within %s%s", name, externalSecretTimeout, last)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   secretRef
+		ok     bool
+		err    string
+		String string
+	}{
+		{in: "plain value"},
+		{in: "https://example.com/#frag"},
+		{
+			in:     "secretsmanager://prod/db#password",
+			want:   secretRef{Scheme: secretsManagerScheme, Name: "prod/db", Key: "password"},
+			ok:     true,
+			String: "secretsmanager://prod/db",
+		},
+		{
+			in:     "secretsmanager://prod/api?region=eu-west-1",
+			want:   secretRef{Scheme: secretsManagerScheme, Name: "prod/api", Region: "eu-west-1"},
+			ok:     true,
+			String: "secretsmanager://prod/api?region=eu-west-1",
+		},
+		{
+			in:     "secretsmanager://arn:aws:secretsmanager:us-west-2:123456789012:secret:db-AbCd#user",
+			want:   secretRef{Scheme: secretsManagerScheme, Name: "arn:aws:secretsmanager:us-west-2:123456789012:secret:db-AbCd", Key: "user", Region: "us-west-2"},
+			ok:     true,
+			String: "secretsmanager://arn:aws:secretsmanager:us-west-2:123456789012:secret:db-AbCd",
+		},
+		{
+			in:     "ssm:///app/prod/token?region=us-east-2#field",
+			want:   secretRef{Scheme: ssmScheme, Name: "/app/prod/token", Key: "field", Region: "us-east-2"},
+			ok:     true,
+			String: "ssm:///app/prod/token?region=us-east-2",
+		},
+		{in: "ssm://", ok: true, err: "no name"},
+		{in: "secretsmanager://x?region=%zz", ok: true, err: "invalid secret reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok, err := parseSecretRef(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+			if ok && got.String() != tt.String {
+				t.Errorf("String() = %q, want %q", got.String(), tt.String)
+			}
+		})
+	}
+}
+
+// useSecretStoreFile points the resolver at a local store with entries.
+func useSecretStoreFile(t *testing.T, entries map[string]interface{}) {
+	t.Helper()
+	b, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := writeTree(t, map[string]string{"store.json": string(b)})
+	t.Setenv(secretStoreFileEnv, filepath.Join(dir, "store.json"))
+	old := secretRefs
+	secretRefs = &secretRefResolver{}
+	t.Cleanup(func() { secretRefs = old })
+}
+
+func TestResolveSecretRefs(t *testing.T) {
+	useSecretStoreFile(t, map[string]interface{}{
+		"secretsmanager://prod/db":                  map[string]interface{}{"user": "app", "password": "s3cret", "port": 5432, "opts": map[string]interface{}{"ssl": true}},
+		"ssm:///app/token":                          "tok-123",
+		"secretsmanager://prod/db?region=eu-west-1": `{"password":"other-region"}`,
+	})
+	data := map[string]string{
+		"DB_USER":     "secretsmanager://prod/db#user",
+		"DB_PASSWORD": "secretsmanager://prod/db#password",
+		"DB_PORT":     "secretsmanager://prod/db#port",
+		"DB_OPTS":     "secretsmanager://prod/db#opts",
+		"DB_EU":       "secretsmanager://prod/db?region=eu-west-1#password",
+		"TOKEN":       "ssm:///app/token",
+		"LITERAL":     "kept as is",
+	}
+	if err := resolveSecretRefs(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DB_USER":     "app",
+		"DB_PASSWORD": "s3cret",
+		"DB_PORT":     "5432",
+		"DB_OPTS":     `{"ssl":true}`,
+		"DB_EU":       "other-region",
+		"TOKEN":       "tok-123",
+		"LITERAL":     "kept as is",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("resolveSecretRefs() =\n%v\nwant\n%v", data, want)
+	}
+	if got := secretRedactor.redact("password is s3cret"); strings.Contains(got, "s3cret") {
+		t.Errorf("resolved value is not redacted: %q", got)
+	}
+
+	for ref, msg := range map[string]string{
+		"secretsmanager://prod/db#missing": "has no key missing",
+		"ssm:///app/token#field":           "not a JSON object",
+		"ssm:///app/unknown":               "not found in",
+	} {
+		err := resolveSecretRefs(context.Background(), map[string]string{"K": ref})
+		if err == nil || !strings.Contains(err.Error(), msg) || !strings.HasPrefix(err.Error(), "K: ") {
+			t.Errorf("%s: err = %v, want %q", ref, err, msg)
+		}
+	}
+}
+
+func TestSplitSecretRefs(t *testing.T) {
+	data := map[string]string{
+		"A":   "literal",
+		"B":   "secretsmanager://prod/db#password",
+		"TOK": "ssm:///app/token",
+	}
+	refs, err := splitSecretRefs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"A": "literal"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("data = %v, want %v", data, want)
+	}
+	want := map[string]secretRef{
+		"B":   {Scheme: secretsManagerScheme, Name: "prod/db", Key: "password"},
+		"TOK": {Scheme: ssmScheme, Name: "/app/token"},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("refs = %v, want %v", refs, want)
+	}
+	if _, err := splitSecretRefs(map[string]string{"BAD": "ssm://"}); err == nil || !strings.HasPrefix(err.Error(), "BAD: ") {
+		t.Errorf("invalid reference: err = %v", err)
+	}
+}
+
+func TestExternalSecretAbsent(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{`error: the server doesn't have a resource type "externalsecrets"`, true},
+		{`Error from server (NotFound): externalsecrets.external-secrets.io "app-secrets" not found`, true},
+		{"The connection to the server localhost:8080 was refused - did you specify the right host or port?", false},
+		{`Error from server (Forbidden): externalsecrets.external-secrets.io "app-secrets" is forbidden`, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := externalSecretAbsent(tt.stderr); got != tt.want {
+			t.Errorf("externalSecretAbsent(%q) = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestExternalSecretsAPIVersion(t *testing.T) {
+	tests := []struct {
+		served  string
+		want    string
+		wantErr bool
+	}{
+		{"apps/v1\nexternal-secrets.io/v1\nexternal-secrets.io/v1beta1\nv1\n", "external-secrets.io/v1", false},
+		{"apps/v1\nexternal-secrets.io/v1beta1\nv1\n", "external-secrets.io/v1beta1", false},
+		{"external-secrets.io/v1alpha1\ngenerators.external-secrets.io/v1\nv1\n", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := externalSecretsAPIVersion(tt.served)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("externalSecretsAPIVersion(%q) = %q, %v; want %q (error %v)", tt.served, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExternalSecretSyncedSince(t *testing.T) {
+	es := func(version, ready string) *externalSecret {
+		var e externalSecret
+		raw := `{"status": {"syncedResourceVersion": "` + version + `", "conditions": [{"type": "Ready", "status": "` + ready + `"}]}}`
+		if err := json.Unmarshal([]byte(raw), &e); err != nil {
+			t.Fatal(err)
+		}
+		return &e
+	}
+	tests := []struct {
+		name       string
+		es         *externalSecret
+		before     string
+		generation string
+		want       bool
+	}{
+		{"not created yet", nil, "", "1", false},
+		{"never synced", es("", "False"), "", "1", false},
+		{"first sync", es("1-abc", "True"), "", "1", true},
+		{"still the previous sync", es("2-abc", "True"), "2-abc", "2", false},
+		{"annotation change synced", es("2-def", "True"), "2-abc", "2", true},
+		// An ExternalSecret that had never synced (before is empty) finishing
+		// a sync of the spec before the apply
+		{"sync of an older generation", es("1-abc", "True"), "", "2", false},
+		{"sync failed", es("2-def", "False"), "2-abc", "2", false},
+		{"generation unknown", es("3-xyz", "True"), "2-abc", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.es.syncedSince(tt.before, tt.generation); got != tt.want {
+				t.Errorf("syncedSince(%q, %q) = %v, want %v", tt.before, tt.generation, got, tt.want)
+			}
+		})
+	}
+}
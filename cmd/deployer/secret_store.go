@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// keyUpdate is a change to the keys of a Secret or ConfigMap. By default
+// Set is merged into the existing keys; Replace drops every key not in Set.
+type keyUpdate struct {
+	Set     map[string]string
+	Unset   []string
+	Replace bool
+	// Keep lists keys Replace leaves alone, because another writer owns them.
+	Keep []string
+	// Labels are added to the object; existing labels are kept.
+	Labels map[string]string
+}
+
+func (u keyUpdate) validate() error {
+	for _, k := range u.Unset {
+		if _, ok := u.Set[k]; ok {
+			return fmt.Errorf("key %s is both set and unset", k)
+		}
+	}
+	return nil
+}
+
+// keyChange reports which keys an update touched, never values.
+type keyChange struct {
+	Created bool
+	Set     []string
+	Removed []string
+}
+
+func (c keyChange) String() string {
+	var parts []string
+	if len(c.Set) > 0 {
+		parts = append(parts, "set "+strings.Join(c.Set, ", "))
+	}
+	if len(c.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(c.Removed, ", "))
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// upsertSecret applies u to the Secret name in ns, creating it if needed.
+// Updates are sent with the resourceVersion that was read, so a concurrent
+// writer makes the update fail with a conflict; it is then re-read and
+// re-applied rather than overwritten.
+func upsertSecret(ctx context.Context, client *kubernetes.Clientset, ns, name string, u keyUpdate) (keyChange, error) {
+	if err := u.validate(); err != nil {
+		return keyChange{}, err
+	}
+	var change keyChange
+	retriable := func(err error) bool { return errors.IsConflict(err) || errors.IsAlreadyExists(err) }
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		secrets := client.CoreV1().Secrets(ns)
+		sec, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			sec = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}
+			change = applySecretUpdate(sec, u)
+			change.Created = true
+			// AlreadyExists means someone else created it first; retry as
+			// an update
+			_, err = secrets.Create(ctx, sec, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		change = applySecretUpdate(sec, u)
+		_, err = secrets.Update(ctx, sec, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return keyChange{}, fmt.Errorf("failed to write secret %s: %v", name, err)
+	}
+	return change, nil
+}
+
+// applySecretUpdate changes sec in place.
+func applySecretUpdate(sec *corev1.Secret, u keyUpdate) keyChange {
+	data := map[string]string{}
+	for k, v := range sec.Data {
+		data[k] = string(v)
+	}
+	change := applyKeyUpdate(data, u)
+	sec.Data = map[string][]byte{}
+	for k, v := range data {
+		sec.Data[k] = []byte(v)
+	}
+	// StringData is write-only; anything read back is already in Data
+	sec.StringData = nil
+	sec.Labels = mergeLabels(sec.Labels, u.Labels)
+	return change
+}
+
+// applyKeyUpdate changes data in place.
+func applyKeyUpdate(data map[string]string, u keyUpdate) keyChange {
+	var change keyChange
+	remove := map[string]bool{}
+	for _, k := range u.Unset {
+		remove[k] = true
+	}
+	if u.Replace {
+		for k := range data {
+			if _, keep := u.Set[k]; !keep && !contains(u.Keep, k) {
+				remove[k] = true
+			}
+		}
+	}
+	for k := range remove {
+		if _, ok := data[k]; ok {
+			delete(data, k)
+			change.Removed = append(change.Removed, k)
+		}
+	}
+	for k, v := range u.Set {
+		if old, ok := data[k]; !ok || old != v {
+			change.Set = append(change.Set, k)
+		}
+		data[k] = v
+	}
+	sort.Strings(change.Set)
+	sort.Strings(change.Removed)
+	return change
+}
+
+func mergeLabels(labels, add map[string]string) map[string]string {
+	if len(add) > 0 && labels == nil {
+		labels = map[string]string{}
+	}
+	for k, v := range add {
+		labels[k] = v
+	}
+	return labels
+}
+
+// upsertConfigMap is upsertSecret for ConfigMaps.
+func upsertConfigMap(ctx context.Context, client *kubernetes.Clientset, ns, name string, u keyUpdate) (keyChange, error) {
+	if err := u.validate(); err != nil {
+		return keyChange{}, err
+	}
+	var change keyChange
+	retriable := func(err error) bool { return errors.IsConflict(err) || errors.IsAlreadyExists(err) }
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		configMaps := client.CoreV1().ConfigMaps(ns)
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		created := errors.IsNotFound(err)
+		if created {
+			cm, err = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}, nil
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		change = applyKeyUpdate(cm.Data, u)
+		change.Created = created
+		cm.Labels = mergeLabels(cm.Labels, u.Labels)
+		if created {
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		} else {
+			_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		return err
+	})
+	if err != nil {
+		return keyChange{}, fmt.Errorf("failed to write configmap %s: %v", name, err)
+	}
+	return change, nil
+}
+
+// parseSecretPairs turns key=value flags into Secret data.
+func parseSecretPairs(pairs []string) (map[string]string, error) {
+	data := map[string]string{}
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid secret pair: %s", p)
+		}
+		data[k] = v
+	}
+	return data, nil
+}
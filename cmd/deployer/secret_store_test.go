@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyKeyUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   map[string]string
+		update keyUpdate
+		want   map[string]string
+		change keyChange
+	}{
+		{
+			name:   "merge",
+			data:   map[string]string{"A": "1", "B": "2"},
+			update: keyUpdate{Set: map[string]string{"B": "3", "C": "4"}},
+			want:   map[string]string{"A": "1", "B": "3", "C": "4"},
+			change: keyChange{Set: []string{"B", "C"}},
+		},
+		{
+			name:   "unchanged values are not reported",
+			data:   map[string]string{"A": "1"},
+			update: keyUpdate{Set: map[string]string{"A": "1"}},
+			want:   map[string]string{"A": "1"},
+		},
+		{
+			name:   "unset ignores missing keys",
+			data:   map[string]string{"A": "1", "B": "2"},
+			update: keyUpdate{Unset: []string{"B", "MISSING"}},
+			want:   map[string]string{"A": "1"},
+			change: keyChange{Removed: []string{"B"}},
+		},
+		{
+			name:   "replace keeps owned keys",
+			data:   map[string]string{"A": "1", "B": "2", "OWNED": "x"},
+			update: keyUpdate{Set: map[string]string{"A": "1", "C": "3"}, Replace: true, Keep: []string{"OWNED"}},
+			want:   map[string]string{"A": "1", "C": "3", "OWNED": "x"},
+			change: keyChange{Set: []string{"C"}, Removed: []string{"B"}},
+		},
+		{
+			name:   "replace with nothing empties",
+			data:   map[string]string{"Z": "1", "A": "2"},
+			update: keyUpdate{Replace: true},
+			want:   map[string]string{},
+			change: keyChange{Removed: []string{"A", "Z"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change := applyKeyUpdate(tt.data, tt.update)
+			if !reflect.DeepEqual(tt.data, tt.want) {
+				t.Errorf("data = %v, want %v", tt.data, tt.want)
+			}
+			if !reflect.DeepEqual(change, tt.change) {
+				t.Errorf("change = %+v, want %+v", change, tt.change)
+			}
+		})
+	}
+}
+
+func TestKeyUpdateValidate(t *testing.T) {
+	if err := (keyUpdate{Set: map[string]string{"A": "1"}, Unset: []string{"B"}}).validate(); err != nil {
+		t.Errorf("validate() = %v", err)
+	}
+	if err := (keyUpdate{Set: map[string]string{"A": "1"}, Unset: []string{"A"}}).validate(); err == nil {
+		t.Error("set and unset of the same key: want an error")
+	}
+}
+
+func TestKeyChangeString(t *testing.T) {
+	tests := []struct {
+		change keyChange
+		want   string
+	}{
+		{keyChange{}, "no changes"},
+		{keyChange{Created: true}, "no changes"},
+		{keyChange{Set: []string{"A", "B"}}, "set A, B"},
+		{keyChange{Removed: []string{"C"}}, "removed C"},
+		{keyChange{Set: []string{"A"}, Removed: []string{"C"}}, "set A; removed C"},
+	}
+	for _, tt := range tests {
+		if got := tt.change.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.change, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Signatures use cosign's key-pair format: a simple-signing payload per
+// digest, stored as a layer of <repo>:sha256-<hex>.sig with the base64
+// signature in an annotation. `cosign verify --key` accepts them.
+const (
+	simpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnno    = "dev.cosignproject.cosign/signature"
+	cosignSignatureType    = "cosign container image signature"
+)
+
+// PEM block types cosign writes for encrypted private keys (current and
+// older releases).
+var encryptedKeyTypes = []string{"ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY"}
+
+// signingConfig is the signing section of flow.yaml. Key paths are
+// relative to the manifest; the private key password comes from
+// COSIGN_PASSWORD.
+type signingConfig struct {
+	Key       string `json:"key,omitempty"`
+	PublicKey string `json:"publicKey,omitempty"`
+	// Verify refuses to deploy images without a valid signature.
+	Verify bool `json:"verify,omitempty"`
+}
+
+// resolve makes key paths absolute against dir.
+func (c signingConfig) resolve(dir string) signingConfig {
+	abs := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	c.Key, c.PublicKey = abs(c.Key), abs(c.PublicKey)
+	return c
+}
+
+// verifyKey returns the public key to verify with: the configured public
+// key, else the private key's.
+func (c signingConfig) verifyKey() (*ecdsa.PublicKey, error) {
+	if c.PublicKey != "" {
+		return loadPublicKey(c.PublicKey)
+	}
+	if c.Key != "" {
+		key, err := loadPrivateKey(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &key.PublicKey, nil
+	}
+	return nil, fmt.Errorf("signature verification is enabled but no signing.publicKey is configured")
+}
+
+// simpleSigningPayload is cosign's payload for a signed digest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+func signaturePayload(repo name.Repository, digest v1.Hash) ([]byte, error) {
+	var p simpleSigningPayload
+	p.Critical.Identity.DockerReference = repo.Name()
+	p.Critical.Image.DockerManifestDigest = digest.String()
+	p.Critical.Type = cosignSignatureType
+	return json.Marshal(p)
+}
+
+// signatureTag is where cosign looks for digest's signatures.
+func signatureTag(repo name.Repository, digest v1.Hash) name.Tag {
+	return repo.Tag(fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex))
+}
+
+// signImage signs imageRef's current digest with the key at keyPath and
+// pushes the signature. Returns the signed digest reference.
+func signImage(ctx context.Context, imageRef, keyPath string) (string, error) {
+	key, err := loadPrivateKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return "", err
+	}
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain())}
+	desc, err := remote.Head(ref, opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", imageRef, err)
+	}
+	repo := ref.Context()
+	signed := repo.Digest(desc.Digest.String()).String()
+
+	existing, err := signatureImage(signatureTag(repo, desc.Digest), opts)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil && hasValidSignature(existing, repo, desc.Digest, &key.PublicKey) == nil {
+		// Already signed with this key; tags may be immutable
+		fmt.Printf("%s is already signed\n", signed)
+		return signed, nil
+	}
+
+	payload, err := signaturePayload(repo, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	base := existing
+	if base == nil {
+		base = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	}
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer:       static.NewLayer(payload, simpleSigningMediaType),
+		Annotations: map[string]string{cosignSignatureAnno: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := remote.Write(signatureTag(repo, desc.Digest), img, opts...); err != nil {
+		return "", fmt.Errorf("failed to push signature: %v", err)
+	}
+	fmt.Printf("Signed %s\n", signed)
+	return signed, nil
+}
+
+// verifyImageSignature checks that imageRef's current digest carries a
+// signature from pub, returning the verified digest reference to deploy.
+func verifyImageSignature(ctx context.Context, imageRef string, pub *ecdsa.PublicKey) (string, error) {
+	ref, err := remoteRef(imageRef)
+	if err != nil {
+		return "", err
+	}
+	opts := []remote.Option{remote.WithContext(ctx), remote.WithAuthFromKeychain(registryKeychain())}
+	desc, err := remote.Head(ref, opts...)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", imageRef, err)
+	}
+	repo := ref.Context()
+	sigs, err := signatureImage(signatureTag(repo, desc.Digest), opts)
+	if err != nil {
+		return "", err
+	}
+	if sigs == nil {
+		return "", fmt.Errorf("%s@%s is not signed", repo.Name(), desc.Digest)
+	}
+	if err := hasValidSignature(sigs, repo, desc.Digest, pub); err != nil {
+		return "", fmt.Errorf("%s@%s: %v", repo.Name(), desc.Digest, err)
+	}
+	return repo.Digest(desc.Digest.String()).String(), nil
+}
+
+// signatureImage fetches the signature image at tag, or nil if there is
+// none yet.
+func signatureImage(tag name.Tag, opts []remote.Option) (v1.Image, error) {
+	img, err := remote.Image(tag, opts...)
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signatures %s: %v", tag.Name(), err)
+	}
+	return img, nil
+}
+
+// hasValidSignature returns nil if any layer of sigs is a signature by pub
+// over a payload naming digest.
+func hasValidSignature(sigs v1.Image, repo name.Repository, digest v1.Hash, pub *ecdsa.PublicKey) error {
+	m, err := sigs.Manifest()
+	if err != nil {
+		return err
+	}
+	for _, d := range m.Layers {
+		sig, err := base64.StdEncoding.DecodeString(d.Annotations[cosignSignatureAnno])
+		if err != nil || len(sig) == 0 || d.MediaType != simpleSigningMediaType {
+			continue
+		}
+		layer, err := sigs.LayerByDigest(d.Digest)
+		if err != nil {
+			continue
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			continue
+		}
+		payload, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(pub, sum[:], sig) {
+			continue
+		}
+		var p simpleSigningPayload
+		if json.Unmarshal(payload, &p) != nil || p.Critical.Type != cosignSignatureType {
+			continue
+		}
+		if p.Critical.Image.DockerManifestDigest == digest.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("no signature matches the verification key")
+}
+
+// loadPrivateKey reads an ECDSA key: cosign's encrypted format (password
+// from COSIGN_PASSWORD) or an unencrypted PKCS#8/SEC 1 PEM.
+func loadPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key", path)
+	}
+	der := block.Bytes
+	for _, t := range encryptedKeyTypes {
+		if block.Type == t {
+			if der, err = decryptCosignKey(block.Bytes, []byte(os.Getenv("COSIGN_PASSWORD"))); err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s (is COSIGN_PASSWORD set?): %v", path, err)
+			}
+		}
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(der)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %v", path, err)
+	}
+	ec, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ECDSA key", path)
+	}
+	return ec, nil
+}
+
+func loadPublicKey(path string) (*ecdsa.PublicKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s is not a PEM public key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ec, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an ECDSA key", path)
+	}
+	return ec, nil
+}
+
+// encryptedKey is the scrypt + secretbox envelope cosign stores private
+// keys in.
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func decryptCosignKey(data, password []byte) ([]byte, error) {
+	var k encryptedKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	if k.KDF.Name != "scrypt" || k.Cipher.Name != "nacl/secretbox" || len(k.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported key encryption %s/%s", k.KDF.Name, k.Cipher.Name)
+	}
+	secret, err := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], secret)
+	copy(nonce[:], k.Cipher.Nonce)
+	out, ok := secretbox.Open(nil, k.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("wrong password")
+	}
+	return out, nil
+}
+
+func encryptCosignKey(der, password []byte) ([]byte, error) {
+	var k encryptedKey
+	k.KDF.Name = "scrypt"
+	k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P = 32768, 8, 1
+	k.KDF.Salt = make([]byte, 32)
+	k.Cipher.Name = "nacl/secretbox"
+	k.Cipher.Nonce = make([]byte, 24)
+	if _, err := rand.Read(k.KDF.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(k.Cipher.Nonce); err != nil {
+		return nil, err
+	}
+	secret, err := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], secret)
+	copy(nonce[:], k.Cipher.Nonce)
+	k.Ciphertext = secretbox.Seal(nil, der, &nonce, &key)
+	return json.Marshal(k)
+}
+
+func newSigningCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "signing",
+		Short: "Manage image signing keys",
+	}
+	cmd.AddCommand(newGenerateKeyPairCmd())
+	return cmd
+}
+
+func newGenerateKeyPairCmd() *cobra.Command {
+	var prefix string
+	cmd := &cobra.Command{
+		Use:   "generate-key-pair",
+		Short: "Generate a cosign-compatible key pair (<prefix>.key encrypted with COSIGN_PASSWORD, <prefix>.pub)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyPath, pubPath := prefix+".key", prefix+".pub"
+			for _, p := range []string{keyPath, pubPath} {
+				if _, err := os.Stat(p); err == nil {
+					return fmt.Errorf("%s already exists", p)
+				}
+			}
+			password := os.Getenv("COSIGN_PASSWORD")
+			if password == "" {
+				fmt.Printf("Warning: COSIGN_PASSWORD is empty; the private key is encrypted with an empty password\n")
+			}
+
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return err
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return err
+			}
+			enc, err := encryptCosignKey(der, []byte(password))
+			if err != nil {
+				return err
+			}
+			pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: encryptedKeyTypes[0], Bytes: enc}), 0600); err != nil {
+				return err
+			}
+			if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %s and %s. Keep %s out of version control.\n", keyPath, pubPath, keyPath)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&prefix, "output-key-prefix", "cosign", "Path prefix of the key files")
+	return cmd
+}
+
+// signingFromFlags layers --sign-key and --verify-signatures over the
+// manifest's signing section.
+func signingFromFlags(cmd *cobra.Command, manifest *projectManifest, signKey string, verify bool) signingConfig {
+	cfg := manifest.Signing.resolve(manifest.dir)
+	if cmd.Flags().Changed("sign-key") {
+		cfg.Key = signKey
+	}
+	if cmd.Flags().Changed("verify-signatures") {
+		cfg.Verify = verify
+	}
+	return cfg
+}
+
+func addSigningFlags(cmd *cobra.Command, signKey *string, verify *bool) {
+	cmd.Flags().StringVar(signKey, "sign-key", "", "cosign private key to sign pushed images with (password from COSIGN_PASSWORD)")
+	if verify != nil {
+		cmd.Flags().BoolVar(verify, "verify-signatures", false, "Refuse to deploy images without a valid signature from signing.publicKey")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// writeSigningKey writes a cosign-format encrypted key and its public key
+// to dir and returns their paths.
+func writeSigningKey(t *testing.T, dir, password string) (keyPath, pubPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encryptCosignKey(der, []byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, pubPath = filepath.Join(dir, "cosign.key"), filepath.Join(dir, "cosign.pub")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: encryptedKeyTypes[0], Bytes: enc}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, pubPath
+}
+
+func TestCosignKeyEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyPath, pubPath := writeSigningKey(t, dir, "hunter2")
+
+	t.Setenv("COSIGN_PASSWORD", "hunter2")
+	key, err := loadPrivateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := loadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(pub) {
+		t.Error("decrypted key doesn't match the public key")
+	}
+	verify, err := signingConfig{Key: keyPath}.verifyKey()
+	if err != nil || !verify.Equal(pub) {
+		t.Errorf("verifyKey() from the private key = %v, %v", verify, err)
+	}
+
+	t.Setenv("COSIGN_PASSWORD", "wrong")
+	if _, err := loadPrivateKey(keyPath); err == nil || !strings.Contains(err.Error(), "wrong password") {
+		t.Errorf("wrong password: err = %v", err)
+	}
+
+	raw, _ := os.ReadFile(keyPath)
+	block, _ := pem.Decode(raw)
+	var envelope encryptedKey
+	if err := json.Unmarshal(block.Bytes, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.KDF.Name != "scrypt" || envelope.Cipher.Name != "nacl/secretbox" || len(envelope.KDF.Salt) != 32 {
+		t.Errorf("envelope = %+v", envelope)
+	}
+	envelope.KDF.Name = "pbkdf2"
+	data, _ := json.Marshal(envelope)
+	if _, err := decryptCosignKey(data, []byte("hunter2")); err == nil || !strings.Contains(err.Error(), "unsupported key encryption") {
+		t.Errorf("unsupported KDF: err = %v", err)
+	}
+
+	if _, err := loadPublicKey(keyPath); err == nil {
+		t.Error("loadPublicKey() accepted a private key")
+	}
+	if _, err := (signingConfig{}).verifyKey(); err == nil {
+		t.Error("verifyKey() without keys succeeded")
+	}
+}
+
+func TestSignAndVerifyImage(t *testing.T) {
+	host := testRegistry(t)
+	imageRef := host + "/team/app:v1"
+	ref, _ := name.ParseReference(imageRef, name.Insecure)
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := img.Digest()
+
+	dir := t.TempDir()
+	t.Setenv("COSIGN_PASSWORD", "")
+	keyPath, pubPath := writeSigningKey(t, dir, "")
+	pub, err := loadPublicKey(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := verifyImageSignature(ctx, imageRef, pub); err == nil || !strings.Contains(err.Error(), "is not signed") {
+		t.Errorf("unsigned image: err = %v", err)
+	}
+
+	signed, err := signImage(ctx, imageRef, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ref.Context().Digest(digest.String()).String()
+	if signed != want {
+		t.Errorf("signImage() = %s, want %s", signed, want)
+	}
+	// Signing again adds no duplicate signature layer
+	if _, err := signImage(ctx, imageRef, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := remote.Image(signatureTag(ref.Context(), digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layers, _ := sigs.Layers(); len(layers) != 1 {
+		t.Errorf("signature image has %d layers, want 1", len(layers))
+	}
+
+	got, err := verifyImageSignature(ctx, imageRef, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("verifyImageSignature() = %s, want %s", got, want)
+	}
+
+	_, otherPub := writeSigningKey(t, t.TempDir(), "")
+	other, err := loadPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyImageSignature(ctx, imageRef, other); err == nil || !strings.Contains(err.Error(), "no signature matches") {
+		t.Errorf("other key: err = %v", err)
+	}
+}
+
+func TestSignaturePayload(t *testing.T) {
+	repo, _ := name.NewRepository("registry.example.com/team/app")
+	img, _ := random.Image(16, 1)
+	digest, _ := img.Digest()
+	raw, err := signaturePayload(repo, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p simpleSigningPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Critical.Identity.DockerReference != "registry.example.com/team/app" ||
+		p.Critical.Image.DockerManifestDigest != digest.String() || p.Critical.Type != cosignSignatureType {
+		t.Errorf("payload = %s", raw)
+	}
+	if got := signatureTag(repo, digest).TagStr(); got != "sha256-"+digest.Hex+".sig" {
+		t.Errorf("signatureTag() = %s", got)
+	}
+}
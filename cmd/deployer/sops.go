@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// defaultSecretsFile is looked up next to the app.
+	defaultSecretsFile = "secrets.enc.yaml"
+	// sopsVersion is written to new files; the layout is that of SOPS 3.
+	sopsVersion              = "3.8.1"
+	defaultUnencryptedSuffix = "_unencrypted"
+	sopsNonceSize            = 32
+	sopsTagSize              = 16
+)
+
+var (
+	sopsValueRE = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+	// secretKeyRE matches the keys a Kubernetes Secret accepts.
+	secretKeyRE = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+)
+
+// sopsMetadata is the sops section of an encrypted file. The data key is
+// stored once per master key: age recipients or AWS KMS keys.
+type sopsMetadata struct {
+	KMS               []sopsKMSKey `yaml:"kms,omitempty"`
+	Age               []sopsAgeKey `yaml:"age,omitempty"`
+	LastModified      string       `yaml:"lastmodified"`
+	MAC               string       `yaml:"mac"`
+	UnencryptedSuffix string       `yaml:"unencrypted_suffix,omitempty"`
+	Version           string       `yaml:"version"`
+
+	// Selective encryption is not supported; every value but those with
+	// the unencrypted suffix is encrypted.
+	EncryptedSuffix  string `yaml:"encrypted_suffix,omitempty"`
+	EncryptedRegex   string `yaml:"encrypted_regex,omitempty"`
+	UnencryptedRegex string `yaml:"unencrypted_regex,omitempty"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted,omitempty"`
+}
+
+type sopsKMSKey struct {
+	ARN        string             `yaml:"arn"`
+	Role       string             `yaml:"role,omitempty"`
+	Context    map[string]*string `yaml:"context,omitempty"`
+	CreatedAt  string             `yaml:"created_at"`
+	Enc        string             `yaml:"enc"`
+	AWSProfile string             `yaml:"aws_profile"`
+}
+
+type sopsAgeKey struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+// secretsFile is a decrypted secrets.enc.yaml: a flat map of Secret keys
+// in a SOPS-compatible layout, so sops itself can read and edit it too.
+type secretsFile struct {
+	keys    []string
+	values  map[string]string
+	dataKey []byte
+	meta    sopsMetadata
+	// metaNode is the sops section as read, so master keys flow doesn't
+	// know (pgp, gcp_kms...) survive an edit.
+	metaNode *yaml.Node
+}
+
+// data returns the values as Secret data.
+func (f *secretsFile) data() map[string]string {
+	out := map[string]string{}
+	for k, v := range f.values {
+		out[strings.TrimSuffix(k, f.meta.UnencryptedSuffix)] = v
+	}
+	return out
+}
+
+// readSecretsFile decrypts path with the first master key available:
+// an age identity from $SOPS_AGE_KEY, $SOPS_AGE_KEY_FILE or
+// <config dir>/sops/age/keys.txt, or AWS KMS with the current credentials.
+func readSecretsFile(ctx context.Context, path string) (*secretsFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: not a SOPS YAML file", path)
+	}
+	f := &secretsFile{values: map[string]string{}}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		if k.Value == "sops" {
+			if err := v.Decode(&f.meta); err != nil {
+				return nil, fmt.Errorf("%s: invalid sops metadata: %v", path, err)
+			}
+			f.metaNode = v
+			continue
+		}
+		if v.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s: %s is not a string; secrets files are a flat map of KEY: value", path, k.Value)
+		}
+		f.keys = append(f.keys, k.Value)
+		f.values[k.Value] = v.Value
+	}
+	if f.metaNode == nil {
+		return nil, fmt.Errorf("%s is not encrypted (no sops section)", path)
+	}
+	m := f.meta
+	if m.EncryptedSuffix != "" || m.EncryptedRegex != "" || m.UnencryptedRegex != "" || m.MACOnlyEncrypted {
+		return nil, fmt.Errorf("%s uses selective encryption, which flow does not support", path)
+	}
+	if f.dataKey, err = m.dataKey(ctx); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	mac := sha512.New()
+	for _, k := range f.keys {
+		v := f.values[k]
+		if !f.unencrypted(k) {
+			if v, err = sopsDecrypt(f.dataKey, v, k+":"); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, k, err)
+			}
+			f.values[k] = v
+		}
+		mac.Write([]byte(v))
+	}
+	want, err := sopsDecrypt(f.dataKey, m.MAC, m.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid MAC: %v", path, err)
+	}
+	if !strings.EqualFold(want, hex.EncodeToString(mac.Sum(nil))) {
+		return nil, fmt.Errorf("%s: MAC mismatch; the file was modified without re-encrypting", path)
+	}
+	for _, v := range f.values {
+		secretRedactor.add(v)
+	}
+	return f, nil
+}
+
+func (f *secretsFile) unencrypted(key string) bool {
+	return f.meta.UnencryptedSuffix != "" && strings.HasSuffix(key, f.meta.UnencryptedSuffix)
+}
+
+// newSecretsFile returns an empty file whose data key is encrypted to
+// the given age recipients and KMS key ARNs.
+func newSecretsFile(ctx context.Context, ageRecipients, kmsARNs []string) (*secretsFile, error) {
+	if len(ageRecipients) == 0 && len(kmsARNs) == 0 {
+		return nil, fmt.Errorf("a new secrets file needs at least one --age recipient or --kms key")
+	}
+	f := &secretsFile{
+		values:  map[string]string{},
+		dataKey: make([]byte, 32),
+		meta:    sopsMetadata{UnencryptedSuffix: defaultUnencryptedSuffix, Version: sopsVersion},
+	}
+	if _, err := rand.Read(f.dataKey); err != nil {
+		return nil, err
+	}
+	for _, r := range ageRecipients {
+		enc, err := ageWrap(f.dataKey, r)
+		if err != nil {
+			return nil, fmt.Errorf("age recipient %s: %v", r, err)
+		}
+		f.meta.Age = append(f.meta.Age, sopsAgeKey{Recipient: r, Enc: enc})
+	}
+	for _, arn := range kmsARNs {
+		client, err := kmsClient(ctx, arn)
+		if err != nil {
+			return nil, err
+		}
+		out, err := client.Encrypt(ctx, &kms.EncryptInput{KeyId: &arn, Plaintext: f.dataKey})
+		if err != nil {
+			return nil, fmt.Errorf("KMS key %s: %v", arn, err)
+		}
+		f.meta.KMS = append(f.meta.KMS, sopsKMSKey{
+			ARN:       arn,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			Enc:       base64.StdEncoding.EncodeToString(out.CiphertextBlob),
+		})
+	}
+	return f, nil
+}
+
+// write encrypts the values with the file's data key and writes path.
+func (f *secretsFile) write(path string) error {
+	f.meta.LastModified = time.Now().UTC().Format(time.RFC3339)
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	mac := sha512.New()
+	for _, k := range f.keys {
+		v := f.values[k]
+		mac.Write([]byte(v))
+		if !f.unencrypted(k) {
+			var err error
+			if v, err = sopsEncrypt(f.dataKey, v, k+":"); err != nil {
+				return err
+			}
+		}
+		root.Content = append(root.Content, scalarNode(k), scalarNode(v))
+	}
+	var err error
+	if f.meta.MAC, err = sopsEncrypt(f.dataKey, strings.ToUpper(hex.EncodeToString(mac.Sum(nil))), f.meta.LastModified); err != nil {
+		return err
+	}
+	if f.metaNode == nil {
+		f.metaNode = &yaml.Node{}
+		if err := f.metaNode.Encode(f.meta); err != nil {
+			return err
+		}
+	} else {
+		setMappingValue(f.metaNode, "lastmodified", f.meta.LastModified)
+		setMappingValue(f.metaNode, "mac", f.meta.MAC)
+	}
+	root.Content = append(root.Content, scalarNode("sops"), f.metaNode)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(4)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	enc.Close()
+	// Replace the file in one step so an interrupted write can't lose it
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".secrets-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func scalarNode(v string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	if strings.Contains(v, "\n") {
+		n.Style = yaml.LiteralStyle
+	}
+	return n
+}
+
+func setMappingValue(m *yaml.Node, key, value string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = scalarNode(value)
+			return
+		}
+	}
+	m.Content = append(m.Content, scalarNode(key), scalarNode(value))
+}
+
+// dataKey decrypts the data key with the first master key that works.
+func (m sopsMetadata) dataKey(ctx context.Context) ([]byte, error) {
+	var errs []string
+	if len(m.Age) > 0 {
+		ids, err := ageIdentities()
+		if err != nil {
+			errs = append(errs, "age: "+err.Error())
+		}
+		for _, k := range m.Age {
+			if len(ids) == 0 {
+				break
+			}
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(k.Enc)), ids...)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("age %s: %v", k.Recipient, err))
+				continue
+			}
+			return io.ReadAll(r)
+		}
+	}
+	for _, k := range m.KMS {
+		key, err := kmsUnwrap(ctx, k)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("kms %s: %v", k.ARN, err))
+			continue
+		}
+		return key, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no age or KMS master key to decrypt with")
+	}
+	return nil, fmt.Errorf("cannot decrypt the data key:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// ageIdentities loads age identities the way sops does.
+func ageIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+	path := os.Getenv("SOPS_AGE_KEY_FILE")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("no identity (set SOPS_AGE_KEY_FILE): %v", err)
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+func ageWrap(key []byte, recipient string) (string, error) {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, r)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(key); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func kmsUnwrap(ctx context.Context, k sopsKMSKey) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(k.Enc)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kmsClient(ctx, k.ARN)
+	if err != nil {
+		return nil, err
+	}
+	encCtx := map[string]string{}
+	for name, v := range k.Context {
+		if v != nil {
+			encCtx[name] = *v
+		}
+	}
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{KeyId: &k.ARN, CiphertextBlob: blob, EncryptionContext: encCtx})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// kmsClient returns a KMS client for the region in arn.
+func kmsClient(ctx context.Context, arn string) (*kms.Client, error) {
+	cfg, err := awsClients.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 || parts[0] != "arn" || parts[2] != "kms" {
+		return nil, fmt.Errorf("invalid KMS key ARN %q", arn)
+	}
+	return kms.NewFromConfig(cfg, func(o *kms.Options) { o.Region = parts[3] }), nil
+}
+
+// sopsEncrypt encrypts value as SOPS does: AES-256-GCM with a 32-byte
+// nonce and the value's path as additional data. Empty strings stay empty.
+func sopsEncrypt(key []byte, value, aad string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	gcm, err := sopsGCM(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, sopsNonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	out := gcm.Seal(nil, iv, []byte(value), []byte(aad))
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]",
+		b64(out[:len(out)-sopsTagSize]), b64(iv), b64(out[len(out)-sopsTagSize:])), nil
+}
+
+func sopsDecrypt(key []byte, value, aad string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	m := sopsValueRE.FindStringSubmatch(value)
+	if m == nil {
+		return "", fmt.Errorf("value is not encrypted")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		b, err := base64.StdEncoding.DecodeString(m[i+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid encrypted value: %v", err)
+		}
+		parts[i] = b
+	}
+	gcm, err := sopsGCM(key)
+	if err != nil {
+		return "", err
+	}
+	out, err := gcm.Open(nil, parts[1], append(parts[0], parts[2]...), []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("decryption failed (wrong key or tampered value)")
+	}
+	return string(out), nil
+}
+
+func sopsGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, sopsNonceSize)
+}
+
+// newSecretsEditCmd edits an encrypted secrets file in $EDITOR.
+func newSecretsEditCmd() *cobra.Command {
+	var ageRecipients, kmsARNs []string
+	cmd := &cobra.Command{
+		Use:   "edit [FILE]",
+		Short: "Edit an encrypted secrets file",
+		Long: `Decrypt a secrets file (default ` + defaultSecretsFile + `), open it in $EDITOR and
+re-encrypt it on save. The file is SOPS-compatible, so sops can read it too.
+
+A new file needs its master keys: age recipients (--age) and/or AWS KMS
+key ARNs (--kms). flow deploy decrypts the file into <app>-secrets.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path := defaultSecretsFile
+			if len(args) > 0 {
+				path = args[0]
+			}
+			var f *secretsFile
+			if _, err := os.Stat(path); err == nil {
+				if len(ageRecipients) > 0 || len(kmsARNs) > 0 {
+					return fmt.Errorf("--age and --kms only apply to new files; %s already exists", path)
+				}
+				if f, err = readSecretsFile(cmd.Context(), path); err != nil {
+					return err
+				}
+			} else if os.IsNotExist(err) {
+				if f, err = newSecretsFile(cmd.Context(), ageRecipients, kmsARNs); err != nil {
+					return err
+				}
+			} else {
+				return err
+			}
+
+			changed, err := f.edit()
+			if err != nil {
+				return err
+			}
+			if !changed {
+				fmt.Printf("No changes to %s\n", path)
+				return nil
+			}
+			if err := f.write(path); err != nil {
+				return fmt.Errorf("failed to write %s: %v", path, err)
+			}
+			fmt.Printf("Encrypted %d secrets to %s\n", len(f.keys), path)
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&ageRecipients, "age", nil, "age recipient (age1...) for a new file (repeatable)")
+	cmd.Flags().StringSliceVar(&kmsARNs, "kms", nil, "AWS KMS key ARN for a new file (repeatable)")
+	return cmd
+}
+
+// edit opens the plaintext in an editor, reopening it until it parses.
+// The plaintext only lives in a 0600 temp file that is removed afterwards.
+func (f *secretsFile) edit() (bool, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, k := range f.keys {
+		root.Content = append(root.Content, scalarNode(k), scalarNode(f.values[k]))
+	}
+	var before []byte
+	if len(f.keys) == 0 {
+		before = []byte("# One secret per line: KEY: value\n")
+	} else {
+		var err error
+		if before, err = yaml.Marshal(root); err != nil {
+			return false, err
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "flow-secrets-*.yaml")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(before)
+	tmp.Close()
+	if err != nil {
+		return false, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	last := before
+	for {
+		// Run through the shell so EDITOR may carry arguments ("code --wait")
+		c := exec.Command("sh", "-c", editor+` "$1"`, "sh", tmp.Name())
+		c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := c.Run(); err != nil {
+			return false, fmt.Errorf("editor %s failed: %v", editor, err)
+		}
+		after, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(after, before) {
+			return false, nil
+		}
+		keys, values, err := parseSecretsYAML(after)
+		if err == nil {
+			changed := len(keys) != len(f.keys)
+			for i, k := range keys {
+				changed = changed || k != f.keys[i] || values[k] != f.values[k]
+			}
+			f.keys, f.values = keys, values
+			return changed, nil
+		}
+		if bytes.Equal(after, last) {
+			return false, fmt.Errorf("invalid secrets, nothing saved: %v", err)
+		}
+		last = after
+		fmt.Fprintf(os.Stderr, "Invalid secrets: %v\nReopening the editor; save without changes to abort.\n", err)
+	}
+}
+
+// parseSecretsYAML parses a flat KEY: value map, keeping the key order.
+func parseSecretsYAML(b []byte) ([]string, map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, nil, err
+	}
+	values := map[string]string{}
+	if len(doc.Content) == 0 {
+		return nil, values, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("want a map of KEY: value")
+	}
+	var keys []string
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i].Value, root.Content[i+1]
+		if !secretKeyRE.MatchString(k) || k == "sops" {
+			return nil, nil, fmt.Errorf("invalid key %q", k)
+		}
+		if _, dup := values[k]; dup {
+			return nil, nil, fmt.Errorf("duplicate key %s", k)
+		}
+		if v.Kind != yaml.ScalarNode {
+			return nil, nil, fmt.Errorf("%s is not a string", k)
+		}
+		keys = append(keys, k)
+		values[k] = v.Value
+	}
+	return keys, values, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+func testDataKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSopsEncryptDecrypt(t *testing.T) {
+	key := testDataKey(t)
+	for _, v := range []string{"s3cret", "multi\nline\n", "ünïcode"} {
+		enc, err := sopsEncrypt(key, v, "API_KEY:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sopsValueRE.MatchString(enc) || strings.Contains(enc, v) {
+			t.Fatalf("sopsEncrypt(%q) = %s", v, enc)
+		}
+		got, err := sopsDecrypt(key, enc, "API_KEY:")
+		if err != nil || got != v {
+			t.Errorf("round trip of %q = %q, %v", v, got, err)
+		}
+	}
+	// Empty values stay empty, as sops leaves them
+	if enc, err := sopsEncrypt(key, "", "A:"); enc != "" || err != nil {
+		t.Errorf("sopsEncrypt(\"\") = %q, %v", enc, err)
+	}
+
+	enc, err := sopsEncrypt(key, "s3cret", "API_KEY:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := sopsValueRE.FindStringSubmatch(enc)
+	data, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 1
+	tests := []struct {
+		name  string
+		key   []byte
+		value string
+		aad   string
+		want  string
+	}{
+		{"wrong key", testDataKey(t), enc, "API_KEY:", "wrong key or tampered"},
+		{"moved to another key", key, enc, "OTHER:", "wrong key or tampered"},
+		{"tampered data", key, strings.Replace(enc, m[1], base64.StdEncoding.EncodeToString(data), 1), "API_KEY:", "wrong key or tampered"},
+		{"tampered tag", key, strings.Replace(enc, "tag:"+m[3], "tag:AAAAAAAAAAAAAAAAAAAAAA==", 1), "API_KEY:", "wrong key or tampered"},
+		{"plaintext", key, "s3cret", "API_KEY:", "not encrypted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sopsDecrypt(tt.key, tt.value, tt.aad)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// writeTestSecretsFile creates an age-encrypted secrets file and makes
+// its identity the one sops would use.
+func writeTestSecretsFile(t *testing.T, keys []string, values map[string]string) string {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOPS_AGE_KEY", id.String())
+	f, err := newSecretsFile(context.Background(), []string{id.Recipient().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.keys, f.values = keys, values
+	path := filepath.Join(t.TempDir(), defaultSecretsFile)
+	if err := f.write(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// editSecretsYAML rewrites path's top-level mapping with edit.
+func editSecretsYAML(t *testing.T, path string, edit func(root *yaml.Node)) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	edit(doc.Content[0])
+	var buf bytes.Buffer
+	if err := yaml.NewEncoder(&buf).Encode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretsFileRoundTrip(t *testing.T) {
+	keys := []string{"API_KEY", "CERT", "EMPTY", "REGION_unencrypted"}
+	values := map[string]string{"API_KEY": "s3cret", "CERT": "-----BEGIN-----\nabc\n", "EMPTY": "", "REGION_unencrypted": "eu-west-1"}
+	path := writeTestSecretsFile(t, keys, values)
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "s3cret") || !strings.Contains(string(raw), "REGION_unencrypted: eu-west-1") {
+		t.Errorf("encrypted file:\n%s", raw)
+	}
+
+	f, err := readSecretsFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.keys, keys) {
+		t.Errorf("keys = %v, want %v", f.keys, keys)
+	}
+	want := map[string]string{"API_KEY": "s3cret", "CERT": "-----BEGIN-----\nabc\n", "EMPTY": "", "REGION": "eu-west-1"}
+	if got := f.data(); !reflect.DeepEqual(got, want) {
+		t.Errorf("data() = %v, want %v", got, want)
+	}
+
+	// Re-encrypting keeps the master keys, so the file still opens
+	f.keys = append(f.keys, "ADDED")
+	f.values["ADDED"] = "new"
+	if err := f.write(path); err != nil {
+		t.Fatal(err)
+	}
+	f, err = readSecretsFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.data()["ADDED"] != "new" || len(f.meta.Age) != 1 {
+		t.Errorf("after rewrite: data %v, age keys %d", f.data(), len(f.meta.Age))
+	}
+}
+
+func TestSecretsFileTamper(t *testing.T) {
+	keys := []string{"A", "B", "NOTE_unencrypted"}
+	values := map[string]string{"A": "one", "B": "two", "NOTE_unencrypted": "plain"}
+	value := func(root *yaml.Node, key string) *yaml.Node {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == key {
+				return root.Content[i+1]
+			}
+		}
+		t.Fatalf("no key %s", key)
+		return nil
+	}
+	tests := []struct {
+		name string
+		edit func(root *yaml.Node)
+		want string
+	}{
+		{"swapped ciphertexts", func(root *yaml.Node) {
+			a, b := value(root, "A"), value(root, "B")
+			a.Value, b.Value = b.Value, a.Value
+		}, "A: decryption failed"},
+		{"edited unencrypted value", func(root *yaml.Node) { value(root, "NOTE_unencrypted").Value = "changed" }, "MAC mismatch"},
+		{"removed key", func(root *yaml.Node) { root.Content = root.Content[2:] }, "MAC mismatch"},
+		{"added key", func(root *yaml.Node) {
+			root.Content = append([]*yaml.Node{scalarNode("EXTRA_unencrypted"), scalarNode("x")}, root.Content...)
+		}, "MAC mismatch"},
+		{"dropped MAC", func(root *yaml.Node) { setMappingValue(value(root, "sops"), "mac", "") }, "MAC mismatch"},
+		{"selective encryption", func(root *yaml.Node) { setMappingValue(value(root, "sops"), "encrypted_regex", "^data$") }, "selective encryption"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestSecretsFile(t, keys, values)
+			editSecretsYAML(t, path, tt.edit)
+			_, err := readSecretsFile(context.Background(), path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("wrong identity", func(t *testing.T) {
+		path := writeTestSecretsFile(t, keys, values)
+		other, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("SOPS_AGE_KEY", other.String())
+		if _, err := readSecretsFile(context.Background(), path); err == nil || !strings.Contains(err.Error(), "cannot decrypt the data key") {
+			t.Errorf("err = %v, want a data key error", err)
+		}
+	})
+}
+
+func TestParseSecretsYAML(t *testing.T) {
+	keys, values, err := parseSecretsYAML([]byte("B: two\nA: |\n  multi\n  line\nC: \"\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"B", "A", "C"}) || values["A"] != "multi\nline\n" || values["C"] != "" {
+		t.Errorf("parseSecretsYAML() = %v, %v", keys, values)
+	}
+	for in, want := range map[string]string{
+		"- a\n":             "want a map",
+		"A: 1\nA: 2\n":      "duplicate key A",
+		"sops: x\n":         `invalid key "sops"`,
+		"has space: x\n":    "invalid key",
+		"A:\n  nested: x\n": "A is not a string",
+	} {
+		if _, _, err := parseSecretsYAML([]byte(in)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseSecretsYAML(%q) err = %v, want %q", in, err, want)
+		}
+	}
+}
@@ -19,6 +19,21 @@ type Deployment struct {
 	Status      string    `json:"status"`
 	Description string    `json:"description"`
 	CreatedAt   time.Time `json:"createdAt"`
+	Digest      string    `json:"digest,omitempty"`
+	SBOM        string    `json:"sbom,omitempty"`
+	Provenance  string    `json:"provenance,omitempty"`
+
+	Vulnerabilities *VulnerabilitySummary `json:"vulnerabilities,omitempty"`
+}
+
+// VulnerabilitySummary is the scan gate result the CLI reports.
+type VulnerabilitySummary struct {
+	Source    string         `json:"source"`
+	Status    string         `json:"status"`
+	Threshold string         `json:"threshold,omitempty"`
+	Counts    map[string]int `json:"counts,omitempty"`
+	Blocking  []string       `json:"blocking,omitempty"`
+	Error     string         `json:"error,omitempty"`
 }
 
 type Store struct {
@@ -8,6 +8,19 @@ export type Deployment = {
   status: string;
   description: string;
   createdAt: string;
+  digest?: string;
+  sbom?: string;
+  provenance?: string;
+  vulnerabilities?: VulnerabilitySummary;
+};
+
+export type VulnerabilitySummary = {
+  source: string;
+  status: 'passed' | 'failed' | 'overridden' | 'unavailable';
+  threshold?: string;
+  counts?: Record<string, number>;
+  blocking?: string[];
+  error?: string;
 };
 
 const API_BASE: string = (import.meta as any).env?.VITE_API_BASE || http://localhost:8080;